@@ -1,7 +1,20 @@
-CREATE TABLE conversations (
+CREATE TABLE IF NOT EXISTS conversations (
     thread_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     document_id UUID REFERENCES documents(id) ON DELETE CASCADE,
     section_id UUID NOT NULL,
+    parent_thread_id UUID REFERENCES conversations(thread_id) ON DELETE SET NULL,
+    forked_from_message_id UUID,
+    title VARCHAR(255),
+    archived_at TIMESTAMP WITH TIME ZONE,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
+
+-- Databases created before threads could be named and archived
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS title VARCHAR(255);
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP WITH TIME ZONE;
+-- Databases created before threads could be forked
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS parent_thread_id UUID REFERENCES conversations(thread_id) ON DELETE SET NULL;
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS forked_from_message_id UUID;
+
+CREATE INDEX IF NOT EXISTS conversations_document_section_updated_idx ON conversations (document_id, section_id, updated_at DESC);
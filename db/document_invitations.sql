@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS document_invitations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    document_id UUID NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    responded_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS document_invitations_pending_idx ON document_invitations (document_id, lower(email)) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS document_invitations_email_idx ON document_invitations (lower(email)) WHERE status = 'pending';
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS jobs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    kind VARCHAR(32) NOT NULL,
+    section_id UUID REFERENCES sections(id) ON DELETE CASCADE,
+    requested_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL DEFAULT 8,
+    run_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP WITH TIME ZONE,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS jobs_ready_idx ON jobs (run_at) WHERE status IN ('pending', 'running');
+CREATE INDEX IF NOT EXISTS jobs_section_created_idx ON jobs (section_id, created_at DESC);
+CREATE UNIQUE INDEX IF NOT EXISTS jobs_pending_section_idx ON jobs (kind, section_id) WHERE status = 'pending';
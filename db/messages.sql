@@ -1,7 +1,8 @@
-CREATE TABLE messages (
+CREATE TABLE IF NOT EXISTS messages (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     thread_id UUID REFERENCES conversations(thread_id) ON DELETE CASCADE,
     role TEXT NOT NULL, 
     content TEXT NOT NULL,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
+CREATE INDEX IF NOT EXISTS messages_thread_created_idx ON messages (thread_id, created_at);
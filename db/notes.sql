@@ -1,7 +1,32 @@
 CREATE TABLE IF NOT EXISTS notes (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     section_id UUID REFERENCES sections(id) ON DELETE CASCADE,
+    author_id UUID REFERENCES users(id) ON DELETE SET NULL,
     content TEXT, 
+    anchor_start INT,
+    anchor_end INT,
+    anchor_quote TEXT,
+    anchor_prefix TEXT,
+    anchor_suffix TEXT,
+    anchor_status VARCHAR(16),
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
\ No newline at end of file
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', coalesce(content, ''))) STORED
+);
+
+-- Databases created before search
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', coalesce(content, ''))) STORED;
+-- Databases created before notes were anchored. Existing notes have no
+-- anchor and stay attached to the whole section.
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS anchor_start INT;
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS anchor_end INT;
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS anchor_quote TEXT;
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS anchor_prefix TEXT;
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS anchor_suffix TEXT;
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS anchor_status VARCHAR(16);
+-- Databases created before documents were shared. Existing notes have no
+-- recorded author.
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS author_id UUID REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS notes_section_idx ON notes (section_id);
+CREATE INDEX IF NOT EXISTS notes_search_idx ON notes USING GIN (search_vector);
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS proposals (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    section_id UUID NOT NULL REFERENCES sections(id) ON DELETE CASCADE,
+    author_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    thread_id UUID REFERENCES conversations(thread_id) ON DELETE SET NULL,
+    source VARCHAR(16) NOT NULL DEFAULT 'user',
+    status VARCHAR(24) NOT NULL DEFAULT 'pending',
+    anchor_start INT NOT NULL,
+    anchor_end INT NOT NULL,
+    anchor_quote TEXT NOT NULL,
+    anchor_prefix TEXT,
+    anchor_suffix TEXT,
+    replacement TEXT NOT NULL,
+    diff JSONB NOT NULL,
+    note TEXT,
+    accepted_changes JSONB,
+    resolved_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS proposals_section_status_idx ON proposals (section_id, status, created_at);
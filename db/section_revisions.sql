@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS section_revisions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    section_id UUID REFERENCES sections(id) ON DELETE CASCADE,
+    document_id UUID REFERENCES documents(id) ON DELETE CASCADE,
+    author_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    title VARCHAR(255) NOT NULL,
+    content TEXT,
+    summary TEXT,
+    metadata JSONB,
+    length INT DEFAULT 0,
+    num_words INT DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS section_revisions_section_created_idx ON section_revisions (section_id, created_at DESC);
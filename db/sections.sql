@@ -1,12 +1,39 @@
 CREATE TABLE IF NOT EXISTS sections (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     document_id UUID REFERENCES documents(id) ON DELETE CASCADE,
+    parent_id UUID REFERENCES sections(id) ON DELETE SET NULL,
+    kind VARCHAR(16) NOT NULL DEFAULT 'chapter',
+    position INT NOT NULL DEFAULT 0,
     title VARCHAR(255) NOT NULL,
     content TEXT, 
     summary TEXT,
     metadata JSONB,
     length INT DEFAULT 0,
     num_words INT DEFAULT 0,
+    indexed_hash TEXT,
+    indexed_at TIMESTAMP WITH TIME ZONE,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
\ No newline at end of file
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    search_vector TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+        setweight(to_tsvector('english', regexp_replace(coalesce(content, ''), '<[^>]+>', ' ', 'g')), 'B')
+    ) STORED
+);
+
+-- Databases created before sections had an outline. Existing sections all
+-- start at position 0 and keep their order by creation time.
+ALTER TABLE sections ADD COLUMN IF NOT EXISTS parent_id UUID REFERENCES sections(id) ON DELETE SET NULL;
+ALTER TABLE sections ADD COLUMN IF NOT EXISTS kind VARCHAR(16) NOT NULL DEFAULT 'chapter';
+ALTER TABLE sections ADD COLUMN IF NOT EXISTS position INT NOT NULL DEFAULT 0;
+-- Databases created before search
+ALTER TABLE sections ADD COLUMN IF NOT EXISTS search_vector TSVECTOR GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('english', regexp_replace(coalesce(content, ''), '<[^>]+>', ' ', 'g')), 'B')
+) STORED;
+-- Databases created before indexing jobs. Existing sections count as never
+-- indexed, so reindexing a document picks them all up.
+ALTER TABLE sections ADD COLUMN IF NOT EXISTS indexed_hash TEXT;
+ALTER TABLE sections ADD COLUMN IF NOT EXISTS indexed_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS sections_document_parent_position_idx ON sections (document_id, parent_id, position);
+CREATE INDEX IF NOT EXISTS sections_search_idx ON sections USING GIN (search_vector);
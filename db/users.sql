@@ -1,9 +1,11 @@
 CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    google_id VARCHAR(255) NOT NULL,
+    google_id VARCHAR(255),
     name VARCHAR(255) NOT NULL,
     email VARCHAR(255) NOT NULL,
     picture VARCHAR(255),
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
\ No newline at end of file
+);
+-- Databases created when Google was the only way to log in
+ALTER TABLE users ALTER COLUMN google_id DROP NOT NULL;
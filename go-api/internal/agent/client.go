@@ -0,0 +1,48 @@
+// Package agent talks to the Python agent backend that answers writers'
+// questions and indexes saved sections. Handlers depend on the AgentClient
+// interface so the HTTP client can be swapped for the in-process fake.
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+var (
+	// ErrUnavailable means the backend could not be reached or kept failing
+	// after every retry.
+	ErrUnavailable = errors.New("agent backend unavailable")
+	// ErrCircuitOpen means recent calls failed so often that calls are being
+	// refused without trying, to give the backend time to recover.
+	ErrCircuitOpen = errors.New("agent backend circuit open")
+	// ErrTimeout means the backend did not answer within the call's deadline.
+	ErrTimeout = errors.New("agent backend timed out")
+)
+
+// StatusError is a non-success HTTP response from the backend.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("agent backend returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("agent backend returned status %d: %s", e.StatusCode, e.Message)
+}
+
+type AgentClient interface {
+	// SendMessage asks the agent a question and waits for its whole reply.
+	SendMessage(ctx context.Context, message *store.AgentMessage) (*store.AgentMessage, error)
+	// StreamMessage asks the agent a question and returns its reply as a
+	// Server-Sent Events stream of thread, tool, token and done events.
+	StreamMessage(ctx context.Context, message *store.AgentMessage) (io.ReadCloser, error)
+	// SaveSection hands a section to the backend to embed and store, and
+	// returns the LLM usage it reported, if any.
+	SaveSection(ctx context.Context, section *store.Section) (*store.TokenUsage, error)
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+// FakeClient is an in-process AgentClient for running and testing the API
+// without the Python service. By default it echoes each message back; set
+// Reply to script answers or Err to make every call fail. It records what it
+// was sent.
+type FakeClient struct {
+	mu       sync.Mutex
+	Reply    func(message *store.AgentMessage) (*store.AgentMessage, error)
+	Err      error
+	messages []store.AgentMessage
+	sections []store.Section
+	threads  int
+}
+
+func NewFakeClient() *FakeClient {
+	return &FakeClient{}
+}
+
+func (f *FakeClient) SendMessage(ctx context.Context, message *store.AgentMessage) (*store.AgentMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(ctx)
+	}
+
+	f.mu.Lock()
+	f.messages = append(f.messages, *message)
+	if f.Err != nil {
+		f.mu.Unlock()
+		return nil, f.Err
+	}
+	reply := f.Reply
+	threadID := ""
+	if message.ThreadID != nil {
+		threadID = *message.ThreadID
+	} else {
+		f.threads++
+		threadID = fmt.Sprintf("fake-thread-%d", f.threads)
+	}
+	f.mu.Unlock()
+
+	if reply != nil {
+		return reply(message)
+	}
+	return &store.AgentMessage{
+		DocumentID: message.DocumentID,
+		SectionID:  message.SectionID,
+		ThreadID:   &threadID,
+		Role:       "assistant",
+		Content:    "You said: " + message.Content,
+	}, nil
+}
+
+// StreamMessage streams the SendMessage reply a word at a time.
+func (f *FakeClient) StreamMessage(ctx context.Context, message *store.AgentMessage) (io.ReadCloser, error) {
+	reply, err := f.SendMessage(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		send := func(event string, data any) bool {
+			payload, _ := json.Marshal(data)
+			_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+			return err == nil && ctx.Err() == nil
+		}
+
+		ok := send("thread", map[string]any{"thread_id": reply.ThreadID})
+		for _, token := range strings.SplitAfter(reply.Content, " ") {
+			ok = ok && send("token", map[string]string{"content": token})
+		}
+		if ok {
+			send("done", reply)
+		}
+		w.Close()
+	}()
+	return r, nil
+}
+
+func (f *FakeClient) SaveSection(ctx context.Context, section *store.Section) (*store.TokenUsage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(ctx)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sections = append(f.sections, *section)
+	return nil, f.Err
+}
+
+// Messages returns every message the fake has been sent.
+func (f *FakeClient) Messages() []store.AgentMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]store.AgentMessage(nil), f.messages...)
+}
+
+// Sections returns every section the fake has been asked to save.
+func (f *FakeClient) Sections() []store.Section {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]store.Section(nil), f.sections...)
+}
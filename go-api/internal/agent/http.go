@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+type Config struct {
+	// BaseURL is where the agent backend listens, without a trailing slash.
+	BaseURL string
+	// MessageTimeout bounds a whole reply from SendMessage, and how long
+	// StreamMessage waits for the stream to start.
+	MessageTimeout time.Duration
+	// SaveTimeout bounds SaveSection.
+	SaveTimeout time.Duration
+	// MaxRetries is how many times a failed call is tried again. Messages are
+	// only retried when the backend never received them.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry; it doubles on each
+	// later one up to MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// BreakerThreshold consecutive failed calls stop all calls for
+	// BreakerCooldown. Zero disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+var DefaultConfig = Config{
+	BaseURL:          "http://localhost:5001",
+	MessageTimeout:   25 * time.Second,
+	SaveTimeout:      15 * time.Second,
+	MaxRetries:       2,
+	RetryBackoff:     200 * time.Millisecond,
+	MaxRetryBackoff:  2 * time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+// HTTPClient is the AgentClient for the Flask agent backend.
+type HTTPClient struct {
+	config  Config
+	client  *http.Client
+	breaker *breaker
+}
+
+func NewHTTPClient(config Config) *HTTPClient {
+	config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	return &HTTPClient{
+		config:  config,
+		client:  &http.Client{},
+		breaker: newBreaker(config.BreakerThreshold, config.BreakerCooldown),
+	}
+}
+
+func (c *HTTPClient) SendMessage(ctx context.Context, message *store.AgentMessage) (*store.AgentMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.MessageTimeout)
+	defer cancel()
+
+	resp, err := c.post(ctx, "/message", message, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var reply store.AgentMessage
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+		return nil, fmt.Errorf("decoding agent reply: %w", err)
+	}
+	return &reply, nil
+}
+
+func (c *HTTPClient) StreamMessage(ctx context.Context, message *store.AgentMessage) (io.ReadCloser, error) {
+	// The stream itself may run as long as the caller likes; only its start
+	// is held to the message timeout.
+	ctx, cancel := context.WithCancel(ctx)
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(c.config.MessageTimeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+
+	resp, err := c.post(ctx, "/message/stream", message, false)
+	if !timer.Stop() && timedOut.Load() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		c.breaker.failure()
+		return nil, ErrTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &streamBody{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+func (c *HTTPClient) SaveSection(ctx context.Context, section *store.Section) (*store.TokenUsage, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.SaveTimeout)
+	defer cancel()
+
+	resp, err := c.post(ctx, "/save", section, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Older backends report failures in a 200 body
+	var result struct {
+		Status  string            `json:"status"`
+		Message string            `json:"message"`
+		Usage   *store.TokenUsage `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding save response: %w", err)
+	}
+	if result.Status == "error" {
+		return nil, &StatusError{StatusCode: http.StatusInternalServerError, Message: result.Message}
+	}
+	return result.Usage, nil
+}
+
+// streamBody cancels the stream's request when it is closed.
+type streamBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (s *streamBody) Close() error {
+	s.cancel()
+	return s.ReadCloser.Close()
+}
+
+// post sends body as JSON and returns a successful response, retrying what
+// can safely be retried. Calls that are not idempotent are retried only when
+// the connection was refused, since the backend cannot have acted on them.
+func (c *HTTPClient) post(ctx context.Context, path string, body any, idempotent bool) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.attempt(ctx, path, payload)
+
+		var retry bool
+		switch {
+		case err == nil && resp.StatusCode < 300:
+			c.breaker.success()
+			return resp, nil
+		case err == nil:
+			retry = idempotent && retryableStatus(resp.StatusCode)
+			err = statusError(resp)
+		case ctx.Err() != nil:
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				c.breaker.failure()
+			} else {
+				c.breaker.release()
+			}
+			return nil, contextError(ctx)
+		default:
+			retry = idempotent || refused(err)
+			err = fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+
+		if !retry || attempt >= c.config.MaxRetries || !c.wait(ctx, attempt) {
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) && statusErr.StatusCode < 500 {
+				// The backend is up and answering; it just refused this call
+				c.breaker.success()
+			} else {
+				c.breaker.failure()
+			}
+			return nil, err
+		}
+	}
+}
+
+func (c *HTTPClient) attempt(ctx context.Context, path string, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.client.Do(req)
+}
+
+// wait sleeps before retry number attempt+1, with jitter so that callers
+// that failed together do not retry together. It returns false if ctx ends
+// first.
+func (c *HTTPClient) wait(ctx context.Context, attempt int) bool {
+	delay := c.config.RetryBackoff << attempt
+	if delay <= 0 || delay > c.config.MaxRetryBackoff {
+		delay = c.config.MaxRetryBackoff
+	}
+	if delay > 0 {
+		delay = delay/2 + rand.N(delay/2+1)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// refused reports whether err happened while connecting, before any of the
+// request was sent.
+func refused(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// statusError reads the backend's error message and closes the response.
+func statusError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	var body struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body)
+	message := body.Message
+	if message == "" {
+		message = body.Error
+	}
+	return &StatusError{StatusCode: resp.StatusCode, Message: message}
+}
+
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,24 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+func TestSaveSectionReportsUndecodableResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>upstream proxy page</html>"))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(Config{BaseURL: server.URL, MessageTimeout: time.Second, SaveTimeout: time.Second})
+	usage, err := client.SaveSection(context.Background(), &store.Section{ID: "s", DocumentID: "d"})
+	if err == nil {
+		t.Fatalf("got usage %+v and no error, want the decode error", usage)
+	}
+}
@@ -0,0 +1,261 @@
+// Package anchor pins a note to a stretch of section text and finds that
+// stretch again after the text has been edited. Offsets count runes in the
+// section's plain text as produced by richtext.PlainText.
+package anchor
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+const (
+	StatusAnchored  = "anchored"
+	StatusRelocated = "relocated"
+	StatusOrphaned  = "orphaned"
+)
+
+// ContextLength is how much text either side of the quote is remembered to
+// tell repeated quotes apart.
+const ContextLength = 32
+
+// fuzzyBudget bounds the work of an approximate search (quote length times
+// text length); above it only the quote's ends are matched exactly. Notes are
+// re-anchored while the section is locked for a save, so it is kept to a few
+// milliseconds a note.
+const fuzzyBudget = 2_000_000
+
+var ErrNotFound = errors.New("anchor text not found in section")
+
+type Anchor struct {
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Quote  string `json:"quote"`
+	Prefix string `json:"prefix"`
+	Suffix string `json:"suffix"`
+}
+
+// New builds an anchor in text either from a rune range or, when the range is
+// empty, from a quote (with optional prefix/suffix to pick between repeats).
+func New(text string, a Anchor) (Anchor, error) {
+	runes := []rune(text)
+	if a.End > a.Start {
+		if a.Start < 0 || a.End > len(runes) {
+			return Anchor{}, errors.New("anchor range is outside the section text")
+		}
+		return around(runes, a.Start, a.End), nil
+	}
+	if a.Quote == "" {
+		return Anchor{}, errors.New("anchor needs a range or a quote")
+	}
+
+	start, ok := bestExact(runes, []rune(a.Quote), a, -1)
+	if !ok {
+		return Anchor{}, ErrNotFound
+	}
+	return around(runes, start, start+utf8.RuneCountInString(a.Quote)), nil
+}
+
+// Resolve finds a previously created anchor in new text. It prefers an exact
+// match of the quote (using the remembered context and old position to choose
+// among repeats), then whatever now sits between the remembered context, then
+// an approximate match that tolerates small edits, and reports the anchor
+// orphaned when the quoted text is gone.
+func Resolve(text string, a Anchor) (Anchor, string) {
+	runes := []rune(text)
+	quote := []rune(a.Quote)
+	if len(quote) == 0 {
+		return a, StatusOrphaned
+	}
+
+	if start, ok := bestExact(runes, quote, a, a.Start); ok {
+		resolved := around(runes, start, start+len(quote))
+		if resolved.Start == a.Start && resolved.End == a.End {
+			return resolved, StatusAnchored
+		}
+		return resolved, StatusRelocated
+	}
+
+	if start, end, ok := between(runes, a, len(quote)); ok {
+		return around(runes, start, end), StatusRelocated
+	}
+
+	if start, end, ok := approximate(runes, quote); ok {
+		return around(runes, start, end), StatusRelocated
+	}
+
+	return Anchor{Quote: a.Quote, Prefix: a.Prefix, Suffix: a.Suffix}, StatusOrphaned
+}
+
+func around(runes []rune, start, end int) Anchor {
+	return Anchor{
+		Start:  start,
+		End:    end,
+		Quote:  string(runes[start:end]),
+		Prefix: string(runes[max(start-ContextLength, 0):start]),
+		Suffix: string(runes[end:min(end+ContextLength, len(runes))]),
+	}
+}
+
+// bestExact returns the occurrence of quote whose surroundings best match
+// the anchor's prefix and suffix, breaking ties by distance from near.
+func bestExact(runes, quote []rune, a Anchor, near int) (int, bool) {
+	prefix, suffix := []rune(a.Prefix), []rune(a.Suffix)
+	best, bestScore, bestDistance := -1, -1, 0
+	for _, start := range occurrences(runes, quote) {
+		end := start + len(quote)
+		score := commonSuffix(runes[:start], prefix) + commonPrefix(runes[end:], suffix)
+		distance := 0
+		if near >= 0 {
+			distance = abs(start - near)
+		}
+		if score > bestScore || score == bestScore && distance < bestDistance {
+			best, bestScore, bestDistance = start, score, distance
+		}
+	}
+	return best, best >= 0
+}
+
+func occurrences(runes, quote []rune) []int {
+	found := []int{}
+	for i := 0; i+len(quote) <= len(runes); i++ {
+		match := true
+		for j := range quote {
+			if runes[i+j] != quote[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+// between finds the text between the anchor's prefix and suffix, for a quote
+// that was edited where its surroundings were not, and accepts it when it is
+// about as long as the quote was. Context shorter than ContextLength means the
+// quote was that close to the start or end of the text, so it must still be.
+func between(runes []rune, a Anchor, length int) (int, int, bool) {
+	prefix, suffix := []rune(a.Prefix), []rune(a.Suffix)
+	shortest, longest := max(length*3/4, 1), length*5/4
+
+	starts := []int{}
+	if len(prefix) < ContextLength {
+		if commonPrefix(runes, prefix) == len(prefix) {
+			starts = append(starts, len(prefix))
+		}
+	} else {
+		for _, start := range occurrences(runes, prefix) {
+			starts = append(starts, start+len(prefix))
+		}
+	}
+
+	for _, start := range starts {
+		if len(suffix) < ContextLength {
+			end := len(runes) - len(suffix)
+			if end-start >= shortest && end-start <= longest && commonSuffix(runes, suffix) == len(suffix) {
+				return start, end, true
+			}
+			continue
+		}
+		limit := min(start+longest+len(suffix), len(runes))
+		for _, offset := range occurrences(runes[start:limit], suffix) {
+			if offset >= shortest {
+				return start, start + offset, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// approximate finds the substring of runes closest to quote by edit distance
+// (Sellers' algorithm), accepting it when at most a quarter of the quote has
+// changed. Very short quotes must match exactly.
+func approximate(runes, quote []rune) (int, int, bool) {
+	m, n := len(quote), len(runes)
+	if m < 4 || n == 0 {
+		return 0, 0, false
+	}
+	if m*n > fuzzyBudget {
+		return approximateEnds(runes, quote)
+	}
+
+	// prev/cur hold edit distances for the previous and current quote rune
+	// ending at each text position; starts track where each match began.
+	prev, cur := make([]int, n+1), make([]int, n+1)
+	prevStart, curStart := make([]int, n+1), make([]int, n+1)
+	for j := 0; j <= n; j++ {
+		prevStart[j] = j
+	}
+	for i := 1; i <= m; i++ {
+		cur[0], curStart[0] = i, 0
+		for j := 1; j <= n; j++ {
+			cost := 1
+			if quote[i-1] == runes[j-1] {
+				cost = 0
+			}
+			cur[j], curStart[j] = prev[j-1]+cost, prevStart[j-1]
+			if prev[j]+1 < cur[j] {
+				cur[j], curStart[j] = prev[j]+1, prevStart[j]
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j], curStart[j] = cur[j-1]+1, curStart[j-1]
+			}
+		}
+		prev, cur = cur, prev
+		prevStart, curStart = curStart, prevStart
+	}
+
+	bestEnd := -1
+	for j := 1; j <= n; j++ {
+		if bestEnd < 0 || prev[j] < prev[bestEnd] {
+			bestEnd = j
+		}
+	}
+	if bestEnd < 0 || prev[bestEnd] > m/4 || prevStart[bestEnd] >= bestEnd {
+		return 0, 0, false
+	}
+	return prevStart[bestEnd], bestEnd, true
+}
+
+// approximateEnds handles long quotes in long sections: the quote survives if
+// its opening and closing words are both still there, in order, and the text
+// between them is about as long as before.
+func approximateEnds(runes, quote []rune) (int, int, bool) {
+	size := min(ContextLength, len(quote)/2)
+	head, tail := quote[:size], quote[len(quote)-size:]
+	for _, start := range occurrences(runes, head) {
+		limit := min(start+len(quote)*5/4, len(runes))
+		for _, offset := range occurrences(runes[start:limit], tail) {
+			end := start + offset + size
+			if end-start >= len(quote)*3/4 {
+				return start, end, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func commonPrefix(a, b []rune) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func commonSuffix(a, b []rune) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	return n
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
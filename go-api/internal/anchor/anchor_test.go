@@ -0,0 +1,63 @@
+package anchor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	text := "The lighthouse keeper climbed the stairs every evening at dusk. " +
+		"Below him the harbour emptied, one boat at a time, until only the ferry was left."
+	a, err := New(text, Anchor{Quote: "one boat at a time"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		text   string
+		status string
+		quote  string
+	}{
+		{"unchanged", text, StatusAnchored, "one boat at a time"},
+		{"moved", "Night fell. " + text, StatusRelocated, "one boat at a time"},
+		{
+			"edited inside its context",
+			strings.Replace(text, "one boat at a time", "one skiff at a time", 1),
+			StatusRelocated, "one skiff at a time",
+		},
+		{
+			"edited and moved",
+			"Night fell. " + strings.Replace(text, "one boat at a time", "boat after boat", 1),
+			StatusRelocated, "boat after boat",
+		},
+		{"deleted with its context", "The lighthouse keeper slept.", StatusOrphaned, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resolved, status := Resolve(tc.text, a)
+			if status != tc.status {
+				t.Fatalf("status is %s, want %s", status, tc.status)
+			}
+			if status == StatusOrphaned {
+				return
+			}
+			if got := string([]rune(tc.text)[resolved.Start:resolved.End]); got != tc.quote || resolved.Quote != tc.quote {
+				t.Errorf("resolved to %q (quote %q), want %q", got, resolved.Quote, tc.quote)
+			}
+		})
+	}
+}
+
+func TestResolveAtTextEdges(t *testing.T) {
+	text := "Rain. The rest of the chapter follows here."
+	a, err := New(text, Anchor{Start: 0, End: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := "Snow. The rest of the chapter follows here."
+	resolved, status := Resolve(edited, a)
+	if status != StatusRelocated || resolved.Start != 0 || resolved.Quote != "Snow." {
+		t.Errorf("got %+v %s, want the opening word relocated", resolved, status)
+	}
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+type AccessTokenHandler struct {
+	accessTokenStore store.AccessTokenStore
+	logger           *log.Logger
+}
+
+func NewAccessTokenHandler(accessTokenStore store.AccessTokenStore, logger *log.Logger) *AccessTokenHandler {
+	return &AccessTokenHandler{
+		accessTokenStore: accessTokenStore,
+		logger:           logger,
+	}
+}
+
+// HandleCreateAccessToken issues a personal access token. The response is the
+// only time the token itself is shown. Leaving out document_ids gives the
+// token all the user's documents.
+func (ah *AccessTokenHandler) HandleCreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string     `json:"name"`
+		Scope       string     `json:"scope"`
+		DocumentIDs []string   `json:"document_ids"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		ah.logger.Printf("ERROR: decodingCreateAccessToken: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	token, secret, err := ah.accessTokenStore.CreateAccessToken(currentUser, &store.AccessToken{
+		Name:        req.Name,
+		Scope:       req.Scope,
+		DocumentIDs: req.DocumentIDs,
+		ExpiresAt:   req.ExpiresAt,
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidAccessToken) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		ah.logger.Printf("ERROR: createAccessToken: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create access token"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"access_token": token, "token": secret})
+}
+
+func (ah *AccessTokenHandler) HandleGetAccessTokens(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	tokens, err := ah.accessTokenStore.GetAccessTokens(currentUser)
+	if err != nil {
+		ah.logger.Printf("ERROR: getAccessTokens: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get access tokens"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"access_tokens": tokens})
+}
+
+func (ah *AccessTokenHandler) HandleRevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := utils.ReadStringParam(r)
+	if err != nil {
+		ah.logger.Printf("ERROR: readStringParam: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	err = ah.accessTokenStore.RevokeAccessToken(currentUser, tokenID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "access token not found"})
+			return
+		}
+		ah.logger.Printf("ERROR: revokeAccessToken: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to revoke access token"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"result": "access token revoked"})
+}
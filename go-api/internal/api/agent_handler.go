@@ -1,19 +1,28 @@
 package api
 
 import (
-	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
+	"github.com/jackwillis517/Scribo/internal/agent"
 	"github.com/jackwillis517/Scribo/internal/middleware"
 	"github.com/jackwillis517/Scribo/internal/store"
 	"github.com/jackwillis517/Scribo/internal/utils"
 )
 
 type AgentHandler struct {
-	agentStore store.AgentStore
-	logger     *log.Logger
+	agentClient   agent.AgentClient
+	agentStore    store.AgentStore
+	documentStore store.DocumentStore
+	sectionStore  store.SectionStore
+	jobStore      store.JobStore
+	usageStore    store.UsageStore
+	quota         store.Quota
+	logger        *log.Logger
 }
 
 type MessageRequest struct {
@@ -21,10 +30,104 @@ type MessageRequest struct {
 	SectionID  string `json:"section_id"`
 }
 
-func NewAgentHandler(agentStore store.AgentStore, logger *log.Logger) *AgentHandler {
+func NewAgentHandler(agentClient agent.AgentClient, agentStore store.AgentStore, documentStore store.DocumentStore, sectionStore store.SectionStore, jobStore store.JobStore, usageStore store.UsageStore, quota store.Quota, logger *log.Logger) *AgentHandler {
 	return &AgentHandler{
-		agentStore: agentStore,
-		logger:     logger,
+		agentClient:   agentClient,
+		agentStore:    agentStore,
+		documentStore: documentStore,
+		sectionStore:  sectionStore,
+		jobStore:      jobStore,
+		usageStore:    usageStore,
+		quota:         quota,
+		logger:        logger,
+	}
+}
+
+// authorizeDocument writes a 404 and returns false when the current user
+// cannot see the document, or a 403 when their role on it is below role, so
+// the agent backend is never asked about it.
+func (ah *AgentHandler) authorizeDocument(w http.ResponseWriter, user *store.User, documentID string, role string) bool {
+	document, err := ah.documentStore.ReadDocument(user, documentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return false
+		}
+		ah.logger.Printf("ERROR: authorizeDocument: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read document"})
+		return false
+	}
+	if !store.RoleAtLeast(document.Role, role) {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": store.ErrForbidden.Error()})
+		return false
+	}
+	return true
+}
+
+// usageSummary returns the user's usage against their token quota, or writes
+// a 500 and returns nil when it cannot be read.
+func (ah *AgentHandler) usageSummary(w http.ResponseWriter, user *store.User) *store.UsageSummary {
+	summary, err := ah.usageStore.GetUsageSummary(user, ah.quota)
+	if err != nil {
+		ah.logger.Printf("ERROR: getUsageSummary: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to check usage"})
+		return nil
+	}
+	return summary
+}
+
+// checkQuota writes a 429 and returns false when the user has used up a
+// token quota. The check is made before a call, so one call may overrun the
+// quota a little; the next is refused.
+func (ah *AgentHandler) checkQuota(w http.ResponseWriter, user *store.User) bool {
+	summary := ah.usageSummary(w, user)
+	if summary == nil {
+		return false
+	}
+	if period := summary.Exceeded(); period != nil {
+		writeQuotaExceeded(w, utils.Envelope{}, summary, period)
+		return false
+	}
+	return true
+}
+
+// recordMessageUsage records what a message to the agent cost: the usage the
+// backend reported, or an estimate from the text sent and received.
+func (ah *AgentHandler) recordMessageUsage(user *store.User, message *store.AgentMessage, reply string, usage *store.TokenUsage) {
+	event := &store.UsageEvent{Kind: store.UsageKindMessage, DocumentID: &message.DocumentID}
+	if usage != nil {
+		event.InputTokens, event.OutputTokens = usage.InputTokens, usage.OutputTokens
+	} else {
+		event.InputTokens, event.OutputTokens = store.EstimateTokens(message.Content), store.EstimateTokens(reply)
+		event.Estimated = true
+	}
+	if err := ah.usageStore.RecordUsage(user, event); err != nil {
+		ah.logger.Printf("ERROR: recordUsage: %v", err)
+	}
+}
+
+// writeAgentError answers a failed call to the agent backend with the status
+// that best describes it. Nothing is written when the client has gone away.
+func (ah *AgentHandler) writeAgentError(w http.ResponseWriter, name string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	ah.logger.Printf("ERROR: %s: %v", name, err)
+
+	var statusErr *agent.StatusError
+	switch {
+	case errors.Is(err, agent.ErrTimeout):
+		utils.WriteJSON(w, http.StatusGatewayTimeout, utils.Envelope{"error": "agent backend timed out"})
+	case errors.Is(err, agent.ErrCircuitOpen):
+		utils.WriteJSON(w, http.StatusServiceUnavailable, utils.Envelope{"error": "agent backend unavailable, try again shortly"})
+	case errors.Is(err, agent.ErrUnavailable):
+		utils.WriteJSON(w, http.StatusBadGateway, utils.Envelope{"error": "agent backend unavailable"})
+	case errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusBadRequest || statusErr.StatusCode == http.StatusUnprocessableEntity):
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "agent backend rejected the request"})
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests:
+		utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "agent backend is busy, try again shortly"})
+	default:
+		utils.WriteJSON(w, http.StatusBadGateway, utils.Envelope{"error": "agent backend error"})
 	}
 }
 
@@ -50,29 +153,18 @@ func (ah *AgentHandler) HandleAgentMessage(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	payload, err := json.Marshal(req)
-	if err != nil {
-		utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"error": "marshal error"})
+	if !ah.authorizeMessage(w, currentUser, &req) || !ah.checkQuota(w, currentUser) {
 		return
 	}
 
-	// ah.logger.Printf("=== Sending to Flask ===")
-	// ah.logger.Printf("Payload: %s", string(payload))
-
-	flaskResp, err := http.Post("http://localhost:5001/message", "application/json", bytes.NewBuffer(payload))
+	reply, err := ah.agentClient.SendMessage(r.Context(), &req)
 	if err != nil {
-		utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"error": "flask api request failed"})
-		return
-	}
-	defer flaskResp.Body.Close()
-
-	var flaskResult store.AgentMessage
-	if err := json.NewDecoder(flaskResp.Body).Decode(&flaskResult); err != nil {
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "flask response decode error"})
+		ah.writeAgentError(w, "agentMessage", err)
 		return
 	}
+	ah.recordMessageUsage(currentUser, &req, reply.Content, reply.Usage)
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"response": flaskResult})
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"response": reply})
 }
 
 func (ah *AgentHandler) HandleSaveSection(w http.ResponseWriter, r *http.Request) {
@@ -94,26 +186,109 @@ func (ah *AgentHandler) HandleSaveSection(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	payload, err := json.Marshal(req)
+	summary := ah.usageSummary(w, currentUser)
+	if summary == nil {
+		return
+	}
+
+	// Save the section here and index it in the background, so the writer's
+	// text is safe even while the agent backend is slow or down.
+	section, err := ah.sectionStore.UpdateSection(currentUser, &req)
 	if err != nil {
-		utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"error": "marshal error"})
+		if errors.Is(err, store.ErrInvalidOutline) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+			return
+		}
+		ah.logger.Printf("ERROR: updateSection: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to save section"})
 		return
 	}
 
-	flaskResp, err := http.Post("http://localhost:5001/save", "application/json", bytes.NewBuffer(payload))
+	// Over quota the save still succeeds, but the section is not indexed
+	// until the quota resets and it is saved or reindexed again
+	if period := summary.Exceeded(); period != nil {
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{"section": section, "indexing_skipped": quotaExceeded(period), "usage": summary})
+		return
+	}
+
+	job, err := ah.jobStore.EnqueueSectionIndex(currentUser, section.ID)
 	if err != nil {
-		utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"error": "flask api request failed"})
+		ah.logger.Printf("ERROR: enqueueSectionIndex: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "section saved but could not be queued for indexing"})
 		return
 	}
-	defer flaskResp.Body.Close()
 
-	var flaskResult = map[string]any{}
-	if err := json.NewDecoder(flaskResp.Body).Decode(&flaskResult); err != nil {
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "flask response decode error"})
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"section": section, "job": job})
+}
+
+// HandleGetIndexStatus reports whether each section of a document has been
+// indexed by the agent backend since it last changed.
+func (ah *AgentHandler) HandleGetIndexStatus(w http.ResponseWriter, r *http.Request) {
+	var documentId DocumentId
+	err := json.NewDecoder(r.Body).Decode(&documentId)
+	if err != nil {
+		ah.logger.Printf("ERROR: decodingGetIndexStatus: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	if !ah.authorizeDocument(w, currentUser, documentId.DocumentId, store.RoleViewer) {
+		return
+	}
+
+	sections, err := ah.jobStore.GetIndexStatus(currentUser, documentId.DocumentId)
+	if err != nil {
+		ah.logger.Printf("ERROR: getIndexStatus: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get index status"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"sections": sections})
+}
+
+// HandleReindexDocument queues every section of a document that is stale or
+// failed to index.
+func (ah *AgentHandler) HandleReindexDocument(w http.ResponseWriter, r *http.Request) {
+	var documentId DocumentId
+	err := json.NewDecoder(r.Body).Decode(&documentId)
+	if err != nil {
+		ah.logger.Printf("ERROR: decodingReindexDocument: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	if !ah.authorizeDocument(w, currentUser, documentId.DocumentId, store.RoleEditor) || !ah.checkQuota(w, currentUser) {
+		return
+	}
+
+	jobs, err := ah.jobStore.ReindexDocument(currentUser, documentId.DocumentId)
+	if err != nil {
+		ah.logger.Printf("ERROR: reindexDocument: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to queue sections for indexing"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"statue": "success"})
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"jobs": jobs})
 }
 
 func (ah *AgentHandler) HandleGetMessagesById(w http.ResponseWriter, r *http.Request) {
@@ -131,10 +306,10 @@ func (ah *AgentHandler) HandleGetMessagesById(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	messages, err := ah.agentStore.GetAgentMessagesByID(req.DocumentID, req.SectionID)
+	messages, err := ah.agentStore.GetAgentMessagesByID(currentUser, req.DocumentID, req.SectionID)
 	if err != nil {
 		ah.logger.Printf("ERROR: getAgentMessagesByID: %v", err)
-		utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"error": "failed to get messages"})
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get messages"})
 		return
 	}
 
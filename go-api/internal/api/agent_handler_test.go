@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackwillis517/Scribo/internal/agent"
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+type ownedDocuments struct{ store.DocumentStore }
+
+func (ownedDocuments) ReadDocument(user *store.User, id string) (*store.Document, error) {
+	return &store.Document{ID: id, Role: store.RoleOwner}, nil
+}
+
+// sectionsOf serves every section as belonging to the named document.
+type sectionsOf struct {
+	store.SectionStore
+	documentID string
+}
+
+func (s sectionsOf) ReadSection(user *store.User, id string) (*store.Section, error) {
+	return &store.Section{ID: id, DocumentID: s.documentID}, nil
+}
+
+func (s sectionsOf) UpdateSection(user *store.User, section *store.Section) (*store.Section, error) {
+	section.DocumentID = s.documentID
+	return section, nil
+}
+
+// spentQuota reports the daily quota used up.
+type spentQuota struct{ store.UsageStore }
+
+func (spentQuota) GetUsageSummary(user *store.User, quota store.Quota) (*store.UsageSummary, error) {
+	limit := 100
+	return &store.UsageSummary{Day: store.UsagePeriod{Period: "day", Used: limit, Limit: &limit}}, nil
+}
+
+type unusedQuota struct{ store.UsageStore }
+
+func (unusedQuota) GetUsageSummary(user *store.User, quota store.Quota) (*store.UsageSummary, error) {
+	return &store.UsageSummary{}, nil
+}
+
+func TestAgentErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+	}{
+		{agent.ErrTimeout, http.StatusGatewayTimeout},
+		{agent.ErrCircuitOpen, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: connection refused", agent.ErrUnavailable), http.StatusBadGateway},
+		{&agent.StatusError{StatusCode: http.StatusBadRequest}, http.StatusBadRequest},
+		{&agent.StatusError{StatusCode: http.StatusUnprocessableEntity}, http.StatusBadRequest},
+		{&agent.StatusError{StatusCode: http.StatusTooManyRequests}, http.StatusTooManyRequests},
+		{&agent.StatusError{StatusCode: http.StatusInternalServerError}, http.StatusBadGateway},
+	} {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			client := agent.NewFakeClient()
+			client.Err = tc.err
+			handler := NewAgentHandler(client, nil, ownedDocuments{}, sectionsOf{documentID: "d"}, nil, unusedQuota{}, store.Quota{}, log.New(io.Discard, "", 0))
+
+			body := `{"document_id": "d", "section_id": "s", "role": "user", "content": "Hello"}`
+			r := httptest.NewRequest(http.MethodPost, "/agent/message", strings.NewReader(body))
+			r = middleware.SetUser(r, &store.User{ID: "u"})
+			w := httptest.NewRecorder()
+			handler.HandleAgentMessage(w, r)
+
+			if w.Code != tc.status {
+				t.Errorf("status is %d, want %d", w.Code, tc.status)
+			}
+		})
+	}
+}
+
+func TestAgentMessageSectionOfAnotherDocument(t *testing.T) {
+	client := agent.NewFakeClient()
+	handler := NewAgentHandler(client, nil, ownedDocuments{}, sectionsOf{documentID: "other"}, nil, unusedQuota{}, store.Quota{}, log.New(io.Discard, "", 0))
+
+	body := `{"document_id": "d", "section_id": "s", "role": "user", "content": "Hello"}`
+	r := httptest.NewRequest(http.MethodPost, "/agent/message", strings.NewReader(body))
+	r = middleware.SetUser(r, &store.User{ID: "u"})
+	w := httptest.NewRecorder()
+	handler.HandleAgentMessage(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status is %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestSaveSectionOverQuota(t *testing.T) {
+	// No job store: indexing must not be queued
+	handler := NewAgentHandler(agent.NewFakeClient(), nil, ownedDocuments{}, sectionsOf{documentID: "d"}, nil, spentQuota{}, store.Quota{}, log.New(io.Discard, "", 0))
+
+	body := `{"id": "s", "title": "One", "content": "Saved anyway."}`
+	r := httptest.NewRequest(http.MethodPost, "/agent/saveSection", strings.NewReader(body))
+	r = middleware.SetUser(r, &store.User{ID: "u"})
+	w := httptest.NewRecorder()
+	handler.HandleSaveSection(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status is %d, want %d", w.Code, http.StatusOK)
+	}
+	var response struct {
+		Section         store.Section `json:"section"`
+		IndexingSkipped string        `json:"indexing_skipped"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Section.Content != "Saved anyway." {
+		t.Errorf("saved content is %q, want %q", response.Section.Content, "Saved anyway.")
+	}
+	if response.IndexingSkipped != "daily token quota exceeded" {
+		t.Errorf("indexing_skipped is %q, want the daily quota named", response.IndexingSkipped)
+	}
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+// sseHeartbeat is how often a comment line is sent while the agent is quiet,
+// so proxies do not close an idle stream.
+const sseHeartbeat = 15 * time.Second
+
+// sseEvent is one Server-Sent Events message.
+type sseEvent struct {
+	Event string
+	Data  string
+}
+
+// readSSE parses an event stream, sending each complete event on events. It
+// closes events when the stream ends and reports why it ended.
+func readSSE(ctx context.Context, r io.Reader, events chan<- sseEvent) error {
+	defer close(events)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	var event sseEvent
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				event.Data = strings.Join(data, "\n")
+				if event.Event == "" {
+					event.Event = "message"
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			event, data = sseEvent{}, nil
+		case strings.HasPrefix(line, ":"):
+			// Comment
+		case strings.HasPrefix(line, "event:"):
+			event.Event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
+
+// writeSSE writes one event and flushes it to the client.
+func writeSSE(w http.ResponseWriter, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	if err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// HandleAgentMessageStream sends a message to the agent and relays its reply
+// as Server-Sent Events while it is generated: "thread" with the thread ID,
+// "token" for each piece of text, "tool" when the agent calls a tool, and
+// finally "done" with the complete message, or "error". If the client goes
+// away the upstream request is cancelled with it.
+func (ah *AgentHandler) HandleAgentMessageStream(w http.ResponseWriter, r *http.Request) {
+	var req store.AgentMessage
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		ah.logger.Printf("ERROR: decodingAgentMessageStream: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	if !ah.authorizeMessage(w, currentUser, &req) || !ah.checkQuota(w, currentUser) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	upstream, err := ah.agentClient.StreamMessage(ctx, &req)
+	if err != nil {
+		ah.writeAgentError(w, "agentMessageStream", err)
+		return
+	}
+	defer upstream.Close()
+
+	// The backend may have done work even if the stream fails, so usage is
+	// always recorded, estimated from the tokens relayed when there is no
+	// done event reporting it.
+	var reply strings.Builder
+	var usage *store.TokenUsage
+	defer func() {
+		ah.recordMessageUsage(currentUser, &req, reply.String(), usage)
+	}()
+
+	// Streams outlive the server's WriteTimeout, so lift it for this response.
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		ah.logger.Printf("ERROR: setWriteDeadline: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	events := make(chan sseEvent)
+	go func() {
+		if err := readSSE(ctx, upstream, events); err != nil && ctx.Err() == nil {
+			ah.logger.Printf("ERROR: readAgentStream: %v", err)
+		}
+	}()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Client disconnected; the deferred cancel tears down upstream.
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			controller.Flush()
+		case event, ok := <-events:
+			if !ok {
+				writeSSE(w, "error", utils.Envelope{"error": "agent stream ended unexpectedly"})
+				return
+			}
+
+			switch event.Event {
+			case "done":
+				var message store.AgentMessage
+				if err := json.Unmarshal([]byte(event.Data), &message); err != nil {
+					ah.logger.Printf("ERROR: decodingAgentStreamDone: %v", err)
+					writeSSE(w, "error", utils.Envelope{"error": "agent response decode error"})
+					return
+				}
+				reply.Reset()
+				reply.WriteString(message.Content)
+				usage = message.Usage
+				writeSSE(w, "done", utils.Envelope{"response": message})
+				return
+			case "error":
+				ah.logger.Printf("ERROR: agentStream: %s", event.Data)
+				writeSSE(w, "error", utils.Envelope{"error": "agent backend error"})
+				return
+			case "thread", "token", "tool":
+				if event.Event == "token" {
+					var token struct {
+						Content string `json:"content"`
+					}
+					if json.Unmarshal([]byte(event.Data), &token) == nil {
+						reply.WriteString(token.Content)
+					}
+				}
+				if err := writeSSE(w, event.Event, json.RawMessage(event.Data)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
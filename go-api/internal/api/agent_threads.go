@@ -0,0 +1,340 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+const (
+	defaultThreadMessagesLimit = 50
+	maxThreadMessagesLimit     = 200
+	maxThreadTitleLength       = 255
+)
+
+type ThreadRequest struct {
+	ThreadID  string `json:"thread_id"`
+	SectionID string `json:"section_id"`
+	MessageID string `json:"message_id"`
+	Title     string `json:"title"`
+	Archived  *bool  `json:"archived"`
+	Limit     int    `json:"limit"`
+	Offset    int    `json:"offset"`
+}
+
+// authorizeMessage writes an error and returns false unless the message is
+// about a section of a document the user may comment on and, when it
+// continues a thread, that thread belongs to the same document and section
+// and is not archived.
+// An empty thread ID is cleared so the agent backend starts a new thread.
+func (ah *AgentHandler) authorizeMessage(w http.ResponseWriter, user *store.User, message *store.AgentMessage) bool {
+	if !ah.authorizeDocument(w, user, message.DocumentID, store.RoleCommenter) {
+		return false
+	}
+	section, err := ah.sectionStore.ReadSection(user, message.SectionID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		ah.logger.Printf("ERROR: readSection: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read section"})
+		return false
+	}
+	if err != nil || section.DocumentID != message.DocumentID {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+		return false
+	}
+	if message.ThreadID != nil && *message.ThreadID == "" {
+		message.ThreadID = nil
+	}
+	if message.ThreadID == nil {
+		return true
+	}
+
+	thread, err := ah.agentStore.ReadThread(user, *message.ThreadID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "thread not found"})
+			return false
+		}
+		ah.logger.Printf("ERROR: readThread: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read thread"})
+		return false
+	}
+	if thread.DocumentID != message.DocumentID || thread.SectionID != message.SectionID {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "thread not found"})
+		return false
+	}
+	if thread.Archived {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "thread is archived"})
+		return false
+	}
+	return true
+}
+
+func (ah *AgentHandler) HandleCreateThread(w http.ResponseWriter, r *http.Request) {
+	var req ThreadRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		ah.logger.Printf("ERROR: decodingCreateThread: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	if len(strings.TrimSpace(req.Title)) > maxThreadTitleLength {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "title is too long"})
+		return
+	}
+
+	thread, err := ah.agentStore.CreateThread(currentUser, req.SectionID, req.Title)
+	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+			return
+		}
+		ah.logger.Printf("ERROR: createThread: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create thread"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"thread": thread})
+}
+
+// HandleGetThreads lists the threads for a document, or for one section when
+// section_id is given, most recently active first.
+func (ah *AgentHandler) HandleGetThreads(w http.ResponseWriter, r *http.Request) {
+	var req store.ThreadQuery
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		ah.logger.Printf("ERROR: decodingGetThreads: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	if !ah.authorizeDocument(w, currentUser, req.DocumentID, store.RoleViewer) {
+		return
+	}
+
+	threads, err := ah.agentStore.GetThreads(currentUser, req)
+	if err != nil {
+		ah.logger.Printf("ERROR: getThreads: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get threads"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"threads": threads})
+}
+
+// HandleGetThreadMessages returns a page of one thread's messages. Offset
+// counts back from the newest message, so a client loads the latest page
+// first and pages back through the history.
+func (ah *AgentHandler) HandleGetThreadMessages(w http.ResponseWriter, r *http.Request) {
+	var req ThreadRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		ah.logger.Printf("ERROR: decodingGetThreadMessages: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	if req.Limit < 0 || req.Offset < 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit and offset must not be negative"})
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultThreadMessagesLimit
+	}
+	req.Limit = min(req.Limit, maxThreadMessagesLimit)
+
+	messages, total, err := ah.agentStore.GetThreadMessages(currentUser, req.ThreadID, req.Limit, req.Offset)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "thread not found"})
+			return
+		}
+		ah.logger.Printf("ERROR: getThreadMessages: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get messages"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"messages": messages,
+		"total":    total,
+		"has_more": req.Offset+len(messages) < total,
+	})
+}
+
+func (ah *AgentHandler) HandleRenameThread(w http.ResponseWriter, r *http.Request) {
+	var req ThreadRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		ah.logger.Printf("ERROR: decodingRenameThread: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	if len(strings.TrimSpace(req.Title)) > maxThreadTitleLength {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "title is too long"})
+		return
+	}
+
+	thread, err := ah.agentStore.RenameThread(currentUser, req.ThreadID, req.Title)
+	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "thread not found"})
+			return
+		}
+		ah.logger.Printf("ERROR: renameThread: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to rename thread"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"thread": thread})
+}
+
+// HandleArchiveThread archives a thread, or restores it when archived is
+// false.
+func (ah *AgentHandler) HandleArchiveThread(w http.ResponseWriter, r *http.Request) {
+	var req ThreadRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		ah.logger.Printf("ERROR: decodingArchiveThread: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	archived := req.Archived == nil || *req.Archived
+	thread, err := ah.agentStore.ArchiveThread(currentUser, req.ThreadID, archived)
+	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "thread not found"})
+			return
+		}
+		ah.logger.Printf("ERROR: archiveThread: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to archive thread"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"thread": thread})
+}
+
+// HandleForkThread branches a new thread off an existing one at message_id,
+// copying the history up to and including that message.
+func (ah *AgentHandler) HandleForkThread(w http.ResponseWriter, r *http.Request) {
+	var req ThreadRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		ah.logger.Printf("ERROR: decodingForkThread: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	if len(strings.TrimSpace(req.Title)) > maxThreadTitleLength {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "title is too long"})
+		return
+	}
+
+	thread, err := ah.agentStore.ForkThread(currentUser, req.ThreadID, req.MessageID, req.Title)
+	if err != nil {
+		if errors.Is(err, store.ErrMessageNotFound) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "message not found"})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "thread not found"})
+			return
+		}
+		ah.logger.Printf("ERROR: forkThread: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to fork thread"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"thread": thread})
+}
+
+func (ah *AgentHandler) HandleDeleteThread(w http.ResponseWriter, r *http.Request) {
+	threadID, err := utils.ReadStringParam(r)
+	if err != nil {
+		ah.logger.Printf("ERROR: readStringParam: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	err = ah.agentStore.DeleteThread(currentUser, threadID)
+	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "thread not found"})
+			return
+		}
+		ah.logger.Printf("ERROR: deleteThread: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to delete thread"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"result": "thread deleted"})
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/jackwillis517/Scribo/internal/collab"
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+const (
+	// collabReadLimit caps one message from a client, which bounds a single
+	// operation's size.
+	collabReadLimit = 1 << 20
+	// collabPingInterval is how often an idle connection is checked, so dead
+	// clients leave their sessions.
+	collabPingInterval = 30 * time.Second
+	collabWriteTimeout = 10 * time.Second
+)
+
+// collabOrigins are the browser origins allowed to open a collaboration
+// socket besides the API's own, matching CORSMiddleware.
+var collabOrigins = []string{"localhost:5173"}
+
+type CollabHandler struct {
+	hub           *collab.Hub
+	sectionStore  store.SectionStore
+	documentStore store.DocumentStore
+	logger        *log.Logger
+}
+
+func NewCollabHandler(hub *collab.Hub, sectionStore store.SectionStore, documentStore store.DocumentStore, logger *log.Logger) *CollabHandler {
+	return &CollabHandler{
+		hub:           hub,
+		sectionStore:  sectionStore,
+		documentStore: documentStore,
+		logger:        logger,
+	}
+}
+
+// HandleCollaborate opens a WebSocket on which a section is edited together
+// with everyone else who has it open; see package collab for the messages.
+// Viewers, commenters and read-only access tokens get the live text but
+// cannot send edits.
+func (ch *CollabHandler) HandleCollaborate(w http.ResponseWriter, r *http.Request) {
+	sectionID, err := utils.ReadStringParam(r)
+	if err != nil {
+		ch.logger.Printf("ERROR: readStringParam: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	section, err := ch.sectionStore.ReadSection(currentUser, sectionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+			return
+		}
+		ch.logger.Printf("ERROR: readSection: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read section"})
+		return
+	}
+
+	// The session asks again from time to time, so a client whose role is
+	// lowered or removed while connected is disconnected
+	token := middleware.GetAccessToken(r)
+	access := func() (bool, error) {
+		document, err := ch.documentStore.ReadDocument(currentUser, section.DocumentID)
+		if err != nil {
+			return false, err
+		}
+		canEdit := store.RoleAtLeast(document.Role, store.RoleEditor) && (token == nil || token.CanWrite())
+		return canEdit, nil
+	}
+	canEdit, err := access()
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+			return
+		}
+		ch.logger.Printf("ERROR: readDocument: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read document"})
+		return
+	}
+
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: collabOrigins})
+	if err != nil {
+		// Accept has already answered the request
+		ch.logger.Printf("ERROR: acceptWebSocket: %v", err)
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(collabReadLimit)
+
+	connection, err := ch.hub.Join(currentUser, sectionID, canEdit, access)
+	if err != nil {
+		ch.logger.Printf("ERROR: joinSession: %v", err)
+		conn.Close(websocket.StatusInternalError, "failed to open the section")
+		return
+	}
+	defer connection.Leave()
+
+	// The request's context is not safe to use once the connection is
+	// hijacked
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- ch.readOperations(ctx, conn, connection)
+	}()
+
+	ping := time.NewTicker(collabPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case message, ok := <-connection.Messages():
+			if !ok {
+				conn.Close(websocket.StatusTryAgainLater, collab.ErrSessionEnded.Error())
+				return
+			}
+			if err := ch.write(ctx, conn, message); err != nil {
+				return
+			}
+		case <-ping.C:
+			pingCtx, cancelPing := context.WithTimeout(ctx, collabWriteTimeout)
+			err := conn.Ping(pingCtx)
+			cancelPing()
+			if err != nil {
+				return
+			}
+		case err := <-closed:
+			if err != nil {
+				conn.Close(websocket.StatusPolicyViolation, err.Error())
+			}
+			return
+		}
+	}
+}
+
+// readOperations submits the client's operations until the client goes away,
+// when it returns nil, or sends something the session refuses, when it
+// returns the reason.
+func (ch *CollabHandler) readOperations(ctx context.Context, conn *websocket.Conn, connection *collab.Connection) error {
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			return nil
+		}
+
+		var message collab.Message
+		err = json.Unmarshal(data, &message)
+		if err != nil {
+			return errors.New("malformed message")
+		}
+		if message.Type != collab.MessageOperation {
+			return errors.New("only operations may be sent")
+		}
+
+		err = connection.Submit(message.Revision, message.Operation)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (ch *CollabHandler) write(ctx context.Context, conn *websocket.Conn, message collab.Message) error {
+	ctx, cancel := context.WithTimeout(ctx, collabWriteTimeout)
+	defer cancel()
+	return wsjson.Write(ctx, conn, message)
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/jackwillis517/Scribo/internal/diff"
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/richtext"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+// maxCompareTextSize bounds a compareText request, which carries both texts.
+const maxCompareTextSize = 4 << 20
+
+type DiffHandler struct {
+	sectionStore store.SectionStore
+	logger       *log.Logger
+}
+
+type CompareTextRequest struct {
+	Old         string `json:"old"`
+	New         string `json:"new"`
+	Granularity string `json:"granularity"`
+	Format      string `json:"format"`
+}
+
+// CompareRevisionsRequest compares two revisions of a section. When
+// ToRevisionID is empty the section's current content is used instead.
+type CompareRevisionsRequest struct {
+	FromRevisionID string `json:"from_revision_id"`
+	ToRevisionID   string `json:"to_revision_id"`
+	Granularity    string `json:"granularity"`
+	Format         string `json:"format"`
+}
+
+func NewDiffHandler(sectionStore store.SectionStore, logger *log.Logger) *DiffHandler {
+	return &DiffHandler{
+		sectionStore: sectionStore,
+		logger:       logger,
+	}
+}
+
+// writeDiff sends the structured hunks as JSON by default, or the rendered
+// unified text / HTML fragment when asked for with format.
+func (dh *DiffHandler) writeDiff(w http.ResponseWriter, oldContent string, newContent string, granularity string, format string) {
+	result, err := diff.Compare(richtext.PlainText(oldContent), richtext.PlainText(newContent), granularity)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	switch format {
+	case "", "json":
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{"diff": result})
+	case "unified":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(diff.Unified(result)))
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(diff.HTML(result)))
+	default:
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown diff format"})
+	}
+}
+
+func (dh *DiffHandler) HandleCompareText(w http.ResponseWriter, r *http.Request) {
+	var req CompareTextRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxCompareTextSize)
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			utils.WriteJSON(w, http.StatusRequestEntityTooLarge, utils.Envelope{"error": "texts are too large to compare"})
+			return
+		}
+		dh.logger.Printf("ERROR: decodingCompareText: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	dh.writeDiff(w, req.Old, req.New, req.Granularity, req.Format)
+}
+
+func (dh *DiffHandler) HandleCompareRevisions(w http.ResponseWriter, r *http.Request) {
+	var req CompareRevisionsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		dh.logger.Printf("ERROR: decodingCompareRevisions: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	from, err := dh.sectionStore.ReadRevision(currentUser, req.FromRevisionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "revision not found"})
+			return
+		}
+		dh.logger.Printf("ERROR: readRevision: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read revision"})
+		return
+	}
+
+	var toContent string
+	if req.ToRevisionID == "" {
+		section, err := dh.sectionStore.ReadSection(currentUser, from.SectionID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+				return
+			}
+			dh.logger.Printf("ERROR: readSection: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read section"})
+			return
+		}
+		toContent = section.Content
+	} else {
+		to, err := dh.sectionStore.ReadRevision(currentUser, req.ToRevisionID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "revision not found"})
+				return
+			}
+			dh.logger.Printf("ERROR: readRevision: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read revision"})
+			return
+		}
+		if to.SectionID != from.SectionID {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "revisions belong to different sections"})
+			return
+		}
+		toContent = to.Content
+	}
+
+	dh.writeDiff(w, from.Content, toContent, req.Granularity, req.Format)
+}
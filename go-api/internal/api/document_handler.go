@@ -1,7 +1,9 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
@@ -44,6 +46,10 @@ func (dh *DocumentHandler) HandleCreateDocument(w http.ResponseWriter, r *http.R
 	document.UserID = currentUser.ID
 
 	createdDocument, err := dh.documentStore.CreateDocument(&document, currentUser)
+	if errors.Is(err, store.ErrOutsideTokenScope) {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		dh.logger.Printf("ERROR: createWorkout: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create document"})
@@ -69,8 +75,12 @@ func (dh *DocumentHandler) HandleReadDocument(w http.ResponseWriter, r *http.Req
 	}
 
 	// fmt.Println(documentId)
-	document, err := dh.documentStore.ReadDocument(documentId.DocumentId)
+	document, err := dh.documentStore.ReadDocument(currentUser, documentId.DocumentId)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
 		dh.logger.Printf("ERROR: readDocument: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read document"})
 		return
@@ -94,8 +104,16 @@ func (dh *DocumentHandler) HandleUpdateDocument(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	updatedDocument, err := dh.documentStore.UpdateDocument(&document)
+	updatedDocument, err := dh.documentStore.UpdateDocument(currentUser, &document)
 	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
 		dh.logger.Printf("ERROR: updateDocument: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to update document"})
 		return
@@ -119,8 +137,16 @@ func (dh *DocumentHandler) HandleDeleteDocument(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = dh.documentStore.DeleteDocument(documentID)
+	err = dh.documentStore.DeleteDocument(currentUser, documentID)
 	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
 		dh.logger.Printf("ERROR: deleteDocument: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to delete document"})
 		return
@@ -145,3 +171,38 @@ func (dh *DocumentHandler) HandleGetAllDocuments(w http.ResponseWriter, r *http.
 
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"documents": documents})
 }
+
+// HandleRecomputeStats recounts a document's sections from their content and
+// corrects the document totals, for data saved before the server kept them.
+func (dh *DocumentHandler) HandleRecomputeStats(w http.ResponseWriter, r *http.Request) {
+	var documentId DocumentId
+	err := json.NewDecoder(r.Body).Decode(&documentId)
+	if err != nil {
+		dh.logger.Printf("ERROR: decodingRecomputeStats: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	document, err := dh.documentStore.RecomputeStats(currentUser, documentId.DocumentId)
+	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
+		dh.logger.Printf("ERROR: recomputeStats: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to recompute document stats"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"document": document})
+}
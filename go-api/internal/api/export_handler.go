@@ -0,0 +1,114 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/export"
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+type ExportHandler struct {
+	documentStore store.DocumentStore
+	sectionStore  store.SectionStore
+	noteStore     store.NoteStore
+	logger        *log.Logger
+}
+
+func NewExportHandler(documentStore store.DocumentStore, sectionStore store.SectionStore, noteStore store.NoteStore, logger *log.Logger) *ExportHandler {
+	return &ExportHandler{
+		documentStore: documentStore,
+		sectionStore:  sectionStore,
+		noteStore:     noteStore,
+		logger:        logger,
+	}
+}
+
+func queryBool(r *http.Request, key string) bool {
+	value, err := strconv.ParseBool(r.URL.Query().Get(key))
+	return err == nil && value
+}
+
+// HandleExportDocument serves a whole document as a file download. The format
+// query parameter picks the renderer (markdown by default), and summaries and
+// notes opt in to including section summaries and notes. font=times switches
+// the docx manuscript from Courier to Times.
+func (eh *ExportHandler) HandleExportDocument(w http.ResponseWriter, r *http.Request) {
+	documentID, err := utils.ReadStringParam(r)
+	if err != nil {
+		eh.logger.Printf("ERROR: readDocumentIDParam: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = "markdown"
+	}
+	format, ok := export.Lookup(formatName)
+	if !ok {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown export format, expected one of: " + strings.Join(export.Names(), ", ")})
+		return
+	}
+	opts := export.Options{
+		IncludeSummaries: queryBool(r, "summaries"),
+		IncludeNotes:     queryBool(r, "notes"),
+		Font:             r.URL.Query().Get("font"),
+	}
+
+	document, err := eh.documentStore.ReadDocument(currentUser, documentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
+		eh.logger.Printf("ERROR: readDocument: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read document"})
+		return
+	}
+
+	sections, err := eh.sectionStore.GetSectionsForDocument(currentUser, documentID)
+	if err != nil {
+		eh.logger.Printf("ERROR: getSectionsForDocument: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get all sections"})
+		return
+	}
+
+	var notes []*store.Note
+	if opts.IncludeNotes {
+		notes, err = eh.noteStore.GetNotesForDocument(currentUser, documentID)
+		if err != nil {
+			eh.logger.Printf("ERROR: getNotesForDocument: %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get notes"})
+			return
+		}
+	}
+
+	manuscript := export.NewManuscript(document, currentUser.Name, sections, notes)
+	manuscript.Email = currentUser.Email
+	body, err := format.Render(manuscript, opts)
+	if err != nil {
+		eh.logger.Printf("ERROR: exportDocument: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to export document"})
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": export.Filename(document, format)}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
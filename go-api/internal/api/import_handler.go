@@ -0,0 +1,113 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/importer"
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+// maxImportSize bounds an uploaded manuscript. Novels in .docx are a few
+// megabytes at most.
+const maxImportSize = 20 << 20
+
+type ImportHandler struct {
+	sectionStore store.SectionStore
+	logger       *log.Logger
+}
+
+func NewImportHandler(sectionStore store.SectionStore, logger *log.Logger) *ImportHandler {
+	return &ImportHandler{
+		sectionStore: sectionStore,
+		logger:       logger,
+	}
+}
+
+// HandleImportDocument accepts a multipart upload with the manuscript in the
+// "file" field and optional "title" and "description" fields. With
+// dry_run=true (form field or query parameter) it returns a preview of how
+// the file would be split without saving anything.
+func (ih *ImportHandler) HandleImportDocument(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	err := r.ParseMultipartForm(maxImportSize)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			utils.WriteJSON(w, http.StatusRequestEntityTooLarge, utils.Envelope{"error": "file is too large"})
+			return
+		}
+		ih.logger.Printf("ERROR: parseImportForm: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "a file is required"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		ih.logger.Printf("ERROR: readImportFile: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	draft, err := importer.Parse(header.Filename, data)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+	if title := strings.TrimSpace(r.FormValue("title")); title != "" {
+		draft.Title = title
+	}
+
+	dryRun, _ := strconv.ParseBool(r.FormValue("dry_run"))
+	if dryRun {
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{"preview": draft.Preview()})
+		return
+	}
+
+	document := &store.Document{
+		Title:       draft.Title,
+		Description: r.FormValue("description"),
+	}
+	sections := make([]*store.Section, 0, len(draft.Sections))
+	for _, s := range draft.Sections {
+		sections = append(sections, &store.Section{
+			Kind:     s.Kind,
+			Title:    s.Title,
+			Content:  s.Content,
+			Length:   s.Length,
+			NumWords: s.NumWords,
+		})
+	}
+
+	createdDocument, createdSections, err := ih.sectionStore.ImportDocument(currentUser, document, sections)
+	if errors.Is(err, store.ErrOutsideTokenScope) {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ih.logger.Printf("ERROR: importDocument: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to import document"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"document": createdDocument, "sections": createdSections})
+}
@@ -0,0 +1,338 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+type MemberHandler struct {
+	memberStore store.MemberStore
+	logger      *log.Logger
+}
+
+func NewMemberHandler(memberStore store.MemberStore, logger *log.Logger) *MemberHandler {
+	return &MemberHandler{
+		memberStore: memberStore,
+		logger:      logger,
+	}
+}
+
+func (mh *MemberHandler) HandleGetMembers(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DocumentID string `json:"document_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		mh.logger.Printf("ERROR: decodingGetMembers: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	members, err := mh.memberStore.GetMembers(currentUser, req.DocumentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
+		mh.logger.Printf("ERROR: getMembers: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get members"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"members": members})
+}
+
+func (mh *MemberHandler) HandleUpdateMember(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DocumentID string `json:"document_id"`
+		UserID     string `json:"user_id"`
+		Role       string `json:"role"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		mh.logger.Printf("ERROR: decodingUpdateMember: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	member, err := mh.memberStore.UpdateMemberRole(currentUser, req.DocumentID, req.UserID, req.Role)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidMember) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "member not found"})
+			return
+		}
+		mh.logger.Printf("ERROR: updateMember: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to update member"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"member": member})
+}
+
+// HandleRemoveMember takes a member off a document. Members can remove
+// themselves to leave a document shared with them.
+func (mh *MemberHandler) HandleRemoveMember(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DocumentID string `json:"document_id"`
+		UserID     string `json:"user_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		mh.logger.Printf("ERROR: decodingRemoveMember: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	err = mh.memberStore.RemoveMember(currentUser, req.DocumentID, req.UserID)
+	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "member not found"})
+			return
+		}
+		mh.logger.Printf("ERROR: removeMember: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to remove member"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"result": "member removed"})
+}
+
+func (mh *MemberHandler) HandleInviteMember(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DocumentID string `json:"document_id"`
+		Email      string `json:"email"`
+		Role       string `json:"role"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		mh.logger.Printf("ERROR: decodingInviteMember: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	invitation, err := mh.memberStore.InviteMember(currentUser, &store.Invitation{
+		DocumentID: req.DocumentID,
+		Email:      req.Email,
+		Role:       req.Role,
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidMember) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
+		mh.logger.Printf("ERROR: inviteMember: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to invite member"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"invitation": invitation})
+}
+
+// HandleGetDocumentInvitations lists the invitations to a document that have
+// not been answered yet, for its owner.
+func (mh *MemberHandler) HandleGetDocumentInvitations(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DocumentID string `json:"document_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		mh.logger.Printf("ERROR: decodingGetDocumentInvitations: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	invitations, err := mh.memberStore.GetDocumentInvitations(currentUser, req.DocumentID)
+	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
+		mh.logger.Printf("ERROR: getDocumentInvitations: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get invitations"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"invitations": invitations})
+}
+
+func (mh *MemberHandler) HandleRevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	invitationID, err := utils.ReadStringParam(r)
+	if err != nil {
+		mh.logger.Printf("ERROR: readStringParam: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	err = mh.memberStore.RevokeInvitation(currentUser, invitationID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "invitation not found"})
+			return
+		}
+		mh.logger.Printf("ERROR: revokeInvitation: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to revoke invitation"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"result": "invitation revoked"})
+}
+
+// HandleGetInvitations lists the pending invitations sent to the current
+// user's email address.
+func (mh *MemberHandler) HandleGetInvitations(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	invitations, err := mh.memberStore.GetInvitations(currentUser)
+	if err != nil {
+		if errors.Is(err, store.ErrOutsideTokenScope) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		mh.logger.Printf("ERROR: getInvitations: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get invitations"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"invitations": invitations})
+}
+
+func (mh *MemberHandler) HandleAcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		InvitationID string `json:"invitation_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		mh.logger.Printf("ERROR: decodingAcceptInvitation: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	invitation, err := mh.memberStore.AcceptInvitation(currentUser, req.InvitationID)
+	if err != nil {
+		if errors.Is(err, store.ErrOutsideTokenScope) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "invitation not found"})
+			return
+		}
+		mh.logger.Printf("ERROR: acceptInvitation: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to accept invitation"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"invitation": invitation})
+}
+
+func (mh *MemberHandler) HandleDeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		InvitationID string `json:"invitation_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		mh.logger.Printf("ERROR: decodingDeclineInvitation: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	err = mh.memberStore.DeclineInvitation(currentUser, req.InvitationID)
+	if err != nil {
+		if errors.Is(err, store.ErrOutsideTokenScope) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "invitation not found"})
+			return
+		}
+		mh.logger.Printf("ERROR: declineInvitation: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to decline invitation"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"result": "invitation declined"})
+}
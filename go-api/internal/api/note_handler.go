@@ -1,7 +1,9 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
@@ -41,8 +43,20 @@ func (nh *NoteHandler) HandleCreateNote(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	createdNote, err := nh.noteStore.CreateNote(&note)
+	createdNote, err := nh.noteStore.CreateNote(currentUser, &note)
 	if err != nil {
+		if errors.Is(err, store.ErrInvalidAnchor) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+			return
+		}
 		nh.logger.Printf("ERROR: createNote: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create note"})
 		return
@@ -66,8 +80,12 @@ func (nh *NoteHandler) HandleReadNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	note, err := nh.noteStore.ReadNote(noteId.NoteId)
+	note, err := nh.noteStore.ReadNote(currentUser, noteId.NoteId)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "note not found"})
+			return
+		}
 		nh.logger.Printf("ERROR: readNote: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read note"})
 		return
@@ -91,8 +109,20 @@ func (nh *NoteHandler) HandleUpdateNote(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	updatedNote, err := nh.noteStore.UpdateNote(&note)
+	updatedNote, err := nh.noteStore.UpdateNote(currentUser, &note)
 	if err != nil {
+		if errors.Is(err, store.ErrInvalidAnchor) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "note not found"})
+			return
+		}
 		nh.logger.Printf("ERROR: updateNote: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to update note"})
 		return
@@ -116,8 +146,16 @@ func (nh *NoteHandler) HandleDeleteNote(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = nh.noteStore.DeleteNote(noteID)
+	err = nh.noteStore.DeleteNote(currentUser, noteID)
 	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "note not found"})
+			return
+		}
 		nh.logger.Printf("ERROR: deleteNote: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to delete note"})
 		return
@@ -142,3 +180,80 @@ func (nh *NoteHandler) HandleGetAllNotes(w http.ResponseWriter, r *http.Request)
 
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"notes": notes})
 }
+
+func (nh *NoteHandler) HandleGetNotesForSection(w http.ResponseWriter, r *http.Request) {
+	var sectionId SectionId
+	err := json.NewDecoder(r.Body).Decode(&sectionId)
+	if err != nil {
+		nh.logger.Printf("ERROR: decodingGetNotesForSection: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	notes, err := nh.noteStore.GetNotesForSection(currentUser, sectionId.SectionId)
+	if err != nil {
+		nh.logger.Printf("ERROR: getNotesForSection: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get notes"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"notes": notes})
+}
+
+func (nh *NoteHandler) HandleGetNotesForDocument(w http.ResponseWriter, r *http.Request) {
+	var documentId DocumentId
+	err := json.NewDecoder(r.Body).Decode(&documentId)
+	if err != nil {
+		nh.logger.Printf("ERROR: decodingGetNotesForDocument: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	notes, err := nh.noteStore.GetNotesForDocument(currentUser, documentId.DocumentId)
+	if err != nil {
+		nh.logger.Printf("ERROR: getNotesForDocument: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get notes"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"notes": notes})
+}
+
+// HandleGetOrphanedNotes lists the notes in a document whose anchored text has
+// since been deleted, so the writer can re-anchor or remove them.
+func (nh *NoteHandler) HandleGetOrphanedNotes(w http.ResponseWriter, r *http.Request) {
+	var documentId DocumentId
+	err := json.NewDecoder(r.Body).Decode(&documentId)
+	if err != nil {
+		nh.logger.Printf("ERROR: decodingGetOrphanedNotes: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	notes, err := nh.noteStore.GetOrphanedNotes(currentUser, documentId.DocumentId)
+	if err != nil {
+		nh.logger.Printf("ERROR: getOrphanedNotes: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get orphaned notes"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"notes": notes})
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/presence"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+// presenceReadLimit caps one message from a client; moves and heartbeats are
+// tiny.
+const presenceReadLimit = 4 << 10
+
+type PresenceHandler struct {
+	hub           *presence.Hub
+	documentStore store.DocumentStore
+	sectionStore  store.SectionStore
+	logger        *log.Logger
+}
+
+func NewPresenceHandler(hub *presence.Hub, documentStore store.DocumentStore, sectionStore store.SectionStore, logger *log.Logger) *PresenceHandler {
+	return &PresenceHandler{
+		hub:           hub,
+		documentStore: documentStore,
+		sectionStore:  sectionStore,
+		logger:        logger,
+	}
+}
+
+// presenceMessage is what clients send: a heartbeat, or a move to a section
+// and cursor position.
+type presenceMessage struct {
+	Type      string           `json:"type"`
+	SectionID *string          `json:"section_id"`
+	Cursor    *presence.Cursor `json:"cursor"`
+}
+
+// HandlePresence opens a WebSocket that shows who else has a document open
+// and where. The client is sent a snapshot of everyone present, then their
+// joins, moves and leaves. It sends a move whenever its section or cursor
+// changes, and a heartbeat at least every HeartbeatInterval to stay present.
+func (ph *PresenceHandler) HandlePresence(w http.ResponseWriter, r *http.Request) {
+	documentID, err := utils.ReadStringParam(r)
+	if err != nil {
+		ph.logger.Printf("ERROR: readStringParam: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	document, err := ph.documentStore.ReadDocument(currentUser, documentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
+		ph.logger.Printf("ERROR: readDocument: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read document"})
+		return
+	}
+
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: collabOrigins})
+	if err != nil {
+		// Accept has already answered the request
+		ph.logger.Printf("ERROR: acceptWebSocket: %v", err)
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(presenceReadLimit)
+
+	// The hub asks again from time to time, so a client removed from the
+	// document while connected is disconnected
+	access := func() error {
+		_, err := ph.documentStore.ReadDocument(currentUser, document.ID)
+		return err
+	}
+	subscriber := ph.hub.Join(currentUser, document.ID, access)
+	defer subscriber.Leave()
+
+	// The request's context is not safe to use once the connection is
+	// hijacked
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- ph.readMoves(ctx, conn, currentUser, document.ID, subscriber)
+	}()
+
+	// A client that stops heartbeating expires, which closes its events, so
+	// unlike collaboration this needs no pings to notice dead connections
+	for {
+		select {
+		case event, ok := <-subscriber.Events():
+			if !ok {
+				if err := subscriber.Err(); err != nil {
+					conn.Close(websocket.StatusPolicyViolation, err.Error())
+					return
+				}
+				conn.Close(websocket.StatusTryAgainLater, "no longer present; reconnect")
+				return
+			}
+			if err := ph.write(ctx, conn, event); err != nil {
+				return
+			}
+		case err := <-closed:
+			if err != nil {
+				conn.Close(websocket.StatusPolicyViolation, err.Error())
+			}
+			return
+		}
+	}
+}
+
+// readMoves applies the client's moves and heartbeats until it goes away,
+// when it returns nil, or sends something invalid, when it returns why. Any
+// message keeps the client present.
+func (ph *PresenceHandler) readMoves(ctx context.Context, conn *websocket.Conn, user *store.User, documentID string, subscriber *presence.Subscriber) error {
+	// Sections already checked to be in the document
+	sections := map[string]bool{}
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			return nil
+		}
+
+		var message presenceMessage
+		err = json.Unmarshal(data, &message)
+		if err != nil {
+			return errors.New("malformed message")
+		}
+
+		switch message.Type {
+		case "heartbeat":
+			subscriber.Heartbeat()
+		case presence.EventMove:
+			if message.SectionID != nil && !sections[*message.SectionID] {
+				section, err := ph.sectionStore.ReadSection(user, *message.SectionID)
+				if err != nil && !errors.Is(err, sql.ErrNoRows) {
+					ph.logger.Printf("ERROR: readSection: %v", err)
+					return errors.New("failed to read section")
+				}
+				if err != nil || section.DocumentID != documentID {
+					return errors.New("the section is not in this document")
+				}
+				sections[*message.SectionID] = true
+			}
+			if message.Cursor != nil && message.SectionID == nil {
+				return errors.New("a cursor must be in a section")
+			}
+			if message.Cursor != nil && (message.Cursor.Anchor < 0 || message.Cursor.Head < 0) {
+				return errors.New("cursor positions cannot be negative")
+			}
+			subscriber.Move(message.SectionID, message.Cursor)
+		default:
+			return errors.New("unknown message type")
+		}
+	}
+}
+
+func (ph *PresenceHandler) write(ctx context.Context, conn *websocket.Conn, event presence.Event) error {
+	ctx, cancel := context.WithTimeout(ctx, collabWriteTimeout)
+	defer cancel()
+	return wsjson.Write(ctx, conn, event)
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/presence"
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+// TestPresenceMoves checks which moves a presence client may send: a
+// cursor must be at a non-negative position in a section of the document.
+func TestPresenceMoves(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// sectionsIn is the document every section is in
+		sectionsIn string
+		move       string
+		refused    bool
+	}{
+		{"cursor in the document", "d", `{"type": "move", "section_id": "s", "cursor": {"anchor": 0, "head": 4}}`, false},
+		{"no section", "d", `{"type": "move"}`, false},
+		{"section of another document", "other", `{"type": "move", "section_id": "s", "cursor": {"anchor": 0, "head": 4}}`, true},
+		{"cursor outside a section", "d", `{"type": "move", "cursor": {"anchor": 0, "head": 4}}`, true},
+		{"negative cursor", "d", `{"type": "move", "section_id": "s", "cursor": {"anchor": -1, "head": 4}}`, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hub := presence.NewHub(nil, presence.DefaultConfig, log.New(io.Discard, "", 0))
+			handler := NewPresenceHandler(hub, ownedDocuments{}, sectionsOf{documentID: tc.sectionsIn}, log.New(io.Discard, "", 0))
+			router := chi.NewRouter()
+			router.Get("/documents/presence/{id}", func(w http.ResponseWriter, r *http.Request) {
+				handler.HandlePresence(w, middleware.SetUser(r, &store.User{ID: "u"}))
+			})
+			server := httptest.NewServer(router)
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/documents/presence/d", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.CloseNow()
+
+			var snapshot presence.Event
+			if err := wsjson.Read(ctx, conn, &snapshot); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Write(ctx, websocket.MessageText, []byte(tc.move)); err != nil {
+				t.Fatal(err)
+			}
+
+			// A refused move closes the connection; an accepted one leaves it
+			// open for the heartbeat that follows
+			if err := conn.Write(ctx, websocket.MessageText, []byte(`{"type": "heartbeat"}`)); err != nil && !tc.refused {
+				t.Fatal(err)
+			}
+			readCtx, cancelRead := context.WithTimeout(ctx, 200*time.Millisecond)
+			defer cancelRead()
+			_, _, err = conn.Read(readCtx)
+			status := websocket.CloseStatus(err)
+			if tc.refused && status != websocket.StatusPolicyViolation {
+				t.Errorf("got %v, want the connection closed for a policy violation", err)
+			}
+			if !tc.refused && status != -1 {
+				t.Errorf("the connection was closed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+type ProposalHandler struct {
+	proposalStore store.ProposalStore
+	logger        *log.Logger
+}
+
+type ProposalId struct {
+	ProposalId string `json:"id"`
+}
+
+type GetProposalsRequest struct {
+	SectionID string `json:"section_id"`
+	Status    string `json:"status"`
+}
+
+// AcceptProposalRequest accepts the changes listed by index, or every change
+// when Changes is omitted.
+type AcceptProposalRequest struct {
+	ProposalID string `json:"id"`
+	Changes    []int  `json:"changes"`
+}
+
+func NewProposalHandler(proposalStore store.ProposalStore, logger *log.Logger) *ProposalHandler {
+	return &ProposalHandler{
+		proposalStore: proposalStore,
+		logger:        logger,
+	}
+}
+
+func (ph *ProposalHandler) HandleCreateProposal(w http.ResponseWriter, r *http.Request) {
+	var proposal store.Proposal
+	err := json.NewDecoder(r.Body).Decode(&proposal)
+	if err != nil {
+		ph.logger.Printf("ERROR: decodingCreateProposal: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	createdProposal, err := ph.proposalStore.CreateProposal(currentUser, &proposal)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidProposal) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+			return
+		}
+		ph.logger.Printf("ERROR: createProposal: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create proposal"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"proposal": createdProposal})
+}
+
+func (ph *ProposalHandler) HandleReadProposal(w http.ResponseWriter, r *http.Request) {
+	var proposalId ProposalId
+	err := json.NewDecoder(r.Body).Decode(&proposalId)
+	if err != nil {
+		ph.logger.Printf("ERROR: decodingReadProposal: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	proposal, err := ph.proposalStore.ReadProposal(currentUser, proposalId.ProposalId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "proposal not found"})
+			return
+		}
+		ph.logger.Printf("ERROR: readProposal: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read proposal"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"proposal": proposal})
+}
+
+// HandleGetProposalsForSection lists a section's proposals, optionally only
+// those with one status (pending, say).
+func (ph *ProposalHandler) HandleGetProposalsForSection(w http.ResponseWriter, r *http.Request) {
+	var req GetProposalsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		ph.logger.Printf("ERROR: decodingGetProposalsForSection: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	proposals, err := ph.proposalStore.GetProposalsForSection(currentUser, req.SectionID, req.Status)
+	if err != nil {
+		ph.logger.Printf("ERROR: getProposalsForSection: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get proposals"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"proposals": proposals})
+}
+
+// HandleAcceptProposal applies all or some of a proposal's changes to its
+// section, saved as a revision by the accepting user, and marks the proposal
+// accepted or partially accepted.
+func (ph *ProposalHandler) HandleAcceptProposal(w http.ResponseWriter, r *http.Request) {
+	var req AcceptProposalRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		ph.logger.Printf("ERROR: decodingAcceptProposal: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	if req.Changes != nil {
+		slices.Sort(req.Changes)
+		req.Changes = slices.Compact(req.Changes)
+		if len(req.Changes) == 0 {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "no changes to accept; reject the proposal instead"})
+			return
+		}
+	}
+
+	proposal, section, err := ph.proposalStore.AcceptProposal(currentUser, req.ProposalID, req.Changes)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidProposal) || errors.Is(err, store.ErrInvalidOutline) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrProposalResolved) || errors.Is(err, store.ErrProposalStale) {
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "proposal not found"})
+			return
+		}
+		ph.logger.Printf("ERROR: acceptProposal: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to accept proposal"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"proposal": proposal, "section": section})
+}
+
+func (ph *ProposalHandler) HandleRejectProposal(w http.ResponseWriter, r *http.Request) {
+	var proposalId ProposalId
+	err := json.NewDecoder(r.Body).Decode(&proposalId)
+	if err != nil {
+		ph.logger.Printf("ERROR: decodingRejectProposal: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	proposal, err := ph.proposalStore.ResolveProposal(currentUser, proposalId.ProposalId, store.ProposalStatusRejected, nil)
+	if err != nil {
+		if errors.Is(err, store.ErrProposalResolved) {
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "proposal not found"})
+			return
+		}
+		ph.logger.Printf("ERROR: rejectProposal: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to reject proposal"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"proposal": proposal})
+}
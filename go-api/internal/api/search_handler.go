@@ -0,0 +1,87 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+type SearchHandler struct {
+	searchStore store.SearchStore
+	logger      *log.Logger
+}
+
+func NewSearchHandler(searchStore store.SearchStore, logger *log.Logger) *SearchHandler {
+	return &SearchHandler{
+		searchStore: searchStore,
+		logger:      logger,
+	}
+}
+
+// queryInt reads a non-negative integer query parameter, using fallback when
+// it is absent.
+func queryInt(r *http.Request, key string, fallback int) (int, bool) {
+	raw := r.URL.Query().Get(key)
+	if raw == "" {
+		return fallback, true
+	}
+	value, err := strconv.Atoi(raw)
+	return value, err == nil && value >= 0
+}
+
+// HandleSearch serves GET /search?q=...&document_id=&sort=relevance|recent&limit=&offset=
+func (sh *SearchHandler) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	params := r.URL.Query()
+	search := store.SearchQuery{
+		Query:      strings.TrimSpace(params.Get("q")),
+		DocumentID: params.Get("document_id"),
+		Sort:       params.Get("sort"),
+	}
+	if search.Query == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "a search query is required"})
+		return
+	}
+	if search.Sort == "" {
+		search.Sort = store.SearchSortRelevance
+	}
+	if search.Sort != store.SearchSortRelevance && search.Sort != store.SearchSortRecent {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "sort must be relevance or recent"})
+		return
+	}
+
+	var ok bool
+	if search.Limit, ok = queryInt(r, "limit", defaultSearchLimit); !ok || search.Limit == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be a positive number"})
+		return
+	}
+	search.Limit = min(search.Limit, maxSearchLimit)
+	if search.Offset, ok = queryInt(r, "offset", 0); !ok {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "offset must be a non-negative number"})
+		return
+	}
+
+	hits, err := sh.searchStore.Search(currentUser, search)
+	if err != nil {
+		sh.logger.Printf("ERROR: search: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to search"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"results": hits})
+}
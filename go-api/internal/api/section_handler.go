@@ -1,7 +1,9 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
@@ -19,6 +21,15 @@ type SectionId struct {
 	SectionId string `json:"id"`
 }
 
+type RevisionId struct {
+	RevisionId string `json:"id"`
+}
+
+type ReorderSectionsRequest struct {
+	DocumentID string              `json:"document_id"`
+	Moves      []store.SectionMove `json:"moves"`
+}
+
 func NewSectionHandler(sectionStore store.SectionStore, logger *log.Logger) *SectionHandler {
 	return &SectionHandler{
 		sectionStore: sectionStore,
@@ -41,8 +52,20 @@ func (sh *SectionHandler) HandleCreateSection(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	createdSection, err := sh.sectionStore.CreateSection(&section)
+	createdSection, err := sh.sectionStore.CreateSection(currentUser, &section)
 	if err != nil {
+		if errors.Is(err, store.ErrInvalidOutline) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
 		sh.logger.Printf("ERROR: createSection: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create section"})
 		return
@@ -66,8 +89,12 @@ func (sh *SectionHandler) HandleReadSection(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	section, err := sh.sectionStore.ReadSection(sectionId.SectionId)
+	section, err := sh.sectionStore.ReadSection(currentUser, sectionId.SectionId)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+			return
+		}
 		sh.logger.Printf("ERROR: readDocument: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read section"})
 		return
@@ -91,8 +118,20 @@ func (sh *SectionHandler) HandleUpdateSection(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	updatedSection, err := sh.sectionStore.UpdateSection(&section)
+	updatedSection, err := sh.sectionStore.UpdateSection(currentUser, &section)
 	if err != nil {
+		if errors.Is(err, store.ErrInvalidOutline) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+			return
+		}
 		sh.logger.Printf("ERROR: updateSection: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to update section"})
 		return
@@ -116,8 +155,16 @@ func (sh *SectionHandler) HandleDeleteSection(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = sh.sectionStore.DeleteSection(sectionID)
+	err = sh.sectionStore.DeleteSection(currentUser, sectionID)
 	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+			return
+		}
 		sh.logger.Printf("ERROR: deleteSection: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to delete section"})
 		return
@@ -150,3 +197,165 @@ func (sh *SectionHandler) HandleGetSectionsForDocument(w http.ResponseWriter, r
 
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"sections": sections})
 }
+
+func (sh *SectionHandler) HandleGetOutline(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	var documentId DocumentId
+	err := json.NewDecoder(r.Body).Decode(&documentId)
+	if err != nil {
+		sh.logger.Printf("ERROR: decodingGetOutline: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	outline, err := sh.sectionStore.GetOutline(currentUser, documentId.DocumentId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
+		sh.logger.Printf("ERROR: getOutline: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get outline"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"outline": outline})
+}
+
+func (sh *SectionHandler) HandleReorderSections(w http.ResponseWriter, r *http.Request) {
+	var req ReorderSectionsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		sh.logger.Printf("ERROR: decodingReorderSections: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	if len(req.Moves) == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "no moves given"})
+		return
+	}
+
+	sections, err := sh.sectionStore.ReorderSections(currentUser, req.DocumentID, req.Moves)
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidOutline) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "document not found"})
+			return
+		}
+		sh.logger.Printf("ERROR: reorderSections: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to reorder sections"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"sections": sections})
+}
+
+func (sh *SectionHandler) HandleGetRevisions(w http.ResponseWriter, r *http.Request) {
+	var sectionId SectionId
+	err := json.NewDecoder(r.Body).Decode(&sectionId)
+	if err != nil {
+		sh.logger.Printf("ERROR: decodingGetRevisions: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	revisions, err := sh.sectionStore.GetRevisions(currentUser, sectionId.SectionId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "section not found"})
+			return
+		}
+		sh.logger.Printf("ERROR: getRevisions: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get revisions"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"revisions": revisions})
+}
+
+func (sh *SectionHandler) HandleReadRevision(w http.ResponseWriter, r *http.Request) {
+	var revisionId RevisionId
+	err := json.NewDecoder(r.Body).Decode(&revisionId)
+	if err != nil {
+		sh.logger.Printf("ERROR: decodingReadRevision: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	revision, err := sh.sectionStore.ReadRevision(currentUser, revisionId.RevisionId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "revision not found"})
+			return
+		}
+		sh.logger.Printf("ERROR: readRevision: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to read revision"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"revision": revision})
+}
+
+func (sh *SectionHandler) HandleRestoreRevision(w http.ResponseWriter, r *http.Request) {
+	var revisionId RevisionId
+	err := json.NewDecoder(r.Body).Decode(&revisionId)
+	if err != nil {
+		sh.logger.Printf("ERROR: decodingRestoreRevision: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	section, err := sh.sectionStore.RestoreRevision(currentUser, revisionId.RevisionId)
+	if err != nil {
+		if errors.Is(err, store.ErrForbidden) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "revision not found"})
+			return
+		}
+		sh.logger.Printf("ERROR: restoreRevision: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to restore revision"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"section": section})
+}
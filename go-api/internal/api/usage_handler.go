@@ -0,0 +1,92 @@
+package api
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+const (
+	defaultUsageDays = 30
+	maxUsageDays     = 366
+)
+
+// quotaNames names each usage period's quota in messages.
+var quotaNames = map[string]string{
+	"day":   "daily",
+	"month": "monthly",
+}
+
+// quotaExceeded says which of the user's token quotas is used up.
+func quotaExceeded(period *store.UsagePeriod) string {
+	return quotaNames[period.Period] + " token quota exceeded"
+}
+
+type UsageHandler struct {
+	usageStore store.UsageStore
+	quota      store.Quota
+	logger     *log.Logger
+}
+
+func NewUsageHandler(usageStore store.UsageStore, quota store.Quota, logger *log.Logger) *UsageHandler {
+	return &UsageHandler{
+		usageStore: usageStore,
+		quota:      quota,
+		logger:     logger,
+	}
+}
+
+// writeQuotaExceeded answers a request refused because the user has used up
+// a token quota, saying which one and when it resets. Anything already in
+// envelope is sent along with it.
+func writeQuotaExceeded(w http.ResponseWriter, envelope utils.Envelope, summary *store.UsageSummary, period *store.UsagePeriod) {
+	retryAfter := math.Ceil(time.Until(period.ResetsAt).Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(retryAfter), 1)))
+
+	envelope["error"] = quotaExceeded(period)
+	envelope["usage"] = summary
+	utils.WriteJSON(w, http.StatusTooManyRequests, envelope)
+}
+
+// HandleGetUsage reports the user's token usage in the current day and month
+// against their quota, and a per-day history over the last days days
+// (default 30).
+func (uh *UsageHandler) HandleGetUsage(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	days := defaultUsageDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "days must be a positive number"})
+			return
+		}
+		days = min(parsed, maxUsageDays)
+	}
+
+	summary, err := uh.usageStore.GetUsageSummary(currentUser, uh.quota)
+	if err != nil {
+		uh.logger.Printf("ERROR: getUsageSummary: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get usage"})
+		return
+	}
+
+	daily, err := uh.usageStore.GetDailyUsage(currentUser, days)
+	if err != nil {
+		uh.logger.Printf("ERROR: getDailyUsage: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get usage"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"usage": summary, "daily": daily})
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/store"
+	"github.com/jackwillis517/Scribo/internal/utils"
+)
+
+func TestWriteQuotaExceeded(t *testing.T) {
+	limit := 100
+	for _, tc := range []struct {
+		period string
+		error  string
+	}{
+		{"day", "daily token quota exceeded"},
+		{"month", "monthly token quota exceeded"},
+	} {
+		t.Run(tc.period, func(t *testing.T) {
+			period := &store.UsagePeriod{Period: tc.period, Used: limit, Limit: &limit, ResetsAt: time.Now().Add(time.Hour)}
+			w := httptest.NewRecorder()
+			writeQuotaExceeded(w, utils.Envelope{}, &store.UsageSummary{}, period)
+
+			if w.Code != http.StatusTooManyRequests {
+				t.Errorf("status is %d, want %d", w.Code, http.StatusTooManyRequests)
+			}
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != tc.error {
+				t.Errorf("error is %q, want %q", body.Error, tc.error)
+			}
+		})
+	}
+}
@@ -4,183 +4,150 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strings"
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackwillis517/Scribo/internal/identity"
 	"github.com/jackwillis517/Scribo/internal/middleware"
 	"github.com/jackwillis517/Scribo/internal/store"
 	"github.com/jackwillis517/Scribo/internal/utils"
 )
 
 type UserHandler struct {
-	userStore store.UserStore
-	logger    *log.Logger
+	userStore       store.UserStore
+	sessionStore    store.SessionStore
+	providers       map[string]identity.Provider
+	defaultProvider string
+	logger          *log.Logger
 }
 
-func NewUserHandler(userStore store.UserStore, logger *log.Logger) *UserHandler {
+// NewUserHandler logs users in through the given identity providers. Login
+// requests that do not name a provider use defaultProvider.
+func NewUserHandler(userStore store.UserStore, sessionStore store.SessionStore, providers []identity.Provider, defaultProvider string, logger *log.Logger) *UserHandler {
+	byName := make(map[string]identity.Provider, len(providers))
+	for _, provider := range providers {
+		byName[provider.Name()] = provider
+	}
 	return &UserHandler{
-		userStore: userStore,
-		logger:    logger,
+		userStore:       userStore,
+		sessionStore:    sessionStore,
+		providers:       byName,
+		defaultProvider: defaultProvider,
+		logger:          logger,
 	}
 }
 
-func generateJWT(userID string) (string, error) {
+func generateJWT(session *store.Session) (string, error) {
 	jwtSecret := os.Getenv("JWT_SECRET")
 	jwtSecretBytes := []byte(jwtSecret)
 	claims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 72).Unix(),
+		"user_id":    session.UserID,
+		"session_id": session.ID,
+		"exp":        session.ExpiresAt.Unix(),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(jwtSecretBytes)
 }
 
-type GoogleTokenResponse struct {
-	IdToken      string `json:"id_token"`
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token,omitempty"`
-	ExpiresIn    int    `json:"expires_in,omitempty"`
-	TokenType    string `json:"token_type,omitempty"`
-}
-
-// ExchangeCodeAndGetUser exchanges the auth code for an ID token and returns a parsed user.
-func ExchangeCodeAndGetUser(authCode string) (*store.User, error) {
-	clientID := os.Getenv("GOOGLE_OAUTH_CLIENT_ID")
-	clientSecret := os.Getenv("GOOGLE_OAUTH_CLIENT_SECRET")
-	redirectURI := os.Getenv("GOOGLE_OAUTH_REDIRECT_URL")
-
-	data := url.Values{}
-	data.Set("code", authCode)
-	data.Set("client_id", clientID)
-	data.Set("client_secret", clientSecret)
-	data.Set("redirect_uri", redirectURI)
-	data.Set("grant_type", "authorization_code")
-
-	resp, err := http.Post(
-		"https://oauth2.googleapis.com/token",
-		"application/x-www-form-urlencoded",
-		strings.NewReader(data.Encode()),
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// HandleGetLoginProviders lists the identity providers users can log in
+// with, so the client knows which login options to offer.
+func (u *UserHandler) HandleGetLoginProviders(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(u.providers))
+	for name := range u.providers {
+		names = append(names, name)
 	}
+	slices.Sort(names)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"providers": names, "default": u.defaultProvider})
+}
 
-	var tokenResp GoogleTokenResponse
-	if err := json.Unmarshal(body, &tokenResp); err != nil {
-		return nil, err
-	}
-	if tokenResp.IdToken == "" {
-		return nil, errors.New("no id_token in response")
+// HandleUserLogin logs in with one of the configured identity providers and
+// starts a session. OAuth providers take the authorization code, which the
+// client has always sent as id_token.
+func (u *UserHandler) HandleUserLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Provider string `json:"provider"`
+		Code     string `json:"code"`
+		IDToken  string `json:"id_token"`
+		Username string `json:"username"`
 	}
+	json.NewDecoder(r.Body).Decode(&req)
 
-	token, _, err := new(jwt.Parser).ParseUnverified(tokenResp.IdToken, jwt.MapClaims{})
-	if err != nil {
-		return nil, err
+	providerName := req.Provider
+	if providerName == "" {
+		providerName = u.defaultProvider
 	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
+	provider, ok := u.providers[providerName]
 	if !ok {
-		return nil, errors.New("invalid claims type")
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown login provider"})
+		return
 	}
 
-	user := &store.User{
-		GoogleID: getStringClaim(claims, "sub"),
-		Email:    getStringClaim(claims, "email"),
-		Name:     getStringClaim(claims, "name"),
-		Picture:  getStringClaim(claims, "picture"),
+	code := req.Code
+	if code == "" {
+		code = req.IDToken
 	}
-
-	return user, nil
-}
-
-func getStringClaim(claims jwt.MapClaims, key string) string {
-	if val, ok := claims[key]; ok {
-		if s, ok := val.(string); ok {
-			return s
+	login, err := provider.Authenticate(r.Context(), identity.Credentials{Code: code, Username: req.Username})
+	if err != nil {
+		u.logger.Printf("ERROR: authenticate %s: %v", providerName, err)
+		if errors.Is(err, identity.ErrInvalidCredentials) {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid login credentials"})
+			return
 		}
+		utils.WriteJSON(w, http.StatusBadGateway, utils.Envelope{"error": "login provider unavailable"})
+		return
 	}
-	return ""
-}
-
-func (u *UserHandler) HandleUserLogin(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		IDToken string `json:"id_token"`
-	}
-	json.NewDecoder(r.Body).Decode(&req)
 
-	user, err := ExchangeCodeAndGetUser(req.IDToken)
+	user, err := u.userStore.LoginUser(login)
 	if err != nil {
-		fmt.Printf("ERROR: ExchangeCodeAndGetUser: %v\n", err)
-		http.Error(w, "Invalid id_token", http.StatusUnauthorized)
+		u.logger.Printf("ERROR: loginUser: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to log in"})
+		return
 	}
 
-	// Query database for existing user
-	foundUser, err := u.userStore.FindUserByGoogleID(user)
-	if err != nil && err != sql.ErrNoRows {
-		u.logger.Printf("ERROR: FindUserByGoogleID: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "bad user data"})
+	if !u.startSession(w, r, user) {
 		return
 	}
 
-	// If user not found
-	if err == sql.ErrNoRows {
-		newUser, err := u.userStore.CreateUser(user)
-		if err != nil {
-			u.logger.Printf("ERROR: CreateUser: %v", err)
-			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "bad user data"})
-			return
-		}
-		// Return jwt token using new user id
-		tokenString, err := generateJWT(newUser.ID)
-		if err != nil {
-			u.logger.Printf("ERROR: generateJWT: %v", err)
-			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create JWT token"})
-			return
-		}
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{
+		"google_id": user.GoogleID,
+		"email":     user.Email,
+		"name":      user.Name,
+		"picture":   user.Picture,
+	})
+}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "auth_token",
-			Value:    tokenString,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   false,
-			SameSite: http.SameSiteLaxMode,
-			Expires:  time.Now().Add(72 * time.Hour),
-			MaxAge:   259200,
-			Domain:   "localhost",
-		})
-
-		utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{
-			"google_id": user.GoogleID,
-			"email":     user.Email,
-			"name":      user.Name,
-			"picture":   user.Picture,
-		})
-		return
+// startSession records a new login session for the user and sets the auth
+// cookie carrying it, or writes an error and returns false.
+func (u *UserHandler) startSession(w http.ResponseWriter, r *http.Request, user *store.User) bool {
+	ipAddress, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ipAddress = r.RemoteAddr
+	}
+
+	session, err := u.sessionStore.CreateSession(&store.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IPAddress: ipAddress,
+	})
+	if err != nil {
+		u.logger.Printf("ERROR: createSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create session"})
+		return false
 	}
 
-	// If user found
-	tokenString, err := generateJWT(foundUser.ID)
+	// Return jwt token carrying the new session
+	tokenString, err := generateJWT(session)
 	if err != nil {
 		u.logger.Printf("ERROR: generateJWT: %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create JWT token"})
-		return
+		return false
 	}
 
-	// fmt.Printf("%v", tokenString)
-
 	http.SetCookie(w, &http.Cookie{
 		Name:     "auth_token",
 		Value:    tokenString,
@@ -188,16 +155,24 @@ func (u *UserHandler) HandleUserLogin(w http.ResponseWriter, r *http.Request) {
 		HttpOnly: true,
 		Secure:   false,
 		SameSite: http.SameSiteLaxMode,
-		Expires:  time.Now().Add(72 * time.Hour),
-		MaxAge:   259200,
+		Expires:  session.ExpiresAt,
+		MaxAge:   int(time.Until(session.ExpiresAt).Seconds()),
 		Domain:   "localhost",
 	})
+	return true
+}
 
-	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{
-		"google_id": user.GoogleID,
-		"email":     user.Email,
-		"name":      user.Name,
-		"picture":   user.Picture,
+// clearAuthCookie tells the browser to drop the auth cookie.
+func clearAuthCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth_token",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+		Domain:   "localhost",
 	})
 }
 
@@ -211,16 +186,107 @@ func (u *UserHandler) HandleGetUser(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// HandleInvalidateUser logs out: it revokes the session the auth cookie
+// carries, so the token stops working even if it was copied, and clears the
+// cookie.
 func (u *UserHandler) HandleInvalidateUser(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "auth_token",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   false,
-		SameSite: http.SameSiteLaxMode,
-		Expires:  time.Now().Add(72 * time.Hour),
-		MaxAge:   259200,
-		Domain:   "localhost",
-	})
+	if cookie, err := r.Cookie("auth_token"); err == nil {
+		userID, sessionID, err := middleware.ParseAuthToken(cookie.Value)
+		if err == nil {
+			err = u.sessionStore.RevokeSession(&store.User{ID: userID}, sessionID)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				u.logger.Printf("ERROR: revokeSession: %v", err)
+				utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to revoke session"})
+				return
+			}
+		}
+	}
+
+	clearAuthCookie(w)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"result": "logged out"})
+}
+
+// HandleGetSessions lists the user's active sessions, marking the one this
+// request was made with.
+func (u *UserHandler) HandleGetSessions(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	sessions, err := u.sessionStore.GetSessions(currentUser)
+	if err != nil {
+		u.logger.Printf("ERROR: getSessions: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get sessions"})
+		return
+	}
+
+	if current := middleware.GetSession(r); current != nil {
+		for _, session := range sessions {
+			session.Current = session.ID == current.ID
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"sessions": sessions})
+}
+
+func (u *UserHandler) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := utils.ReadStringParam(r)
+	if err != nil {
+		u.logger.Printf("ERROR: readStringParam: %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "internal request error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	err = u.sessionStore.RevokeSession(currentUser, sessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "session not found"})
+			return
+		}
+		u.logger.Printf("ERROR: revokeSession: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to revoke session"})
+		return
+	}
+
+	if current := middleware.GetSession(r); current != nil && current.ID == sessionID {
+		clearAuthCookie(w)
+	}
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"result": "session revoked"})
+}
+
+// HandleRevokeAllSessions signs the user out everywhere, or everywhere else
+// with ?keep_current=true.
+func (u *UserHandler) HandleRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		return
+	}
+
+	keep := ""
+	current := middleware.GetSession(r)
+	keepCurrent := r.URL.Query().Get("keep_current") == "true"
+	if keepCurrent && current != nil {
+		keep = current.ID
+	}
+
+	revoked, err := u.sessionStore.RevokeAllSessions(currentUser, keep)
+	if err != nil {
+		u.logger.Printf("ERROR: revokeAllSessions: %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to revoke sessions"})
+		return
+	}
+
+	if keep == "" {
+		clearAuthCookie(w)
+	}
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"revoked": revoked})
 }
@@ -6,22 +6,43 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/jackwillis517/Scribo/internal/agent"
 	"github.com/jackwillis517/Scribo/internal/api"
+	"github.com/jackwillis517/Scribo/internal/collab"
+	"github.com/jackwillis517/Scribo/internal/identity"
+	"github.com/jackwillis517/Scribo/internal/jobs"
 	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/oidc"
+	"github.com/jackwillis517/Scribo/internal/presence"
 	"github.com/jackwillis517/Scribo/internal/store"
 	"github.com/joho/godotenv"
 )
 
 type Application struct {
-	Logger          *log.Logger
-	DB              *sql.DB
-	UserHandler     *api.UserHandler
-	DocumentHandler *api.DocumentHandler
-	SectionHandler  *api.SectionHandler
-	NoteHandler     *api.NoteHandler
-	AgentHandler    *api.AgentHandler
-	Middleware      middleware.UserMiddleware
+	Logger             *log.Logger
+	DB                 *sql.DB
+	UserHandler        *api.UserHandler
+	DocumentHandler    *api.DocumentHandler
+	SectionHandler     *api.SectionHandler
+	NoteHandler        *api.NoteHandler
+	AgentHandler       *api.AgentHandler
+	DiffHandler        *api.DiffHandler
+	ExportHandler      *api.ExportHandler
+	ImportHandler      *api.ImportHandler
+	SearchHandler      *api.SearchHandler
+	ProposalHandler    *api.ProposalHandler
+	UsageHandler       *api.UsageHandler
+	AccessTokenHandler *api.AccessTokenHandler
+	MemberHandler      *api.MemberHandler
+	CollabHandler      *api.CollabHandler
+	PresenceHandler    *api.PresenceHandler
+	Middleware         middleware.UserMiddleware
+	JobWorker          *jobs.Worker
+	CollabHub          *collab.Hub
+	PresenceHub        *presence.Hub
 }
 
 func NewApplication() (*Application, error) {
@@ -40,33 +61,170 @@ func NewApplication() (*Application, error) {
 		panic(err)
 	}
 
+	revisionRetention := store.RevisionRetention{
+		MinKeep: envInt("SECTION_REVISIONS_MIN_KEEP", store.DefaultRevisionRetention.MinKeep),
+		MaxKeep: envInt("SECTION_REVISIONS_MAX_KEEP", store.DefaultRevisionRetention.MaxKeep),
+		MaxAge:  time.Duration(envInt("SECTION_REVISIONS_MAX_AGE_DAYS", int(store.DefaultRevisionRetention.MaxAge/(24*time.Hour)))) * 24 * time.Hour,
+	}
+
+	// AGENT_BACKEND=fake answers agent calls in-process, for running the API
+	// without the Python service
+	var agentClient agent.AgentClient
+	if os.Getenv("AGENT_BACKEND") == "fake" {
+		agentClient = agent.NewFakeClient()
+	} else {
+		agentClient = agent.NewHTTPClient(agent.Config{
+			BaseURL:          envString("AGENT_URL", agent.DefaultConfig.BaseURL),
+			MessageTimeout:   time.Duration(envInt("AGENT_MESSAGE_TIMEOUT_SECONDS", int(agent.DefaultConfig.MessageTimeout/time.Second))) * time.Second,
+			SaveTimeout:      time.Duration(envInt("AGENT_SAVE_TIMEOUT_SECONDS", int(agent.DefaultConfig.SaveTimeout/time.Second))) * time.Second,
+			MaxRetries:       envInt("AGENT_MAX_RETRIES", agent.DefaultConfig.MaxRetries),
+			RetryBackoff:     agent.DefaultConfig.RetryBackoff,
+			MaxRetryBackoff:  agent.DefaultConfig.MaxRetryBackoff,
+			BreakerThreshold: envInt("AGENT_BREAKER_THRESHOLD", agent.DefaultConfig.BreakerThreshold),
+			BreakerCooldown:  time.Duration(envInt("AGENT_BREAKER_COOLDOWN_SECONDS", int(agent.DefaultConfig.BreakerCooldown/time.Second))) * time.Second,
+		})
+	}
+
+	quota := store.Quota{
+		DailyTokens:   envInt("USAGE_DAILY_TOKEN_QUOTA", 0),
+		MonthlyTokens: envInt("USAGE_MONTHLY_TOKEN_QUOTA", 0),
+	}
+
 	userStore := store.NewPostgresUserStore(db)
+	sessionStore := store.NewPostgresSessionStore(db)
+	accessTokenStore := store.NewPostgresAccessTokenStore(db)
 	documentStore := store.NewPostgresDocumentStore(db)
-	sectionStore := store.NewPostgresSectionStore(db)
+	memberStore := store.NewPostgresMemberStore(db)
+	sectionStore := store.NewPostgresSectionStore(db, revisionRetention)
 	noteStore := store.NewPostgresNoteStore(db)
 	agentStore := store.NewPostgresAgentStore(db)
+	searchStore := store.NewPostgresSearchStore(db)
+	jobStore := store.NewPostgresJobStore(db)
+	proposalStore := store.NewPostgresProposalStore(db, sectionStore)
+	usageStore := store.NewPostgresUsageStore(db)
+
+	// Login providers: Google when it has credentials, any OpenID Connect
+	// issuer set by OIDC_ISSUER, and DEV_LOGIN=true for a passwordless login
+	// as any named local user. GOOGLE_JWKS_URL can point at a local key set
+	// for development.
+	var providers []identity.Provider
+	if clientID := os.Getenv("GOOGLE_OAUTH_CLIENT_ID"); clientID != "" {
+		providers = append(providers, identity.NewGoogleProvider(
+			clientID,
+			os.Getenv("GOOGLE_OAUTH_CLIENT_SECRET"),
+			os.Getenv("GOOGLE_OAUTH_REDIRECT_URL"),
+			envString("GOOGLE_JWKS_URL", oidc.GoogleJWKSURL),
+		))
+	}
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		providers = append(providers, identity.NewOIDCProvider(identity.OIDCConfig{
+			Name:         envString("OIDC_PROVIDER_NAME", "oidc"),
+			Issuer:       issuer,
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			TokenURL:     os.Getenv("OIDC_TOKEN_URL"),
+			JWKSURL:      os.Getenv("OIDC_JWKS_URL"),
+		}))
+	}
+	if os.Getenv("DEV_LOGIN") == "true" {
+		logger.Println("WARNING: DEV_LOGIN is enabled, anyone can log in as any local user")
+		providers = append(providers, identity.DevProvider{})
+	}
+	defaultProvider := identity.GoogleProviderName
+	if len(providers) > 0 {
+		defaultProvider = providers[0].Name()
+	}
+	defaultProvider = envString("LOGIN_DEFAULT_PROVIDER", defaultProvider)
 
-	userHandler := api.NewUserHandler(userStore, logger)
+	userHandler := api.NewUserHandler(userStore, sessionStore, providers, defaultProvider, logger)
 	documentHandler := api.NewDocumentHandler(documentStore, logger)
 	sectionHandler := api.NewSectionHandler(sectionStore, logger)
 	noteHandler := api.NewNoteHandler(noteStore, logger)
-	agentHandler := api.NewAgentHandler(agentStore, logger)
-	middlewareHandler := middleware.UserMiddleware{UserStore: userStore}
+	agentHandler := api.NewAgentHandler(agentClient, agentStore, documentStore, sectionStore, jobStore, usageStore, quota, logger)
+	diffHandler := api.NewDiffHandler(sectionStore, logger)
+	exportHandler := api.NewExportHandler(documentStore, sectionStore, noteStore, logger)
+	importHandler := api.NewImportHandler(sectionStore, logger)
+	searchHandler := api.NewSearchHandler(searchStore, logger)
+	proposalHandler := api.NewProposalHandler(proposalStore, logger)
+	usageHandler := api.NewUsageHandler(usageStore, quota, logger)
+	accessTokenHandler := api.NewAccessTokenHandler(accessTokenStore, logger)
+	memberHandler := api.NewMemberHandler(memberStore, logger)
+
+	collabHub := collab.NewHub(sectionStore, collab.Config{
+		SaveInterval:     time.Duration(envInt("COLLAB_SAVE_INTERVAL_SECONDS", int(collab.DefaultConfig.SaveInterval/time.Second))) * time.Second,
+		RevisionInterval: time.Duration(envInt("COLLAB_REVISION_INTERVAL_SECONDS", int(collab.DefaultConfig.RevisionInterval/time.Second))) * time.Second,
+		AccessInterval:   collab.DefaultConfig.AccessInterval,
+		MaxHistory:       collab.DefaultConfig.MaxHistory,
+		Outbox:           collab.DefaultConfig.Outbox,
+	}, logger)
+	collabHandler := api.NewCollabHandler(collabHub, sectionStore, documentStore, logger)
+
+	// Presence is shared between API instances over LISTEN/NOTIFY on the
+	// same database
+	presenceHub := presence.NewHub(presence.NewPostgresBroker(db, databaseUrl, logger), presence.Config{
+		HeartbeatInterval: time.Duration(envInt("PRESENCE_HEARTBEAT_SECONDS", int(presence.DefaultConfig.HeartbeatInterval/time.Second))) * time.Second,
+		Expiry:            time.Duration(envInt("PRESENCE_EXPIRY_SECONDS", int(presence.DefaultConfig.Expiry/time.Second))) * time.Second,
+		AccessInterval:    presence.DefaultConfig.AccessInterval,
+		Outbox:            presence.DefaultConfig.Outbox,
+	}, logger)
+	presenceHandler := api.NewPresenceHandler(presenceHub, documentStore, sectionStore, logger)
+	middlewareHandler := middleware.UserMiddleware{UserStore: userStore, SessionStore: sessionStore, AccessTokenStore: accessTokenStore}
+
+	jobWorker := jobs.NewWorker(jobStore, usageStore, agentClient, jobs.Config{
+		Workers:         envInt("JOB_WORKERS", jobs.DefaultConfig.Workers),
+		PollInterval:    jobs.DefaultConfig.PollInterval,
+		Lease:           jobs.DefaultConfig.Lease,
+		RetryBackoff:    jobs.DefaultConfig.RetryBackoff,
+		MaxRetryBackoff: jobs.DefaultConfig.MaxRetryBackoff,
+	}, logger)
 
 	app := &Application{
-		Logger:          logger,
-		DB:              db,
-		UserHandler:     userHandler,
-		DocumentHandler: documentHandler,
-		SectionHandler:  sectionHandler,
-		NoteHandler:     noteHandler,
-		AgentHandler:    agentHandler,
-		Middleware:      middlewareHandler,
+		Logger:             logger,
+		DB:                 db,
+		UserHandler:        userHandler,
+		DocumentHandler:    documentHandler,
+		SectionHandler:     sectionHandler,
+		NoteHandler:        noteHandler,
+		AgentHandler:       agentHandler,
+		DiffHandler:        diffHandler,
+		ExportHandler:      exportHandler,
+		ImportHandler:      importHandler,
+		SearchHandler:      searchHandler,
+		ProposalHandler:    proposalHandler,
+		UsageHandler:       usageHandler,
+		AccessTokenHandler: accessTokenHandler,
+		MemberHandler:      memberHandler,
+		CollabHandler:      collabHandler,
+		PresenceHandler:    presenceHandler,
+		Middleware:         middlewareHandler,
+		JobWorker:          jobWorker,
+		CollabHub:          collabHub,
+		PresenceHub:        presenceHub,
 	}
 
 	return app, nil
 }
 
+// envInt reads an integer setting from the environment, falling back to the
+// default when it is unset or malformed.
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// envString reads a setting from the environment, falling back to the default
+// when it is unset.
+func envString(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
 func (a *Application) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Status is available\n")
 }
@@ -0,0 +1,362 @@
+package collab_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackwillis517/Scribo/internal/api"
+	"github.com/jackwillis517/Scribo/internal/collab"
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+const sectionID = "section"
+
+// memorySections is a section store holding one section. Only the methods
+// the collaboration endpoint uses are implemented.
+type memorySections struct {
+	store.SectionStore
+
+	mu      sync.Mutex
+	section store.Section
+	saves   int
+}
+
+func (m *memorySections) ReadSection(user *store.User, id string) (*store.Section, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	section := m.section
+	return &section, nil
+}
+
+func (m *memorySections) UpdateSection(user *store.User, section *store.Section) (*store.Section, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.section.Content = section.Content
+	m.saves++
+	return section, nil
+}
+
+func (m *memorySections) AutosaveSection(user *store.User, section *store.Section) (*store.Section, error) {
+	return m.UpdateSection(user, section)
+}
+
+// edit changes the stored content as a save from outside the session would.
+func (m *memorySections) edit(change func(string) string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.section.Content = change(m.section.Content)
+}
+
+func (m *memorySections) content() (string, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.section.Content, m.saves
+}
+
+type memoryDocuments struct {
+	store.DocumentStore
+}
+
+func (memoryDocuments) ReadDocument(user *store.User, id string) (*store.Document, error) {
+	return &store.Document{ID: id, Role: store.RoleEditor}, nil
+}
+
+type options struct {
+	clients int
+	edits   int
+	latency time.Duration
+	pause   time.Duration
+}
+
+// client is one simulated writer. Its editor is only touched by its own
+// goroutine; state reports it to the coordinator.
+type client struct {
+	id     int
+	conn   *websocket.Conn
+	editor *collab.Editor
+	rng    *rand.Rand
+	outbox chan collab.Message
+	state  chan chan clientState
+	// external counts operations saved outside the session
+	external int
+}
+
+type clientState struct {
+	text     string
+	revision int
+	pending  bool
+	editing  bool
+}
+
+// TestConvergence checks that collaborative editing converges. It serves
+// the collaboration endpoint over an in-memory section store, connects
+// several WebSocket clients that make random edits at once with random
+// network delays, saves a change to the section behind the session's back
+// part way through, and then checks that every client, and the saved
+// section, ended up with the same text. The edits are random but seeded;
+// the order they reach the server in depends on scheduling.
+func TestConvergence(t *testing.T) {
+	opts := options{clients: 5, edits: 200, latency: 5 * time.Millisecond, pause: 2 * time.Millisecond}
+	if testing.Short() {
+		opts.edits = 50
+	}
+	for _, seed := range []int64{1, 2, 3} {
+		t.Run(fmt.Sprint("seed ", seed), func(t *testing.T) {
+			if err := simulate(t, opts, seed); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func simulate(t *testing.T, opts options, seed int64) error {
+	logger := log.New(io.Discard, "", 0)
+	sections := &memorySections{section: store.Section{ID: sectionID, Content: "The quick brown fox jumps over the lazy dog."}}
+	hub := collab.NewHub(sections, collab.Config{
+		SaveInterval: 20 * time.Millisecond,
+		MaxHistory:   collab.DefaultConfig.MaxHistory,
+		Outbox:       collab.DefaultConfig.Outbox,
+	}, logger)
+	handler := api.NewCollabHandler(hub, sections, memoryDocuments{}, logger)
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := &store.User{ID: r.URL.Query().Get("user")}
+			next.ServeHTTP(w, middleware.SetUser(r, user))
+		})
+	})
+	r.Get("/sections/collaborate/{id}", handler.HandleCollaborate)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var clients []*client
+	for i := 0; i < opts.clients; i++ {
+		url := fmt.Sprintf("ws%s/sections/collaborate/%s?user=user-%d", strings.TrimPrefix(server.URL, "http"), sectionID, i)
+		conn, _, err := websocket.Dial(ctx, url, nil)
+		if err != nil {
+			return fmt.Errorf("client %d connecting: %w", i, err)
+		}
+		defer conn.CloseNow()
+
+		var snapshot collab.Message
+		if err := wsjson.Read(ctx, conn, &snapshot); err != nil {
+			return fmt.Errorf("client %d reading the snapshot: %w", i, err)
+		}
+		editor, err := collab.NewEditor(snapshot)
+		if err != nil {
+			return fmt.Errorf("client %d: %w", i, err)
+		}
+		clients = append(clients, &client{
+			id:     i,
+			conn:   conn,
+			editor: editor,
+			rng:    rand.New(rand.NewSource(seed + int64(i))),
+			outbox: make(chan collab.Message, opts.edits+1),
+			state:  make(chan chan clientState),
+		})
+	}
+
+	errs := make(chan error, len(clients))
+	for _, c := range clients {
+		go func(c *client) {
+			errs <- c.run(ctx, opts)
+		}(c)
+	}
+
+	// Save a change behind the session's back while the clients are busy
+	time.AfterFunc(time.Duration(opts.edits)*opts.pause/4, func() {
+		sections.edit(func(content string) string { return "[saved elsewhere] " + content })
+	})
+
+	states, err := waitForConvergence(ctx, clients, errs)
+	if err != nil {
+		return err
+	}
+	external := 0
+	for _, c := range clients {
+		c.conn.Close(websocket.StatusNormalClosure, "")
+		external += c.external
+	}
+	if err := hub.Close(ctx); err != nil {
+		return err
+	}
+
+	text := states[0].text
+	saved, saves := sections.content()
+	t.Logf("revision %d, %d characters, %d saves, %d changes from outside the session seen by clients",
+		states[0].revision, utf8.RuneCountInString(text), saves, external)
+	if saved != text {
+		return fmt.Errorf("the saved section differs from what the clients have:\nsaved:   %q\nclients: %q", saved, text)
+	}
+	return nil
+}
+
+// waitForConvergence waits until every client has finished editing, has no
+// unacknowledged edits and has been at the same revision as the others for
+// a while, then checks their texts are the same.
+func waitForConvergence(ctx context.Context, clients []*client, errs chan error) ([]clientState, error) {
+	const quiet = 200 * time.Millisecond
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	settledRevision, settledAt := -1, time.Time{}
+	for {
+		select {
+		case err := <-errs:
+			return nil, err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		states := make([]clientState, len(clients))
+		settled := true
+		for i, c := range clients {
+			reply := make(chan clientState)
+			select {
+			case c.state <- reply:
+			case err := <-errs:
+				return nil, err
+			}
+			states[i] = <-reply
+			if states[i].editing || states[i].pending || states[i].revision != states[0].revision {
+				settled = false
+			}
+		}
+		if !settled {
+			settledRevision = -1
+			continue
+		}
+		if states[0].revision != settledRevision {
+			settledRevision, settledAt = states[0].revision, time.Now()
+		}
+		if time.Since(settledAt) < quiet {
+			continue
+		}
+
+		for i, state := range states {
+			if state.text != states[0].text {
+				return nil, fmt.Errorf("clients diverged at revision %d:\nclient 0: %q\nclient %d: %q", state.revision, states[0].text, i, state.text)
+			}
+		}
+		return states, nil
+	}
+}
+
+// run makes the client's edits and applies what the server sends until ctx
+// is done or the connection closes.
+func (c *client) run(ctx context.Context, opts options) error {
+	incoming := make(chan collab.Message)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			var message collab.Message
+			if err := wsjson.Read(ctx, c.conn, &message); err != nil {
+				readErr <- err
+				return
+			}
+			incoming <- message
+		}
+	}()
+
+	// Messages go out in order, each after a random delay
+	delays := rand.New(rand.NewSource(c.rng.Int63()))
+	go func() {
+		for message := range c.outbox {
+			time.Sleep(time.Duration(delays.Int63n(int64(opts.latency) + 1)))
+			if err := wsjson.Write(ctx, c.conn, message); err != nil {
+				return
+			}
+		}
+	}()
+	defer close(c.outbox)
+
+	edits := opts.edits
+	editTimer := time.NewTimer(0)
+	defer editTimer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err := <-readErr:
+			if edits > 0 || c.editor.Pending() {
+				return fmt.Errorf("client %d: connection lost: %w", c.id, err)
+			}
+			return nil
+
+		case message := <-incoming:
+			if message.Type == collab.MessageOperation && message.UserID == "" {
+				c.external++
+			}
+			reply, err := c.editor.Receive(message)
+			if err != nil {
+				return fmt.Errorf("client %d: %w", c.id, err)
+			}
+			if reply != nil {
+				c.outbox <- *reply
+			}
+
+		case <-editTimer.C:
+			if edits == 0 {
+				continue
+			}
+			edits--
+			message, err := c.editor.Edit(c.randomEdit())
+			if err != nil {
+				return fmt.Errorf("client %d: %w", c.id, err)
+			}
+			if message != nil {
+				c.outbox <- *message
+			}
+			if edits > 0 {
+				editTimer.Reset(time.Duration(c.rng.Int63n(int64(opts.pause) + 1)))
+			}
+
+		case reply := <-c.state:
+			reply <- clientState{
+				text:     c.editor.Text,
+				revision: c.editor.Revision,
+				pending:  c.editor.Pending(),
+				editing:  edits > 0,
+			}
+		}
+	}
+}
+
+var words = []string{"a", "ink", "quill", "é", "page", "draft", "—", "ß", " ", "\n"}
+
+// randomEdit deletes up to four characters somewhere in the text and inserts
+// a word or two in their place.
+func (c *client) randomEdit() collab.Operation {
+	length := utf8.RuneCountInString(c.editor.Text)
+	start := c.rng.Intn(length + 1)
+	deleteCount := c.rng.Intn(min(4, length-start) + 1)
+
+	var insert strings.Builder
+	for n := c.rng.Intn(3); n > 0; n-- {
+		insert.WriteString(words[c.rng.Intn(len(words))])
+	}
+	if deleteCount == 0 && insert.Len() == 0 {
+		insert.WriteString(words[c.rng.Intn(len(words))])
+	}
+	return collab.Splice(length, start, deleteCount, insert.String())
+}
@@ -0,0 +1,105 @@
+package collab
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Editor is the client side of a session: the text as one client sees it,
+// and its edits the server has not acknowledged yet. At most one operation
+// is in flight; edits made while it is are composed into a buffer that is
+// sent once it is acknowledged. Operations from other clients are
+// transformed against both before being applied, which is what keeps every
+// client converging on the server's text.
+type Editor struct {
+	Text     string
+	Revision int
+
+	sent     Operation
+	awaiting bool
+	buffer   Operation
+	buffered bool
+}
+
+// NewEditor starts an editor from the snapshot a session sends first.
+func NewEditor(snapshot Message) (*Editor, error) {
+	if snapshot.Type != MessageSnapshot || snapshot.Content == nil {
+		return nil, fmt.Errorf("expected a snapshot, got %q", snapshot.Type)
+	}
+	return &Editor{Text: *snapshot.Content, Revision: snapshot.Revision}, nil
+}
+
+// Pending reports whether some of the client's edits have not been
+// acknowledged.
+func (e *Editor) Pending() bool {
+	return e.awaiting
+}
+
+// Edit applies a local edit and returns the message to send for it, or nil
+// when it has to wait for an earlier edit to be acknowledged.
+func (e *Editor) Edit(op Operation) (*Message, error) {
+	text, err := op.Apply(e.Text)
+	if err != nil {
+		return nil, err
+	}
+	e.Text = text
+
+	switch {
+	case !e.awaiting:
+		e.sent, e.awaiting = op, true
+		return &Message{Type: MessageOperation, Revision: e.Revision, Operation: op}, nil
+	case !e.buffered:
+		e.buffer, e.buffered = op, true
+	default:
+		e.buffer, err = Compose(e.buffer, op)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// Receive handles a message from the server and returns the message to send
+// next, if any.
+func (e *Editor) Receive(message Message) (*Message, error) {
+	switch message.Type {
+	case MessageAck:
+		if !e.awaiting {
+			return nil, errors.New("ack without an operation in flight")
+		}
+		e.Revision = message.Revision
+		e.sent, e.awaiting = nil, false
+		if !e.buffered {
+			return nil, nil
+		}
+		e.sent, e.awaiting = e.buffer, true
+		e.buffer, e.buffered = nil, false
+		return &Message{Type: MessageOperation, Revision: e.Revision, Operation: e.sent}, nil
+
+	case MessageOperation:
+		op := message.Operation
+		var err error
+		if e.awaiting {
+			e.sent, op, err = Transform(e.sent, op)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if e.buffered {
+			e.buffer, op, err = Transform(e.buffer, op)
+			if err != nil {
+				return nil, err
+			}
+		}
+		e.Text, err = op.Apply(e.Text)
+		if err != nil {
+			return nil, err
+		}
+		e.Revision = message.Revision
+		return nil, nil
+
+	case MessageError:
+		return nil, errors.New(message.Error)
+	}
+	return nil, fmt.Errorf("unexpected %q message", message.Type)
+}
@@ -0,0 +1,585 @@
+package collab
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+const (
+	MessageSnapshot  = "snapshot"
+	MessageOperation = "operation"
+	MessageAck       = "ack"
+	MessageError     = "error"
+)
+
+var (
+	ErrReadOnly = errors.New("your role on this document does not allow editing")
+	// ErrStaleRevision means an operation was made against a revision the
+	// session no longer remembers; the client has to reload.
+	ErrStaleRevision = errors.New("the operation is too far behind; reload the section")
+	ErrSessionEnded  = errors.New("the editing session has ended; reconnect to continue")
+	ErrAccessChanged = errors.New("your access to this document has changed; reconnect to continue")
+)
+
+// Message is what clients and the server send each other.
+type Message struct {
+	Type string `json:"type"`
+	// Revision is, from the server, the revision the section is at once the
+	// message is applied; from a client, the revision its operation was made
+	// against.
+	Revision  int       `json:"revision"`
+	Operation Operation `json:"operation,omitempty"`
+	// Content is the whole text, in snapshots.
+	Content *string `json:"content,omitempty"`
+	// CanEdit tells a client in its snapshot whether it may send operations.
+	CanEdit bool `json:"can_edit,omitempty"`
+	// UserID is who made an operation; empty when it was saved to the
+	// section from outside the session.
+	UserID string `json:"user_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Config struct {
+	// SaveInterval is how often a section being edited is written back to
+	// the store, when it has changed.
+	SaveInterval time.Duration
+	// RevisionInterval is the least time between the revisions recorded
+	// while a section is edited; saves in between record none. The last save
+	// of a session always records one. Zero records one with every save.
+	RevisionInterval time.Duration
+	// AccessInterval is how often every client's access is checked again, so
+	// that one whose role is lowered or removed is disconnected. Zero checks
+	// only when a save is refused.
+	AccessInterval time.Duration
+	// MaxHistory is how many past operations a session keeps to transform
+	// late operations against. Clients further behind must reload.
+	MaxHistory int
+	// Outbox is how many messages may wait for a slow client before it is
+	// disconnected.
+	Outbox int
+}
+
+var DefaultConfig = Config{
+	SaveInterval:     5 * time.Second,
+	RevisionInterval: 10 * time.Minute,
+	AccessInterval:   time.Minute,
+	MaxHistory:       1000,
+	Outbox:           256,
+}
+
+// Hub keeps a session for every section that someone is editing. A session
+// starts with the first client to join and ends, after a last save, when the
+// last one leaves.
+type Hub struct {
+	sectionStore store.SectionStore
+	config       Config
+	logger       *log.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func NewHub(sectionStore store.SectionStore, config Config, logger *log.Logger) *Hub {
+	return &Hub{
+		sectionStore: sectionStore,
+		config:       config,
+		logger:       logger,
+		sessions:     map[string]*session{},
+	}
+}
+
+type session struct {
+	hub       *Hub
+	sectionID string
+
+	load    sync.Once
+	loadErr error
+	quit    chan struct{}
+	stopped chan struct{}
+	// done is closed once the session has been saved and removed from the
+	// hub
+	done chan struct{}
+
+	// Guarded by hub.mu
+	refs    int
+	closing bool
+
+	mu          sync.Mutex
+	content     string
+	revision    int
+	history     []Operation
+	historyBase int
+	connections map[*Connection]struct{}
+	ended       bool
+	// failed stops saving once the section cannot be saved any more
+	failed bool
+	// saved is the content as last read from or written to the store, at
+	// savedRevision
+	saved         string
+	savedRevision int
+	// merged is text read from the store whose changes have been merged in
+	// but not yet saved over, so a save that is retried does not merge them
+	// twice
+	merged *string
+	// revisedAt is when a revision was last recorded, and unrevised whether
+	// content has been saved without one since
+	revisedAt time.Time
+	unrevised bool
+	// editor is who made the latest edit; saves are made with their access
+	editor *store.User
+}
+
+// Access reports whether a client may edit the section, or returns
+// sql.ErrNoRows or store.ErrForbidden once it may not even read it.
+type Access func() (canEdit bool, err error)
+
+// Connection is one client's place in a session.
+type Connection struct {
+	session  *session
+	user     *store.User
+	canEdit  bool
+	access   Access
+	messages chan Message
+
+	leave sync.Once
+}
+
+// Join adds the user to the session for a section, starting it from the
+// stored section if nobody has the section open. The caller must already
+// have checked that the user may read the section, and whether they may edit
+// it; access checks again later. The connection's first message is a
+// snapshot of the content.
+func (h *Hub) Join(user *store.User, sectionID string, canEdit bool, access Access) (*Connection, error) {
+	var s *session
+	for {
+		h.mu.Lock()
+		s = h.sessions[sectionID]
+		if s == nil {
+			s = &session{
+				hub:         h,
+				sectionID:   sectionID,
+				quit:        make(chan struct{}),
+				stopped:     make(chan struct{}),
+				done:        make(chan struct{}),
+				connections: map[*Connection]struct{}{},
+			}
+			h.sessions[sectionID] = s
+		}
+		if !s.closing {
+			s.refs++
+			h.mu.Unlock()
+			break
+		}
+		// Wait for the last save of a session that is ending, so the new one
+		// starts from what it saved
+		h.mu.Unlock()
+		<-s.done
+	}
+
+	s.load.Do(func() {
+		s.loadErr = s.start(user)
+	})
+	if s.loadErr != nil {
+		h.release(s)
+		return nil, s.loadErr
+	}
+
+	c := &Connection{
+		session:  s,
+		user:     user,
+		canEdit:  canEdit,
+		access:   access,
+		messages: make(chan Message, h.config.Outbox),
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		h.release(s)
+		return nil, ErrSessionEnded
+	}
+	content := s.content
+	c.messages <- Message{Type: MessageSnapshot, Revision: s.revision, Content: &content, CanEdit: canEdit}
+	s.connections[c] = struct{}{}
+	s.mu.Unlock()
+	return c, nil
+}
+
+// release drops a reference to the session, stopping it after the last.
+func (h *Hub) release(s *session) {
+	h.mu.Lock()
+	s.refs--
+	last := s.refs == 0
+	if last {
+		s.closing = true
+	}
+	h.mu.Unlock()
+	if !last {
+		return
+	}
+
+	s.stop()
+	h.mu.Lock()
+	delete(h.sessions, s.sectionID)
+	h.mu.Unlock()
+	close(s.done)
+}
+
+// Close ends every session, telling their clients to reconnect, and returns
+// once the sessions have been saved or ctx is done.
+func (h *Hub) Close(ctx context.Context) error {
+	h.mu.Lock()
+	sessions := make([]*session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range sessions {
+		s.end(ErrSessionEnded)
+	}
+	for _, s := range sessions {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *session) start(user *store.User) error {
+	section, err := s.hub.sectionStore.ReadSection(user, s.sectionID)
+	if err != nil {
+		return err
+	}
+	s.content = section.Content
+	s.saved = section.Content
+	s.revisedAt = time.Now()
+	s.editor = user
+
+	go s.saveLoop()
+	return nil
+}
+
+// stop ends the save loop, which saves once more on its way out.
+func (s *session) stop() {
+	if s.loadErr != nil {
+		return
+	}
+	close(s.quit)
+	<-s.stopped
+}
+
+// end disconnects every client with err and closes the session to new ones.
+func (s *session) end(err error) {
+	s.hub.mu.Lock()
+	s.closing = true
+	s.hub.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+	for c := range s.connections {
+		s.drop(c, err)
+	}
+}
+
+// drop tells a client why it is being disconnected, if it has room for the
+// message, and disconnects it. The session's lock must be held.
+func (s *session) drop(c *Connection, err error) {
+	select {
+	case c.messages <- Message{Type: MessageError, Revision: s.revision, Error: err.Error()}:
+	default:
+	}
+	s.disconnect(c)
+}
+
+// checkAccess asks each client's Access again and disconnects those that
+// have lost the access they joined with. A client whose access cannot be
+// checked for another reason is kept.
+func (s *session) checkAccess() {
+	s.mu.Lock()
+	connections := make([]*Connection, 0, len(s.connections))
+	for c := range s.connections {
+		connections = append(connections, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range connections {
+		canEdit, err := c.access()
+		if err != nil && !lostAccess(err) {
+			s.hub.logger.Printf("ERROR: collab: checking access to section %s: %v", s.sectionID, err)
+			continue
+		}
+		if err == nil && (canEdit || !c.canEdit) {
+			continue
+		}
+		s.mu.Lock()
+		if _, ok := s.connections[c]; ok {
+			s.drop(c, ErrAccessChanged)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// lostAccess reports whether err means a user may no longer read or write
+// the section.
+func lostAccess(err error) bool {
+	return errors.Is(err, sql.ErrNoRows) || errors.Is(err, store.ErrForbidden)
+}
+
+// disconnect removes a client, closing its messages. The session's lock must
+// be held.
+func (s *session) disconnect(c *Connection) {
+	if _, ok := s.connections[c]; !ok {
+		return
+	}
+	delete(s.connections, c)
+	close(c.messages)
+}
+
+// send queues a message for a client, disconnecting it instead if it has
+// fallen too far behind to take it. The session's lock must be held.
+func (s *session) send(c *Connection, message Message) {
+	select {
+	case c.messages <- message:
+	default:
+		s.hub.logger.Printf("ERROR: collab: disconnecting a client too slow to keep up with section %s", s.sectionID)
+		s.disconnect(c)
+	}
+}
+
+// broadcast sends a message to every client but from. The session's lock
+// must be held.
+func (s *session) broadcast(message Message, from *Connection) {
+	for c := range s.connections {
+		if c != from {
+			s.send(c, message)
+		}
+	}
+}
+
+// apply transforms an operation made at revision against everything applied
+// since, applies it and records it in the history. The session's lock must
+// be held.
+func (s *session) apply(revision int, op Operation) (Operation, error) {
+	if revision < s.historyBase || revision > s.revision {
+		return nil, ErrStaleRevision
+	}
+	for _, past := range s.history[revision-s.historyBase:] {
+		var err error
+		op, _, err = Transform(op, past)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := op.Apply(s.content)
+	if err != nil {
+		return nil, err
+	}
+	s.content = content
+	s.revision++
+	s.history = append(s.history, op)
+	if extra := len(s.history) - s.hub.config.MaxHistory; extra > 0 {
+		s.history = append([]Operation(nil), s.history[extra:]...)
+		s.historyBase += extra
+	}
+	return op, nil
+}
+
+// Messages delivers the server's messages for the client. It is closed when
+// the client is disconnected by the session.
+func (c *Connection) Messages() <-chan Message {
+	return c.messages
+}
+
+// Submit applies the client's operation, made against revision. The client
+// is sent an ack and everyone else the transformed operation.
+func (c *Connection) Submit(revision int, op Operation) error {
+	if !c.canEdit {
+		return ErrReadOnly
+	}
+
+	s := c.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.connections[c]; !ok {
+		return ErrSessionEnded
+	}
+
+	op, err := s.apply(revision, op)
+	if err != nil {
+		return err
+	}
+	s.editor = c.user
+
+	s.send(c, Message{Type: MessageAck, Revision: s.revision})
+	s.broadcast(Message{Type: MessageOperation, Revision: s.revision, Operation: op, UserID: c.user.ID}, c)
+	return nil
+}
+
+// Leave takes the client out of the session. It is safe to call more than
+// once.
+func (c *Connection) Leave() {
+	c.leave.Do(func() {
+		s := c.session
+		s.mu.Lock()
+		s.disconnect(c)
+		s.mu.Unlock()
+		s.hub.release(s)
+	})
+}
+
+func (s *session) saveLoop() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.hub.config.SaveInterval)
+	defer ticker.Stop()
+	var recheck <-chan time.Time
+	if s.hub.config.AccessInterval > 0 {
+		accessTicker := time.NewTicker(s.hub.config.AccessInterval)
+		defer accessTicker.Stop()
+		recheck = accessTicker.C
+	}
+	for {
+		select {
+		case <-s.quit:
+			s.save(true)
+			return
+		case <-ticker.C:
+			s.save(false)
+		case <-recheck:
+			s.checkAccess()
+		}
+	}
+}
+
+// save writes the content to the store if it has changed since it was last
+// saved, recording a revision when RevisionInterval has passed since the
+// last one or, on the session's last save, if any save has gone without.
+// Edits saved to the section outside the session in the meantime are merged
+// in first, as if another client had made them.
+func (s *session) save(last bool) {
+	s.mu.Lock()
+	if s.failed || (s.revision == s.savedRevision && !(last && s.unrevised)) {
+		s.mu.Unlock()
+		return
+	}
+	revise := last || time.Since(s.revisedAt) >= s.hub.config.RevisionInterval
+	editor := s.editor
+	s.mu.Unlock()
+
+	err := s.saveAs(editor, revise)
+	if lostAccess(err) {
+		// The last editor may have lost access since their edit; save with
+		// the access of an editor who still has it
+		s.checkAccess()
+		if other := s.otherEditor(editor); other != nil {
+			err = s.saveAs(other, revise)
+		}
+	}
+	if err != nil {
+		s.saveFailed(err)
+	}
+}
+
+// otherEditor makes a connected client other than user who may edit the
+// section the session's editor and returns them, or returns nil if there is
+// none.
+func (s *session) otherEditor(user *store.User) *store.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.connections {
+		if c.canEdit && c.user.ID != user.ID {
+			s.editor = c.user
+			return c.user
+		}
+	}
+	return nil
+}
+
+// saveAs makes a save with the editor's access.
+func (s *session) saveAs(editor *store.User, revise bool) error {
+	section, err := s.hub.sectionStore.ReadSection(editor, s.sectionID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if section.Content != s.saved && (s.merged == nil || section.Content != *s.merged) {
+		stored := section.Content
+		s.mergeSaved(stored)
+		s.merged = &stored
+	}
+	section.Content = s.content
+	revision := s.revision
+	s.mu.Unlock()
+
+	if revise {
+		_, err = s.hub.sectionStore.UpdateSection(editor, section)
+	} else {
+		_, err = s.hub.sectionStore.AutosaveSection(editor, section)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.saved, s.merged = section.Content, nil
+	s.savedRevision = revision
+	if revise {
+		s.revisedAt, s.unrevised = time.Now(), false
+	} else {
+		s.unrevised = true
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// mergeSaved brings in a change saved to the section outside the session
+// since savedRevision. The session's lock must be held.
+func (s *session) mergeSaved(stored string) {
+	op := diffOperation(s.saved, stored)
+	op, err := s.apply(s.savedRevision, op)
+	if err != nil {
+		s.hub.logger.Printf("ERROR: collab: overwriting changes saved outside the session to section %s: %v", s.sectionID, err)
+		return
+	}
+	s.broadcast(Message{Type: MessageOperation, Revision: s.revision, Operation: op}, nil)
+}
+
+// saveFailed ends the session when the section is gone or no editor left can
+// save it. Other errors are retried at the next save.
+func (s *session) saveFailed(err error) {
+	s.hub.logger.Printf("ERROR: collab: saving section %s: %v", s.sectionID, err)
+	if lostAccess(err) {
+		s.mu.Lock()
+		s.failed = true
+		s.mu.Unlock()
+		s.end(fmt.Errorf("the section can no longer be saved: %w", err))
+	}
+}
+
+// diffOperation returns an operation turning before into after, replacing
+// whatever lies between their common start and end.
+func diffOperation(before, after string) Operation {
+	b, a := []rune(before), []rune(after)
+	prefix := 0
+	for prefix < len(b) && prefix < len(a) && b[prefix] == a[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(b)-prefix && suffix < len(a)-prefix && b[len(b)-1-suffix] == a[len(a)-1-suffix] {
+		suffix++
+	}
+	return Splice(len(b), prefix, len(b)-prefix-suffix, string(a[prefix:len(a)-suffix]))
+}
@@ -0,0 +1,221 @@
+package collab
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+// memorySections is a section store holding one section, which refuses to
+// save for users in forbidden.
+type memorySections struct {
+	store.SectionStore
+
+	mu        sync.Mutex
+	section   store.Section
+	forbidden map[string]bool
+	savedBy   string
+	saves     int
+	revisions int
+}
+
+func (m *memorySections) ReadSection(user *store.User, id string) (*store.Section, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	section := m.section
+	return &section, nil
+}
+
+func (m *memorySections) UpdateSection(user *store.User, section *store.Section) (*store.Section, error) {
+	saved, err := m.AutosaveSection(user, section)
+	if err == nil {
+		m.mu.Lock()
+		m.revisions++
+		m.mu.Unlock()
+	}
+	return saved, err
+}
+
+func (m *memorySections) AutosaveSection(user *store.User, section *store.Section) (*store.Section, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.forbidden[user.ID] {
+		return nil, store.ErrForbidden
+	}
+	m.section.Content = section.Content
+	m.savedBy = user.ID
+	m.saves++
+	return section, nil
+}
+
+func (m *memorySections) forbid(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.forbidden[userID] = true
+}
+
+func (m *memorySections) state() (content string, savedBy string, saves int, revisions int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.section.Content, m.savedBy, m.saves, m.revisions
+}
+
+func newMemorySections(content string) *memorySections {
+	return &memorySections{section: store.Section{ID: "section", Content: content}, forbidden: map[string]bool{}}
+}
+
+// revocable is an editor's Access that can be taken away.
+type revocable struct {
+	revoked atomic.Bool
+}
+
+func (r *revocable) access() (bool, error) {
+	if r.revoked.Load() {
+		return false, sql.ErrNoRows
+	}
+	return true, nil
+}
+
+func testHub(sections *memorySections, config Config) *Hub {
+	config.MaxHistory, config.Outbox = DefaultConfig.MaxHistory, DefaultConfig.Outbox
+	return NewHub(sections, config, log.New(io.Discard, "", 0))
+}
+
+func join(t *testing.T, hub *Hub, userID string, access Access) *Connection {
+	t.Helper()
+	c, err := hub.Join(&store.User{ID: userID}, "section", true, access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Leave)
+	if message := receive(t, c); message.Type != MessageSnapshot {
+		t.Fatalf("first message is %q, want a snapshot", message.Type)
+	}
+	return c
+}
+
+func receive(t *testing.T, c *Connection) Message {
+	t.Helper()
+	select {
+	case message, ok := <-c.Messages():
+		if !ok {
+			t.Fatal("disconnected")
+		}
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return Message{}
+}
+
+// expectDropped checks that c is told its access changed and disconnected.
+func expectDropped(t *testing.T, c *Connection) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message, ok := <-c.Messages():
+			if !ok {
+				t.Fatal("disconnected without being told why")
+			}
+			if message.Type != MessageError {
+				continue
+			}
+			if message.Error != ErrAccessChanged.Error() {
+				t.Fatalf("got error %q, want %q", message.Error, ErrAccessChanged)
+			}
+			if _, ok := <-c.Messages(); ok {
+				t.Fatal("still connected after the error")
+			}
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting to be disconnected")
+		}
+	}
+}
+
+func TestAccessCheckedPeriodically(t *testing.T) {
+	sections := newMemorySections("Hello")
+	hub := testHub(sections, Config{SaveInterval: time.Hour, AccessInterval: 10 * time.Millisecond})
+
+	var alice, bob revocable
+	a := join(t, hub, "alice", alice.access)
+	b := join(t, hub, "bob", bob.access)
+
+	bob.revoked.Store(true)
+	expectDropped(t, b)
+
+	// Alice goes on editing
+	if err := a.Submit(0, Splice(5, 5, 0, ", world")); err != nil {
+		t.Fatal(err)
+	}
+	if message := receive(t, a); message.Type != MessageAck {
+		t.Fatalf("got %q, want an ack", message.Type)
+	}
+}
+
+func TestSaveRefusedFallsBackToAnotherEditor(t *testing.T) {
+	sections := newMemorySections("Hello")
+	hub := testHub(sections, Config{SaveInterval: 10 * time.Millisecond, RevisionInterval: time.Hour})
+
+	var alice, bob revocable
+	a := join(t, hub, "alice", alice.access)
+	b := join(t, hub, "bob", bob.access)
+
+	// Bob makes the latest edit, then loses access before it is saved
+	bob.revoked.Store(true)
+	sections.forbid("bob")
+	if err := b.Submit(0, Splice(5, 5, 0, "!")); err != nil {
+		t.Fatal(err)
+	}
+	expectDropped(t, b)
+	if message := receive(t, a); message.Type != MessageOperation {
+		t.Fatalf("got %q, want bob's operation", message.Type)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		content, savedBy, _, _ := sections.state()
+		if content == "Hello!" && savedBy == "alice" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("saved %q as %q, want %q saved as alice", content, savedBy, "Hello!")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := a.Submit(1, Splice(6, 0, 0, "Oh. ")); err != nil {
+		t.Fatalf("alice was disconnected too: %v", err)
+	}
+}
+
+func TestSavesCoalesceRevisions(t *testing.T) {
+	sections := newMemorySections("")
+	hub := testHub(sections, Config{SaveInterval: 5 * time.Millisecond, RevisionInterval: time.Hour})
+
+	a := join(t, hub, "alice", (&revocable{}).access)
+	for i := range 5 {
+		if err := a.Submit(i, Splice(i, i, 0, "x")); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, a)
+		time.Sleep(20 * time.Millisecond)
+	}
+	// The last to leave ends the session with a last save
+	a.Leave()
+
+	content, _, saves, revisions := sections.state()
+	if content != "xxxxx" {
+		t.Errorf("saved %q, want %q", content, "xxxxx")
+	}
+	if saves < 2 || revisions != 1 {
+		t.Errorf("%d saves recorded %d revisions, want several saves and one revision at the end", saves, revisions)
+	}
+}
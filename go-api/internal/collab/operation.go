@@ -0,0 +1,332 @@
+// Package collab lets several people edit a section's content at once. Each
+// section being edited has a session that orders everyone's edits, transforms
+// edits made against an older revision so they still mean what their author
+// intended (operational transformation), and periodically saves the merged
+// content through the section store.
+//
+// Clients speak JSON messages over a WebSocket. On connecting they receive a
+// snapshot of the content and its revision. They send each edit as an
+// operation against the latest revision they have seen, and wait for the
+// server's ack before sending the next one, buffering edits made meanwhile.
+// Other clients' edits arrive as operations to be transformed against the
+// client's own unacknowledged edits before being applied. Editor implements
+// the client side.
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrInvalidOperation = errors.New("invalid operation")
+
+// Component is one step of an Operation. Exactly one field is set.
+type Component struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+// Operation is an edit that walks over the whole text, component by
+// component: keeping the next Retain characters, inserting Insert, or
+// removing the next Delete characters. Positions and lengths count Unicode
+// code points. In JSON an operation is an array in which a positive number
+// retains, a negative number deletes and a string inserts, as in ot.js.
+type Operation []Component
+
+// Splice is the operation that replaces deleteCount characters at start of a
+// text length characters long with insert.
+func Splice(length int, start int, deleteCount int, insert string) Operation {
+	var op Operation
+	return op.retain(start).insert(insert).delete(deleteCount).retain(length - start - deleteCount)
+}
+
+// The builders merge a component into the one before it when they are the
+// same kind and put inserts ahead of deletes, so that equal edits are equal
+// operations. They may change the last component in place, so they are only
+// used on operations being built.
+
+func (o Operation) retain(n int) Operation {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o) - 1; last >= 0 && o[last].Retain > 0 {
+		o[last].Retain += n
+		return o
+	}
+	return append(o, Component{Retain: n})
+}
+
+func (o Operation) insert(s string) Operation {
+	if s == "" {
+		return o
+	}
+	last := len(o) - 1
+	if last >= 0 && o[last].Insert != "" {
+		o[last].Insert += s
+		return o
+	}
+	if last >= 0 && o[last].Delete > 0 {
+		if last > 0 && o[last-1].Insert != "" {
+			o[last-1].Insert += s
+			return o
+		}
+		o = append(o, o[last])
+		o[last] = Component{Insert: s}
+		return o
+	}
+	return append(o, Component{Insert: s})
+}
+
+func (o Operation) delete(n int) Operation {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o) - 1; last >= 0 && o[last].Delete > 0 {
+		o[last].Delete += n
+		return o
+	}
+	return append(o, Component{Delete: n})
+}
+
+// lengths returns how long a text the operation applies to is, and how long
+// it is afterwards.
+func (o Operation) lengths() (base int, target int) {
+	for _, c := range o {
+		switch {
+		case c.Retain > 0:
+			base += c.Retain
+			target += c.Retain
+		case c.Insert != "":
+			target += utf8.RuneCountInString(c.Insert)
+		default:
+			base += c.Delete
+		}
+	}
+	return base, target
+}
+
+// IsNoop reports whether the operation leaves every text it applies to as it
+// was.
+func (o Operation) IsNoop() bool {
+	for _, c := range o {
+		if c.Retain == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply returns text with the operation applied.
+func (o Operation) Apply(text string) (string, error) {
+	runes := []rune(text)
+	if base, _ := o.lengths(); base != len(runes) {
+		return "", fmt.Errorf("%w: it edits a text of %d characters, not %d", ErrInvalidOperation, base, len(runes))
+	}
+
+	var b strings.Builder
+	pos := 0
+	for _, c := range o {
+		switch {
+		case c.Retain > 0:
+			b.WriteString(string(runes[pos : pos+c.Retain]))
+			pos += c.Retain
+		case c.Insert != "":
+			b.WriteString(c.Insert)
+		default:
+			pos += c.Delete
+		}
+	}
+	return b.String(), nil
+}
+
+// size is how many characters of the original text a retain or delete
+// component covers.
+func (c Component) size() int {
+	return c.Retain + c.Delete
+}
+
+func (c Component) empty() bool {
+	return c.Retain == 0 && c.Insert == "" && c.Delete == 0
+}
+
+// shorten drops the first n characters a component covers or inserts.
+func (c *Component) shorten(n int) {
+	switch {
+	case c.Retain > 0:
+		c.Retain -= n
+	case c.Insert != "":
+		c.Insert = string([]rune(c.Insert)[n:])
+	default:
+		c.Delete -= n
+	}
+}
+
+func firstRunes(s string, n int) string {
+	return string([]rune(s)[:n])
+}
+
+// Compose returns the single operation that has the effect of a followed by
+// b.
+func Compose(a, b Operation) (Operation, error) {
+	_, aTarget := a.lengths()
+	bBase, _ := b.lengths()
+	if aTarget != bBase {
+		return nil, fmt.Errorf("%w: the second operation does not follow the first", ErrInvalidOperation)
+	}
+
+	as, bs := slices.Clone(a), slices.Clone(b)
+	var out Operation
+	i, j := 0, 0
+	for i < len(as) || j < len(bs) {
+		if i < len(as) && as[i].Delete > 0 {
+			out = out.delete(as[i].Delete)
+			i++
+			continue
+		}
+		if j < len(bs) && bs[j].Insert != "" {
+			out = out.insert(bs[j].Insert)
+			j++
+			continue
+		}
+		if i == len(as) || j == len(bs) {
+			return nil, fmt.Errorf("%w: the second operation does not follow the first", ErrInvalidOperation)
+		}
+
+		ca, cb := &as[i], &bs[j]
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			n := min(ca.Retain, cb.Retain)
+			out = out.retain(n)
+			ca.shorten(n)
+			cb.shorten(n)
+		case ca.Retain > 0:
+			n := min(ca.Retain, cb.Delete)
+			out = out.delete(n)
+			ca.shorten(n)
+			cb.shorten(n)
+		case cb.Retain > 0:
+			n := min(utf8.RuneCountInString(ca.Insert), cb.Retain)
+			out = out.insert(firstRunes(ca.Insert, n))
+			ca.shorten(n)
+			cb.shorten(n)
+		default:
+			// b deletes what a inserted
+			n := min(utf8.RuneCountInString(ca.Insert), cb.Delete)
+			ca.shorten(n)
+			cb.shorten(n)
+		}
+		if ca.empty() {
+			i++
+		}
+		if cb.empty() {
+			j++
+		}
+	}
+	return out, nil
+}
+
+// Transform takes two operations made concurrently on the same text and
+// returns a' and b' such that applying a then b' gives the same text as b
+// then a'. Where both insert at the same place, a's text comes first.
+func Transform(a, b Operation) (Operation, Operation, error) {
+	aBase, _ := a.lengths()
+	bBase, _ := b.lengths()
+	if aBase != bBase {
+		return nil, nil, fmt.Errorf("%w: the operations edit different texts", ErrInvalidOperation)
+	}
+
+	as, bs := slices.Clone(a), slices.Clone(b)
+	var ap, bp Operation
+	i, j := 0, 0
+	for i < len(as) || j < len(bs) {
+		if i < len(as) && as[i].Insert != "" {
+			ap = ap.insert(as[i].Insert)
+			bp = bp.retain(utf8.RuneCountInString(as[i].Insert))
+			i++
+			continue
+		}
+		if j < len(bs) && bs[j].Insert != "" {
+			ap = ap.retain(utf8.RuneCountInString(bs[j].Insert))
+			bp = bp.insert(bs[j].Insert)
+			j++
+			continue
+		}
+		if i == len(as) || j == len(bs) {
+			return nil, nil, fmt.Errorf("%w: the operations edit different texts", ErrInvalidOperation)
+		}
+
+		ca, cb := &as[i], &bs[j]
+		n := min(ca.size(), cb.size())
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			ap = ap.retain(n)
+			bp = bp.retain(n)
+		case ca.Delete > 0 && cb.Retain > 0:
+			ap = ap.delete(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			bp = bp.delete(n)
+		}
+		// When both delete the same characters neither transformed
+		// operation needs to
+		ca.shorten(n)
+		cb.shorten(n)
+		if ca.empty() {
+			i++
+		}
+		if cb.empty() {
+			j++
+		}
+	}
+	return ap, bp, nil
+}
+
+func (o Operation) MarshalJSON() ([]byte, error) {
+	parts := make([]any, 0, len(o))
+	for _, c := range o {
+		switch {
+		case c.Retain > 0:
+			parts = append(parts, c.Retain)
+		case c.Insert != "":
+			parts = append(parts, c.Insert)
+		default:
+			parts = append(parts, -c.Delete)
+		}
+	}
+	return json.Marshal(parts)
+}
+
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidOperation, err)
+	}
+
+	var op Operation
+	for _, part := range parts {
+		if len(part) > 0 && part[0] == '"' {
+			var s string
+			if err := json.Unmarshal(part, &s); err != nil || s == "" {
+				return fmt.Errorf("%w: inserts must be non-empty strings", ErrInvalidOperation)
+			}
+			op = op.insert(s)
+			continue
+		}
+
+		var n int
+		if err := json.Unmarshal(part, &n); err != nil || n == 0 {
+			return fmt.Errorf("%w: retains and deletes must be non-zero integers", ErrInvalidOperation)
+		}
+		if n > 0 {
+			op = op.retain(n)
+		} else {
+			op = op.delete(-n)
+		}
+	}
+	*o = op
+	return nil
+}
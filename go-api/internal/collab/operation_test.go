@@ -0,0 +1,128 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"slices"
+	"testing"
+	"unicode/utf8"
+)
+
+var alphabet = []rune("ab é—ß\n")
+
+func randomText(rng *rand.Rand, maxLength int) string {
+	runes := make([]rune, rng.Intn(maxLength+1))
+	for i := range runes {
+		runes[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return string(runes)
+}
+
+// randomOperation returns an operation on a text length characters long
+// that retains, deletes and inserts at random along it.
+func randomOperation(rng *rand.Rand, length int) Operation {
+	var op Operation
+	for pos := 0; pos < length; {
+		n := 1 + rng.Intn(min(3, length-pos))
+		switch rng.Intn(3) {
+		case 0:
+			op = op.retain(n)
+			pos += n
+		case 1:
+			op = op.delete(n)
+			pos += n
+		default:
+			op = op.insert(randomText(rng, 3))
+		}
+	}
+	if rng.Intn(2) == 0 {
+		op = op.insert(randomText(rng, 3))
+	}
+	return op
+}
+
+func TestTransformConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		text := randomText(rng, 12)
+		length := utf8.RuneCountInString(text)
+		a, b := randomOperation(rng, length), randomOperation(rng, length)
+
+		ap, bp, err := Transform(a, b)
+		if err != nil {
+			t.Fatalf("Transform(%v, %v): %v", a, b, err)
+		}
+		left := mustApply(t, mustApply(t, text, a), bp)
+		right := mustApply(t, mustApply(t, text, b), ap)
+		if left != right {
+			t.Fatalf("text %q, a %v, b %v: a then b' gives %q but b then a' gives %q", text, a, b, left, right)
+		}
+	}
+}
+
+func TestTransformPutsFirstInsertFirst(t *testing.T) {
+	a, b := Splice(3, 1, 0, "A"), Splice(3, 1, 0, "B")
+	ap, bp, err := Transform(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mustApply(t, mustApply(t, "xyz", a), bp); got != "xAByz" {
+		t.Errorf("got %q, want %q", got, "xAByz")
+	}
+	if got := mustApply(t, mustApply(t, "xyz", b), ap); got != "xAByz" {
+		t.Errorf("got %q, want %q", got, "xAByz")
+	}
+}
+
+func TestCompose(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 5000; i++ {
+		text := randomText(rng, 12)
+		a := randomOperation(rng, utf8.RuneCountInString(text))
+		middle := mustApply(t, text, a)
+		b := randomOperation(rng, utf8.RuneCountInString(middle))
+
+		composed, err := Compose(a, b)
+		if err != nil {
+			t.Fatalf("Compose(%v, %v): %v", a, b, err)
+		}
+		if got, want := mustApply(t, text, composed), mustApply(t, middle, b); got != want {
+			t.Fatalf("text %q, a %v, b %v: composed gives %q, want %q", text, a, b, got, want)
+		}
+	}
+}
+
+func TestOperationJSON(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 1000; i++ {
+		op := randomOperation(rng, rng.Intn(12))
+		data, err := json.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Operation
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if !slices.Equal(decoded, op) {
+			t.Fatalf("%v came back from %s as %v", op, data, decoded)
+		}
+	}
+
+	var op Operation
+	for _, bad := range []string{`[0]`, `[""]`, `[1.5]`, `{}`, `[true]`} {
+		if err := json.Unmarshal([]byte(bad), &op); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("%s: got %v, want ErrInvalidOperation", bad, err)
+		}
+	}
+}
+
+func mustApply(t *testing.T, text string, op Operation) string {
+	t.Helper()
+	out, err := op.Apply(text)
+	if err != nil {
+		t.Fatalf("applying %v to %q: %v", op, text, err)
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+package diff
+
+import "strings"
+
+// Change is one contiguous edit in a result: a run of deletes and inserts
+// between two equal hunks. Changes are numbered in order from zero.
+type Change struct {
+	Index    int    `json:"index"`
+	Deleted  string `json:"deleted"`
+	Inserted string `json:"inserted"`
+}
+
+// Changes groups a result's hunks into changes.
+func Changes(r *Result) []Change {
+	changes := []Change{}
+	open := false
+	for _, h := range r.Hunks {
+		if h.Op == OpEqual {
+			open = false
+			continue
+		}
+		if !open {
+			changes = append(changes, Change{Index: len(changes)})
+			open = true
+		}
+		change := &changes[len(changes)-1]
+		if h.Op == OpDelete {
+			change.Deleted += h.Text
+		} else {
+			change.Inserted += h.Text
+		}
+	}
+	return changes
+}
+
+// Apply rebuilds the text a result was compared against, taking only the
+// changes whose index is in accepted and keeping the old text everywhere
+// else. Accepting every change gives the new text; accepting none gives the
+// old.
+func Apply(r *Result, accepted []int) string {
+	keep := make(map[int]bool, len(accepted))
+	for _, index := range accepted {
+		keep[index] = true
+	}
+
+	var b strings.Builder
+	index, open := -1, false
+	for _, h := range r.Hunks {
+		if h.Op == OpEqual {
+			open = false
+			b.WriteString(h.Text)
+			continue
+		}
+		if !open {
+			index++
+			open = true
+		}
+		if (h.Op == OpInsert) == keep[index] {
+			b.WriteString(h.Text)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,360 @@
+package diff
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	OpEqual  = "equal"
+	OpInsert = "insert"
+	OpDelete = "delete"
+)
+
+const (
+	GranularityWord      = "word"
+	GranularityParagraph = "paragraph"
+)
+
+var ErrUnknownGranularity = errors.New("unknown diff granularity")
+
+type Hunk struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+type Stats struct {
+	WordsInserted      int `json:"words_inserted"`
+	WordsDeleted       int `json:"words_deleted"`
+	ParagraphsChanged  int `json:"paragraphs_changed"`
+	ParagraphsInserted int `json:"paragraphs_inserted"`
+	ParagraphsDeleted  int `json:"paragraphs_deleted"`
+}
+
+type Result struct {
+	Granularity string `json:"granularity"`
+	Hunks       []Hunk `json:"hunks"`
+	Stats       Stats  `json:"stats"`
+}
+
+var paragraphBreak = regexp.MustCompile(`\n[ \t]*\n\s*`)
+
+// Compare diffs two plain texts (see richtext.PlainText for editor HTML).
+// Paragraphs are matched first; at word granularity
+// each replaced paragraph is then diffed word by word, which keeps the edit
+// script small on long manuscripts where most paragraphs are untouched.
+func Compare(oldText string, newText string, granularity string) (*Result, error) {
+	if granularity == "" {
+		granularity = GranularityWord
+	}
+	if granularity != GranularityWord && granularity != GranularityParagraph {
+		return nil, ErrUnknownGranularity
+	}
+
+	oldParas := splitParagraphs(oldText)
+	newParas := splitParagraphs(newText)
+	paraHunks := diffTokens(oldParas, newParas)
+
+	result := &Result{Granularity: granularity}
+	for i := 0; i < len(paraHunks); i++ {
+		h := paraHunks[i]
+		switch h.Op {
+		case OpDelete:
+			if i+1 < len(paraHunks) && paraHunks[i+1].Op == OpInsert {
+				result.Stats.ParagraphsChanged++
+			} else {
+				result.Stats.ParagraphsDeleted++
+			}
+		case OpInsert:
+			if i == 0 || paraHunks[i-1].Op != OpDelete {
+				result.Stats.ParagraphsInserted++
+			}
+		}
+
+		if granularity == GranularityWord && h.Op == OpDelete && i+1 < len(paraHunks) && paraHunks[i+1].Op == OpInsert {
+			result.Hunks = append(result.Hunks, diffTokens(splitWords(h.Text), splitWords(paraHunks[i+1].Text))...)
+			i++
+			continue
+		}
+		result.Hunks = append(result.Hunks, h)
+	}
+
+	result.Hunks = cleanup(result.Hunks)
+	for _, h := range result.Hunks {
+		switch h.Op {
+		case OpInsert:
+			result.Stats.WordsInserted += len(strings.Fields(h.Text))
+		case OpDelete:
+			result.Stats.WordsDeleted += len(strings.Fields(h.Text))
+		}
+	}
+	if result.Hunks == nil {
+		result.Hunks = []Hunk{}
+	}
+	return result, nil
+}
+
+// splitParagraphs splits text into paragraphs, keeping the blank-line
+// separator attached to the end of each paragraph so the pieces rejoin into
+// the original text exactly.
+func splitParagraphs(text string) []string {
+	if text == "" {
+		return nil
+	}
+	tokens := []string{}
+	last := 0
+	for _, loc := range paragraphBreak.FindAllStringIndex(text, -1) {
+		tokens = append(tokens, text[last:loc[1]])
+		last = loc[1]
+	}
+	if last < len(text) {
+		tokens = append(tokens, text[last:])
+	}
+	return tokens
+}
+
+// splitWords splits text into words, whitespace runs and single punctuation
+// marks. Joining the tokens gives back the original text.
+func splitWords(text string) []string {
+	tokens := []string{}
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		j := i + 1
+		switch {
+		case isWordRune(runes[i]):
+			for j < len(runes) && isWordRune(runes[j]) {
+				j++
+			}
+		case unicode.IsSpace(runes[i]):
+			for j < len(runes) && unicode.IsSpace(runes[j]) {
+				j++
+			}
+		}
+		tokens = append(tokens, string(runes[i:j]))
+		i = j
+	}
+	return tokens
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' || r == '’' || r == '_'
+}
+
+// maxDiffTokens bounds the tokens one pass compares once the common prefix
+// and suffix are set aside. Myers' algorithm takes time proportional to their
+// number times the number of edits, so a longer changed run is reported whole
+// instead: at word granularity the paragraphs it covers show as replaced, as
+// they would at paragraph granularity.
+const maxDiffTokens = 20000
+
+// diffTokens diffs two token slices and returns the edit script as merged
+// hunks.
+func diffTokens(a []string, b []string) []Hunk {
+	prefix := commonPrefix(a, b)
+	suffix := commonSuffix(a[prefix:], b[prefix:])
+
+	hunks := []Hunk{}
+	hunks = appendHunk(hunks, OpEqual, a[:prefix]...)
+	changedA, changedB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(changedA)+len(changedB) > maxDiffTokens {
+		hunks = appendHunk(hunks, OpDelete, changedA...)
+		hunks = appendHunk(hunks, OpInsert, changedB...)
+	} else {
+		hunks = myers(hunks, changedA, changedB)
+	}
+	hunks = appendHunk(hunks, OpEqual, a[len(a)-suffix:]...)
+	return hunks
+}
+
+func commonPrefix(a []string, b []string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func commonSuffix(a []string, b []string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	return n
+}
+
+// myers appends the edits turning a into b to hunks, using the linear space
+// refinement of Myers' O(ND) algorithm: it finds a point the middle of a
+// shortest edit script passes through and diffs either side of it.
+func myers(hunks []Hunk, a []string, b []string) []Hunk {
+	prefix := commonPrefix(a, b)
+	hunks = appendHunk(hunks, OpEqual, a[:prefix]...)
+	a, b = a[prefix:], b[prefix:]
+	suffix := commonSuffix(a, b)
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch {
+	case len(a) == 0:
+		hunks = appendHunk(hunks, OpInsert, b...)
+	case len(b) == 0:
+		hunks = appendHunk(hunks, OpDelete, a...)
+	default:
+		if x, y, ok := middle(a, b); ok {
+			hunks = myers(hunks, a[:x], b[:y])
+			hunks = myers(hunks, a[x:], b[y:])
+		} else {
+			hunks = appendHunk(hunks, OpDelete, a...)
+			hunks = appendHunk(hunks, OpInsert, b...)
+		}
+	}
+	return appendHunk(hunks, OpEqual, common...)
+}
+
+// middle searches forwards from the start and backwards from the end at
+// once, and returns where the two searches first overlap, which splits the
+// edit script in half. a and b must be non-empty and differ at both ends.
+func middle(a []string, b []string) (x int, y int, ok bool) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+
+	delta := n - m
+	// When delta is odd the searches can only meet after a forward step
+	odd := delta%2 != 0
+	// Diagonals that have run off the edge of the grid are not searched again
+	forwardStart, forwardEnd, backwardStart, backwardEnd := 0, 0, 0, 0
+
+	for d := 0; d < maxD; d++ {
+		for k := -d + forwardStart; k <= d-forwardEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			switch {
+			case x > n:
+				forwardEnd += 2
+			case y > m:
+				forwardStart += 2
+			case odd:
+				// The backward search's diagonal through the same point
+				back := offset + delta - k
+				if back >= 0 && back < len(backward) && backward[back] != -1 && x >= n-backward[back] {
+					return x, y, true
+				}
+			}
+		}
+
+		for k := -d + backwardStart; k <= d-backwardEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			switch {
+			case x > n:
+				backwardEnd += 2
+			case y > m:
+				backwardStart += 2
+			case !odd:
+				fwd := offset + delta - k
+				if fwd >= 0 && fwd < len(forward) && forward[fwd] != -1 {
+					forwardX := forward[fwd]
+					forwardY := forwardX - (fwd - offset)
+					if forwardX >= n-x {
+						return forwardX, forwardY, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func appendHunk(hunks []Hunk, op string, tokens ...string) []Hunk {
+	if len(tokens) == 0 {
+		return hunks
+	}
+	text := strings.Join(tokens, "")
+	if n := len(hunks); n > 0 && hunks[n-1].Op == op {
+		hunks[n-1].Text += text
+		return hunks
+	}
+	return append(hunks, Hunk{Op: op, Text: text})
+}
+
+// cleanup folds whitespace-only equal runs that sit between two changes into
+// the surrounding delete and insert, so "the red car" -> "a blue bus" reads as
+// one replacement instead of three interleaved ones. Deletes are always
+// emitted before inserts within a change.
+func cleanup(hunks []Hunk) []Hunk {
+	merged := []Hunk{}
+	for _, h := range hunks {
+		merged = appendHunk(merged, h.Op, h.Text)
+	}
+	hunks = merged
+
+	out := []Hunk{}
+	for i := 0; i < len(hunks); {
+		if hunks[i].Op == OpEqual {
+			out = appendHunk(out, OpEqual, hunks[i].Text)
+			i++
+			continue
+		}
+
+		start := i
+		hasDelete, hasInsert := false, false
+		for i < len(hunks) {
+			h := hunks[i]
+			if h.Op == OpEqual && (strings.TrimSpace(h.Text) != "" || i+1 >= len(hunks)) {
+				break
+			}
+			hasDelete = hasDelete || h.Op == OpDelete
+			hasInsert = hasInsert || h.Op == OpInsert
+			i++
+		}
+		run := hunks[start:i]
+
+		if !hasDelete || !hasInsert {
+			for _, h := range run {
+				out = appendHunk(out, h.Op, h.Text)
+			}
+			continue
+		}
+
+		var deleted, inserted strings.Builder
+		for _, h := range run {
+			if h.Op != OpInsert {
+				deleted.WriteString(h.Text)
+			}
+			if h.Op != OpDelete {
+				inserted.WriteString(h.Text)
+			}
+		}
+		out = appendHunk(out, OpDelete, deleted.String())
+		out = appendHunk(out, OpInsert, inserted.String())
+	}
+	return out
+}
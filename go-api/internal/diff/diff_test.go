@@ -0,0 +1,84 @@
+package diff
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// sides rebuilds the old and new texts from hunks and counts the tokens
+// deleted and inserted.
+func sides(hunks []Hunk) (oldText string, newText string, edits int) {
+	var o, n strings.Builder
+	for _, h := range hunks {
+		if h.Op != OpInsert {
+			o.WriteString(h.Text)
+		}
+		if h.Op != OpDelete {
+			n.WriteString(h.Text)
+		}
+		if h.Op != OpEqual {
+			edits += len([]rune(h.Text))
+		}
+	}
+	return o.String(), n.String(), edits
+}
+
+// shortestEdit is the length of a shortest edit script by dynamic
+// programming over the longest common subsequence.
+func shortestEdit(a []string, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	return len(a) + len(b) - 2*lcs[0][0]
+}
+
+func TestDiffTokensIsShortest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	letters := func(alphabet int) []string {
+		tokens := make([]string, rng.Intn(30))
+		for i := range tokens {
+			tokens[i] = string(rune('a' + rng.Intn(alphabet)))
+		}
+		return tokens
+	}
+
+	for i := 0; i < 5000; i++ {
+		alphabet := 1 + rng.Intn(6)
+		a, b := letters(alphabet), letters(alphabet)
+		oldText, newText, edits := sides(diffTokens(a, b))
+		if oldText != strings.Join(a, "") || newText != strings.Join(b, "") {
+			t.Fatalf("diff of %q and %q rebuilds %q and %q", a, b, oldText, newText)
+		}
+		if want := shortestEdit(a, b); edits != want {
+			t.Fatalf("diff of %q and %q makes %d edits, want %d", a, b, edits, want)
+		}
+	}
+}
+
+func TestCompareFallsBackPastTokenLimit(t *testing.T) {
+	oldText := strings.Repeat("the quiet river ", maxDiffTokens/3) + "ends."
+	newText := strings.Repeat("a loud ocean! ", maxDiffTokens/3) + "Fin"
+
+	result, err := Compare(oldText, newText, GranularityWord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Hunks) != 2 || result.Hunks[0].Op != OpDelete || result.Hunks[1].Op != OpInsert {
+		t.Fatalf("got %d hunks, want the paragraph replaced whole", len(result.Hunks))
+	}
+	gotOld, gotNew, _ := sides(result.Hunks)
+	if gotOld != oldText || gotNew != newText {
+		t.Fatal("hunks do not rebuild the texts")
+	}
+}
@@ -0,0 +1,65 @@
+package diff
+
+import (
+	"html"
+	"strings"
+)
+
+// Unified renders a result as text. Paragraph diffs use one line per
+// paragraph prefixed with " ", "-" or "+", like a unified diff. Word diffs are
+// inline in the style of git's --word-diff: [-removed-]{+added+}.
+func Unified(r *Result) string {
+	var b strings.Builder
+	if r.Granularity == GranularityParagraph {
+		for _, h := range r.Hunks {
+			prefix := " "
+			switch h.Op {
+			case OpInsert:
+				prefix = "+"
+			case OpDelete:
+				prefix = "-"
+			}
+			for _, para := range splitParagraphs(h.Text) {
+				for _, line := range strings.Split(strings.TrimRight(para, "\n"), "\n") {
+					b.WriteString(prefix)
+					b.WriteString(line)
+					b.WriteString("\n")
+				}
+			}
+		}
+		return b.String()
+	}
+
+	for _, h := range r.Hunks {
+		switch h.Op {
+		case OpInsert:
+			b.WriteString("{+" + h.Text + "+}")
+		case OpDelete:
+			b.WriteString("[-" + h.Text + "-]")
+		default:
+			b.WriteString(h.Text)
+		}
+	}
+	return b.String()
+}
+
+// HTML renders a result as an HTML fragment with <del> and <ins> around
+// changes. Line breaks are kept as text, so the fragment should be shown with
+// white-space: pre-wrap (set inline on the wrapper).
+func HTML(r *Result) string {
+	var b strings.Builder
+	b.WriteString(`<div class="scribo-diff" style="white-space: pre-wrap">`)
+	for _, h := range r.Hunks {
+		text := html.EscapeString(h.Text)
+		switch h.Op {
+		case OpInsert:
+			b.WriteString("<ins>" + text + "</ins>")
+		case OpDelete:
+			b.WriteString("<del>" + text + "</del>")
+		default:
+			b.WriteString(text)
+		}
+	}
+	b.WriteString("</div>")
+	return b.String()
+}
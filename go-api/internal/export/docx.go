@@ -0,0 +1,326 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+func init() {
+	register(Format{
+		Name:        "docx",
+		Extension:   ".docx",
+		ContentType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		Render:      renderDOCX,
+	})
+}
+
+const (
+	docxFontCourier = "Courier New"
+	docxFontTimes   = "Times New Roman"
+)
+
+const docxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+<Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/>
+<Override PartName="/word/settings.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.settings+xml"/>
+<Override PartName="/word/header1.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.header+xml"/>
+<Override PartName="/word/header2.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.header+xml"/>
+<Override PartName="/docProps/core.xml" ContentType="application/vnd.openxmlformats-package.core-properties+xml"/>
+<Override PartName="/docProps/app.xml" ContentType="application/vnd.openxmlformats-officedocument.extended-properties+xml"/>
+</Types>
+`
+
+const docxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties" Target="docProps/core.xml"/>
+<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/extended-properties" Target="docProps/app.xml"/>
+</Relationships>
+`
+
+const docxDocumentRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/settings" Target="settings.xml"/>
+<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/header" Target="header1.xml"/>
+<Relationship Id="rId4" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/header" Target="header2.xml"/>
+</Relationships>
+`
+
+const docxSettings = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:settings xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+<w:defaultTabStop w:val="720"/>
+<w:characterSpacingControl w:val="doNotCompress"/>
+<w:compat><w:compatSetting w:name="compatibilityMode" w:uri="http://schemas.microsoft.com/office/word" w:val="15"/></w:compat>
+</w:settings>
+`
+
+const wordNamespaces = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"`
+
+// Standard Manuscript Format, following William Shunn's guide: one inch
+// margins, 12pt monospaced or Times, double spaced body with half inch first
+// line indents, chapters starting a third of the way down a new page.
+func docxStyles(font string) string {
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+<w:docDefaults>
+<w:rPrDefault><w:rPr><w:rFonts w:ascii="` + font + `" w:hAnsi="` + font + `" w:eastAsia="` + font + `" w:cs="` + font + `"/><w:sz w:val="24"/><w:szCs w:val="24"/><w:lang w:val="en-US"/></w:rPr></w:rPrDefault>
+<w:pPrDefault><w:pPr><w:spacing w:before="0" w:after="0" w:line="480" w:lineRule="auto"/></w:pPr></w:pPrDefault>
+</w:docDefaults>
+<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/><w:qFormat/></w:style>
+<w:style w:type="paragraph" w:styleId="Body"><w:name w:val="Manuscript Body"/><w:basedOn w:val="Normal"/><w:qFormat/><w:pPr><w:ind w:firstLine="720"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="Contact"><w:name w:val="Contact Info"/><w:basedOn w:val="Normal"/><w:pPr><w:tabs><w:tab w:val="right" w:pos="9360"/></w:tabs><w:spacing w:line="240" w:lineRule="auto"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="Title"><w:name w:val="Title"/><w:basedOn w:val="Normal"/><w:qFormat/><w:pPr><w:jc w:val="center"/><w:spacing w:before="4320"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="Byline"><w:name w:val="Byline"/><w:basedOn w:val="Normal"/><w:pPr><w:jc w:val="center"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/><w:basedOn w:val="Normal"/><w:next w:val="Body"/><w:qFormat/><w:pPr><w:keepNext/><w:pageBreakBefore/><w:jc w:val="center"/><w:spacing w:before="3600" w:after="480"/><w:outlineLvl w:val="0"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading2"><w:name w:val="heading 2"/><w:basedOn w:val="Normal"/><w:next w:val="Body"/><w:qFormat/><w:pPr><w:keepNext/><w:pageBreakBefore/><w:jc w:val="center"/><w:spacing w:before="3600" w:after="480"/><w:outlineLvl w:val="1"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading3"><w:name w:val="heading 3"/><w:basedOn w:val="Normal"/><w:next w:val="Body"/><w:qFormat/><w:pPr><w:keepNext/><w:jc w:val="center"/><w:outlineLvl w:val="2"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="SceneBreak"><w:name w:val="Scene Break"/><w:basedOn w:val="Normal"/><w:next w:val="Body"/><w:pPr><w:keepNext/><w:jc w:val="center"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="Header"><w:name w:val="header"/><w:basedOn w:val="Normal"/><w:pPr><w:jc w:val="right"/><w:spacing w:line="240" w:lineRule="auto"/></w:pPr></w:style>
+</w:styles>
+`
+}
+
+func xmlEscape(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
+
+// docxRun writes one run, turning newlines into <w:br/> and tabs into
+// <w:tab/>.
+func docxRun(buf *bytes.Buffer, run richtext.Run) {
+	buf.WriteString("<w:r>")
+	if run.Bold || run.Italic {
+		buf.WriteString("<w:rPr>")
+		if run.Bold {
+			buf.WriteString("<w:b/>")
+		}
+		if run.Italic {
+			buf.WriteString("<w:i/>")
+		}
+		buf.WriteString("</w:rPr>")
+	}
+	for i, line := range strings.Split(run.Text, "\n") {
+		if i > 0 {
+			buf.WriteString("<w:br/>")
+		}
+		for j, segment := range strings.Split(line, "\t") {
+			if j > 0 {
+				buf.WriteString("<w:tab/>")
+			}
+			fmt.Fprintf(buf, `<w:t xml:space="preserve">%s</w:t>`, xmlEscape(segment))
+		}
+	}
+	buf.WriteString("</w:r>")
+}
+
+func docxParagraph(buf *bytes.Buffer, style string, runs []richtext.Run) {
+	fmt.Fprintf(buf, `<w:p><w:pPr><w:pStyle w:val="%s"/></w:pPr>`, style)
+	for _, run := range runs {
+		docxRun(buf, run)
+	}
+	buf.WriteString("</w:p>\n")
+}
+
+func docxText(buf *bytes.Buffer, style string, text string) {
+	docxParagraph(buf, style, []richtext.Run{{Text: text}})
+}
+
+// approximateWords rounds a word count the way manuscripts quote it: to the
+// nearest hundred, or the nearest thousand for novel-length work.
+func approximateWords(count int) string {
+	step := 100
+	if count >= 20000 {
+		step = 1000
+	}
+	rounded := max((count+step/2)/step*step, step)
+	digits := fmt.Sprint(rounded)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteRune(',')
+		}
+		b.WriteRune(d)
+	}
+	return "about " + b.String() + " words"
+}
+
+func surname(name string) string {
+	fields := strings.Fields(name)
+	if len(fields) == 0 {
+		return "Anonymous"
+	}
+	return fields[len(fields)-1]
+}
+
+func docxHeader(m *Manuscript) string {
+	keyword := strings.ToUpper(m.Document.Title)
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:hdr ` + wordNamespaces + `>
+<w:p><w:pPr><w:pStyle w:val="Header"/></w:pPr><w:r><w:t xml:space="preserve">` + xmlEscape(surname(m.Author)+" / "+keyword+" / ") + `</w:t></w:r><w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText xml:space="preserve"> PAGE </w:instrText></w:r><w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>1</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r></w:p>
+</w:hdr>
+`
+}
+
+// docxFirstHeader is intentionally empty: the title page carries no running
+// header.
+const docxFirstHeader = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:hdr ` + wordNamespaces + `>
+<w:p><w:pPr><w:pStyle w:val="Header"/></w:pPr></w:p>
+</w:hdr>
+`
+
+func docxBody(m *Manuscript, opts Options) string {
+	var buf bytes.Buffer
+
+	words := m.Document.NumWords
+	if words <= 0 {
+		for _, entry := range m.Entries {
+			words += entry.Section.NumWords
+		}
+	}
+	if words <= 0 {
+		words = m.WordCount()
+	}
+	author := m.Author
+	if author == "" {
+		author = "Anonymous"
+	}
+
+	// Title page: contact details top left, word count top right, then the
+	// title and byline centred halfway down.
+	docxText(&buf, "Contact", author+"\t"+approximateWords(words))
+	if m.Email != "" {
+		docxText(&buf, "Contact", m.Email)
+	}
+	docxText(&buf, "Title", m.Document.Title)
+	docxText(&buf, "Byline", "by "+author)
+
+	var previous *Entry
+	for i := range m.Entries {
+		entry := &m.Entries[i]
+		isScene := entry.Section.Kind == "scene"
+
+		switch {
+		case isScene && previous != nil && (previous.Section.Kind == "scene" || len(previous.Blocks) > 0):
+			docxText(&buf, "SceneBreak", "#")
+		case isScene && previous != nil:
+			// The first scene of a chapter runs straight on from its heading.
+		default:
+			style := "Heading2"
+			if entry.Section.Kind == "part" {
+				style = "Heading1"
+			}
+			docxText(&buf, style, entry.Section.Title)
+		}
+
+		if opts.IncludeSummaries && entry.Section.Summary != "" {
+			docxParagraph(&buf, "Body", []richtext.Run{{Text: "Summary: " + entry.Section.Summary, Italic: true}})
+		}
+
+		for _, block := range entry.Blocks {
+			switch {
+			case richtext.IsSceneBreak(block):
+				docxText(&buf, "SceneBreak", "#")
+			case isHeading(block.Tag):
+				docxText(&buf, "Heading3", block.Text)
+			default:
+				docxParagraph(&buf, "Body", block.Runs)
+			}
+		}
+
+		if opts.IncludeNotes {
+			for _, note := range entry.Notes {
+				docxParagraph(&buf, "Body", []richtext.Run{{Text: "[Note: " + note.Content + "]", Italic: true}})
+			}
+		}
+		previous = entry
+	}
+
+	docxText(&buf, "SceneBreak", "END")
+
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document ` + wordNamespaces + `>
+<w:body>
+` + buf.String() + `<w:sectPr><w:headerReference w:type="default" r:id="rId3"/><w:headerReference w:type="first" r:id="rId4"/><w:pgSz w:w="12240" w:h="15840"/><w:pgMar w:top="1440" w:right="1440" w:bottom="1440" w:left="1440" w:header="720" w:footer="720" w:gutter="0"/><w:titlePg/></w:sectPr>
+</w:body>
+</w:document>
+`
+}
+
+func docxCore(m *Manuscript, modified time.Time) string {
+	stamp := modified.UTC().Format("2006-01-02T15:04:05Z")
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+<dc:title>` + xmlEscape(m.Document.Title) + `</dc:title>
+<dc:creator>` + xmlEscape(m.Author) + `</dc:creator>
+<dc:description>` + xmlEscape(m.Document.Description) + `</dc:description>
+<dcterms:created xsi:type="dcterms:W3CDTF">` + stamp + `</dcterms:created>
+<dcterms:modified xsi:type="dcterms:W3CDTF">` + stamp + `</dcterms:modified>
+</cp:coreProperties>
+`
+}
+
+func docxApp(m *Manuscript) string {
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/extended-properties">
+<Application>Scribo</Application>
+<Words>` + fmt.Sprint(m.WordCount()) + `</Words>
+</Properties>
+`
+}
+
+// renderDOCX writes a Standard Manuscript Format .docx. Options.Font picks
+// "times" for Times New Roman; anything else gets Courier New.
+func renderDOCX(m *Manuscript, opts Options) ([]byte, error) {
+	font := docxFontCourier
+	if opts.Font == "times" {
+		font = docxFontTimes
+	}
+	modified := m.Document.UpdatedAt
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+
+	parts := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", docxContentTypes},
+		{"_rels/.rels", docxRootRels},
+		{"docProps/core.xml", docxCore(m, modified)},
+		{"docProps/app.xml", docxApp(m)},
+		{"word/_rels/document.xml.rels", docxDocumentRels},
+		{"word/document.xml", docxBody(m, opts)},
+		{"word/styles.xml", docxStyles(font)},
+		{"word/settings.xml", docxSettings},
+		{"word/header1.xml", docxHeader(m)},
+		{"word/header2.xml", docxFirstHeader},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, part := range parts {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: part.name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,314 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+func init() {
+	register(Format{
+		Name:        "epub",
+		Extension:   ".epub",
+		ContentType: "application/epub+zip",
+		Render:      renderEPUB,
+	})
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const epubStyle = `body { font-family: serif; line-height: 1.5; margin: 0 5%; }
+h1, h2, h3, h4, h5, h6 { text-align: center; page-break-after: avoid; }
+p { margin: 0; text-indent: 1.5em; }
+h1 + p, h2 + p, h3 + p, hr + p { text-indent: 0; }
+hr { border: none; margin: 1.5em 0; text-align: center; }
+hr::after { content: "* * *"; }
+.title-page { text-align: center; margin-top: 30%; }
+.title-page p { text-indent: 0; }
+.summary, .notes { font-style: italic; }
+`
+
+type epubItem struct {
+	id         string
+	href       string
+	mediaType  string
+	properties string
+	entry      *Entry
+}
+
+func xhtmlPage(title string, body string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="en" lang="en">
+<head>
+<meta charset="UTF-8"/>
+<title>` + html.EscapeString(title) + `</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+` + body + `</body>
+</html>
+`
+}
+
+// epubCover draws a plain typographic cover as SVG, so every book gets cover
+// metadata without needing an uploaded image.
+func epubCover(m *Manuscript) string {
+	var lines strings.Builder
+	words := strings.Fields(m.Document.Title)
+	line := ""
+	y := 500
+	for _, word := range words {
+		if line != "" && len([]rune(line+" "+word)) > 18 {
+			fmt.Fprintf(&lines, "<text x=\"800\" y=\"%d\" font-size=\"120\" text-anchor=\"middle\">%s</text>\n", y, html.EscapeString(line))
+			line = ""
+			y += 150
+		}
+		line = strings.TrimSpace(line + " " + word)
+	}
+	if line != "" {
+		fmt.Fprintf(&lines, "<text x=\"800\" y=\"%d\" font-size=\"120\" text-anchor=\"middle\">%s</text>\n", y, html.EscapeString(line))
+	}
+	if m.Author != "" {
+		fmt.Fprintf(&lines, "<text x=\"800\" y=\"2000\" font-size=\"80\" text-anchor=\"middle\">%s</text>\n", html.EscapeString(m.Author))
+	}
+
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="1600" height="2400" viewBox="0 0 1600 2400">
+<rect width="1600" height="2400" fill="#f4efe6"/>
+<rect x="80" y="80" width="1440" height="2240" fill="none" stroke="#3b3b3b" stroke-width="6"/>
+<g font-family="serif" fill="#1f1f1f">
+` + lines.String() + `</g>
+</svg>
+`
+}
+
+func epubTitlePage(m *Manuscript) string {
+	var body strings.Builder
+	body.WriteString("<section class=\"title-page\" epub:type=\"titlepage\">\n")
+	fmt.Fprintf(&body, "<h1>%s</h1>\n", html.EscapeString(m.Document.Title))
+	if m.Author != "" {
+		fmt.Fprintf(&body, "<p class=\"author\">%s</p>\n", html.EscapeString(m.Author))
+	}
+	if m.Document.Description != "" {
+		fmt.Fprintf(&body, "<p class=\"description\">%s</p>\n", html.EscapeString(m.Document.Description))
+	}
+	body.WriteString("</section>\n")
+	return xhtmlPage(m.Document.Title, body.String())
+}
+
+func epubChapter(entry Entry, opts Options) string {
+	var body bytes.Buffer
+	level := headingLevel(entry.Depth) - 1
+	epubType := "chapter"
+	if entry.Section.Kind == "part" {
+		epubType = "part"
+	}
+
+	fmt.Fprintf(&body, "<section epub:type=\"%s\">\n<h%d>%s</h%d>\n", epubType, level, html.EscapeString(entry.Section.Title), level)
+	if opts.IncludeSummaries && entry.Section.Summary != "" {
+		fmt.Fprintf(&body, "<p class=\"summary\">%s</p>\n", html.EscapeString(entry.Section.Summary))
+	}
+	writeHTMLBlocks(&body, entry.Blocks, entry.Depth)
+	if opts.IncludeNotes && len(entry.Notes) > 0 {
+		body.WriteString("<aside class=\"notes\">\n<ul>\n")
+		for _, note := range entry.Notes {
+			fmt.Fprintf(&body, "<li>%s</li>\n", strings.ReplaceAll(html.EscapeString(note.Content), "\n", "<br/>\n"))
+		}
+		body.WriteString("</ul>\n</aside>\n")
+	}
+	body.WriteString("</section>\n")
+	return xhtmlPage(entry.Section.Title, body.String())
+}
+
+func epubNav(m *Manuscript, items []epubItem) string {
+	var body bytes.Buffer
+	body.WriteString("<nav epub:type=\"toc\" id=\"toc\">\n<h1>Contents</h1>\n")
+	hrefs := map[string]string{}
+	for _, item := range items {
+		if item.entry != nil {
+			hrefs[item.entry.Section.ID] = item.href
+		}
+	}
+	if len(m.Entries) > 0 {
+		writeTOC(&body, m.Entries, func(entry Entry) string { return hrefs[entry.Section.ID] })
+	} else {
+		body.WriteString("<ol>\n<li><a href=\"title.xhtml\">" + html.EscapeString(m.Document.Title) + "</a></li>\n</ol>\n")
+	}
+	body.WriteString("</nav>\n")
+	body.WriteString("<nav epub:type=\"landmarks\" hidden=\"hidden\">\n<ol>\n")
+	body.WriteString("<li><a epub:type=\"titlepage\" href=\"title.xhtml\">Title Page</a></li>\n")
+	if len(m.Entries) > 0 {
+		fmt.Fprintf(&body, "<li><a epub:type=\"bodymatter\" href=\"%s\">Start</a></li>\n", hrefs[m.Entries[0].Section.ID])
+	}
+	body.WriteString("</ol>\n</nav>\n")
+	return xhtmlPage("Contents", body.String())
+}
+
+// epubNCX is the EPUB 2 table of contents. EPUB 3 readers use the nav
+// document, but older Kindle and Kobo firmware still look for toc.ncx.
+func epubNCX(m *Manuscript, identifier string, items []epubItem) string {
+	var points strings.Builder
+	open := 0
+	order := 0
+	for _, item := range items {
+		if item.entry == nil {
+			continue
+		}
+		for open > item.entry.Depth {
+			points.WriteString("</navPoint>\n")
+			open--
+		}
+		order++
+		fmt.Fprintf(&points, "<navPoint id=\"nav-%d\" playOrder=\"%d\">\n<navLabel><text>%s</text></navLabel>\n<content src=\"%s\"/>\n", order, order, html.EscapeString(item.entry.Section.Title), item.href)
+		open++
+	}
+	for ; open > 0; open-- {
+		points.WriteString("</navPoint>\n")
+	}
+	if order == 0 {
+		fmt.Fprintf(&points, "<navPoint id=\"nav-1\" playOrder=\"1\">\n<navLabel><text>%s</text></navLabel>\n<content src=\"title.xhtml\"/>\n</navPoint>\n", html.EscapeString(m.Document.Title))
+	}
+
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+<head>
+<meta name="dtb:uid" content="` + identifier + `"/>
+</head>
+<docTitle><text>` + html.EscapeString(m.Document.Title) + `</text></docTitle>
+<navMap>
+` + points.String() + `</navMap>
+</ncx>
+`
+}
+
+func epubPackage(m *Manuscript, identifier string, modified time.Time, items []epubItem) string {
+	var metadata, manifest, spine strings.Builder
+
+	fmt.Fprintf(&metadata, "<dc:identifier id=\"bookid\">%s</dc:identifier>\n", identifier)
+	fmt.Fprintf(&metadata, "<dc:title>%s</dc:title>\n", html.EscapeString(m.Document.Title))
+	metadata.WriteString("<dc:language>en</dc:language>\n")
+	if m.Author != "" {
+		fmt.Fprintf(&metadata, "<dc:creator id=\"author\">%s</dc:creator>\n", html.EscapeString(m.Author))
+		metadata.WriteString("<meta refines=\"#author\" property=\"role\" scheme=\"marc:relators\">aut</meta>\n")
+	}
+	if m.Document.Description != "" {
+		fmt.Fprintf(&metadata, "<dc:description>%s</dc:description>\n", html.EscapeString(m.Document.Description))
+	}
+	fmt.Fprintf(&metadata, "<meta property=\"dcterms:modified\">%s</meta>\n", modified.UTC().Format("2006-01-02T15:04:05Z"))
+	metadata.WriteString("<meta name=\"cover\" content=\"cover-image\"/>\n")
+
+	for _, item := range items {
+		properties := ""
+		if item.properties != "" {
+			properties = fmt.Sprintf(" properties=\"%s\"", item.properties)
+		}
+		fmt.Fprintf(&manifest, "<item id=\"%s\" href=\"%s\" media-type=\"%s\"%s/>\n", item.id, item.href, item.mediaType, properties)
+		if item.mediaType == "application/xhtml+xml" {
+			linear := ""
+			if item.id == "nav" {
+				linear = " linear=\"no\""
+			}
+			fmt.Fprintf(&spine, "<itemref idref=\"%s\"%s/>\n", item.id, linear)
+		}
+	}
+
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid" xml:lang="en">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+` + metadata.String() + `</metadata>
+<manifest>
+` + manifest.String() + `</manifest>
+<spine toc="ncx">
+` + spine.String() + `</spine>
+</package>
+`
+}
+
+// renderEPUB builds an EPUB 3 container: the uncompressed mimetype entry
+// first, the container pointing at the OPF package, then the package
+// document, nav, NCX, stylesheet, cover and one XHTML file per section.
+func renderEPUB(m *Manuscript, opts Options) ([]byte, error) {
+	identifier := "urn:uuid:" + m.Document.ID
+	modified := m.Document.UpdatedAt
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+
+	items := []epubItem{
+		{id: "cover-image", href: "cover.svg", mediaType: "image/svg+xml", properties: "cover-image"},
+		{id: "css", href: "style.css", mediaType: "text/css"},
+		{id: "ncx", href: "toc.ncx", mediaType: "application/x-dtbncx+xml"},
+		{id: "title", href: "title.xhtml", mediaType: "application/xhtml+xml"},
+		{id: "nav", href: "nav.xhtml", mediaType: "application/xhtml+xml", properties: "nav"},
+	}
+	for i := range m.Entries {
+		items = append(items, epubItem{
+			id:        fmt.Sprintf("section-%03d", i+1),
+			href:      fmt.Sprintf("section-%03d.xhtml", i+1),
+			mediaType: "application/xhtml+xml",
+			entry:     &m.Entries[i],
+		})
+	}
+
+	files := map[string]string{
+		"cover.svg":   epubCover(m),
+		"style.css":   epubStyle,
+		"toc.ncx":     epubNCX(m, identifier, items),
+		"title.xhtml": epubTitlePage(m),
+		"nav.xhtml":   epubNav(m, items),
+	}
+	for _, item := range items {
+		if item.entry != nil {
+			files[item.href] = epubChapter(*item.entry, opts)
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	// The mimetype entry must come first and be stored without compression or
+	// extra fields, which a modification time would add
+	mimetype, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := mimetype.Write([]byte("application/epub+zip")); err != nil {
+		return nil, err
+	}
+
+	write := func(name string, content string) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write([]byte(content))
+		return err
+	}
+
+	if err := write("META-INF/container.xml", epubContainer); err != nil {
+		return nil, err
+	}
+	if err := write("OEBPS/content.opf", epubPackage(m, identifier, modified, items)); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if err := write("OEBPS/"+item.href, files[item.href]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,182 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+func testManuscript() *Manuscript {
+	part := "part-1"
+	chapter := "chapter-1"
+	document := &store.Document{
+		ID:          "0b0e3f6c-6a55-4b7e-9d2a-6f1f3c2a9e10",
+		Title:       "Salt & Smoke: A <Novel>",
+		Description: `A "story" of the sea`,
+		UpdatedAt:   time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+	sections := []*store.Section{
+		{ID: part, Kind: store.SectionKindPart, Title: "Part One", Position: 0},
+		{ID: chapter, ParentID: &part, Kind: store.SectionKindChapter, Title: "The Harbour", Position: 0,
+			Summary: "Ships & storms", Content: "<p>The <em>tide</em> came in &amp; went out.</p><p>Then&nbsp;silence.</p>"},
+		{ID: "scene-1", ParentID: &chapter, Kind: store.SectionKindScene, Title: "Night <Watch>", Position: 0,
+			Content: "<p>Lamps<br>swung.</p><hr><p>Dawn.</p>"},
+		{ID: "chapter-2", Kind: store.SectionKindChapter, Title: "Epilogue", Position: 1, Content: "<p>Fin.</p>"},
+	}
+	notes := []*store.Note{{SectionID: chapter, Content: "Check the <tide> tables\nagain"}}
+	return NewManuscript(document, "Ada O'Brien", sections, notes)
+}
+
+// TestEPUBStructure checks the container the way epubcheck's packaging and
+// OPF checks do.
+func TestEPUBStructure(t *testing.T) {
+	data, err := renderEPUB(testManuscript(), Options{IncludeSummaries: true, IncludeNotes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The mimetype entry comes first, stored, with no extra field, so its
+	// content sits at a fixed offset readers sniff
+	const mimetype = "application/epub+zip"
+	if !bytes.HasPrefix(data, []byte("PK\x03\x04")) || string(data[30:38]) != "mimetype" || string(data[38:38+len(mimetype)]) != mimetype {
+		t.Errorf("the archive does not start with the mimetype entry at its fixed offset")
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := archive.File[0]
+	if first.Name != "mimetype" || first.Method != zip.Store || len(first.Extra) != 0 {
+		t.Errorf("first entry is %q with method %d and %d bytes of extra fields, want mimetype stored without any", first.Name, first.Method, len(first.Extra))
+	}
+	if got := readEntry(t, first); got != mimetype {
+		t.Errorf("mimetype is %q, want %q", got, mimetype)
+	}
+
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	open := func(name string) string {
+		t.Helper()
+		f, ok := files[name]
+		if !ok {
+			t.Fatalf("%s is missing", name)
+		}
+		return readEntry(t, f)
+	}
+
+	var container struct {
+		Rootfiles []struct {
+			FullPath  string `xml:"full-path,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal([]byte(open("META-INF/container.xml")), &container); err != nil {
+		t.Fatalf("container.xml: %v", err)
+	}
+	if len(container.Rootfiles) != 1 || container.Rootfiles[0].MediaType != "application/oebps-package+xml" {
+		t.Fatalf("container.xml rootfiles are %+v, want one OPF package", container.Rootfiles)
+	}
+	opfPath := container.Rootfiles[0].FullPath
+
+	var opf struct {
+		UniqueIdentifier string `xml:"unique-identifier,attr"`
+		Identifiers      []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"metadata>identifier"`
+		Items []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			MediaType  string `xml:"media-type,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"manifest>item"`
+		Spine struct {
+			Toc      string `xml:"toc,attr"`
+			Itemrefs []struct {
+				IDRef string `xml:"idref,attr"`
+			} `xml:"itemref"`
+		} `xml:"spine"`
+	}
+	if err := xml.Unmarshal([]byte(open(opfPath)), &opf); err != nil {
+		t.Fatalf("%s: %v", opfPath, err)
+	}
+	if len(opf.Identifiers) == 0 || opf.Identifiers[0].ID != opf.UniqueIdentifier {
+		t.Errorf("unique-identifier %q does not name a dc:identifier", opf.UniqueIdentifier)
+	}
+
+	base := path.Dir(opfPath)
+	manifest := map[string]string{}
+	navHref := ""
+	for _, item := range opf.Items {
+		if _, ok := manifest[item.ID]; ok {
+			t.Errorf("manifest id %q is used twice", item.ID)
+		}
+		manifest[item.ID] = item.Href
+		if _, ok := files[path.Join(base, item.Href)]; !ok {
+			t.Errorf("manifest item %q points at %s, which is not in the archive", item.ID, item.Href)
+		}
+		if strings.Contains(" "+item.Properties+" ", " nav ") {
+			navHref = item.Href
+		}
+	}
+	if len(opf.Spine.Itemrefs) != len(testManuscript().Entries)+2 {
+		t.Errorf("spine has %d items, want the title page, nav and %d sections", len(opf.Spine.Itemrefs), len(testManuscript().Entries))
+	}
+	if _, ok := manifest[opf.Spine.Toc]; !ok {
+		t.Errorf("spine toc %q is not in the manifest", opf.Spine.Toc)
+	}
+	for _, itemref := range opf.Spine.Itemrefs {
+		if _, ok := manifest[itemref.IDRef]; !ok {
+			t.Errorf("spine itemref %q is not in the manifest", itemref.IDRef)
+		}
+	}
+
+	if navHref == "" {
+		t.Fatal("no manifest item has the nav property")
+	}
+	if !strings.Contains(open(path.Join(base, navHref)), `epub:type="toc"`) {
+		t.Errorf("the nav document has no epub:type=\"toc\" nav")
+	}
+
+	for name, f := range files {
+		switch path.Ext(name) {
+		case ".xhtml", ".opf", ".ncx", ".xml", ".svg":
+		default:
+			continue
+		}
+		decoder := xml.NewDecoder(strings.NewReader(readEntry(t, f)))
+		for {
+			_, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("%s is not well-formed XML: %v", name, err)
+				break
+			}
+		}
+	}
+}
+
+func readEntry(t *testing.T, f *zip.File) string {
+	t.Helper()
+	r, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,135 @@
+// Package export renders a document and its sections into downloadable
+// manuscript files. Each output format registers itself in formats, and the
+// export handler looks formats up by name.
+package export
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/richtext"
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+type Options struct {
+	IncludeSummaries bool
+	IncludeNotes     bool
+	// Font selects the manuscript typeface for formats that set one.
+	Font string
+}
+
+// Entry is one section in manuscript order. Depth is 0 for top-level
+// sections, 1 for their children and so on.
+type Entry struct {
+	Section *store.Section
+	Depth   int
+	Blocks  []richtext.Block
+	Notes   []*store.Note
+}
+
+type Manuscript struct {
+	Document *store.Document
+	Author   string
+	Email    string
+	Entries  []Entry
+}
+
+type Format struct {
+	Name        string
+	Extension   string
+	ContentType string
+	Render      func(*Manuscript, Options) ([]byte, error)
+}
+
+var formats = map[string]Format{}
+
+func register(format Format) {
+	formats[format.Name] = format
+}
+
+// Lookup returns the format registered under name.
+func Lookup(name string) (Format, bool) {
+	format, ok := formats[name]
+	return format, ok
+}
+
+// Names lists the registered format names in alphabetical order.
+func Names() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewManuscript orders the sections of a document, works out how deeply each
+// one is nested, and attaches notes to the section they belong to.
+func NewManuscript(document *store.Document, author string, sections []*store.Section, notes []*store.Note) *Manuscript {
+	notesBySection := map[string][]*store.Note{}
+	for _, note := range notes {
+		notesBySection[note.SectionID] = append(notesBySection[note.SectionID], note)
+	}
+
+	byID := map[string]*store.Section{}
+	for _, section := range sections {
+		byID[section.ID] = section
+	}
+
+	manuscript := &Manuscript{Document: document, Author: author}
+	for _, section := range store.OrderSections(sections) {
+		depth := 0
+		for p := section.ParentID; p != nil && byID[*p] != nil; p = byID[*p].ParentID {
+			depth++
+		}
+		manuscript.Entries = append(manuscript.Entries, Entry{
+			Section: section,
+			Depth:   depth,
+			Blocks:  richtext.Parse(section.Content),
+			Notes:   notesBySection[section.ID],
+		})
+	}
+	return manuscript
+}
+
+// WordCount totals the words across every section as a reader would count
+// them.
+func (m *Manuscript) WordCount() int {
+	count := 0
+	for _, entry := range m.Entries {
+		for _, block := range entry.Blocks {
+			count += len(strings.Fields(block.Text))
+		}
+	}
+	return count
+}
+
+var unsafeFilename = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// Filename turns a document title into a download filename with the format's
+// extension.
+func Filename(document *store.Document, format Format) string {
+	base := strings.Trim(unsafeFilename.ReplaceAllString(strings.ToLower(document.Title), "-"), "-")
+	if base == "" {
+		base = "manuscript"
+	}
+	return base + format.Extension
+}
+
+// headingLevel maps a section depth to an HTML/Markdown heading level. The
+// document title takes level 1, so top-level sections start at 2.
+func headingLevel(depth int) int {
+	return min(depth+2, 6)
+}
+
+// shiftHeading pushes a heading inside section content below the section's
+// own heading level.
+func shiftHeading(tag string, depth int) int {
+	level := int(tag[1] - '0')
+	return min(level+headingLevel(depth), 6)
+}
+
+func isHeading(tag string) bool {
+	return len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6'
+}
@@ -0,0 +1,164 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+func init() {
+	register(Format{
+		Name:        "html",
+		Extension:   ".html",
+		ContentType: "text/html; charset=utf-8",
+		Render:      renderHTML,
+	})
+}
+
+const htmlStyle = `body { max-width: 42em; margin: 2em auto; padding: 0 1em; font-family: Georgia, serif; line-height: 1.6; }
+nav ol { list-style: none; padding-left: 1.2em; }
+.description, .summary { font-style: italic; color: #555; }
+.notes { border-left: 3px solid #ccc; padding-left: 1em; color: #555; }
+hr { border: none; text-align: center; }
+hr::after { content: "* * *"; }`
+
+// htmlRuns renders runs as escaped inline HTML. Line breaks become <br/>.
+// Void elements are self-closed throughout so the same markup is valid XHTML
+// for EPUB chapters.
+func htmlRuns(runs []richtext.Run) string {
+	var b strings.Builder
+	for _, run := range runs {
+		text := strings.ReplaceAll(html.EscapeString(run.Text), "\n", "<br/>\n")
+		if run.Italic {
+			text = "<em>" + text + "</em>"
+		}
+		if run.Bold {
+			text = "<strong>" + text + "</strong>"
+		}
+		b.WriteString(text)
+	}
+	return b.String()
+}
+
+// writeHTMLBlocks renders parsed blocks rather than copying the stored HTML,
+// so the export only ever contains markup we generated ourselves.
+func writeHTMLBlocks(buf *bytes.Buffer, blocks []richtext.Block, depth int) {
+	inList := false
+	for _, block := range blocks {
+		if block.Tag == "li" && !inList {
+			buf.WriteString("<ul>\n")
+			inList = true
+		} else if block.Tag != "li" && inList {
+			buf.WriteString("</ul>\n")
+			inList = false
+		}
+
+		switch {
+		case block.Tag == "hr":
+			buf.WriteString("<hr/>\n")
+		case isHeading(block.Tag):
+			level := shiftHeading(block.Tag, depth)
+			fmt.Fprintf(buf, "<h%d>%s</h%d>\n", level, html.EscapeString(block.Text), level)
+		case block.Tag == "li":
+			buf.WriteString("<li>" + htmlRuns(block.Runs) + "</li>\n")
+		case block.Tag == "blockquote":
+			buf.WriteString("<blockquote><p>" + htmlRuns(block.Runs) + "</p></blockquote>\n")
+		case block.Tag == "pre":
+			buf.WriteString("<pre>" + html.EscapeString(block.Text) + "</pre>\n")
+		default:
+			buf.WriteString("<p>" + htmlRuns(block.Runs) + "</p>\n")
+		}
+	}
+	if inList {
+		buf.WriteString("</ul>\n")
+	}
+}
+
+func sectionAnchor(entry Entry) string {
+	return "section-" + entry.Section.ID
+}
+
+// writeTOC renders the table of contents as nested ordered lists following
+// section depth, with each sub-list inside its parent's <li>.
+func writeTOC(buf *bytes.Buffer, entries []Entry, href func(Entry) string) {
+	depth := -1
+	for _, entry := range entries {
+		if entry.Depth > depth {
+			for depth < entry.Depth {
+				buf.WriteString("<ol>\n")
+				depth++
+				if depth < entry.Depth {
+					buf.WriteString("<li>\n")
+				}
+			}
+		} else {
+			buf.WriteString("</li>\n")
+			for depth > entry.Depth {
+				buf.WriteString("</ol>\n</li>\n")
+				depth--
+			}
+		}
+		fmt.Fprintf(buf, "<li><a href=\"%s\">%s</a>\n", href(entry), html.EscapeString(entry.Section.Title))
+	}
+	if depth >= 0 {
+		buf.WriteString("</li>\n")
+		for ; depth > 0; depth-- {
+			buf.WriteString("</ol>\n</li>\n")
+		}
+		buf.WriteString("</ol>\n")
+	}
+}
+
+func renderHTML(m *Manuscript, opts Options) ([]byte, error) {
+	var buf bytes.Buffer
+	title := html.EscapeString(m.Document.Title)
+
+	buf.WriteString("<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&buf, "<title>%s</title>\n", title)
+	if m.Author != "" {
+		fmt.Fprintf(&buf, "<meta name=\"author\" content=\"%s\">\n", html.EscapeString(m.Author))
+	}
+	fmt.Fprintf(&buf, "<style>\n%s\n</style>\n</head>\n<body>\n", htmlStyle)
+
+	fmt.Fprintf(&buf, "<header>\n<h1>%s</h1>\n", title)
+	if m.Author != "" {
+		fmt.Fprintf(&buf, "<p class=\"author\">by %s</p>\n", html.EscapeString(m.Author))
+	}
+	if m.Document.Description != "" {
+		fmt.Fprintf(&buf, "<p class=\"description\">%s</p>\n", html.EscapeString(m.Document.Description))
+	}
+	buf.WriteString("</header>\n")
+
+	if len(m.Entries) > 0 {
+		buf.WriteString("<nav id=\"toc\">\n<h2>Contents</h2>\n")
+		writeTOC(&buf, m.Entries, func(entry Entry) string { return "#" + sectionAnchor(entry) })
+		buf.WriteString("</nav>\n")
+	}
+
+	for _, entry := range m.Entries {
+		level := headingLevel(entry.Depth)
+		fmt.Fprintf(&buf, "<section id=\"%s\">\n<h%d>%s</h%d>\n", sectionAnchor(entry), level, html.EscapeString(entry.Section.Title), level)
+
+		if opts.IncludeSummaries && entry.Section.Summary != "" {
+			fmt.Fprintf(&buf, "<p class=\"summary\">%s</p>\n", html.EscapeString(entry.Section.Summary))
+		}
+
+		writeHTMLBlocks(&buf, entry.Blocks, entry.Depth)
+
+		if opts.IncludeNotes && len(entry.Notes) > 0 {
+			buf.WriteString("<aside class=\"notes\">\n<h4>Notes</h4>\n<ul>\n")
+			for _, note := range entry.Notes {
+				fmt.Fprintf(&buf, "<li>%s</li>\n", strings.ReplaceAll(html.EscapeString(note.Content), "\n", "<br/>\n"))
+			}
+			buf.WriteString("</ul>\n</aside>\n")
+		}
+
+		buf.WriteString("</section>\n")
+	}
+
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,112 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+func init() {
+	register(Format{
+		Name:        "markdown",
+		Extension:   ".md",
+		ContentType: "text/markdown; charset=utf-8",
+		Render:      renderMarkdown,
+	})
+}
+
+var (
+	markdownSpecial   = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`)
+	markdownLineStart = regexp.MustCompile(`^(#|>|[-+] |\d+\. )`)
+)
+
+func escapeMarkdown(text string) string {
+	text = markdownSpecial.Replace(text)
+	if markdownLineStart.MatchString(text) {
+		text = `\` + text
+	}
+	return text
+}
+
+// markdownRuns renders emphasis, keeping surrounding whitespace outside the
+// markers since "** bold**" is not valid emphasis.
+func markdownRuns(runs []richtext.Run) string {
+	var b strings.Builder
+	for _, run := range runs {
+		marker := ""
+		switch {
+		case run.Bold && run.Italic:
+			marker = "***"
+		case run.Bold:
+			marker = "**"
+		case run.Italic:
+			marker = "*"
+		}
+
+		text := escapeMarkdown(run.Text)
+		trimmed := strings.TrimSpace(text)
+		if marker == "" || trimmed == "" {
+			b.WriteString(text)
+			continue
+		}
+		lead := text[:strings.Index(text, trimmed)]
+		trail := text[len(lead)+len(trimmed):]
+		b.WriteString(lead + marker + trimmed + marker + trail)
+	}
+	// A hard line break in Markdown is two trailing spaces
+	return strings.ReplaceAll(b.String(), "\n", "  \n")
+}
+
+func writeMarkdownBlocks(buf *bytes.Buffer, blocks []richtext.Block, depth int) {
+	for _, block := range blocks {
+		switch {
+		case block.Tag == "hr":
+			buf.WriteString("* * *\n\n")
+		case isHeading(block.Tag):
+			fmt.Fprintf(buf, "%s %s\n\n", strings.Repeat("#", shiftHeading(block.Tag, depth)), escapeMarkdown(block.Text))
+		case block.Tag == "li":
+			buf.WriteString("- " + markdownRuns(block.Runs) + "\n\n")
+		case block.Tag == "blockquote":
+			buf.WriteString("> " + strings.ReplaceAll(markdownRuns(block.Runs), "\n", "\n> ") + "\n\n")
+		case block.Tag == "pre":
+			buf.WriteString("```\n" + block.Text + "\n```\n\n")
+		default:
+			buf.WriteString(markdownRuns(block.Runs) + "\n\n")
+		}
+	}
+}
+
+func renderMarkdown(m *Manuscript, opts Options) ([]byte, error) {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "# %s\n\n", escapeMarkdown(m.Document.Title))
+	if m.Author != "" {
+		fmt.Fprintf(&buf, "*by %s*\n\n", escapeMarkdown(m.Author))
+	}
+	if m.Document.Description != "" {
+		buf.WriteString(escapeMarkdown(m.Document.Description) + "\n\n")
+	}
+
+	for _, entry := range m.Entries {
+		fmt.Fprintf(&buf, "%s %s\n\n", strings.Repeat("#", headingLevel(entry.Depth)), escapeMarkdown(entry.Section.Title))
+
+		if opts.IncludeSummaries && entry.Section.Summary != "" {
+			buf.WriteString("> **Summary:** " + escapeMarkdown(entry.Section.Summary) + "\n\n")
+		}
+
+		writeMarkdownBlocks(&buf, entry.Blocks, entry.Depth)
+
+		if opts.IncludeNotes && len(entry.Notes) > 0 {
+			buf.WriteString("**Notes**\n\n")
+			for _, note := range entry.Notes {
+				buf.WriteString("- " + strings.ReplaceAll(escapeMarkdown(note.Content), "\n", "\n  ") + "\n")
+			}
+			buf.WriteString("\n")
+		}
+	}
+
+	return append(bytes.TrimRight(buf.Bytes(), "\n"), '\n'), nil
+}
@@ -0,0 +1,61 @@
+package export
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+func init() {
+	register(Format{
+		Name:        "text",
+		Extension:   ".txt",
+		ContentType: "text/plain; charset=utf-8",
+		Render:      renderText,
+	})
+}
+
+// underline gives setext-style headings: "=" for the title and top-level
+// sections, "-" below that.
+func underline(title string, char string) string {
+	return title + "\n" + strings.Repeat(char, max(len([]rune(title)), 3)) + "\n\n"
+}
+
+func renderText(m *Manuscript, opts Options) ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteString(underline(strings.ToUpper(m.Document.Title), "="))
+	if m.Author != "" {
+		buf.WriteString("by " + m.Author + "\n\n")
+	}
+	if m.Document.Description != "" {
+		buf.WriteString(m.Document.Description + "\n\n")
+	}
+
+	for _, entry := range m.Entries {
+		char := "-"
+		if entry.Depth == 0 {
+			char = "="
+		}
+		buf.WriteString("\n" + underline(entry.Section.Title, char))
+
+		if opts.IncludeSummaries && entry.Section.Summary != "" {
+			buf.WriteString("Summary: " + entry.Section.Summary + "\n\n")
+		}
+
+		if text := richtext.BlocksText(entry.Blocks); text != "" {
+			buf.WriteString(text + "\n\n")
+		}
+
+		if opts.IncludeNotes && len(entry.Notes) > 0 {
+			buf.WriteString("Notes:\n")
+			for _, note := range entry.Notes {
+				buf.WriteString("  - " + strings.ReplaceAll(note.Content, "\n", "\n    ") + "\n")
+			}
+			buf.WriteString("\n")
+		}
+	}
+
+	return append(bytes.TrimRight(buf.Bytes(), "\n"), '\n'), nil
+}
@@ -0,0 +1,34 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const DevProviderName = "dev"
+
+var devUsernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// DevProvider logs in as whichever local user is named, with no password
+// and no network. It lets the stack run without Google credentials, for
+// development and tests only, and must never be enabled in production.
+type DevProvider struct{}
+
+func (DevProvider) Name() string {
+	return DevProviderName
+}
+
+func (DevProvider) Authenticate(ctx context.Context, credentials Credentials) (*Identity, error) {
+	username := strings.ToLower(strings.TrimSpace(credentials.Username))
+	if !devUsernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("%w: username must be letters, digits, '.', '_' or '-'", ErrInvalidCredentials)
+	}
+	return &Identity{
+		Provider: DevProviderName,
+		Subject:  username,
+		Email:    username + "@localhost",
+		Name:     username,
+	}, nil
+}
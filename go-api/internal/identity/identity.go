@@ -0,0 +1,39 @@
+// Package identity signs users in through pluggable identity providers:
+// Google, any OpenID Connect issuer, and a development provider that needs
+// no external service.
+package identity
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrInvalidCredentials means the provider did not accept what the client
+// sent, as opposed to the provider being unreachable.
+var ErrInvalidCredentials = errors.New("invalid login credentials")
+
+// Identity is who a provider says the user is. Provider and Subject together
+// identify the account; the rest is profile data.
+type Identity struct {
+	Provider string
+	Subject  string
+	Email    string
+	Name     string
+	Picture  string
+}
+
+// Credentials is what the client sends to log in. Which fields a provider
+// reads depends on the provider.
+type Credentials struct {
+	// Code is an OAuth authorization code.
+	Code string
+	// Username names the local user to log in as, for the dev provider.
+	Username string
+}
+
+type Provider interface {
+	// Name is how clients choose the provider, and keys the identities it
+	// returns.
+	Name() string
+	Authenticate(context.Context, Credentials) (*Identity, error)
+}
@@ -0,0 +1,203 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/oidc"
+)
+
+const (
+	GoogleProviderName = "google"
+	googleTokenURL     = "https://oauth2.googleapis.com/token"
+	exchangeTimeout    = 10 * time.Second
+)
+
+type OIDCConfig struct {
+	// Name is the provider's name, see Provider.
+	Name string
+	// Issuer is the provider's issuer URL, which discovery starts from.
+	Issuer string
+	// Issuers lists the accepted values of the iss claim when the provider
+	// uses more than one; it defaults to Issuer.
+	Issuers      []string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// TokenURL and JWKSURL are found through discovery when left empty.
+	TokenURL string
+	JWKSURL  string
+}
+
+// OIDCProvider logs in with an OpenID Connect provider's authorization code
+// flow: it exchanges the code for an ID token and verifies the token against
+// the provider's published keys.
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	tokenURL string
+	verifier *oidc.Verifier
+}
+
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	if len(config.Issuers) == 0 {
+		config.Issuers = []string{config.Issuer}
+	}
+	return &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: exchangeTimeout},
+	}
+}
+
+// NewGoogleProvider is the OIDC provider for Sign in with Google. jwksURL
+// may point at a local key set for development.
+func NewGoogleProvider(clientID, clientSecret, redirectURL, jwksURL string) *OIDCProvider {
+	return NewOIDCProvider(OIDCConfig{
+		Name:         GoogleProviderName,
+		Issuer:       oidc.GoogleIssuers[0],
+		Issuers:      oidc.GoogleIssuers,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		TokenURL:     googleTokenURL,
+		JWKSURL:      jwksURL,
+	})
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.config.Name
+}
+
+// endpoints returns the token endpoint and a verifier for the provider's
+// ID tokens, running discovery the first time if they were not configured.
+// A failed discovery is retried on the next login.
+func (p *OIDCProvider) endpoints(ctx context.Context) (string, *oidc.Verifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.verifier != nil {
+		return p.tokenURL, p.verifier, nil
+	}
+
+	tokenURL, jwksURL := p.config.TokenURL, p.config.JWKSURL
+	if tokenURL == "" || jwksURL == "" {
+		metadata, err := oidc.Discover(ctx, p.client, p.config.Issuer)
+		if err != nil {
+			return "", nil, err
+		}
+		if tokenURL == "" {
+			tokenURL = metadata.TokenEndpoint
+		}
+		if jwksURL == "" {
+			jwksURL = metadata.JWKSURI
+		}
+	}
+
+	p.tokenURL = tokenURL
+	p.verifier = oidc.NewVerifier(oidc.Config{
+		JWKSURL:  jwksURL,
+		Issuers:  p.config.Issuers,
+		Audience: p.config.ClientID,
+	})
+	return p.tokenURL, p.verifier, nil
+}
+
+func (p *OIDCProvider) Authenticate(ctx context.Context, credentials Credentials) (*Identity, error) {
+	if credentials.Code == "" {
+		return nil, fmt.Errorf("%w: no authorization code", ErrInvalidCredentials)
+	}
+
+	tokenURL, verifier, err := p.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	idToken, err := p.exchangeCode(ctx, tokenURL, credentials.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := verifier.Verify(ctx, idToken)
+	if err != nil {
+		if errors.Is(err, oidc.ErrInvalidToken) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+		}
+		return nil, err
+	}
+
+	// Invitations are matched on email, so an address the provider has not
+	// checked belongs to the user is left out
+	email := ""
+	if claims.EmailVerified {
+		email = claims.Email
+	}
+
+	return &Identity{
+		Provider: p.config.Name,
+		Subject:  claims.Subject,
+		Email:    email,
+		Name:     claims.Name,
+		Picture:  claims.Picture,
+	}, nil
+}
+
+type tokenResponse struct {
+	IDToken string `json:"id_token"`
+	Error   string `json:"error"`
+}
+
+// exchangeCode trades an authorization code for the ID token at the
+// provider's token endpoint.
+func (p *OIDCProvider) exchangeCode(ctx context.Context, tokenURL string, code string) (string, error) {
+	data := url.Values{}
+	data.Set("code", code)
+	data.Set("client_id", p.config.ClientID)
+	data.Set("client_secret", p.config.ClientSecret)
+	data.Set("redirect_uri", p.config.RedirectURL)
+	data.Set("grant_type", "authorization_code")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("exchanging authorization code: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	var token tokenResponse
+	decodeErr := json.Unmarshal(body, &token)
+	// The token endpoint answers a bad, used or expired code with a 400
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		return "", fmt.Errorf("%w: token endpoint refused the code: %s", ErrInvalidCredentials, token.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("exchanging authorization code: status %d", resp.StatusCode)
+	}
+	if decodeErr != nil {
+		return "", fmt.Errorf("decoding token response: %w", decodeErr)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("no id_token in response")
+	}
+	return token.IDToken, nil
+}
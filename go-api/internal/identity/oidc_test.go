@@ -0,0 +1,81 @@
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackwillis517/Scribo/internal/oidc"
+)
+
+func TestOIDCProviderEmailVerified(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer keys.Close()
+
+	for _, tc := range []struct {
+		name     string
+		verified bool
+		email    string
+	}{
+		{"verified", true, "ada@example.com"},
+		{"unverified", false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, &oidc.Claims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					Issuer:    "https://issuer.example.com",
+					Subject:   "user-1",
+					Audience:  jwt.ClaimStrings{"scribo-client"},
+					IssuedAt:  jwt.NewNumericDate(now),
+					ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+				},
+				Email:         "ada@example.com",
+				EmailVerified: tc.verified,
+			})
+			token.Header["kid"] = "key-1"
+			idToken, err := token.SignedString(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+			}))
+			defer tokens.Close()
+
+			provider := NewOIDCProvider(OIDCConfig{
+				Name:     "test",
+				Issuer:   "https://issuer.example.com",
+				ClientID: "scribo-client",
+				TokenURL: tokens.URL,
+				JWKSURL:  keys.URL,
+			})
+			identity, err := provider.Authenticate(context.Background(), Credentials{Code: "code"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Subject != "user-1" || identity.Email != tc.email {
+				t.Errorf("got subject %q and email %q, want user-1 and %q", identity.Subject, identity.Email, tc.email)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+// maxDOCXPart caps how much of a single zip entry is read, so a small upload
+// cannot inflate into an unbounded amount of XML.
+const maxDOCXPart = 64 << 20
+
+var headingStyleName = regexp.MustCompile(`(?i)^heading\s*([1-6])$`)
+
+// docxStyle is what the importer needs to know about a paragraph style.
+type docxStyle struct {
+	level int // heading level, 0 for body text
+}
+
+func readZipPart(archive *zip.Reader, name string) ([]byte, error) {
+	for _, f := range archive.File {
+		if f.Name != name {
+			continue
+		}
+		if f.UncompressedSize64 > maxDOCXPart {
+			return nil, fmt.Errorf("%s is too large", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, maxDOCXPart))
+	}
+	return nil, nil
+}
+
+// docxStyles maps style IDs to heading levels. Style IDs are localized
+// ("Heading1", "Titre1", ...), so levels come from the style's outline
+// level or its built-in English name rather than the ID. The Title style sits
+// above every heading.
+func docxStyles(data []byte) (map[string]docxStyle, error) {
+	var doc struct {
+		Styles []struct {
+			ID   string `xml:"styleId,attr"`
+			Name struct {
+				Val string `xml:"val,attr"`
+			} `xml:"name"`
+			OutlineLevel *struct {
+				Val int `xml:"val,attr"`
+			} `xml:"pPr>outlineLvl"`
+		} `xml:"style"`
+	}
+	styles := map[string]docxStyle{}
+	if data == nil {
+		return styles, nil
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for _, style := range doc.Styles {
+		switch m := headingStyleName.FindStringSubmatch(style.Name.Val); {
+		case strings.EqualFold(style.Name.Val, "title"):
+			styles[style.ID] = docxStyle{level: 1}
+		case m != nil:
+			level, _ := strconv.Atoi(m[1])
+			styles[style.ID] = docxStyle{level: min(level+1, 6)}
+		case style.OutlineLevel != nil && style.OutlineLevel.Val < 6:
+			styles[style.ID] = docxStyle{level: min(style.OutlineLevel.Val+2, 6)}
+		}
+	}
+	return styles, nil
+}
+
+// toggleOn reads an OOXML on/off property such as <w:i/> or <w:b w:val="0"/>.
+func toggleOn(element xml.StartElement) bool {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == "val" {
+			switch attr.Value {
+			case "0", "false", "off":
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func attrValue(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// parseDOCX reads the main document part of a Word file. Paragraph styles
+// decide headings and list items; bold and italic are kept from direct run
+// formatting. Text boxes, deleted and moved-away text are skipped.
+func parseDOCX(data []byte) ([]richtext.Block, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.New("file is not a valid .docx")
+	}
+
+	stylesXML, err := readZipPart(archive, "word/styles.xml")
+	if err != nil {
+		return nil, err
+	}
+	styles, err := docxStyles(stylesXML)
+	if err != nil {
+		return nil, fmt.Errorf("reading styles: %w", err)
+	}
+
+	documentXML, err := readZipPart(archive, "word/document.xml")
+	if err != nil {
+		return nil, err
+	}
+	if documentXML == nil {
+		return nil, errors.New("file is not a valid .docx")
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(documentXML))
+	blocks := []richtext.Block{}
+
+	var (
+		runs                 []richtext.Run
+		style                string
+		outline              = -1
+		list                 bool
+		inPPr, inRPr, inText bool
+		bold, italic         bool
+	)
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading document: %w", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "txbxContent", "moveFrom", "del", "footnoteReference", "endnoteReference":
+				if err := decoder.Skip(); err != nil {
+					return nil, err
+				}
+			case "p":
+				runs, style, outline, list = nil, "", -1, false
+			case "pPr":
+				inPPr = true
+			case "pStyle":
+				if inPPr {
+					style = attrValue(t, "val")
+				}
+			case "outlineLvl":
+				if inPPr {
+					outline, _ = strconv.Atoi(attrValue(t, "val"))
+				}
+			case "numPr":
+				if inPPr {
+					list = true
+				}
+			case "r":
+				bold, italic = false, false
+			case "rPr":
+				inRPr = !inPPr
+			case "b":
+				if inRPr {
+					bold = toggleOn(t)
+				}
+			case "i":
+				if inRPr {
+					italic = toggleOn(t)
+				}
+			case "t":
+				inText = true
+			case "tab":
+				if !inPPr {
+					runs = append(runs, richtext.Run{Text: " "})
+				}
+			case "br", "cr":
+				if attrValue(t, "type") != "page" && attrValue(t, "type") != "column" {
+					runs = append(runs, richtext.Run{Text: "\n"})
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "pPr":
+				inPPr = false
+			case "rPr":
+				inRPr = false
+			case "t":
+				inText = false
+			case "p":
+				tag := "p"
+				level := styles[style].level
+				if outline >= 0 && outline < 6 {
+					level = outline + 2
+				}
+				switch {
+				case level > 0:
+					tag = "h" + strconv.Itoa(min(level, 6))
+				case list:
+					tag = "li"
+				}
+				if block, ok := richtext.NewBlock(tag, runs); ok {
+					blocks = append(blocks, block)
+				}
+				runs = nil
+			}
+		case xml.CharData:
+			if inText {
+				runs = append(runs, richtext.Run{Text: string(t), Bold: bold, Italic: italic})
+			}
+		}
+	}
+	return blocks, nil
+}
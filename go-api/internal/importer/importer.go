@@ -0,0 +1,256 @@
+// Package importer turns an uploaded manuscript (Markdown, plain text or
+// DOCX) into a draft document split into chapter sections, ready to be
+// previewed or saved.
+package importer
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported file type, expected .md, .txt or .docx")
+	ErrEmpty             = errors.New("file has no text to import")
+)
+
+type Section struct {
+	Title    string           `json:"title"`
+	Kind     string           `json:"kind"`
+	Blocks   []richtext.Block `json:"-"`
+	Content  string           `json:"-"`
+	Length   int              `json:"length"`
+	NumWords int              `json:"num_words"`
+}
+
+type Draft struct {
+	Title    string     `json:"title"`
+	Format   string     `json:"format"`
+	Sections []*Section `json:"sections"`
+}
+
+// SectionPreview is what a dry run shows for each section: its statistics and
+// the opening of its text.
+type SectionPreview struct {
+	*Section
+	Excerpt string `json:"excerpt"`
+}
+
+type Preview struct {
+	Title       string           `json:"title"`
+	Format      string           `json:"format"`
+	Length      int              `json:"length"`
+	NumWords    int              `json:"num_words"`
+	NumSections int              `json:"num_sections"`
+	Sections    []SectionPreview `json:"sections"`
+}
+
+const excerptLength = 200
+
+// parsers maps a file extension to the reader for that format.
+var parsers = map[string]func([]byte) ([]richtext.Block, error){
+	".md":       parseMarkdown,
+	".markdown": parseMarkdown,
+	".txt":      parseText,
+	".docx":     parseDOCX,
+}
+
+// Parse reads an uploaded file, picking the format from its extension, and
+// splits it into sections. The document title is taken from a lone top-level
+// heading when there is one, otherwise from the file name.
+func Parse(filename string, data []byte) (*Draft, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	parse, ok := parsers[ext]
+	if !ok {
+		return nil, ErrUnsupportedFormat
+	}
+	if ext != ".docx" && !utf8.Valid(data) {
+		return nil, errors.New("file is not valid UTF-8 text")
+	}
+
+	blocks, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	title, sections := split(blocks)
+	if len(sections) == 0 {
+		return nil, ErrEmpty
+	}
+	if title == "" {
+		title = strings.TrimSpace(strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)))
+	}
+	if title == "" {
+		title = "Untitled"
+	}
+
+	return &Draft{Title: title, Format: strings.TrimPrefix(ext, "."), Sections: sections}, nil
+}
+
+// Totals sums the statistics of every section.
+func (d *Draft) Totals() (length int, numWords int) {
+	for _, section := range d.Sections {
+		length += section.Length
+		numWords += section.NumWords
+	}
+	return length, numWords
+}
+
+func (d *Draft) Preview() *Preview {
+	length, numWords := d.Totals()
+	preview := &Preview{
+		Title:       d.Title,
+		Format:      d.Format,
+		Length:      length,
+		NumWords:    numWords,
+		NumSections: len(d.Sections),
+		Sections:    make([]SectionPreview, 0, len(d.Sections)),
+	}
+	for _, section := range d.Sections {
+		excerpt := []rune(richtext.BlocksText(section.Blocks))
+		if len(excerpt) > excerptLength {
+			excerpt = append(excerpt[:excerptLength], '…')
+		}
+		preview.Sections = append(preview.Sections, SectionPreview{Section: section, Excerpt: string(excerpt)})
+	}
+	return preview
+}
+
+// chapterLine matches a line that opens a chapter in manuscripts that do not
+// use heading styles: "Chapter 12", "CHAPTER ONE: The Storm", "Chapter IV",
+// "Prologue" and so on. A title after the number needs a separator, so a
+// sentence that happens to start with "Chapter one" stays prose.
+var chapterLine = regexp.MustCompile(`(?i)^(chapter\s+(\d+|[ivxlcdm]+|[a-z]+(-[a-z]+)?)|prologue|epilogue|interlude)\s*([:.\-–—]\s*(\S.*)?)?$`)
+
+const maxChapterLineWords = 12
+
+func isChapterLine(text string) bool {
+	text = strings.TrimSpace(text)
+	return chapterLine.MatchString(text) && !strings.Contains(text, "\n") && len(strings.Fields(text)) <= maxChapterLineWords
+}
+
+func headingLevel(tag string) int {
+	if len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6' {
+		return int(tag[1] - '0')
+	}
+	return 0
+}
+
+// split cuts blocks into sections at the highest heading level used. When
+// only one heading sits at that level and there are more headings below it,
+// that heading is the book title and the next level down splits chapters.
+// Files without headings are split on "Chapter N" lines, and failing that
+// become a single section.
+func split(blocks []richtext.Block) (string, []*Section) {
+	blocks = normalizeBreaks(blocks)
+
+	levels := map[int]int{}
+	for _, block := range blocks {
+		if level := headingLevel(block.Tag); level > 0 {
+			levels[level]++
+		}
+	}
+	if len(levels) == 0 {
+		for i, block := range blocks {
+			if block.Tag == "p" && isChapterLine(block.Text) {
+				blocks[i].Tag = "h1"
+				levels[1]++
+			}
+		}
+	}
+
+	title := ""
+	splitLevel := 0
+	for level := 1; level <= 6; level++ {
+		if levels[level] == 0 {
+			continue
+		}
+		if splitLevel == 0 && levels[level] == 1 && len(levels) > 1 {
+			for i, block := range blocks {
+				if headingLevel(block.Tag) == level {
+					title = block.Text
+					blocks = append(blocks[:i:i], blocks[i+1:]...)
+					break
+				}
+			}
+			delete(levels, level)
+			continue
+		}
+		if splitLevel == 0 {
+			splitLevel = level
+		}
+	}
+
+	sections := []*Section{}
+	var current *Section
+	for _, block := range blocks {
+		level := headingLevel(block.Tag)
+		if splitLevel > 0 && level == splitLevel {
+			current = &Section{Title: block.Text, Kind: "chapter"}
+			sections = append(sections, current)
+			continue
+		}
+		if current == nil {
+			current = &Section{Kind: "chapter"}
+			sections = append(sections, current)
+		}
+		if level > 0 {
+			// Headings inside a section keep their relative depth below
+			// the section title.
+			block.Tag = "h" + string(rune('0'+min(level-splitLevel+1, 6)))
+		}
+		current.Blocks = append(current.Blocks, block)
+	}
+
+	kept := sections[:0]
+	for i, section := range sections {
+		section.Blocks = trimBreaks(section.Blocks)
+		if section.Title == "" && len(section.Blocks) == 0 {
+			continue
+		}
+		if section.Title == "" {
+			if i == 0 && len(sections) > 1 {
+				section.Title = "Front Matter"
+			} else {
+				section.Title = "Untitled"
+			}
+		}
+		section.Content = richtext.HTML(section.Blocks)
+		section.Length = richtext.CountCharacters(section.Content)
+		section.NumWords = richtext.CountWords(section.Content)
+		kept = append(kept, section)
+	}
+	return title, kept
+}
+
+// normalizeBreaks turns typed scene breaks into rules and collapses runs of
+// them into one.
+func normalizeBreaks(blocks []richtext.Block) []richtext.Block {
+	out := []richtext.Block{}
+	for _, block := range blocks {
+		if richtext.IsSceneBreak(block) {
+			if len(out) > 0 && out[len(out)-1].Tag == "hr" {
+				continue
+			}
+			block = richtext.Block{Tag: "hr", Runs: []richtext.Run{}}
+		}
+		out = append(out, block)
+	}
+	return out
+}
+
+// trimBreaks drops rules at the start or end of a section, where they
+// separate nothing.
+func trimBreaks(blocks []richtext.Block) []richtext.Block {
+	for len(blocks) > 0 && blocks[0].Tag == "hr" {
+		blocks = blocks[1:]
+	}
+	for len(blocks) > 0 && blocks[len(blocks)-1].Tag == "hr" {
+		blocks = blocks[:len(blocks)-1]
+	}
+	return blocks
+}
@@ -0,0 +1,172 @@
+package importer
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+var (
+	atxHeading    = regexp.MustCompile(`^(#{1,6})\s+(.*?)(\s+#+)?\s*$`)
+	setextHeading = regexp.MustCompile(`^(=+|-+)\s*$`)
+	thematicBreak = regexp.MustCompile(`^\s*([-*_])(\s*([-*_])){2,}\s*$`)
+	listItem      = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+`)
+	fence         = regexp.MustCompile("^\\s*(```|~~~)")
+	markdownLink  = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+)
+
+// normalizeNewlines strips a byte order mark and turns Windows and old Mac
+// line endings into "\n".
+func normalizeNewlines(data []byte) string {
+	text := strings.TrimPrefix(string(data), "\uFEFF")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
+
+// parseMarkdown reads the block structure manuscripts actually use:
+// headings, paragraphs, block quotes, lists, fenced code and rules. Inline
+// emphasis is kept; links keep their text.
+func parseMarkdown(data []byte) ([]richtext.Block, error) {
+	lines := strings.Split(normalizeNewlines(data), "\n")
+
+	blocks := []richtext.Block{}
+	tag := ""
+	var para strings.Builder
+	hardBreak := false
+
+	// add joins a line onto the open paragraph: a space for a soft line
+	// break, a newline after a hard one.
+	add := func(line string) {
+		if para.Len() > 0 {
+			if hardBreak {
+				para.WriteString("\n")
+			} else {
+				para.WriteString(" ")
+			}
+		}
+		para.WriteString(line)
+		hardBreak = false
+	}
+	flush := func() {
+		if para.Len() > 0 {
+			if block, ok := richtext.NewBlock(tag, markdownRuns(para.String())); ok {
+				blocks = append(blocks, block)
+			}
+		}
+		tag = ""
+		para.Reset()
+		hardBreak = false
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case fence.MatchString(line):
+			flush()
+			marker := fence.FindStringSubmatch(line)[1]
+			code := []string{}
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), marker); i++ {
+				code = append(code, lines[i])
+			}
+			if block, ok := richtext.NewBlock("pre", []richtext.Run{{Text: strings.Join(code, "\n")}}); ok {
+				blocks = append(blocks, block)
+			}
+		case trimmed == "":
+			flush()
+		case trimmed == "#" || thematicBreak.MatchString(line) && !(tag == "p" && setextHeading.MatchString(trimmed)):
+			flush()
+			blocks = append(blocks, richtext.Block{Tag: "hr", Runs: []richtext.Run{}})
+		case atxHeading.MatchString(trimmed):
+			flush()
+			m := atxHeading.FindStringSubmatch(trimmed)
+			tag = "h" + string(rune('0'+len(m[1])))
+			add(m[2])
+			flush()
+		case setextHeading.MatchString(trimmed) && tag == "p":
+			tag = "h2"
+			if trimmed[0] == '=' {
+				tag = "h1"
+			}
+			flush()
+		case strings.HasPrefix(trimmed, ">"):
+			if tag != "blockquote" {
+				flush()
+				tag = "blockquote"
+			}
+			add(strings.TrimSpace(strings.TrimPrefix(trimmed, ">")))
+		case listItem.MatchString(line):
+			flush()
+			tag = "li"
+			add(listItem.ReplaceAllString(line, ""))
+		default:
+			if tag == "" {
+				tag = "p"
+			}
+			add(strings.TrimSuffix(trimmed, "\\"))
+			// Two trailing spaces or a backslash is a hard line break.
+			hardBreak = strings.HasSuffix(line, "  ") || strings.HasSuffix(line, "\\")
+		}
+	}
+	flush()
+	return blocks, nil
+}
+
+// markdownRuns splits inline Markdown into emphasis runs. A delimiter only
+// opens emphasis when a matching closer follows, so a stray asterisk stays
+// literal.
+func markdownRuns(text string) []richtext.Run {
+	text = markdownLink.ReplaceAllString(text, "$1")
+	runs := []richtext.Run{}
+	var current strings.Builder
+	bold, italic := false, false
+
+	emit := func() {
+		if current.Len() > 0 {
+			runs = append(runs, richtext.Run{Text: current.String(), Bold: bold, Italic: italic})
+			current.Reset()
+		}
+	}
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.ContainsRune("\\`*_{}[]()#+-.!>~", rune(rest[1])):
+			current.WriteByte(rest[1])
+			i += 2
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			delim := rest[:2]
+			if bold || strings.Contains(rest[2:], delim) {
+				emit()
+				bold = !bold
+			} else {
+				current.WriteString(delim)
+			}
+			i += 2
+		case rest[0] == '*' || rest[0] == '_':
+			delim := rest[:1]
+			// Underscores inside words (snake_case) are not emphasis.
+			inWord := delim == "_" && i > 0 && isWordByte(text[i-1]) && len(rest) > 1 && isWordByte(rest[1])
+			if !inWord && (italic || strings.Contains(rest[1:], delim)) {
+				emit()
+				italic = !italic
+			} else {
+				current.WriteString(delim)
+			}
+			i++
+		case rest[0] == '`':
+			i++
+		default:
+			current.WriteByte(rest[0])
+			i++
+		}
+	}
+	emit()
+	return runs
+}
+
+func isWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
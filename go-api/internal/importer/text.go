@@ -0,0 +1,49 @@
+package importer
+
+import (
+	"strings"
+
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+// parseText reads a plain text manuscript. Paragraphs are separated by blank
+// lines; files that never use blank lines put one paragraph on each line
+// instead. "Chapter N" lines become headings wherever they appear.
+func parseText(data []byte) ([]richtext.Block, error) {
+	lines := strings.Split(normalizeNewlines(data), "\n")
+
+	linePerParagraph := true
+	for i := 1; i < len(lines)-1; i++ {
+		if strings.TrimSpace(lines[i]) == "" {
+			linePerParagraph = false
+			break
+		}
+	}
+
+	blocks := []richtext.Block{}
+	para := []string{}
+	flush := func() {
+		if block, ok := richtext.NewBlock("p", []richtext.Run{{Text: strings.Join(para, " ")}}); ok {
+			blocks = append(blocks, block)
+		}
+		para = para[:0]
+	}
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flush()
+		case isChapterLine(trimmed):
+			flush()
+			blocks = append(blocks, richtext.Block{Tag: "h1", Text: trimmed, Runs: []richtext.Run{{Text: trimmed}}})
+		default:
+			para = append(para, trimmed)
+			if linePerParagraph {
+				flush()
+			}
+		}
+	}
+	flush()
+	return blocks, nil
+}
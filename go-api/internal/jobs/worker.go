@@ -0,0 +1,161 @@
+// Package jobs runs the background work queued in the jobs table, such as
+// indexing saved sections in the agent backend.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/agent"
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+type Config struct {
+	// Workers is how many jobs run at once.
+	Workers int
+	// PollInterval is how long an idle worker waits before looking again.
+	PollInterval time.Duration
+	// Lease is how long a job may run before another worker assumes it was
+	// abandoned and takes it over.
+	Lease time.Duration
+	// RetryBackoff is the wait after a job's first failure; it doubles with
+	// each later failure up to MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+var DefaultConfig = Config{
+	Workers:         2,
+	PollInterval:    time.Second,
+	Lease:           5 * time.Minute,
+	RetryBackoff:    30 * time.Second,
+	MaxRetryBackoff: 30 * time.Minute,
+}
+
+type Worker struct {
+	jobStore    store.JobStore
+	usageStore  store.UsageStore
+	agentClient agent.AgentClient
+	config      Config
+	logger      *log.Logger
+}
+
+func NewWorker(jobStore store.JobStore, usageStore store.UsageStore, agentClient agent.AgentClient, config Config, logger *log.Logger) *Worker {
+	return &Worker{
+		jobStore:    jobStore,
+		usageStore:  usageStore,
+		agentClient: agentClient,
+		config:      config,
+		logger:      logger,
+	}
+}
+
+// Run processes jobs until ctx is cancelled, then waits for the jobs in
+// progress to stop.
+func (wk *Worker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range max(wk.config.Workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wk.loop(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (wk *Worker) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := wk.jobStore.ClaimJob(wk.config.Lease)
+		if err != nil {
+			wk.logger.Printf("ERROR: claimJob: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(wk.config.PollInterval):
+			}
+			continue
+		}
+		wk.process(ctx, job)
+	}
+}
+
+func (wk *Worker) process(ctx context.Context, job *store.Job) {
+	ctx, cancel := context.WithTimeout(ctx, wk.config.Lease)
+	defer cancel()
+
+	var hash string
+	var err error
+	switch job.Kind {
+	case store.JobKindIndexSection:
+		hash, err = wk.indexSection(ctx, job)
+	default:
+		err = fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+
+	if err == nil {
+		if err := wk.jobStore.CompleteJob(job, hash); err != nil {
+			wk.logger.Printf("ERROR: completeJob: %v", err)
+		}
+		return
+	}
+
+	retryAt := time.Now().Add(wk.backoff(job.Attempts))
+	if errors.Is(err, context.Canceled) {
+		// Shutting down; run it again as soon as a worker is back
+		retryAt = time.Now()
+	} else {
+		wk.logger.Printf("ERROR: job %s (%s, attempt %d of %d): %v", job.ID, job.Kind, job.Attempts, job.MaxAttempts, err)
+	}
+	if err := wk.jobStore.FailJob(job, err.Error(), retryAt); err != nil {
+		wk.logger.Printf("ERROR: failJob: %v", err)
+	}
+}
+
+// indexSection sends a section's current text to the agent backend to be
+// chunked, embedded and summarized, records the tokens that cost the user who
+// queued it, and returns the fingerprint of the text it sent.
+func (wk *Worker) indexSection(ctx context.Context, job *store.Job) (string, error) {
+	if job.SectionID == nil {
+		return "", errors.New("index job has no section")
+	}
+
+	section, hash, err := wk.jobStore.ReadSectionForIndex(*job.SectionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The section was deleted; there is nothing left to index
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	usage, err := wk.agentClient.SaveSection(ctx, section)
+	if err != nil {
+		return "", err
+	}
+
+	event := &store.UsageEvent{Kind: store.UsageKindIndexSection}
+	if usage != nil {
+		event.InputTokens, event.OutputTokens = usage.InputTokens, usage.OutputTokens
+	} else {
+		event.InputTokens, event.Estimated = store.EstimateTokens(section.Content), true
+	}
+	if err := wk.usageStore.RecordJobUsage(job.ID, event); err != nil {
+		wk.logger.Printf("ERROR: recordJobUsage: %v", err)
+	}
+	return hash, nil
+}
+
+func (wk *Worker) backoff(attempts int) time.Duration {
+	delay := wk.config.RetryBackoff << max(attempts-1, 0)
+	if delay <= 0 || delay > wk.config.MaxRetryBackoff {
+		delay = wk.config.MaxRetryBackoff
+	}
+	return delay
+}
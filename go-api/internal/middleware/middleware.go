@@ -2,9 +2,12 @@ package middleware
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackwillis517/Scribo/internal/store"
@@ -12,12 +15,18 @@ import (
 )
 
 type UserMiddleware struct {
-	UserStore store.UserStore
+	UserStore        store.UserStore
+	SessionStore     store.SessionStore
+	AccessTokenStore store.AccessTokenStore
 }
 
 type contextKey string
 
-const UserContextKey = contextKey("user")
+const (
+	UserContextKey        = contextKey("user")
+	SessionContextKey     = contextKey("session")
+	AccessTokenContextKey = contextKey("access_token")
+)
 
 func SetUser(r *http.Request, user *store.User) *http.Request {
 	ctx := context.WithValue(r.Context(), UserContextKey, user)
@@ -32,6 +41,35 @@ func GetUser(r *http.Request) *store.User {
 	return user
 }
 
+func SetSession(r *http.Request, session *store.Session) *http.Request {
+	ctx := context.WithValue(r.Context(), SessionContextKey, session)
+	return r.WithContext(ctx)
+}
+
+// GetSession returns the session the request was authenticated with.
+func GetSession(r *http.Request) *store.Session {
+	session, ok := r.Context().Value(SessionContextKey).(*store.Session)
+	if !ok {
+		return nil
+	}
+	return session
+}
+
+func SetAccessToken(r *http.Request, token *store.AccessToken) *http.Request {
+	ctx := context.WithValue(r.Context(), AccessTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// GetAccessToken returns the personal access token the request was
+// authenticated with, or nil when it was made with a login session.
+func GetAccessToken(r *http.Request) *store.AccessToken {
+	token, ok := r.Context().Value(AccessTokenContextKey).(*store.AccessToken)
+	if !ok {
+		return nil
+	}
+	return token
+}
+
 func parseJWTToken(jwtToken string) (*jwt.Token, error) {
 	token, err := jwt.Parse(jwtToken, func(t *jwt.Token) (interface{}, error) {
 
@@ -47,8 +85,36 @@ func parseJWTToken(jwtToken string) (*jwt.Token, error) {
 	return token, err
 }
 
+// ParseAuthToken checks an auth token's signature and expiry and returns the
+// user and session it was issued for. It does not check the session is
+// still active.
+func ParseAuthToken(jwtToken string) (userID string, sessionID string, err error) {
+	token, err := parseJWTToken(jwtToken)
+	if err != nil {
+		return "", "", err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", "", errors.New("invalid token claims")
+	}
+
+	userID, _ = claims["user_id"].(string)
+	sessionID, _ = claims["session_id"].(string)
+	if userID == "" || sessionID == "" {
+		return "", "", errors.New("token has no user or session")
+	}
+	return userID, sessionID, nil
+}
+
+// Authenticate accepts either a personal access token in an
+// "Authorization: Bearer" header or the auth_token cookie of a login session.
 func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Authorization"); header != "" {
+			um.authenticateAccessToken(w, r, header, next)
+			return
+		}
+
 		// Get the JWT token from the auth_token cookie
 		cookie, err := r.Cookie("auth_token")
 		if err != nil {
@@ -62,39 +128,103 @@ func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 		}
 
 		// Parse the JWT token
-		jwtToken := cookie.Value
-		token, err := parseJWTToken(jwtToken)
-
-		if err != nil || !token.Valid {
-			fmt.Println(err)
+		userID, sessionID, err := ParseAuthToken(cookie.Value)
+		if err != nil {
 			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "unauthorized: invalid auth token"})
 			return
 		}
 
-		// Check the user_id claim in the token and set the user object in the request context
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			userID := claims["user_id"].(string)
-			// Get user from the database
-			user, err := um.UserStore.GetUserByID(userID)
-
-			// Check if user is nil or error is nil
-			if err != nil {
-				utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		// The token is only good while its session has not been revoked
+		session, err := um.SessionStore.GetActiveSession(sessionID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "unauthorized: session expired or revoked"})
 				return
 			}
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+		if session.UserID != userID {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "unauthorized: invalid auth token"})
+			return
+		}
 
-			if user == nil {
+		// Get user from the database
+		user, err := um.UserStore.GetUserByID(userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
 				utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "token expired or user not found"})
 				return
 			}
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+
+		// Set user and session in context
+		r = SetUser(r, user)
+		r = SetSession(r, session)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (um *UserMiddleware) authenticateAccessToken(w http.ResponseWriter, r *http.Request, header string, next http.Handler) {
+	scheme, credential, _ := strings.Cut(header, " ")
+	credential = strings.TrimSpace(credential)
+	if !strings.EqualFold(scheme, "Bearer") || !store.IsAccessToken(credential) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "unauthorized: expected a bearer access token"})
+		return
+	}
+
+	token, err := um.AccessTokenStore.GetActiveAccessToken(credential)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "unauthorized: access token invalid, expired or revoked"})
+			return
+		}
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
 
-			// Set user in context
-			r = SetUser(r, user)
-			next.ServeHTTP(w, r)
-		} else {
-			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "unauthorized: invalid token claims"})
+	user, err := um.UserStore.GetUserByID(token.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "token expired or user not found"})
 			return
 		}
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	// The stores keep the request inside the token's documents
+	user.DocumentIDs = token.DocumentIDs
+
+	r = SetUser(r, user)
+	r = SetAccessToken(r, token)
+	next.ServeHTTP(w, r)
+}
+
+// RequireWriteAccess refuses requests made with a read-only access token.
+// It goes on every route that changes anything.
+func (um *UserMiddleware) RequireWriteAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := GetAccessToken(r); token != nil && !token.CanWrite() {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "forbidden: access token is read-only"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireSession refuses requests made with an access token, for routes that
+// manage the account's credentials: a leaked token must not be able to mint
+// or revoke others.
+func (um *UserMiddleware) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetSession(r) == nil {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "forbidden: sign in to manage sessions and access tokens"})
+			return
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
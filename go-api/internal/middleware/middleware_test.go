@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+// activeSessions holds the sessions that are neither revoked nor expired.
+type activeSessions struct {
+	store.SessionStore
+	sessions map[string]*store.Session
+}
+
+func (s activeSessions) GetActiveSession(id string) (*store.Session, error) {
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return session, nil
+}
+
+// activeTokens holds the access tokens that are neither revoked nor
+// expired, by their value.
+type activeTokens struct {
+	store.AccessTokenStore
+	tokens map[string]*store.AccessToken
+}
+
+func (s activeTokens) GetActiveAccessToken(secret string) (*store.AccessToken, error) {
+	token, ok := s.tokens[secret]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return token, nil
+}
+
+type users struct{ store.UserStore }
+
+func (users) GetUserByID(id string) (*store.User, error) {
+	return &store.User{ID: id}, nil
+}
+
+// authToken signs an auth token cookie value as the login handler does.
+func authToken(t *testing.T, userID, sessionID string) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"user_id":    userID,
+		"session_id": sessionID,
+		"exp":        time.Now().Add(time.Hour).Unix(),
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// serve runs a request through Authenticate and then the given middleware,
+// and returns the status.
+func serve(um *UserMiddleware, r *http.Request, middleware ...func(http.Handler) http.Handler) int {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	w := httptest.NewRecorder()
+	um.Authenticate(handler).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAuthenticateSession(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	um := &UserMiddleware{
+		UserStore: users{},
+		SessionStore: activeSessions{sessions: map[string]*store.Session{
+			"current": {ID: "current", UserID: "ada"},
+		}},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		user    string
+		session string
+		status  int
+	}{
+		{"active", "ada", "current", http.StatusOK},
+		{"revoked or expired", "ada", "revoked", http.StatusUnauthorized},
+		{"another user's", "bob", "current", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/documents/getAllDocuments", nil)
+			r.AddCookie(&http.Cookie{Name: "auth_token", Value: authToken(t, tc.user, tc.session)})
+			if status := serve(um, r); status != tc.status {
+				t.Errorf("status is %d, want %d", status, tc.status)
+			}
+		})
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	um := &UserMiddleware{
+		UserStore: users{},
+		SessionStore: activeSessions{sessions: map[string]*store.Session{
+			"current": {ID: "current", UserID: "ada"},
+		}},
+		AccessTokenStore: activeTokens{tokens: map[string]*store.AccessToken{
+			"scribo_pat_full": {ID: "full", UserID: "ada", Scope: store.AccessTokenScopeReadWrite},
+		}},
+	}
+
+	t.Run("session", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/user/createAccessToken", nil)
+		r.AddCookie(&http.Cookie{Name: "auth_token", Value: authToken(t, "ada", "current")})
+		if status := serve(um, r, um.RequireSession); status != http.StatusOK {
+			t.Errorf("status is %d, want %d", status, http.StatusOK)
+		}
+	})
+
+	t.Run("access token", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/user/createAccessToken", nil)
+		r.Header.Set("Authorization", "Bearer scribo_pat_full")
+		if status := serve(um, r, um.RequireSession); status != http.StatusForbidden {
+			t.Errorf("status is %d, want %d", status, http.StatusForbidden)
+		}
+	})
+}
+
+func TestAuthenticateAccessToken(t *testing.T) {
+	var scopedUser *store.User
+	um := &UserMiddleware{
+		UserStore: users{},
+		AccessTokenStore: activeTokens{tokens: map[string]*store.AccessToken{
+			"scribo_pat_full":   {ID: "full", UserID: "ada", Scope: store.AccessTokenScopeReadWrite},
+			"scribo_pat_read":   {ID: "read", UserID: "ada", Scope: store.AccessTokenScopeRead},
+			"scribo_pat_scoped": {ID: "scoped", UserID: "ada", Scope: store.AccessTokenScopeReadWrite, DocumentIDs: []string{"d1"}},
+		}},
+	}
+	keepUser := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scopedUser = GetUser(r)
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		write  bool
+		status int
+	}{
+		{"read and write", "scribo_pat_full", true, http.StatusOK},
+		{"read only reading", "scribo_pat_read", false, http.StatusOK},
+		{"read only writing", "scribo_pat_read", true, http.StatusForbidden},
+		{"revoked or expired", "scribo_pat_revoked", false, http.StatusUnauthorized},
+		{"not an access token", "eyJhbGciOiJIUzI1NiJ9", false, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/documents/getAllDocuments", nil)
+			var middleware []func(http.Handler) http.Handler
+			if tc.write {
+				r = httptest.NewRequest(http.MethodPost, "/documents/createDocument", nil)
+				middleware = append(middleware, um.RequireWriteAccess)
+			}
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+			if status := serve(um, r, middleware...); status != tc.status {
+				t.Errorf("status is %d, want %d", status, tc.status)
+			}
+		})
+	}
+
+	t.Run("document scope", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/documents/getAllDocuments", nil)
+		r.Header.Set("Authorization", "Bearer scribo_pat_scoped")
+		if status := serve(um, r, keepUser); status != http.StatusOK {
+			t.Fatalf("status is %d, want %d", status, http.StatusOK)
+		}
+		// The stores keep the user to these, see TestAccessTokens
+		if len(scopedUser.DocumentIDs) != 1 || scopedUser.DocumentIDs[0] != "d1" {
+			t.Errorf("the user is limited to %v, want [d1]", scopedUser.DocumentIDs)
+		}
+	})
+}
+
+func TestRequireWriteAccessSession(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	um := &UserMiddleware{
+		UserStore: users{},
+		SessionStore: activeSessions{sessions: map[string]*store.Session{
+			"current": {ID: "current", UserID: "ada"},
+		}},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/documents/createDocument", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_token", Value: authToken(t, "ada", "current")})
+	if status := serve(um, r, um.RequireWriteAccess); status != http.StatusOK {
+		t.Errorf("status is %d, want %d", status, http.StatusOK)
+	}
+}
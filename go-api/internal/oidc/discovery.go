@@ -0,0 +1,50 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ProviderMetadata is the part of a provider's discovery document Scribo
+// uses.
+type ProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Discover fetches an issuer's OpenID Connect discovery document. The
+// document must name the same issuer it was fetched from, so a provider
+// cannot vouch for tokens from another.
+func Discover(ctx context.Context, client *http.Client, issuer string) (*ProviderMetadata, error) {
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching discovery document: status %d", resp.StatusCode)
+	}
+
+	metadata := &ProviderMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(metadata); err != nil {
+		return nil, fmt.Errorf("decoding discovery document: %w", err)
+	}
+	if metadata.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", metadata.Issuer, issuer)
+	}
+	if metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("discovery document has no token endpoint or key set")
+	}
+	return metadata, nil
+}
@@ -0,0 +1,212 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultKeyLifetime is how long keys are cached when the provider does
+	// not say with Cache-Control.
+	defaultKeyLifetime = time.Hour
+	// minRefreshInterval stops tokens with unknown key IDs from making us
+	// fetch the key set on every request.
+	minRefreshInterval = time.Minute
+	fetchTimeout       = 10 * time.Second
+)
+
+var ErrUnknownKey = errors.New("token signed with an unknown key")
+
+// KeySet is a provider's JSON Web Key Set, fetched on first use and cached
+// for as long as the provider's Cache-Control allows. A key ID that is not
+// in the cache triggers a refetch, so keys the provider rotates in are
+// picked up before the cache expires.
+type KeySet struct {
+	url    string
+	client *http.Client
+	now    func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	expires time.Time
+	fetched time.Time
+	err     error
+}
+
+func NewKeySet(url string) *KeySet {
+	return &KeySet{
+		url:    url,
+		client: &http.Client{Timeout: fetchTimeout},
+		now:    time.Now,
+	}
+}
+
+// Key returns the public key with the given key ID. If the cache has expired
+// but the key set cannot be fetched, cached keys go on being used until the
+// provider is reachable again.
+func (ks *KeySet) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := ks.now()
+	key, found := ks.keys[kid]
+	recent := !ks.fetched.IsZero() && now.Sub(ks.fetched) < minRefreshInterval
+	if found && (now.Before(ks.expires) || recent) {
+		return key, nil
+	}
+	if !found && recent {
+		if ks.err != nil {
+			return nil, ks.err
+		}
+		return nil, ErrUnknownKey
+	}
+
+	ks.fetched = now
+	ks.err = ks.refresh(ctx, now)
+	if err := ks.err; err != nil {
+		if found {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	key, found = ks.keys[kid]
+	if !found {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// refresh fetches the key set. Key records the time of every attempt,
+// failed ones too, so an unreachable provider is not asked again at once.
+func (ks *KeySet) refresh(ctx context.Context, now time.Time) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching key set: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching key set: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decoding key set: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// One malformed or unsupported key should not lock everyone out
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("key set has no usable signing keys")
+	}
+
+	ks.keys = keys
+	ks.expires = now.Add(cacheLifetime(resp.Header.Get("Cache-Control")))
+	return nil
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent out of range")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+// cacheLifetime reads max-age from a Cache-Control header.
+func cacheLifetime(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "no-cache") || strings.EqualFold(name, "no-store") {
+			return 0
+		}
+		if strings.EqualFold(name, "max-age") {
+			seconds, err := strconv.Atoi(value)
+			if err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return defaultKeyLifetime
+}
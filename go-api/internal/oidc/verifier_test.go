@@ -0,0 +1,236 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "scribo-client"
+)
+
+// keyServer publishes a JSON Web Key Set that tests can rotate or break.
+type keyServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	failing bool
+	fetches int
+}
+
+func newKeyServer(t *testing.T) *keyServer {
+	ks := &keyServer{keys: map[string]*rsa.PrivateKey{}}
+	ks.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		ks.fetches++
+		if ks.failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		var set struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		for kid, key := range ks.keys {
+			set.Keys = append(set.Keys, jsonWebKey{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(ks.Close)
+	return ks
+}
+
+// rotate replaces the published keys with a new one under kid.
+func (ks *keyServer) rotate(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = map[string]*rsa.PrivateKey{kid: key}
+	return key
+}
+
+func (ks *keyServer) setFailing(failing bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.failing = failing
+}
+
+func (ks *keyServer) fetchCount() int {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.fetches
+}
+
+// testVerifier returns a verifier for the key server whose key set reads
+// the time from clock.
+func testVerifier(ks *keyServer, clock *time.Time) *Verifier {
+	v := NewVerifier(Config{JWKSURL: ks.URL, Issuers: []string{testIssuer}, Audience: testAudience})
+	v.keys.now = func() time.Time { return *clock }
+	return v
+}
+
+func validClaims() *Claims {
+	now := time.Now()
+	return &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    testIssuer,
+			Subject:   "user-1",
+			Audience:  jwt.ClaimStrings{testAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+		Email: "ada@example.com",
+	}
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, kid string, claims *Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerify(t *testing.T) {
+	ks := newKeyServer(t)
+	key := ks.rotate(t, "key-1")
+	clock := time.Now()
+	v := testVerifier(ks, &clock)
+
+	tampered := sign(t, key, "key-1", validClaims())
+	dot := strings.LastIndex(tampered, ".")
+	middle := dot + (len(tampered)-dot)/2
+	flipped := byte('A')
+	if tampered[middle] == 'A' {
+		flipped = 'B'
+	}
+	tampered = tampered[:middle] + string(flipped) + tampered[middle+1:]
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", sign(t, key, "key-1", validClaims()), true},
+		{"tampered signature", tampered, false},
+		{"wrong issuer", sign(t, key, "key-1", func() *Claims {
+			c := validClaims()
+			c.Issuer = "https://elsewhere.example.com"
+			return c
+		}()), false},
+		{"wrong audience", sign(t, key, "key-1", func() *Claims {
+			c := validClaims()
+			c.Audience = jwt.ClaimStrings{"another-client"}
+			return c
+		}()), false},
+		{"expired", sign(t, key, "key-1", func() *Claims {
+			c := validClaims()
+			c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-3 * time.Hour))
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-2 * time.Hour))
+			return c
+		}()), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := v.Verify(context.Background(), tc.token)
+			if tc.valid {
+				if err != nil {
+					t.Fatalf("got %v, want the token accepted", err)
+				}
+				if claims.Subject != "user-1" || claims.Email != "ada@example.com" {
+					t.Errorf("claims are %+v", claims)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("got %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRefetchesAfterRotation(t *testing.T) {
+	ks := newKeyServer(t)
+	oldKey := ks.rotate(t, "key-1")
+	clock := time.Now()
+	v := testVerifier(ks, &clock)
+
+	if _, err := v.Verify(context.Background(), sign(t, oldKey, "key-1", validClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider rotates to a key we have not seen while ours is still
+	// cached
+	newKey := ks.rotate(t, "key-2")
+	clock = clock.Add(2 * minRefreshInterval)
+	if _, err := v.Verify(context.Background(), sign(t, newKey, "key-2", validClaims())); err != nil {
+		t.Fatalf("got %v, want the new key fetched", err)
+	}
+	if got := ks.fetchCount(); got != 2 {
+		t.Errorf("key set fetched %d times, want 2", got)
+	}
+
+	// Tokens with unknown keys do not make us fetch again straight away
+	if _, err := v.Verify(context.Background(), sign(t, newKey, "key-3", validClaims())); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got %v, want ErrInvalidToken", err)
+	}
+	if got := ks.fetchCount(); got != 2 {
+		t.Errorf("key set fetched %d times, want still 2", got)
+	}
+}
+
+func TestVerifyKeepsCachedKeysWhenFetchFails(t *testing.T) {
+	ks := newKeyServer(t)
+	key := ks.rotate(t, "key-1")
+	clock := time.Now()
+	v := testVerifier(ks, &clock)
+
+	if _, err := v.Verify(context.Background(), sign(t, key, "key-1", validClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache has expired and the provider is down
+	ks.setFailing(true)
+	clock = clock.Add(2 * time.Hour)
+	if _, err := v.Verify(context.Background(), sign(t, key, "key-1", validClaims())); err != nil {
+		t.Fatalf("got %v, want the cached key used", err)
+	}
+	if got := ks.fetchCount(); got != 2 {
+		t.Errorf("key set fetched %d times, want 2", got)
+	}
+
+	// A key we never had cannot be checked, which is not the token's fault
+	_, err := v.Verify(context.Background(), sign(t, key, "key-2", validClaims()))
+	if err == nil || errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got %v, want a key set fetch error", err)
+	}
+}
@@ -0,0 +1,93 @@
+package presence
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// postgresChannel is the NOTIFY channel instances share.
+const postgresChannel = "presence"
+
+const (
+	listenRetryBackoff    = time.Second
+	listenMaxRetryBackoff = 30 * time.Second
+)
+
+// PostgresBroker passes notifications between instances with Postgres
+// LISTEN/NOTIFY. Notifications are published through the shared pool and
+// received on a connection of the broker's own, since a listening connection
+// cannot go back to a pool.
+type PostgresBroker struct {
+	db          *sql.DB
+	databaseURL string
+	logger      *log.Logger
+}
+
+func NewPostgresBroker(db *sql.DB, databaseURL string, logger *log.Logger) *PostgresBroker {
+	return &PostgresBroker{db: db, databaseURL: databaseURL, logger: logger}
+}
+
+func (b *PostgresBroker) Publish(ctx context.Context, n *Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, postgresChannel, string(payload))
+	return err
+}
+
+// Listen keeps a connection listening until ctx is done, reconnecting with
+// backoff when it drops. Notifications sent while it is down are lost; the
+// instances' heartbeats make up for them.
+func (b *PostgresBroker) Listen(ctx context.Context, deliver func(*Notification)) error {
+	backoff := listenRetryBackoff
+	for {
+		err := b.listen(ctx, deliver, func() { backoff = listenRetryBackoff })
+		if ctx.Err() != nil {
+			return nil
+		}
+		b.logger.Printf("ERROR: presence: listening for notifications, retrying in %s: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, listenMaxRetryBackoff)
+	}
+}
+
+// listen runs one listening connection until it fails. connected is called
+// once it is listening.
+func (b *PostgresBroker) listen(ctx context.Context, deliver func(*Notification), connected func()) error {
+	conn, err := pgx.Connect(ctx, b.databaseURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "LISTEN "+postgresChannel)
+	if err != nil {
+		return err
+	}
+	connected()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var n Notification
+		if err := json.Unmarshal([]byte(notification.Payload), &n); err != nil {
+			b.logger.Printf("ERROR: presence: decoding notification: %v", err)
+			continue
+		}
+		deliver(&n)
+	}
+}
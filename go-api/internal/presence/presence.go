@@ -0,0 +1,503 @@
+// Package presence tracks who has each document open, which section they are
+// in and where their cursor is, and tells everyone else looking at the
+// document as that changes.
+//
+// Every API instance keeps the presences of its own clients, which heartbeat
+// to stay present, and mirrors those of other instances, which reach it
+// through a Broker. Instances re-announce their clients every heartbeat
+// interval, so a presence whose instance has gone away expires like one
+// whose client stopped heartbeating.
+package presence
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+const (
+	EventSnapshot = "snapshot"
+	EventJoin     = "join"
+	EventMove     = "move"
+	EventLeave    = "leave"
+	// eventHeartbeat only passes between instances, to keep a presence
+	// alive; clients see a join the first time an instance hears of it.
+	eventHeartbeat = "heartbeat"
+)
+
+// ErrAccessChanged is why a client is disconnected once it may no longer
+// read the document.
+var ErrAccessChanged = errors.New("your access to this document has changed; reconnect to continue")
+
+// Cursor is a selection in a section's content, in the characters collab
+// operations count. Anchor and Head are equal for a plain cursor.
+type Cursor struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+// Presence is one client with a document open. A user with the document open
+// in two places has two presences.
+type Presence struct {
+	ID         string    `json:"id"`
+	DocumentID string    `json:"document_id"`
+	UserID     string    `json:"user_id"`
+	Name       string    `json:"name"`
+	Picture    string    `json:"picture"`
+	SectionID  *string   `json:"section_id"`
+	Cursor     *Cursor   `json:"cursor"`
+	JoinedAt   time.Time `json:"joined_at"`
+
+	instance string
+	expires  time.Time
+}
+
+// Event is what clients are sent: a snapshot of everyone present when they
+// join, then each join, move and leave.
+type Event struct {
+	Type     string      `json:"type"`
+	Presence *Presence   `json:"presence,omitempty"`
+	Present  []*Presence `json:"present"`
+}
+
+// Notification is an event as instances send it to each other.
+type Notification struct {
+	Instance string    `json:"instance"`
+	Type     string    `json:"type"`
+	Presence *Presence `json:"presence"`
+}
+
+// Broker passes notifications between the instances of the API.
+type Broker interface {
+	Publish(context.Context, *Notification) error
+	// Listen delivers other instances' notifications until ctx is done.
+	Listen(ctx context.Context, deliver func(*Notification)) error
+}
+
+type Config struct {
+	// HeartbeatInterval is how often clients should heartbeat, and how often
+	// an instance re-announces its clients to the others.
+	HeartbeatInterval time.Duration
+	// Expiry is how long a presence lasts without a heartbeat.
+	Expiry time.Duration
+	// AccessInterval is how often every local client's access is checked
+	// again, so that one removed from the document is disconnected. Zero
+	// never checks again.
+	AccessInterval time.Duration
+	// Outbox is how many events may wait for a slow client before it is
+	// disconnected.
+	Outbox int
+}
+
+var DefaultConfig = Config{
+	HeartbeatInterval: 10 * time.Second,
+	Expiry:            30 * time.Second,
+	AccessInterval:    time.Minute,
+	Outbox:            64,
+}
+
+// Hub holds the presences this instance knows of, by document. A nil broker
+// keeps presence to this instance.
+type Hub struct {
+	instance string
+	broker   Broker
+	config   Config
+	logger   *log.Logger
+
+	mu        sync.Mutex
+	documents map[string]*document
+}
+
+type document struct {
+	present     map[string]*Presence
+	subscribers map[*Subscriber]struct{}
+}
+
+// Access returns nil while a client may read the document, and
+// sql.ErrNoRows or store.ErrForbidden once it may not.
+type Access func() error
+
+// Subscriber is a local client's presence and the events it is sent.
+type Subscriber struct {
+	hub      *Hub
+	presence *Presence
+	access   Access
+	events   chan Event
+	// err is why the subscriber was removed, if not for expiring or
+	// falling behind
+	err error
+
+	leave sync.Once
+}
+
+func NewHub(broker Broker, config Config, logger *log.Logger) *Hub {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Hub{
+		instance:  hex.EncodeToString(id),
+		broker:    broker,
+		config:    config,
+		logger:    logger,
+		documents: map[string]*document{},
+	}
+}
+
+func newPresenceID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// copy returns a snapshot of the presence that is safe to hand out while the
+// hub goes on changing it.
+func (p *Presence) copy() *Presence {
+	c := *p
+	if p.SectionID != nil {
+		sectionID := *p.SectionID
+		c.SectionID = &sectionID
+	}
+	if p.Cursor != nil {
+		cursor := *p.Cursor
+		c.Cursor = &cursor
+	}
+	return &c
+}
+
+// Join makes the user present on the document. The caller must already have
+// checked that they may read it; access checks again later. The subscriber's
+// first event is a snapshot of everyone else present.
+func (h *Hub) Join(user *store.User, documentID string, access Access) *Subscriber {
+	now := time.Now()
+	s := &Subscriber{
+		hub: h,
+		presence: &Presence{
+			ID:         newPresenceID(),
+			DocumentID: documentID,
+			UserID:     user.ID,
+			Name:       user.Name,
+			Picture:    user.Picture,
+			JoinedAt:   now,
+			instance:   h.instance,
+			expires:    now.Add(h.config.Expiry),
+		},
+		access: access,
+		events: make(chan Event, h.config.Outbox),
+	}
+
+	h.mu.Lock()
+	doc := h.documents[documentID]
+	if doc == nil {
+		doc = &document{present: map[string]*Presence{}, subscribers: map[*Subscriber]struct{}{}}
+		h.documents[documentID] = doc
+	}
+	present := make([]*Presence, 0, len(doc.present))
+	for _, p := range doc.present {
+		present = append(present, p.copy())
+	}
+	s.events <- Event{Type: EventSnapshot, Present: present}
+	h.broadcast(doc, Event{Type: EventJoin, Presence: s.presence.copy()}, nil)
+	doc.present[s.presence.ID] = s.presence
+	doc.subscribers[s] = struct{}{}
+	announcement := s.presence.copy()
+	h.mu.Unlock()
+
+	h.publish(EventJoin, announcement)
+	return s
+}
+
+// Events delivers what happens on the document. It is closed when the
+// subscriber is dropped for expiring or falling behind.
+func (s *Subscriber) Events() <-chan Event {
+	return s.events
+}
+
+// Err says why Events was closed: ErrAccessChanged, or nil when the
+// subscriber expired or fell behind.
+func (s *Subscriber) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+// Heartbeat keeps the subscriber present.
+func (s *Subscriber) Heartbeat() {
+	h := s.hub
+	h.mu.Lock()
+	s.presence.expires = time.Now().Add(h.config.Expiry)
+	h.mu.Unlock()
+}
+
+// Move records where the subscriber is. A nil section means no section is
+// open; a nil cursor means the cursor is not in the text.
+func (s *Subscriber) Move(sectionID *string, cursor *Cursor) {
+	h := s.hub
+	h.mu.Lock()
+	doc := h.documents[s.presence.DocumentID]
+	if doc == nil || doc.present[s.presence.ID] != s.presence {
+		h.mu.Unlock()
+		return
+	}
+	s.presence.SectionID = sectionID
+	s.presence.Cursor = cursor
+	s.presence.expires = time.Now().Add(h.config.Expiry)
+	moved := s.presence.copy()
+	h.broadcast(doc, Event{Type: EventMove, Presence: moved}, s)
+	h.mu.Unlock()
+
+	h.publish(EventMove, moved)
+}
+
+// Leave removes the subscriber from the document. It is safe to call more
+// than once.
+func (s *Subscriber) Leave() {
+	s.leave.Do(func() {
+		h := s.hub
+		h.mu.Lock()
+		removed := h.remove(s.presence.DocumentID, s.presence.ID)
+		h.mu.Unlock()
+
+		if removed {
+			h.publish(EventLeave, s.presence.copy())
+		}
+	})
+}
+
+// evict removes the subscriber for err.
+func (s *Subscriber) evict(err error) {
+	s.hub.mu.Lock()
+	s.err = err
+	s.hub.mu.Unlock()
+	s.Leave()
+}
+
+// remove takes a presence off its document, tells the others and, for a
+// local one, drops its subscriber. It reports whether the presence was there.
+// The hub's lock must be held.
+func (h *Hub) remove(documentID string, presenceID string) bool {
+	doc := h.documents[documentID]
+	if doc == nil {
+		return false
+	}
+	p, ok := doc.present[presenceID]
+	if !ok {
+		return false
+	}
+	delete(doc.present, presenceID)
+	for s := range doc.subscribers {
+		if s.presence == p {
+			h.drop(doc, s)
+		}
+	}
+	h.broadcast(doc, Event{Type: EventLeave, Presence: p.copy()}, nil)
+	if len(doc.present) == 0 && len(doc.subscribers) == 0 {
+		delete(h.documents, documentID)
+	}
+	return true
+}
+
+// drop stops sending events to a subscriber. The hub's lock must be held.
+func (h *Hub) drop(doc *document, s *Subscriber) {
+	if _, ok := doc.subscribers[s]; !ok {
+		return
+	}
+	delete(doc.subscribers, s)
+	close(s.events)
+}
+
+// broadcast sends an event to the document's subscribers but except,
+// dropping any too far behind to take it. The hub's lock must be held.
+func (h *Hub) broadcast(doc *document, event Event, except *Subscriber) {
+	for s := range doc.subscribers {
+		if s == except {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			h.logger.Printf("ERROR: presence: dropping a client too slow to keep up with document %s", s.presence.DocumentID)
+			h.drop(doc, s)
+		}
+	}
+}
+
+func (h *Hub) publish(eventType string, p *Presence) {
+	if h.broker == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.HeartbeatInterval)
+	defer cancel()
+	err := h.broker.Publish(ctx, &Notification{Instance: h.instance, Type: eventType, Presence: p})
+	if err != nil {
+		h.logger.Printf("ERROR: presence: publishing %s: %v", eventType, err)
+	}
+}
+
+// receive applies another instance's notification.
+func (h *Hub) receive(n *Notification) {
+	if n.Instance == h.instance || n.Presence == nil || n.Presence.ID == "" || n.Presence.DocumentID == "" {
+		return
+	}
+	p := n.Presence
+	p.instance = n.Instance
+	p.expires = time.Now().Add(h.config.Expiry)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	doc := h.documents[p.DocumentID]
+	if doc == nil {
+		if n.Type == EventLeave {
+			return
+		}
+		doc = &document{present: map[string]*Presence{}, subscribers: map[*Subscriber]struct{}{}}
+		h.documents[p.DocumentID] = doc
+	}
+	// Each instance only speaks for its own clients
+	existing, known := doc.present[p.ID]
+	if known && existing.instance != n.Instance {
+		return
+	}
+	if n.Type == EventLeave {
+		h.remove(p.DocumentID, p.ID)
+		return
+	}
+	// A heartbeat can overtake the move before it, so it only keeps a known
+	// presence alive
+	if known && n.Type == eventHeartbeat {
+		existing.expires = p.expires
+		return
+	}
+	doc.present[p.ID] = p
+	switch {
+	case !known:
+		h.broadcast(doc, Event{Type: EventJoin, Presence: p.copy()}, nil)
+	case n.Type == EventMove:
+		h.broadcast(doc, Event{Type: EventMove, Presence: p.copy()}, nil)
+	}
+}
+
+// Run relays other instances' notifications, re-announces this instance's
+// clients and expires silent presences until ctx is done. On its way out it
+// tells the other instances this one's clients have left.
+func (h *Hub) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	if h.broker != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h.broker.Listen(ctx, h.receive); err != nil && ctx.Err() == nil {
+				h.logger.Printf("ERROR: presence: listening: %v", err)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(h.config.HeartbeatInterval)
+	defer ticker.Stop()
+	var recheck <-chan time.Time
+	if h.config.AccessInterval > 0 {
+		accessTicker := time.NewTicker(h.config.AccessInterval)
+		defer accessTicker.Stop()
+		recheck = accessTicker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			h.leaveAll()
+			return
+		case <-ticker.C:
+			h.sweep()
+		case <-recheck:
+			h.checkAccess()
+		}
+	}
+}
+
+// checkAccess asks each local client's Access again and removes those that
+// may no longer read their document. A client whose access cannot be
+// checked for another reason is kept.
+func (h *Hub) checkAccess() {
+	h.mu.Lock()
+	var subscribers []*Subscriber
+	for _, doc := range h.documents {
+		for s := range doc.subscribers {
+			subscribers = append(subscribers, s)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, s := range subscribers {
+		err := s.access()
+		if err == nil {
+			continue
+		}
+		if !lostAccess(err) {
+			h.logger.Printf("ERROR: presence: checking access to document %s: %v", s.presence.DocumentID, err)
+			continue
+		}
+		s.evict(ErrAccessChanged)
+	}
+}
+
+// lostAccess reports whether err means a user may no longer read the
+// document.
+func lostAccess(err error) bool {
+	return errors.Is(err, sql.ErrNoRows) || errors.Is(err, store.ErrForbidden)
+}
+
+// sweep expires presences that have not been heard from, and re-announces
+// the local ones.
+func (h *Hub) sweep() {
+	now := time.Now()
+	var alive, expired []*Presence
+
+	h.mu.Lock()
+	for documentID, doc := range h.documents {
+		for id, p := range doc.present {
+			local := p.instance == h.instance
+			switch {
+			case now.After(p.expires):
+				h.remove(documentID, id)
+				if local {
+					expired = append(expired, p.copy())
+				}
+			case local:
+				alive = append(alive, p.copy())
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	for _, p := range expired {
+		h.publish(EventLeave, p)
+	}
+	for _, p := range alive {
+		h.publish(eventHeartbeat, p)
+	}
+}
+
+// leaveAll removes every local client, telling the other instances they have
+// left.
+func (h *Hub) leaveAll() {
+	var local []*Presence
+	h.mu.Lock()
+	for documentID, doc := range h.documents {
+		for id, p := range doc.present {
+			if p.instance == h.instance {
+				local = append(local, p.copy())
+				h.remove(documentID, id)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	for _, p := range local {
+		h.publish(EventLeave, p)
+	}
+}
@@ -0,0 +1,250 @@
+package presence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+// memoryBroker records what a hub publishes. Other instances' notifications
+// are handed to the hub with receive.
+type memoryBroker struct {
+	mu        sync.Mutex
+	published []*Notification
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, n *Notification) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, n)
+	return nil
+}
+
+func (b *memoryBroker) Listen(ctx context.Context, deliver func(*Notification)) error {
+	<-ctx.Done()
+	return nil
+}
+
+// types lists the types of the notifications published about a presence.
+func (b *memoryBroker) types(presenceID string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var types []string
+	for _, n := range b.published {
+		if n.Presence.ID == presenceID {
+			types = append(types, n.Type)
+		}
+	}
+	return types
+}
+
+func testHub(t *testing.T) (*Hub, *memoryBroker) {
+	t.Helper()
+	broker := &memoryBroker{}
+	config := DefaultConfig
+	// The tests check access themselves
+	config.AccessInterval = 0
+	return NewHub(broker, config, log.New(io.Discard, "", 0)), broker
+}
+
+// readable is an Access that can be revoked.
+type readable struct{ revoked atomic.Bool }
+
+func (r *readable) access() error {
+	if r.revoked.Load() {
+		return store.ErrForbidden
+	}
+	return nil
+}
+
+func alwaysReadable() error { return nil }
+
+func receive(t *testing.T, s *Subscriber) Event {
+	t.Helper()
+	select {
+	case event, ok := <-s.Events():
+		if !ok {
+			t.Fatal("events closed")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func expectType(t *testing.T, s *Subscriber, eventType string, presenceID string) Event {
+	t.Helper()
+	event := receive(t, s)
+	if event.Type != eventType {
+		t.Fatalf("got a %s event, want %s", event.Type, eventType)
+	}
+	if presenceID != "" && (event.Presence == nil || event.Presence.ID != presenceID) {
+		t.Fatalf("got a %s of %v, want of %s", event.Type, event.Presence, presenceID)
+	}
+	return event
+}
+
+func TestJoinAndLeave(t *testing.T) {
+	hub, broker := testHub(t)
+	ada := hub.Join(&store.User{ID: "ada", Name: "Ada"}, "d", alwaysReadable)
+	if snapshot := expectType(t, ada, EventSnapshot, ""); len(snapshot.Present) != 0 {
+		t.Errorf("the first to join sees %d present, want none", len(snapshot.Present))
+	}
+
+	bob := hub.Join(&store.User{ID: "bob", Name: "Bob"}, "d", alwaysReadable)
+	if snapshot := expectType(t, bob, EventSnapshot, ""); len(snapshot.Present) != 1 || snapshot.Present[0].UserID != "ada" {
+		t.Errorf("the second to join sees %v, want Ada", snapshot.Present)
+	}
+	expectType(t, ada, EventJoin, bob.presence.ID)
+
+	// Someone on another document is not seen
+	other := hub.Join(&store.User{ID: "grace"}, "other", alwaysReadable)
+	expectType(t, other, EventSnapshot, "")
+
+	sectionID := "s"
+	bob.Move(&sectionID, &Cursor{Anchor: 3, Head: 5})
+	move := expectType(t, ada, EventMove, bob.presence.ID)
+	if *move.Presence.SectionID != sectionID || *move.Presence.Cursor != (Cursor{Anchor: 3, Head: 5}) {
+		t.Errorf("Bob moved to %v %v, want %s {3 5}", move.Presence.SectionID, move.Presence.Cursor, sectionID)
+	}
+
+	bob.Leave()
+	expectType(t, ada, EventLeave, bob.presence.ID)
+	if _, ok := <-bob.Events(); ok {
+		t.Error("Bob's events are still open after leaving")
+	}
+
+	want := []string{EventJoin, EventMove, EventLeave}
+	if got := broker.types(bob.presence.ID); !equal(got, want) {
+		t.Errorf("published %v for Bob, want %v", got, want)
+	}
+	select {
+	case event := <-other.Events():
+		t.Errorf("someone on another document was sent %s", event.Type)
+	default:
+	}
+}
+
+func TestOtherInstances(t *testing.T) {
+	hub, _ := testHub(t)
+	ada := hub.Join(&store.User{ID: "ada"}, "d", alwaysReadable)
+	expectType(t, ada, EventSnapshot, "")
+
+	remote := &Presence{ID: "remote", DocumentID: "d", UserID: "bob"}
+	hub.receive(&Notification{Instance: "elsewhere", Type: EventJoin, Presence: remote.copy()})
+	expectType(t, ada, EventJoin, "remote")
+
+	// A heartbeat only keeps a known presence alive
+	hub.receive(&Notification{Instance: "elsewhere", Type: eventHeartbeat, Presence: remote.copy()})
+
+	// Another instance cannot speak for this one's clients
+	hub.receive(&Notification{Instance: "elsewhere", Type: EventLeave, Presence: ada.presence.copy()})
+
+	hub.receive(&Notification{Instance: "elsewhere", Type: EventLeave, Presence: remote.copy()})
+	expectType(t, ada, EventLeave, "remote")
+}
+
+func TestAccessRevoked(t *testing.T) {
+	hub, broker := testHub(t)
+	ada := hub.Join(&store.User{ID: "ada"}, "d", alwaysReadable)
+	expectType(t, ada, EventSnapshot, "")
+
+	var bobAccess readable
+	bob := hub.Join(&store.User{ID: "bob"}, "d", bobAccess.access)
+	expectType(t, bob, EventSnapshot, "")
+	expectType(t, ada, EventJoin, bob.presence.ID)
+
+	// Still allowed: nothing happens
+	hub.checkAccess()
+	select {
+	case event := <-ada.Events():
+		t.Fatalf("got a %s before Bob lost access", event.Type)
+	default:
+	}
+
+	bobAccess.revoked.Store(true)
+	hub.checkAccess()
+
+	if _, ok := <-bob.Events(); ok {
+		t.Fatal("Bob's events are still open after losing access")
+	}
+	if !errors.Is(bob.Err(), ErrAccessChanged) {
+		t.Errorf("Bob was removed for %v, want ErrAccessChanged", bob.Err())
+	}
+	expectType(t, ada, EventLeave, bob.presence.ID)
+	if got := broker.types(bob.presence.ID); len(got) == 0 || got[len(got)-1] != EventLeave {
+		t.Errorf("published %v for Bob, want a leave last", got)
+	}
+	if ada.Err() != nil {
+		t.Errorf("Ada was removed for %v", ada.Err())
+	}
+}
+
+func TestAccessCheckFailing(t *testing.T) {
+	hub, _ := testHub(t)
+	ada := hub.Join(&store.User{ID: "ada"}, "d", func() error { return errors.New("connection refused") })
+	expectType(t, ada, EventSnapshot, "")
+
+	// Access that cannot be checked is not taken away
+	hub.checkAccess()
+	select {
+	case _, ok := <-ada.Events():
+		if !ok {
+			t.Fatal("Ada was removed when the access check failed")
+		}
+	default:
+	}
+
+	// A document that can no longer be seen does remove them
+	gone := hub.Join(&store.User{ID: "bob"}, "gone", func() error { return sql.ErrNoRows })
+	expectType(t, gone, EventSnapshot, "")
+	hub.checkAccess()
+	if _, ok := <-gone.Events(); ok {
+		t.Error("Bob is still present on a document that can no longer be seen")
+	}
+}
+
+func TestAccessCheckedPeriodically(t *testing.T) {
+	broker := &memoryBroker{}
+	config := DefaultConfig
+	config.AccessInterval = 10 * time.Millisecond
+	hub := NewHub(broker, config, log.New(io.Discard, "", 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	var access readable
+	ada := hub.Join(&store.User{ID: "ada"}, "d", access.access)
+	expectType(t, ada, EventSnapshot, "")
+	access.revoked.Store(true)
+
+	select {
+	case _, ok := <-ada.Events():
+		if ok {
+			t.Fatal("got an event, want the events closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Ada was not removed after losing access")
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
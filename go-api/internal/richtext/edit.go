@@ -0,0 +1,196 @@
+package richtext
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackwillis517/Scribo/internal/diff"
+)
+
+// Edit returns content changed so that its plain text (see PlainText) reads
+// text. Blocks whose text is unchanged keep their markup byte for byte; a
+// changed block keeps its tag and the emphasis of the words that survive; new
+// paragraphs are added as plain paragraphs, or as list items after a list
+// item. Content that is not HTML is plain text already and is replaced.
+func Edit(content string, text string) string {
+	if !IsHTML(content) {
+		return text
+	}
+
+	spans := parseHTML(content)
+	oldParas := make([]string, len(spans))
+	for i, span := range spans {
+		oldParas[i] = BlocksText([]Block{span.block})
+	}
+	newParas := []string{}
+	if text != "" {
+		newParas = strings.Split(text, "\n\n")
+	}
+
+	var b strings.Builder
+	pos := 0
+	previousTag := "p"
+	for _, step := range alignParagraphs(oldParas, newParas) {
+		switch {
+		case step.old >= 0 && step.new >= 0 && oldParas[step.old] == newParas[step.new]:
+			span := spans[step.old]
+			b.WriteString(content[pos:span.end])
+			pos = span.end
+			previousTag = span.block.Tag
+		case step.old >= 0 && step.new >= 0:
+			span := spans[step.old]
+			b.WriteString(content[pos:span.start])
+			if block, ok := editBlock(span.block, newParas[step.new]); ok {
+				b.WriteString(blockHTML(block))
+			}
+			pos = span.end
+			previousTag = span.block.Tag
+		case step.old >= 0:
+			span := spans[step.old]
+			b.WriteString(content[pos:span.start])
+			pos = span.end
+		default:
+			tag := "p"
+			if previousTag == "li" {
+				tag = "li"
+			}
+			if block, ok := editBlock(Block{Tag: tag}, newParas[step.new]); ok {
+				b.WriteString(blockHTML(block))
+			}
+		}
+	}
+	b.WriteString(content[pos:])
+	return b.String()
+}
+
+// editBlock rewrites a block to read text. Runes kept from the old text keep
+// their emphasis, and inserted text takes the emphasis of what precedes it.
+func editBlock(block Block, text string) (Block, bool) {
+	if strings.TrimSpace(text) == "* * *" {
+		return Block{Tag: "hr", Runs: []Run{}}, true
+	}
+	tag := block.Tag
+	if tag == "hr" {
+		tag = "p"
+	}
+
+	marks := []Run{}
+	for _, run := range block.Runs {
+		for range run.Text {
+			marks = append(marks, Run{Bold: run.Bold, Italic: run.Italic})
+		}
+	}
+	markAt := func(i int) Run {
+		switch {
+		case i > 0 && i <= len(marks):
+			return marks[i-1]
+		case len(marks) > 0:
+			return marks[0]
+		}
+		return Run{}
+	}
+
+	result, err := diff.Compare(block.Text, text, diff.GranularityWord)
+	if err != nil {
+		return NewBlock(tag, []Run{{Text: text}})
+	}
+
+	runs := []Run{}
+	i := 0
+	for _, h := range result.Hunks {
+		switch h.Op {
+		case diff.OpEqual:
+			for _, r := range h.Text {
+				mark := markAt(i + 1)
+				runs = append(runs, Run{Text: string(r), Bold: mark.Bold, Italic: mark.Italic})
+				i++
+			}
+		case diff.OpDelete:
+			i += utf8.RuneCountInString(h.Text)
+		case diff.OpInsert:
+			mark := markAt(i)
+			runs = append(runs, Run{Text: h.Text, Bold: mark.Bold, Italic: mark.Italic})
+		}
+	}
+	return NewBlock(tag, runs)
+}
+
+// alignStep pairs an old paragraph with a new one; old or new is -1 for a
+// paragraph that was inserted or deleted.
+type alignStep struct {
+	old, new int
+}
+
+// alignParagraphs matches unchanged paragraphs by longest common subsequence
+// and pairs the remaining old and new paragraphs in order, so a rewritten
+// paragraph is an edit of the one it replaced.
+func alignParagraphs(oldParas, newParas []string) []alignStep {
+	prefix := 0
+	for prefix < len(oldParas) && prefix < len(newParas) && oldParas[prefix] == newParas[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldParas)-prefix && suffix < len(newParas)-prefix &&
+		oldParas[len(oldParas)-1-suffix] == newParas[len(newParas)-1-suffix] {
+		suffix++
+	}
+	a, b := oldParas[prefix:len(oldParas)-suffix], newParas[prefix:len(newParas)-suffix]
+
+	// lcs[i][j] is the common subsequence length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	steps := []alignStep{}
+	for i := 0; i < prefix; i++ {
+		steps = append(steps, alignStep{i, i})
+	}
+
+	var deleted, inserted []int
+	pair := func() {
+		n := min(len(deleted), len(inserted))
+		for k := 0; k < n; k++ {
+			steps = append(steps, alignStep{deleted[k], inserted[k]})
+		}
+		for _, i := range deleted[n:] {
+			steps = append(steps, alignStep{i, -1})
+		}
+		for _, j := range inserted[n:] {
+			steps = append(steps, alignStep{-1, j})
+		}
+		deleted, inserted = nil, nil
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			pair()
+			steps = append(steps, alignStep{prefix + i, prefix + j})
+			i++
+			j++
+		case j >= len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			deleted = append(deleted, prefix+i)
+			i++
+		default:
+			inserted = append(inserted, prefix+j)
+			j++
+		}
+	}
+	pair()
+
+	for k := 0; k < suffix; k++ {
+		steps = append(steps, alignStep{len(oldParas) - suffix + k, len(newParas) - suffix + k})
+	}
+	return steps
+}
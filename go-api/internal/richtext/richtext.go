@@ -0,0 +1,350 @@
+// Package richtext reads the HTML that the Tiptap editor stores in
+// sections.content and turns it into plain prose blocks. Content written
+// before the editor existed, or imported as plain text, is also accepted.
+package richtext
+
+import (
+	"encoding/xml"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Run is a stretch of text inside a block that shares the same emphasis.
+type Run struct {
+	Text   string `json:"text"`
+	Bold   bool   `json:"bold,omitempty"`
+	Italic bool   `json:"italic,omitempty"`
+}
+
+type Block struct {
+	Tag  string `json:"tag"`
+	Text string `json:"text"`
+	Runs []Run  `json:"runs"`
+}
+
+var blockTags = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"li": true, "blockquote": true, "pre": true, "hr": true,
+}
+
+var (
+	htmlTag   = regexp.MustCompile(`<[a-zA-Z/!][^>]*>`)
+	blankLine = regexp.MustCompile(`\n[ \t]*\n\s*`)
+)
+
+// IsHTML reports whether content looks like editor HTML rather than plain text.
+func IsHTML(content string) bool {
+	return htmlTag.MatchString(content)
+}
+
+// builder collects the raw text of one block along with the emphasis of each
+// rune, so whitespace can be normalized without losing where runs start.
+type builder struct {
+	tag   string
+	runes []rune
+	marks []Run
+}
+
+func (b *builder) write(text string, bold bool, italic bool) {
+	for _, r := range text {
+		b.runes = append(b.runes, r)
+		b.marks = append(b.marks, Run{Bold: bold, Italic: italic})
+	}
+}
+
+func (b *builder) block() (Block, bool) {
+	type styled struct {
+		r    rune
+		mark Run
+	}
+	out := []styled{}
+
+	if b.tag == "pre" {
+		for i, r := range b.runes {
+			out = append(out, styled{r, b.marks[i]})
+		}
+		for len(out) > 0 && out[0].r == '\n' {
+			out = out[1:]
+		}
+	} else {
+		// Collapse whitespace the way a browser would, keeping the
+		// newlines that came from <br>.
+		var pending *Run
+		for i, r := range b.runes {
+			switch {
+			case r == '\n':
+				pending = nil
+				if len(out) > 0 && out[len(out)-1].r != '\n' {
+					out = append(out, styled{'\n', b.marks[i]})
+				}
+			case unicode.IsSpace(r):
+				if len(out) > 0 && out[len(out)-1].r != '\n' && pending == nil {
+					mark := b.marks[i]
+					pending = &mark
+				}
+			default:
+				if pending != nil {
+					out = append(out, styled{' ', *pending})
+					pending = nil
+				}
+				out = append(out, styled{r, b.marks[i]})
+			}
+		}
+	}
+	for len(out) > 0 && out[len(out)-1].r == '\n' {
+		out = out[:len(out)-1]
+	}
+
+	if len(out) == 0 {
+		return Block{}, false
+	}
+
+	block := Block{Tag: b.tag, Runs: []Run{}}
+	var text strings.Builder
+	for _, s := range out {
+		text.WriteRune(s.r)
+		n := len(block.Runs)
+		if n > 0 && block.Runs[n-1].Bold == s.mark.Bold && block.Runs[n-1].Italic == s.mark.Italic {
+			block.Runs[n-1].Text += string(s.r)
+			continue
+		}
+		block.Runs = append(block.Runs, Run{Text: string(s.r), Bold: s.mark.Bold, Italic: s.mark.Italic})
+	}
+	block.Text = text.String()
+	return block, true
+}
+
+// Parse splits content into blocks. <strong>/<b> and <em>/<i> are kept as
+// run emphasis, other inline markup is dropped, <br> becomes a newline, and
+// list items, quotes and headings each become their own block.
+func Parse(content string) []Block {
+	if !IsHTML(content) {
+		return parsePlain(content)
+	}
+
+	spans := parseHTML(content)
+	blocks := make([]Block, len(spans))
+	for i, span := range spans {
+		blocks[i] = span.block
+	}
+	return blocks
+}
+
+// span is a parsed block along with the byte range of content it came from.
+type span struct {
+	block      Block
+	start, end int
+}
+
+func parseHTML(content string) []span {
+	decoder := xml.NewDecoder(strings.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	spans := []span{}
+	current := &builder{}
+	start := -1
+	bold, italic := 0, 0
+
+	flush := func(end int) {
+		if block, ok := current.block(); ok {
+			spans = append(spans, span{block: block, start: start, end: end})
+		}
+		current = &builder{}
+		start = -1
+	}
+
+	for {
+		offset := int(decoder.InputOffset())
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Malformed markup: keep what was read and fall back to
+			// stripping tags from the rest.
+			if current.tag == "" {
+				current.tag = "p"
+			}
+			if start < 0 {
+				start = offset
+			}
+			current.write(htmlTag.ReplaceAllString(content[decoder.InputOffset():], " "), false, false)
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			switch {
+			case name == "br":
+				if start < 0 {
+					start = offset
+				}
+				current.write("\n", false, false)
+			case name == "hr":
+				flush(offset)
+				spans = append(spans, span{block: Block{Tag: "hr", Runs: []Run{}}, start: offset, end: int(decoder.InputOffset())})
+			case name == "strong" || name == "b":
+				bold++
+			case name == "em" || name == "i":
+				italic++
+			case blockTags[name]:
+				// Nested blocks (a <p> inside an <li>) belong to the outer block
+				if current.tag == "" || name != "p" {
+					flush(offset)
+					current.tag = name
+					start = offset
+				}
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			switch {
+			case name == "strong" || name == "b":
+				bold = max(bold-1, 0)
+			case name == "em" || name == "i":
+				italic = max(italic-1, 0)
+			case blockTags[name] && name == current.tag:
+				flush(int(decoder.InputOffset()))
+			case name == "p" && current.tag != "":
+				current.write("\n", false, false)
+			}
+		case xml.CharData:
+			if current.tag == "" {
+				current.tag = "p"
+			}
+			if start < 0 {
+				start = offset
+			}
+			current.write(string(t), bold > 0, italic > 0)
+		}
+	}
+	flush(len(content))
+	return spans
+}
+
+// NewBlock builds a block from runs, collapsing whitespace the same way Parse
+// does. It reports false when nothing visible is left.
+func NewBlock(tag string, runs []Run) (Block, bool) {
+	b := &builder{tag: tag}
+	for _, run := range runs {
+		b.write(run.Text, run.Bold, run.Italic)
+	}
+	return b.block()
+}
+
+var sceneBreak = regexp.MustCompile(`^(#|\*|~)( ?(#|\*|~))*$`)
+
+// IsSceneBreak reports whether a block marks a scene break: a horizontal rule,
+// or a paragraph holding nothing but "#", "***", "* * *" and the like.
+func IsSceneBreak(block Block) bool {
+	if block.Tag == "hr" {
+		return true
+	}
+	return block.Tag == "p" && sceneBreak.MatchString(strings.TrimSpace(block.Text))
+}
+
+func parsePlain(content string) []Block {
+	blocks := []Block{}
+	for _, para := range blankLine.Split(content, -1) {
+		b := &builder{tag: "p"}
+		b.write(para, false, false)
+		if block, ok := b.block(); ok {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// PlainText renders content as plain text with a blank line between blocks.
+func PlainText(content string) string {
+	return BlocksText(Parse(content))
+}
+
+// BlocksText joins parsed blocks back into plain text, with a blank line
+// between blocks and "* * *" for a horizontal rule.
+func BlocksText(blocks []Block) string {
+	parts := []string{}
+	for _, block := range blocks {
+		if block.Tag == "hr" {
+			parts = append(parts, "* * *")
+			continue
+		}
+		parts = append(parts, block.Text)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// HTML renders blocks back into the markup the editor stores, so imported
+// text loads into Tiptap the same way typed text does.
+func HTML(blocks []Block) string {
+	var b strings.Builder
+	inList := false
+	for _, block := range blocks {
+		if block.Tag == "li" && !inList {
+			b.WriteString("<ul>")
+			inList = true
+		} else if block.Tag != "li" && inList {
+			b.WriteString("</ul>")
+			inList = false
+		}
+
+		b.WriteString(blockHTML(block))
+	}
+	if inList {
+		b.WriteString("</ul>")
+	}
+	return b.String()
+}
+
+// blockHTML renders one block; list items are not wrapped in a list.
+func blockHTML(block Block) string {
+	switch block.Tag {
+	case "hr":
+		return "<hr>"
+	case "pre":
+		return "<pre><code>" + html.EscapeString(block.Text) + "</code></pre>"
+	case "li", "blockquote":
+		return "<" + block.Tag + "><p>" + runsHTML(block.Runs) + "</p></" + block.Tag + ">"
+	default:
+		return "<" + block.Tag + ">" + runsHTML(block.Runs) + "</" + block.Tag + ">"
+	}
+}
+
+func runsHTML(runs []Run) string {
+	var b strings.Builder
+	for _, run := range runs {
+		text := strings.ReplaceAll(html.EscapeString(run.Text), "\n", "<br>")
+		if run.Italic {
+			text = "<em>" + text + "</em>"
+		}
+		if run.Bold {
+			text = "<strong>" + text + "</strong>"
+		}
+		b.WriteString(text)
+	}
+	return b.String()
+}
+
+// CountCharacters counts the characters of visible text, ignoring markup and
+// the blank lines between blocks.
+func CountCharacters(content string) int {
+	count := 0
+	for _, block := range Parse(content) {
+		count += len([]rune(block.Text))
+	}
+	return count
+}
+
+// CountWords counts the words a reader would see, ignoring markup.
+func CountWords(content string) int {
+	count := 0
+	for _, block := range Parse(content) {
+		count += len(strings.Fields(block.Text))
+	}
+	return count
+}
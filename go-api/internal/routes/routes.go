@@ -12,29 +12,90 @@ func SetupRoutes(app *app.Application) *chi.Mux {
 	r.Group(func(r chi.Router) {
 		r.Use(app.Middleware.Authenticate)
 
+		// Anything that changes data is closed to read-only access tokens, and
+		// credentials can only be managed from a signed-in session
+		write := r.With(app.Middleware.RequireWriteAccess)
+		account := r.With(app.Middleware.RequireSession)
+
 		r.Get("/user/getUser", app.UserHandler.HandleGetUser)
+		account.Get("/user/getSessions", app.UserHandler.HandleGetSessions)
+		account.Delete("/user/revokeSession/{id}", app.UserHandler.HandleRevokeSession)
+		account.Post("/user/revokeAllSessions", app.UserHandler.HandleRevokeAllSessions)
+		account.Post("/user/createAccessToken", app.AccessTokenHandler.HandleCreateAccessToken)
+		account.Get("/user/getAccessTokens", app.AccessTokenHandler.HandleGetAccessTokens)
+		account.Delete("/user/revokeAccessToken/{id}", app.AccessTokenHandler.HandleRevokeAccessToken)
 
-		r.Post("/documents/createDocument", app.DocumentHandler.HandleCreateDocument)
+		write.Post("/documents/createDocument", app.DocumentHandler.HandleCreateDocument)
 		r.Post("/documents/readDocument", app.DocumentHandler.HandleReadDocument)
-		r.Put("/documents/updateDocument", app.DocumentHandler.HandleUpdateDocument)
-		r.Delete("/documents/deleteDocument/{id}", app.DocumentHandler.HandleDeleteDocument)
+		write.Put("/documents/updateDocument", app.DocumentHandler.HandleUpdateDocument)
+		write.Delete("/documents/deleteDocument/{id}", app.DocumentHandler.HandleDeleteDocument)
 		r.Get("/documents/getAllDocuments", app.DocumentHandler.HandleGetAllDocuments)
+		r.Get("/documents/exportDocument/{id}", app.ExportHandler.HandleExportDocument)
+		write.Post("/documents/importDocument", app.ImportHandler.HandleImportDocument)
+		write.Post("/documents/recomputeStats", app.DocumentHandler.HandleRecomputeStats)
+		r.Post("/documents/getMembers", app.MemberHandler.HandleGetMembers)
+		write.Put("/documents/updateMember", app.MemberHandler.HandleUpdateMember)
+		write.Post("/documents/removeMember", app.MemberHandler.HandleRemoveMember)
+		write.Post("/documents/inviteMember", app.MemberHandler.HandleInviteMember)
+		r.Post("/documents/getInvitations", app.MemberHandler.HandleGetDocumentInvitations)
+		write.Delete("/documents/revokeInvitation/{id}", app.MemberHandler.HandleRevokeInvitation)
+		r.Get("/documents/presence/{id}", app.PresenceHandler.HandlePresence)
+		r.Get("/invitations/getInvitations", app.MemberHandler.HandleGetInvitations)
+		write.Post("/invitations/acceptInvitation", app.MemberHandler.HandleAcceptInvitation)
+		write.Post("/invitations/declineInvitation", app.MemberHandler.HandleDeclineInvitation)
 
-		r.Post("/sections/createSection", app.SectionHandler.HandleCreateSection)
+		write.Post("/sections/createSection", app.SectionHandler.HandleCreateSection)
 		r.Post("/sections/readSection", app.SectionHandler.HandleReadSection)
-		r.Put("/sections/updateSection", app.SectionHandler.HandleUpdateSection)
-		r.Delete("/sections/deleteSection/{id}", app.SectionHandler.HandleDeleteSection)
+		write.Put("/sections/updateSection", app.SectionHandler.HandleUpdateSection)
+		write.Delete("/sections/deleteSection/{id}", app.SectionHandler.HandleDeleteSection)
 		r.Post("/sections/getSectionsForDocument", app.SectionHandler.HandleGetSectionsForDocument)
+		r.Post("/sections/getOutline", app.SectionHandler.HandleGetOutline)
+		write.Put("/sections/reorderSections", app.SectionHandler.HandleReorderSections)
+		r.Post("/sections/getRevisions", app.SectionHandler.HandleGetRevisions)
+		r.Post("/sections/readRevision", app.SectionHandler.HandleReadRevision)
+		write.Post("/sections/restoreRevision", app.SectionHandler.HandleRestoreRevision)
+		r.Get("/sections/collaborate/{id}", app.CollabHandler.HandleCollaborate)
+
+		r.Post("/diff/compareText", app.DiffHandler.HandleCompareText)
+		r.Post("/diff/compareRevisions", app.DiffHandler.HandleCompareRevisions)
+
+		r.Get("/search", app.SearchHandler.HandleSearch)
 
-		r.Post("/agent/message", app.AgentHandler.HandleAgentMessage)
-		r.Post("/agent/saveSection", app.AgentHandler.HandleSaveSection)
+		r.Get("/usage/getUsage", app.UsageHandler.HandleGetUsage)
+
+		write.Post("/agent/message", app.AgentHandler.HandleAgentMessage)
+		write.Post("/agent/messageStream", app.AgentHandler.HandleAgentMessageStream)
+		write.Post("/agent/saveSection", app.AgentHandler.HandleSaveSection)
+		r.Post("/agent/indexStatus", app.AgentHandler.HandleGetIndexStatus)
+		write.Post("/agent/reindexDocument", app.AgentHandler.HandleReindexDocument)
 		r.Post("/agent/getMessagesById", app.AgentHandler.HandleGetMessagesById)
+		write.Post("/agent/createThread", app.AgentHandler.HandleCreateThread)
+		r.Post("/agent/getThreads", app.AgentHandler.HandleGetThreads)
+		r.Post("/agent/getThreadMessages", app.AgentHandler.HandleGetThreadMessages)
+		write.Post("/agent/forkThread", app.AgentHandler.HandleForkThread)
+		write.Put("/agent/renameThread", app.AgentHandler.HandleRenameThread)
+		write.Put("/agent/archiveThread", app.AgentHandler.HandleArchiveThread)
+		write.Delete("/agent/deleteThread/{id}", app.AgentHandler.HandleDeleteThread)
+
+		write.Post("/proposals/createProposal", app.ProposalHandler.HandleCreateProposal)
+		r.Post("/proposals/readProposal", app.ProposalHandler.HandleReadProposal)
+		r.Post("/proposals/getProposalsForSection", app.ProposalHandler.HandleGetProposalsForSection)
+		write.Post("/proposals/acceptProposal", app.ProposalHandler.HandleAcceptProposal)
+		write.Post("/proposals/rejectProposal", app.ProposalHandler.HandleRejectProposal)
 
-		// /notes/...
+		write.Post("/notes/createNote", app.NoteHandler.HandleCreateNote)
+		r.Post("/notes/readNote", app.NoteHandler.HandleReadNote)
+		write.Put("/notes/updateNote", app.NoteHandler.HandleUpdateNote)
+		write.Delete("/notes/deleteNote/{id}", app.NoteHandler.HandleDeleteNote)
+		r.Get("/notes/getAllNotes", app.NoteHandler.HandleGetAllNotes)
+		r.Post("/notes/getNotesForSection", app.NoteHandler.HandleGetNotesForSection)
+		r.Post("/notes/getNotesForDocument", app.NoteHandler.HandleGetNotesForDocument)
+		r.Post("/notes/getOrphanedNotes", app.NoteHandler.HandleGetOrphanedNotes)
 	})
 
 	r.Get("/health", app.HealthCheck)
 	r.Post("/login", app.UserHandler.HandleUserLogin)
+	r.Get("/login/providers", app.UserHandler.HandleGetLoginProviders)
 	r.Post("/user/invalidateUser", app.UserHandler.HandleInvalidateUser)
 	return r
 }
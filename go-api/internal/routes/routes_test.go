@@ -0,0 +1,62 @@
+package routes
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackwillis517/Scribo/internal/app"
+	"github.com/jackwillis517/Scribo/internal/middleware"
+	"github.com/jackwillis517/Scribo/internal/store"
+)
+
+type readOnlyTokens struct{ store.AccessTokenStore }
+
+func (readOnlyTokens) GetActiveAccessToken(secret string) (*store.AccessToken, error) {
+	if secret != "scribo_pat_read" {
+		return nil, sql.ErrNoRows
+	}
+	return &store.AccessToken{ID: "read", UserID: "ada", Scope: store.AccessTokenScopeRead}, nil
+}
+
+type users struct{ store.UserStore }
+
+func (users) GetUserByID(id string) (*store.User, error) {
+	return &store.User{ID: id}, nil
+}
+
+// TestReadOnlyTokenCannotWrite checks that routes changing each kind of
+// resource, and the account routes, refuse a read-only access token before
+// reaching their handler.
+func TestReadOnlyTokenCannotWrite(t *testing.T) {
+	router := SetupRoutes(&app.Application{
+		Middleware: middleware.UserMiddleware{UserStore: users{}, AccessTokenStore: readOnlyTokens{}},
+	})
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/documents/createDocument"},
+		{http.MethodPut, "/documents/updateDocument"},
+		{http.MethodDelete, "/documents/deleteDocument/d"},
+		{http.MethodPost, "/documents/inviteMember"},
+		{http.MethodPut, "/documents/updateMember"},
+		{http.MethodPut, "/sections/updateSection"},
+		{http.MethodPut, "/sections/reorderSections"},
+		{http.MethodPost, "/notes/createNote"},
+		{http.MethodPost, "/agent/message"},
+		{http.MethodPost, "/agent/createThread"},
+		{http.MethodPost, "/proposals/acceptProposal"},
+		{http.MethodPost, "/user/createAccessToken"},
+		{http.MethodDelete, "/user/revokeSession/s"},
+	} {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			r := httptest.NewRequest(route.method, route.path, nil)
+			r.Header.Set("Authorization", "Bearer scribo_pat_read")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("status is %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
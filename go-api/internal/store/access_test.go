@@ -0,0 +1,218 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+// TestCrossUserAccess checks that another user cannot read, update or
+// delete a user's document, section, note or thread, and is told they do
+// not exist rather than that they are someone else's.
+func TestCrossUserAccess(t *testing.T) {
+	db := testDB(t)
+	documents := NewPostgresDocumentStore(db)
+	sections := NewPostgresSectionStore(db, DefaultRevisionRetention)
+	notes := NewPostgresNoteStore(db)
+	agent := NewPostgresAgentStore(db)
+
+	alice := testUser(t, db, "alice")
+	bob := testUser(t, db, "bob")
+
+	document, err := documents.CreateDocument(&Document{Title: "Alice's novel"}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, err := sections.CreateSection(alice, &Section{DocumentID: document.ID, Title: "One", Content: "It was a dark and stormy night."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := notes.CreateNote(alice, &Note{SectionID: section.ID, Content: "Too cliché?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread, err := agent.CreateThread(alice, section.ID, "Openings")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notFound := func(t *testing.T, what string, err error) {
+		t.Helper()
+		if !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("%s: got %v, want sql.ErrNoRows", what, err)
+		}
+	}
+
+	t.Run("document", func(t *testing.T) {
+		_, err := documents.ReadDocument(bob, document.ID)
+		notFound(t, "read", err)
+		_, err = documents.UpdateDocument(bob, &Document{ID: document.ID, Title: "Bob's now"})
+		notFound(t, "update", err)
+		notFound(t, "delete", documents.DeleteDocument(bob, document.ID))
+	})
+
+	t.Run("section", func(t *testing.T) {
+		_, err := sections.ReadSection(bob, section.ID)
+		notFound(t, "read", err)
+		_, err = sections.UpdateSection(bob, &Section{ID: section.ID, Title: "Mine", Content: "Overwritten."})
+		notFound(t, "update", err)
+		notFound(t, "delete", sections.DeleteSection(bob, section.ID))
+	})
+
+	// The agent handler checks a message's section against its document
+	// with ReadSection, so Bob naming his own document does not reach
+	// Alice's section
+	t.Run("section of another document", func(t *testing.T) {
+		own, err := documents.CreateDocument(&Document{Title: "Bob's novel"}, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := documents.ReadDocument(bob, own.ID); err != nil {
+			t.Fatal(err)
+		}
+		_, err = sections.ReadSection(bob, section.ID)
+		notFound(t, "read", err)
+		read, err := sections.ReadSection(alice, section.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read.DocumentID == own.ID {
+			t.Errorf("section reports document %s, want %s", read.DocumentID, document.ID)
+		}
+	})
+
+	t.Run("note", func(t *testing.T) {
+		_, err := notes.ReadNote(bob, note.ID)
+		notFound(t, "read", err)
+		_, err = notes.UpdateNote(bob, &Note{ID: note.ID, Content: "Overwritten."})
+		notFound(t, "update", err)
+		notFound(t, "delete", notes.DeleteNote(bob, note.ID))
+	})
+
+	t.Run("thread", func(t *testing.T) {
+		_, err := agent.ReadThread(bob, thread.ThreadID)
+		notFound(t, "read", err)
+		_, err = agent.RenameThread(bob, thread.ThreadID, "Mine")
+		notFound(t, "update", err)
+		notFound(t, "delete", agent.DeleteThread(bob, thread.ThreadID))
+	})
+
+	// Nothing Bob tried went through
+	readDocument, err := documents.ReadDocument(alice, document.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readDocument.Title != document.Title {
+		t.Errorf("document title is %q, want %q", readDocument.Title, document.Title)
+	}
+	readSection, err := sections.ReadSection(alice, section.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readSection.Content != section.Content {
+		t.Errorf("section content is %q, want %q", readSection.Content, section.Content)
+	}
+	readNote, err := notes.ReadNote(alice, note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readNote.Content != note.Content {
+		t.Errorf("note content is %q, want %q", readNote.Content, note.Content)
+	}
+	readThread, err := agent.ReadThread(alice, thread.ThreadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readThread.Title != thread.Title {
+		t.Errorf("thread title is %q, want %q", readThread.Title, thread.Title)
+	}
+}
+
+// TestRoleMatrix checks what each role on a shared document may do. Members
+// are told they lack the role; anyone else is told the document does not
+// exist.
+func TestRoleMatrix(t *testing.T) {
+	db := testDB(t)
+	documents := NewPostgresDocumentStore(db)
+	sections := NewPostgresSectionStore(db, DefaultRevisionRetention)
+	notes := NewPostgresNoteStore(db)
+	agent := NewPostgresAgentStore(db)
+	members := NewPostgresMemberStore(db)
+
+	owner := testUser(t, db, "owner")
+	document, err := documents.CreateDocument(&Document{Title: "Shared"}, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, err := sections.CreateSection(owner, &Section{DocumentID: document.ID, Title: "One", Content: "Shared words."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := map[string]*User{RoleOwner: owner, "outsider": testUser(t, db, "outsider")}
+	for _, role := range []string{RoleEditor, RoleCommenter, RoleViewer} {
+		users[role] = testUser(t, db, role)
+		_, err := db.Exec(`INSERT INTO document_members (document_id, user_id, role) VALUES ($1, $2, $3)`, document.ID, users[role].ID, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	operations := []struct {
+		name string
+		// role is the least role that may do it
+		role string
+		do   func(user *User) error
+	}{
+		{"read document", RoleViewer, func(user *User) error {
+			_, err := documents.ReadDocument(user, document.ID)
+			return err
+		}},
+		{"update document", RoleEditor, func(user *User) error {
+			_, err := documents.UpdateDocument(user, &Document{ID: document.ID, Title: document.Title})
+			return err
+		}},
+		{"update section", RoleEditor, func(user *User) error {
+			_, err := sections.UpdateSection(user, &Section{ID: section.ID, Title: section.Title, Content: section.Content})
+			return err
+		}},
+		{"create note", RoleCommenter, func(user *User) error {
+			_, err := notes.CreateNote(user, &Note{SectionID: section.ID, Content: "A comment."})
+			return err
+		}},
+		{"create thread", RoleCommenter, func(user *User) error {
+			_, err := agent.CreateThread(user, section.ID, "")
+			return err
+		}},
+		{"invite member", RoleOwner, func(user *User) error {
+			_, err := members.InviteMember(user, &Invitation{DocumentID: document.ID, Email: "new@example.com", Role: RoleViewer})
+			return err
+		}},
+		{"change member role", RoleOwner, func(user *User) error {
+			_, err := members.UpdateMemberRole(user, document.ID, users[RoleViewer].ID, RoleViewer)
+			return err
+		}},
+	}
+
+	for _, operation := range operations {
+		for _, role := range []string{RoleOwner, RoleEditor, RoleCommenter, RoleViewer, "outsider"} {
+			t.Run(operation.name+"/"+role, func(t *testing.T) {
+				err := operation.do(users[role])
+				switch {
+				case role == "outsider":
+					if !errors.Is(err, sql.ErrNoRows) {
+						t.Errorf("got %v, want sql.ErrNoRows", err)
+					}
+				case RoleAtLeast(role, operation.role):
+					if err != nil {
+						t.Errorf("got %v, want it allowed", err)
+					}
+				default:
+					if !errors.Is(err, ErrForbidden) {
+						t.Errorf("got %v, want ErrForbidden", err)
+					}
+				}
+			})
+		}
+	}
+}
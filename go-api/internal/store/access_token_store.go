@@ -0,0 +1,255 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	AccessTokenScopeRead      = "read"
+	AccessTokenScopeReadWrite = "read_write"
+)
+
+// accessTokenPrefix starts every personal access token, so they are easy to
+// tell from other credentials and to find if leaked.
+const accessTokenPrefix = "scribo_pat_"
+
+// accessTokenShownChars is how much of a token is kept in the clear, after
+// the prefix, for the owner to tell their tokens apart.
+const accessTokenShownChars = 6
+
+// accessTokenTouchInterval limits how often a token's last_used_at is
+// written.
+const accessTokenTouchInterval = time.Minute
+
+var (
+	ErrInvalidAccessToken = errors.New("invalid access token")
+	ErrOutsideTokenScope  = errors.New("the access token does not allow this")
+)
+
+// AccessToken is a personal access token: a long-lived credential for
+// scripts and integrations, limited to reading or to some documents. Only
+// its hash is stored; the token itself is shown once, when it is created.
+type AccessToken struct {
+	ID     string `json:"id"`
+	UserID string `json:"-"`
+	Name   string `json:"name"`
+	// Prefix is the start of the token, for telling tokens apart.
+	Prefix string `json:"prefix"`
+	Scope  string `json:"scope"`
+	// DocumentIDs limits the token to these documents; nil means all the
+	// user's documents, including ones created later.
+	DocumentIDs []string   `json:"document_ids"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// CanWrite reports whether the token may change anything.
+func (t *AccessToken) CanWrite() bool {
+	return t.Scope == AccessTokenScopeReadWrite
+}
+
+// IsAccessToken reports whether a credential looks like a personal access
+// token.
+func IsAccessToken(credential string) bool {
+	return strings.HasPrefix(credential, accessTokenPrefix)
+}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAccessToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return accessTokenPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+type PostgresAccessTokenStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAccessTokenStore(db *sql.DB) *PostgresAccessTokenStore {
+	return &PostgresAccessTokenStore{db: db}
+}
+
+type AccessTokenStore interface {
+	CreateAccessToken(*User, *AccessToken) (*AccessToken, string, error)
+	GetAccessTokens(*User) ([]*AccessToken, error)
+	RevokeAccessToken(*User, string) error
+	GetActiveAccessToken(string) (*AccessToken, error)
+}
+
+const accessTokenColumns = `id, user_id, name, token_prefix, scope, document_ids, expires_at, last_used_at, created_at`
+
+func scanAccessToken(row rowScanner) (*AccessToken, error) {
+	token := &AccessToken{}
+	var documentsJSON []byte
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.Prefix,
+		&token.Scope,
+		&documentsJSON,
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if documentsJSON != nil {
+		if err := json.Unmarshal(documentsJSON, &token.DocumentIDs); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// CreateAccessToken issues a token for the user and returns it along with
+// the token itself, which cannot be recovered later. ErrInvalidAccessToken
+// is returned for an unknown scope, a past expiry, or documents the user
+// cannot see.
+func (p *PostgresAccessTokenStore) CreateAccessToken(user *User, token *AccessToken) (*AccessToken, string, error) {
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		return nil, "", fmt.Errorf("%w: a name is required", ErrInvalidAccessToken)
+	}
+	if token.Scope != AccessTokenScopeRead && token.Scope != AccessTokenScopeReadWrite {
+		return nil, "", fmt.Errorf("%w: unknown scope %q", ErrInvalidAccessToken, token.Scope)
+	}
+	if token.ExpiresAt != nil && !token.ExpiresAt.After(time.Now()) {
+		return nil, "", fmt.Errorf("%w: expiry is in the past", ErrInvalidAccessToken)
+	}
+
+	var documentsJSON []byte
+	if token.DocumentIDs != nil {
+		slices.Sort(token.DocumentIDs)
+		token.DocumentIDs = slices.Compact(token.DocumentIDs)
+		if len(token.DocumentIDs) == 0 {
+			return nil, "", fmt.Errorf("%w: document_ids is empty", ErrInvalidAccessToken)
+		}
+
+		var visible int
+		err := p.db.QueryRow(
+			`SELECT count(*) FROM documents d WHERE `+hasRole("d", 1, RoleViewer)+` AND d.id::text = ANY($2::text[])`,
+			user.ID, token.DocumentIDs,
+		).Scan(&visible)
+		if err != nil {
+			return nil, "", err
+		}
+		if visible != len(token.DocumentIDs) {
+			return nil, "", fmt.Errorf("%w: unknown document", ErrInvalidAccessToken)
+		}
+
+		documentsJSON, err = json.Marshal(token.DocumentIDs)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	secret, err := newAccessToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	query := `
+	INSERT INTO access_tokens (user_id, name, token_prefix, token_hash, scope, document_ids, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING ` + accessTokenColumns + `
+	`
+	created, err := scanAccessToken(p.db.QueryRow(query,
+		user.ID,
+		token.Name,
+		secret[:len(accessTokenPrefix)+accessTokenShownChars],
+		hashAccessToken(secret),
+		token.Scope,
+		documentsJSON,
+		token.ExpiresAt,
+	))
+	if err != nil {
+		return nil, "", err
+	}
+	return created, secret, nil
+}
+
+// GetAccessTokens lists the user's tokens that are neither revoked nor
+// expired, newest first.
+func (p *PostgresAccessTokenStore) GetAccessTokens(user *User) ([]*AccessToken, error) {
+	query := `
+		SELECT ` + accessTokenColumns + `
+		FROM access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY created_at DESC
+	`
+	rows, err := p.db.Query(query, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*AccessToken{}
+	for rows.Next() {
+		token, err := scanAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (p *PostgresAccessTokenStore) RevokeAccessToken(user *User, tokenId string) error {
+	query := `
+		UPDATE access_tokens
+		SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`
+	result, err := p.db.Exec(query, tokenId, user.ID)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// GetActiveAccessToken looks a token up by its value and returns it if it
+// is neither revoked nor expired, or sql.ErrNoRows, noting that it has been
+// used.
+func (p *PostgresAccessTokenStore) GetActiveAccessToken(secret string) (*AccessToken, error) {
+	query := `
+		SELECT ` + accessTokenColumns + `
+		FROM access_tokens
+		WHERE token_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+	`
+	token, err := scanAccessToken(p.db.QueryRow(query, hashAccessToken(secret)))
+	if err != nil {
+		return nil, err
+	}
+
+	if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > accessTokenTouchInterval {
+		_, err := p.db.Exec(`UPDATE access_tokens SET last_used_at = NOW() WHERE id = $1`, token.ID)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		token.LastUsedAt = &now
+	}
+	return token, nil
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestAccessTokens checks that a token only works while it is neither
+// revoked nor expired, and that a token limited to some documents keeps the
+// user to them.
+func TestAccessTokens(t *testing.T) {
+	db := testDB(t)
+	tokens := NewPostgresAccessTokenStore(db)
+	documents := NewPostgresDocumentStore(db)
+	ada := testUser(t, db, "ada")
+
+	inScope, err := documents.CreateDocument(&Document{Title: "Shared with the script"}, ada)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outOfScope, err := documents.CreateDocument(&Document{Title: "Private"}, ada)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newToken := func(t *testing.T, token *AccessToken) (*AccessToken, string) {
+		t.Helper()
+		token.Name = t.Name()
+		created, secret, err := tokens.CreateAccessToken(ada, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created, secret
+	}
+	inactive := func(t *testing.T, secret string) {
+		t.Helper()
+		if _, err := tokens.GetActiveAccessToken(secret); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("got %v, want sql.ErrNoRows", err)
+		}
+	}
+
+	t.Run("document scope", func(t *testing.T) {
+		_, secret := newToken(t, &AccessToken{Scope: AccessTokenScopeReadWrite, DocumentIDs: []string{inScope.ID}})
+		token, err := tokens.GetActiveAccessToken(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// As the middleware does
+		scoped := &User{ID: ada.ID, DocumentIDs: token.DocumentIDs}
+
+		if _, err := documents.ReadDocument(scoped, inScope.ID); err != nil {
+			t.Errorf("reading a document in scope: %v", err)
+		}
+		if _, err := documents.ReadDocument(scoped, outOfScope.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("reading a document out of scope got %v, want sql.ErrNoRows", err)
+		}
+		_, err = documents.UpdateDocument(scoped, &Document{ID: outOfScope.ID, Title: "Changed"})
+		if !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("updating a document out of scope got %v, want sql.ErrNoRows", err)
+		}
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		_, secret := newToken(t, &AccessToken{Scope: AccessTokenScopeRead})
+		token, err := tokens.GetActiveAccessToken(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.CanWrite() {
+			t.Error("a read-only token can write")
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		token, secret := newToken(t, &AccessToken{Scope: AccessTokenScopeReadWrite})
+		if err := tokens.RevokeAccessToken(ada, token.ID); err != nil {
+			t.Fatal(err)
+		}
+		inactive(t, secret)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		expiresAt := time.Now().Add(time.Hour)
+		token, secret := newToken(t, &AccessToken{Scope: AccessTokenScopeReadWrite, ExpiresAt: &expiresAt})
+		if _, err := tokens.GetActiveAccessToken(secret); err != nil {
+			t.Fatalf("a token before its expiry: %v", err)
+		}
+		if _, err := db.Exec(`UPDATE access_tokens SET expires_at = NOW() - INTERVAL '1 second' WHERE id = $1`, token.ID); err != nil {
+			t.Fatal(err)
+		}
+		inactive(t, secret)
+	})
+}
@@ -12,6 +12,8 @@ type AgentMessage struct {
 	ThreadID   *string `json:"thread_id,omitempty"`
 	Role       string  `json:"role"`
 	Content    string  `json:"content"`
+	// Usage is reported by the agent backend on replies.
+	Usage *TokenUsage `json:"usage,omitempty"`
 }
 
 type AgentResponse struct {
@@ -26,19 +28,28 @@ func NewPostgresAgentStore(db *sql.DB) AgentStore {
 }
 
 type AgentStore interface {
-	GetAgentMessagesByID(documentID string, sectionID string) ([]AgentMessage, error)
+	GetAgentMessagesByID(user *User, documentID string, sectionID string) ([]AgentMessage, error)
+	CreateThread(user *User, sectionID string, title string) (*Thread, error)
+	ReadThread(user *User, threadID string) (*Thread, error)
+	GetThreads(user *User, filter ThreadQuery) ([]*Thread, error)
+	GetThreadMessages(user *User, threadID string, limit int, offset int) ([]ThreadMessage, int, error)
+	RenameThread(user *User, threadID string, title string) (*Thread, error)
+	ArchiveThread(user *User, threadID string, archived bool) (*Thread, error)
+	DeleteThread(user *User, threadID string) error
+	ForkThread(user *User, threadID string, messageID string, title string) (*Thread, error)
 }
 
-func (pa *PostgresAgentStore) GetAgentMessagesByID(documentID string, sectionID string) ([]AgentMessage, error) {
+func (pa *PostgresAgentStore) GetAgentMessagesByID(user *User, documentID string, sectionID string) ([]AgentMessage, error) {
 	query := `
 		SELECT m.role, m.content, c.thread_id, c.document_id
 		FROM messages m
 		JOIN conversations c ON m.thread_id = c.thread_id
-		WHERE c.document_id = $1 AND c.section_id = $2
+		JOIN documents d ON c.document_id = d.id
+		WHERE c.document_id = $1 AND c.section_id = $2 AND ` + hasRole("d", 3, RoleViewer) + ` AND ($4::text[] IS NULL OR d.id::text = ANY($4::text[]))
 		ORDER BY m.created_at ASC
 	`
 
-	rows, err := pa.db.Query(query, documentID, sectionID)
+	rows, err := pa.db.Query(query, documentID, sectionID, user.ID, user.documentScope())
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,394 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrMessageNotFound = errors.New("message not found in thread")
+
+// Thread is one conversation with the agent about a section. Title falls back
+// to the start of the first question until the writer names the thread. A
+// fork records the thread and message it branched from; listings nest forks
+// under their parent.
+type Thread struct {
+	ThreadID            string         `json:"thread_id"`
+	DocumentID          string         `json:"document_id"`
+	SectionID           string         `json:"section_id"`
+	ParentThreadID      *string        `json:"parent_thread_id"`
+	ForkedFromMessageID *string        `json:"forked_from_message_id"`
+	Forks               []*Thread      `json:"forks,omitempty"`
+	Title               string         `json:"title"`
+	Archived            bool           `json:"archived"`
+	ArchivedAt          *time.Time     `json:"archived_at"`
+	MessageCount        int            `json:"message_count"`
+	LastMessage         *ThreadMessage `json:"last_message"`
+	CreatedAt           time.Time      `json:"created_at"`
+	UpdatedAt           time.Time      `json:"updated_at"`
+}
+
+type ThreadMessage struct {
+	ID        string    `json:"id"`
+	ThreadID  string    `json:"thread_id"`
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ThreadQuery selects the threads of a document, optionally narrowed to one
+// section. Archived threads are left out unless asked for.
+type ThreadQuery struct {
+	DocumentID      string `json:"document_id"`
+	SectionID       string `json:"section_id"`
+	IncludeArchived bool   `json:"include_archived"`
+}
+
+// threadColumns falls back to the first 80 characters of the first question
+// for the title of a thread that has not been named.
+const threadColumns = `
+	c.thread_id, c.document_id, c.section_id, c.parent_thread_id, c.forked_from_message_id,
+	coalesce(nullif(c.title, ''), left(first.content, 80), ''),
+	c.archived_at, coalesce(stats.message_count, 0),
+	last.id, last.role, last.content, last.created_at,
+	c.created_at, c.updated_at
+`
+
+const threadJoins = `
+	INNER JOIN documents d ON c.document_id = d.id
+	LEFT JOIN LATERAL (
+		SELECT m.content FROM messages m
+		WHERE m.thread_id = c.thread_id AND m.role = 'user'
+		ORDER BY m.created_at ASC
+		LIMIT 1
+	) first ON true
+	LEFT JOIN LATERAL (
+		SELECT m.id, m.role, m.content, m.created_at FROM messages m
+		WHERE m.thread_id = c.thread_id
+		ORDER BY m.created_at DESC
+		LIMIT 1
+	) last ON true
+	LEFT JOIN LATERAL (
+		SELECT count(*) AS message_count FROM messages m
+		WHERE m.thread_id = c.thread_id
+	) stats ON true
+`
+
+func scanThread(row rowScanner) (*Thread, error) {
+	thread := &Thread{}
+	var lastID, lastRole, lastContent sql.NullString
+	var lastCreatedAt sql.NullTime
+	err := row.Scan(
+		&thread.ThreadID,
+		&thread.DocumentID,
+		&thread.SectionID,
+		&thread.ParentThreadID,
+		&thread.ForkedFromMessageID,
+		&thread.Title,
+		&thread.ArchivedAt,
+		&thread.MessageCount,
+		&lastID,
+		&lastRole,
+		&lastContent,
+		&lastCreatedAt,
+		&thread.CreatedAt,
+		&thread.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	thread.Archived = thread.ArchivedAt != nil
+	if lastID.Valid {
+		thread.LastMessage = &ThreadMessage{
+			ID:        lastID.String,
+			ThreadID:  thread.ThreadID,
+			Role:      lastRole.String,
+			Content:   lastContent.String,
+			CreatedAt: lastCreatedAt.Time,
+		}
+	}
+	return thread, nil
+}
+
+// CreateThread starts an empty thread about one of the user's sections.
+func (pa *PostgresAgentStore) CreateThread(user *User, sectionID string, title string) (*Thread, error) {
+	query := `
+		INSERT INTO conversations (document_id, section_id, title)
+		SELECT s.document_id, s.id, nullif($3, '')
+		FROM sections s
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE s.id = $1 AND ` + hasRole("d", 2, RoleCommenter) + ` AND ($4::text[] IS NULL OR d.id::text = ANY($4::text[]))
+		RETURNING thread_id, document_id, section_id, coalesce(title, ''), created_at, updated_at
+	`
+	thread := &Thread{}
+	err := pa.db.QueryRow(query, sectionID, user.ID, strings.TrimSpace(title), user.documentScope()).Scan(
+		&thread.ThreadID,
+		&thread.DocumentID,
+		&thread.SectionID,
+		&thread.Title,
+		&thread.CreatedAt,
+		&thread.UpdatedAt,
+	)
+	if err != nil {
+		return nil, denied(pa.db, user, documentOfSection, sectionID, err)
+	}
+	return thread, nil
+}
+
+func (pa *PostgresAgentStore) ReadThread(user *User, threadID string) (*Thread, error) {
+	query := `
+		SELECT ` + threadColumns + `
+		FROM conversations c
+		` + threadJoins + `
+		WHERE c.thread_id = $1 AND ` + hasRole("d", 2, RoleViewer) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+	`
+	return scanThread(pa.db.QueryRow(query, threadID, user.ID, user.documentScope()))
+}
+
+// GetThreads lists threads most recently active first, as a tree: forks are
+// nested under their parent thread, or listed at the top level when the
+// parent is not listed.
+func (pa *PostgresAgentStore) GetThreads(user *User, filter ThreadQuery) ([]*Thread, error) {
+	query := `
+		SELECT ` + threadColumns + `
+		FROM conversations c
+		` + threadJoins + `
+		WHERE ` + hasRole("d", 1, RoleViewer) + ` AND c.document_id = $2
+			AND ($3 = '' OR c.section_id::text = $3)
+			AND ($4 OR c.archived_at IS NULL)
+			AND ($5::text[] IS NULL OR d.id::text = ANY($5::text[]))
+		ORDER BY c.updated_at DESC
+	`
+	rows, err := pa.db.Query(query, user.ID, filter.DocumentID, filter.SectionID, filter.IncludeArchived, user.documentScope())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	threads := []*Thread{}
+	for rows.Next() {
+		thread, err := scanThread(rows)
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return threadTree(threads), nil
+}
+
+// threadTree nests forks under their parents, keeping the order of threads.
+func threadTree(threads []*Thread) []*Thread {
+	byID := make(map[string]*Thread, len(threads))
+	for _, thread := range threads {
+		byID[thread.ThreadID] = thread
+	}
+
+	roots := []*Thread{}
+	for _, thread := range threads {
+		if thread.ParentThreadID != nil {
+			if parent, ok := byID[*thread.ParentThreadID]; ok {
+				parent.Forks = append(parent.Forks, thread)
+				continue
+			}
+		}
+		roots = append(roots, thread)
+	}
+	return roots
+}
+
+// ForkThread starts a new thread that branches from a thread at one of its
+// messages: the new thread gets a copy of the history up to and including
+// that message, and the original is left as it was.
+func (pa *PostgresAgentStore) ForkThread(user *User, threadID string, messageID string, title string) (*Thread, error) {
+	tx, err := pa.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var documentID, sectionID string
+	err = tx.QueryRow(`
+		SELECT c.document_id, c.section_id
+		FROM conversations c
+		INNER JOIN documents d ON c.document_id = d.id
+		WHERE c.thread_id = $1 AND `+hasRole("d", 2, RoleCommenter)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		FOR SHARE OF c
+	`, threadID, user.ID, user.documentScope()).Scan(&documentID, &sectionID)
+	if err != nil {
+		return nil, denied(tx, user, documentOfThread, threadID, err)
+	}
+
+	var forkedAt time.Time
+	err = tx.QueryRow(`
+		SELECT created_at FROM messages WHERE id = $1 AND thread_id = $2
+	`, messageID, threadID).Scan(&forkedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var forkID string
+	err = tx.QueryRow(`
+		INSERT INTO conversations (document_id, section_id, parent_thread_id, forked_from_message_id, title)
+		VALUES ($1, $2, $3, $4, nullif($5, ''))
+		RETURNING thread_id
+	`, documentID, sectionID, threadID, messageID, strings.TrimSpace(title)).Scan(&forkID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copies keep their timestamps so the fork reads the same up to the
+	// branch point.
+	_, err = tx.Exec(`
+		INSERT INTO messages (thread_id, role, content, created_at)
+		SELECT $1, role, content, created_at
+		FROM messages
+		WHERE thread_id = $2 AND (created_at, id) <= ($3, $4::uuid)
+		ORDER BY created_at, id
+	`, forkID, threadID, forkedAt, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return pa.ReadThread(user, forkID)
+}
+
+// GetThreadMessages returns a page of a thread's messages in the order they
+// were sent, along with how many messages the thread has. Pages count back
+// from the newest message, so offset 0 is the latest exchange.
+func (pa *PostgresAgentStore) GetThreadMessages(user *User, threadID string, limit int, offset int) ([]ThreadMessage, int, error) {
+	var total int
+	err := pa.db.QueryRow(`
+		SELECT count(m.id)
+		FROM conversations c
+		INNER JOIN documents d ON c.document_id = d.id
+		LEFT JOIN messages m ON m.thread_id = c.thread_id
+		WHERE c.thread_id = $1 AND `+hasRole("d", 2, RoleViewer)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		GROUP BY c.thread_id
+	`, threadID, user.ID, user.documentScope()).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, thread_id, role, content, created_at
+		FROM (
+			SELECT m.id, m.thread_id, m.role, m.content, m.created_at
+			FROM messages m
+			WHERE m.thread_id = $1
+			ORDER BY m.created_at DESC, m.id DESC
+			LIMIT $2 OFFSET $3
+		) page
+		ORDER BY created_at ASC, id ASC
+	`
+	rows, err := pa.db.Query(query, threadID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	messages := []ThreadMessage{}
+	for rows.Next() {
+		var message ThreadMessage
+		err := rows.Scan(&message.ID, &message.ThreadID, &message.Role, &message.Content, &message.CreatedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return messages, total, nil
+}
+
+// RenameThread sets a thread's title; an empty title goes back to the
+// default taken from the first question.
+func (pa *PostgresAgentStore) RenameThread(user *User, threadID string, title string) (*Thread, error) {
+	query := `
+		UPDATE conversations c
+		SET title = nullif($3, '')
+		FROM documents d
+		WHERE c.thread_id = $1 AND c.document_id = d.id AND ` + hasRole("d", 2, RoleCommenter) + ` AND ($4::text[] IS NULL OR d.id::text = ANY($4::text[]))
+	`
+	result, err := pa.db.Exec(query, threadID, user.ID, strings.TrimSpace(title), user.documentScope())
+	if err != nil {
+		return nil, err
+	}
+	if err := requireRowsAffected(result); err != nil {
+		return nil, denied(pa.db, user, documentOfThread, threadID, err)
+	}
+	return pa.ReadThread(user, threadID)
+}
+
+// ArchiveThread hides a thread from the default listing, or brings it back.
+// Archived threads are kept but cannot be continued.
+func (pa *PostgresAgentStore) ArchiveThread(user *User, threadID string, archived bool) (*Thread, error) {
+	query := `
+		UPDATE conversations c
+		SET archived_at = CASE WHEN $3 THEN coalesce(c.archived_at, NOW()) END
+		FROM documents d
+		WHERE c.thread_id = $1 AND c.document_id = d.id AND ` + hasRole("d", 2, RoleCommenter) + ` AND ($4::text[] IS NULL OR d.id::text = ANY($4::text[]))
+	`
+	result, err := pa.db.Exec(query, threadID, user.ID, archived, user.documentScope())
+	if err != nil {
+		return nil, err
+	}
+	if err := requireRowsAffected(result); err != nil {
+		return nil, denied(pa.db, user, documentOfThread, threadID, err)
+	}
+	return pa.ReadThread(user, threadID)
+}
+
+// agentCheckpointTables hold the agent's working memory for each thread,
+// written by the agent backend's LangGraph checkpointer.
+var agentCheckpointTables = []string{"checkpoint_writes", "checkpoint_blobs", "checkpoints"}
+
+// DeleteThread removes a thread, its messages and the agent's saved state
+// for it.
+func (pa *PostgresAgentStore) DeleteThread(user *User, threadID string) error {
+	tx, err := pa.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		DELETE FROM conversations c
+		USING documents d
+		WHERE c.thread_id = $1 AND c.document_id = d.id AND `+hasRole("d", 2, RoleEditor)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+	`, threadID, user.ID, user.documentScope())
+	if err != nil {
+		return err
+	}
+	if err := requireRowsAffected(result); err != nil {
+		return denied(tx, user, documentOfThread, threadID, err)
+	}
+
+	for _, table := range agentCheckpointTables {
+		var exists bool
+		err := tx.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE thread_id = $1`, threadID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -15,3 +15,16 @@ func Open(url string) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// requireRowsAffected reports sql.ErrNoRows when a write matched nothing, so
+// callers treat a missing row and a row owned by someone else the same way.
+func requireRowsAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Roles a user can have on a document, from most to least access. The owner
+// is the document's user_id; everyone else is a member with one of the other
+// roles.
+const (
+	RoleOwner     = "owner"
+	RoleEditor    = "editor"
+	RoleCommenter = "commenter"
+	RoleViewer    = "viewer"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer:    1,
+	RoleCommenter: 2,
+	RoleEditor:    3,
+	RoleOwner:     4,
+}
+
+// ErrForbidden means the user can see the document but their role on it does
+// not allow what they tried.
+var ErrForbidden = errors.New("your role on this document does not allow this")
+
+// IsMemberRole reports whether role can be given to a member. There is only
+// ever one owner.
+func IsMemberRole(role string) bool {
+	return role == RoleEditor || role == RoleCommenter || role == RoleViewer
+}
+
+// RoleAtLeast reports whether role grants everything minimum does.
+func RoleAtLeast(role string, minimum string) bool {
+	return roleRanks[role] >= roleRanks[minimum]
+}
+
+// hasRole is the SQL condition that the user bound to $param has at least
+// role on the document aliased as alias.
+func hasRole(alias string, param int, role string) string {
+	if role == RoleOwner {
+		return fmt.Sprintf("%s.user_id = $%d", alias, param)
+	}
+
+	var roles []string
+	for _, memberRole := range []string{RoleEditor, RoleCommenter, RoleViewer} {
+		if RoleAtLeast(memberRole, role) {
+			roles = append(roles, "'"+memberRole+"'")
+		}
+	}
+	return fmt.Sprintf(
+		"(%[1]s.user_id = $%[2]d OR EXISTS (SELECT 1 FROM document_members dm WHERE dm.document_id = %[1]s.id AND dm.user_id = $%[2]d AND dm.role IN (%[3]s)))",
+		alias, param, strings.Join(roles, ", "),
+	)
+}
+
+// documentRole is the SQL expression for the role the user bound to $param
+// has on the document aliased as alias, NULL when they have none.
+func documentRole(alias string, param int) string {
+	return fmt.Sprintf(
+		"CASE WHEN %[1]s.user_id = $%[2]d THEN '%[3]s' ELSE (SELECT dm.role FROM document_members dm WHERE dm.document_id = %[1]s.id AND dm.user_id = $%[2]d) END",
+		alias, param, RoleOwner,
+	)
+}
+
+// Queries selecting the document that the resource with ID $1 is in, for
+// denied.
+const (
+	documentOfDocument = `SELECT id FROM documents WHERE id = $1`
+	documentOfSection  = `SELECT document_id FROM sections WHERE id = $1`
+	documentOfNote     = `SELECT s.document_id FROM notes n INNER JOIN sections s ON n.section_id = s.id WHERE n.id = $1`
+	documentOfProposal = `SELECT s.document_id FROM proposals p INNER JOIN sections s ON p.section_id = s.id WHERE p.id = $1`
+	documentOfThread   = `SELECT document_id FROM conversations WHERE thread_id = $1`
+	documentOfRevision = `SELECT document_id FROM section_revisions WHERE id = $1`
+)
+
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// denied explains a statement that matched nothing because of the role it
+// required: when err is sql.ErrNoRows but the user can see the document the
+// resource is in, it returns ErrForbidden. Any other err is returned as is.
+func denied(q queryRower, user *User, documentOf string, id string, err error) error {
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var visible bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM documents d
+			WHERE d.id IN (` + documentOf + `) AND ` + hasRole("d", 2, RoleViewer) + `
+				AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		)
+	`
+	if qerr := q.QueryRow(query, id, user.ID, user.documentScope()).Scan(&visible); qerr != nil {
+		return qerr
+	}
+	if visible {
+		return ErrForbidden
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+// StatsRepair reports what RepairAllStats changed.
+type StatsRepair struct {
+	Documents       int `json:"documents"`
+	SectionsUpdated int `json:"sections_updated"`
+}
+
+// ComputeStats sets Length and NumWords from Content. Length counts the
+// characters of visible text and NumWords the words in it, so neither
+// depends on the editor's markup. Whatever the client sent is discarded.
+func (s *Section) ComputeStats() {
+	s.Length = richtext.CountCharacters(s.Content)
+	s.NumWords = richtext.CountWords(s.Content)
+}
+
+// refreshDocumentStats rolls the section statistics up into the document. It
+// runs inside the transaction that changed the sections so the totals never
+// disagree with them.
+func refreshDocumentStats(tx *sql.Tx, documentID string) error {
+	query := `
+		UPDATE documents d
+		SET length = t.length, num_words = t.num_words, num_sections = t.num_sections, updated_at = NOW()
+		FROM (
+			SELECT COALESCE(SUM(length), 0) AS length, COALESCE(SUM(num_words), 0) AS num_words, COUNT(*) AS num_sections
+			FROM sections
+			WHERE document_id = $1
+		) t
+		WHERE d.id = $1
+	`
+	_, err := tx.Exec(query, documentID)
+	return err
+}
+
+// recomputeDocumentStats recounts every section of a document from its
+// content and refreshes the document totals. It returns how many sections
+// had drifted.
+func recomputeDocumentStats(tx *sql.Tx, documentID string) (int, error) {
+	rows, err := tx.Query(`SELECT id, COALESCE(content, ''), COALESCE(length, 0), COALESCE(num_words, 0) FROM sections WHERE document_id = $1 FOR UPDATE`, documentID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	drifted := []*Section{}
+	for rows.Next() {
+		section := &Section{}
+		var length, numWords int
+		err := rows.Scan(&section.ID, &section.Content, &length, &numWords)
+		if err != nil {
+			return 0, err
+		}
+		section.ComputeStats()
+		if section.Length != length || section.NumWords != numWords {
+			drifted = append(drifted, section)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	for _, section := range drifted {
+		_, err := tx.Exec(`UPDATE sections SET length = $1, num_words = $2 WHERE id = $3`, section.Length, section.NumWords, section.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(drifted), refreshDocumentStats(tx, documentID)
+}
+
+// RecomputeStats recounts one of the user's documents and returns it with
+// the corrected totals.
+func (pg *PostgresDocumentStore) RecomputeStats(user *User, documentId string) (*Document, error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var documentID string
+	err = tx.QueryRow(`SELECT d.id FROM documents d WHERE d.id = $1 AND `+hasRole("d", 2, RoleEditor)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[])) FOR UPDATE`, documentId, user.ID, user.documentScope()).Scan(&documentID)
+	if err != nil {
+		return nil, denied(tx, user, documentOfDocument, documentId, err)
+	}
+
+	_, err = recomputeDocumentStats(tx, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return pg.ReadDocument(user, documentID)
+}
+
+// RepairAllStats recounts every document in the database, one transaction
+// per document. It is meant for the -repair-stats command, not for requests.
+func (pg *PostgresDocumentStore) RepairAllStats() (*StatsRepair, error) {
+	rows, err := pg.db.Query(`SELECT id FROM documents ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	documentIDs := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		documentIDs = append(documentIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &StatsRepair{}
+	for _, documentID := range documentIDs {
+		tx, err := pg.db.Begin()
+		if err != nil {
+			return report, err
+		}
+
+		updated, err := recomputeDocumentStats(tx, documentID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return report, err
+		}
+
+		report.Documents++
+		report.SectionsUpdated += updated
+	}
+	return report, nil
+}
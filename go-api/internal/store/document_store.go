@@ -15,6 +15,10 @@ type Document struct {
 	NumSections int       `json:"num_sections"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+	// Role is the current user's role on the document, and Shared is set
+	// when that role is not owner.
+	Role   string `json:"role"`
+	Shared bool   `json:"shared"`
 }
 
 type PostgresDocumentStore struct {
@@ -27,26 +31,34 @@ func NewPostgresDocumentStore(db *sql.DB) *PostgresDocumentStore {
 
 type DocumentStore interface {
 	CreateDocument(*Document, *User) (*Document, error)
-	ReadDocument(string) (*Document, error)
-	UpdateDocument(*Document) (*Document, error)
-	DeleteDocument(string) error
+	ReadDocument(*User, string) (*Document, error)
+	UpdateDocument(*User, *Document) (*Document, error)
+	DeleteDocument(*User, string) error
 	GetAllDocuments(*User) ([]*Document, error)
+	RecomputeStats(*User, string) (*Document, error)
 }
 
 func (pg *PostgresDocumentStore) CreateDocument(document *Document, user *User) (*Document, error) {
+	if user.DocumentIDs != nil {
+		return nil, ErrOutsideTokenScope
+	}
+
 	tx, err := pg.db.Begin()
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
+	// Totals start at zero and are maintained as sections change
+	document.Length, document.NumWords, document.NumSections = 0, 0, 0
+
 	query := `
 	INSERT INTO documents (user_id, title, description, length, num_words, num_sections)
-	VALUES ($1, $2, $3, $4, $5, $6)
+	VALUES ($1, $2, $3, 0, 0, 0)
 	RETURNING id, created_at, updated_at
 	`
 
-	err = tx.QueryRow(query, user.ID, document.Title, document.Description, document.Length, document.NumWords, document.NumSections).Scan(&document.ID, &document.CreatedAt, &document.UpdatedAt)
+	err = tx.QueryRow(query, user.ID, document.Title, document.Description).Scan(&document.ID, &document.CreatedAt, &document.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -60,17 +72,18 @@ func (pg *PostgresDocumentStore) CreateDocument(document *Document, user *User)
 		return nil, err
 	}
 
+	document.Role = RoleOwner
 	return document, nil
 }
 
-func (pg *PostgresDocumentStore) ReadDocument(documentId string) (*Document, error) {
+func (pg *PostgresDocumentStore) ReadDocument(user *User, documentId string) (*Document, error) {
 	document := &Document{}
 	query := `
-		SELECT id, user_id, title, description, length, num_words, num_sections, created_at, updated_at
-		FROM documents
-		WHERE id = $1
+		SELECT d.id, d.user_id, d.title, d.description, d.length, d.num_words, d.num_sections, d.created_at, d.updated_at, ` + documentRole("d", 2) + `
+		FROM documents d
+		WHERE d.id = $1 AND ` + hasRole("d", 2, RoleViewer) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
 	`
-	err := pg.db.QueryRow(query, documentId).Scan(
+	err := pg.db.QueryRow(query, documentId, user.ID, user.documentScope()).Scan(
 		&document.ID,
 		&document.UserID,
 		&document.Title,
@@ -80,52 +93,60 @@ func (pg *PostgresDocumentStore) ReadDocument(documentId string) (*Document, err
 		&document.NumSections,
 		&document.CreatedAt,
 		&document.UpdatedAt,
+		&document.Role,
 	)
 
 	if err != nil {
 		return nil, err
 	}
+	document.Shared = document.Role != RoleOwner
 	return document, nil
 }
 
-func (pg *PostgresDocumentStore) UpdateDocument(document *Document) (*Document, error) {
+func (pg *PostgresDocumentStore) UpdateDocument(user *User, document *Document) (*Document, error) {
+	// Length, word and section counts belong to the server, see document_stats.go
 	query := `
-		UPDATE documents
-		SET title = $1, description = $2, length = $3, num_words = $4, num_sections = $5, updated_at = NOW()
-		WHERE id = $6
-		RETURNING updated_at
+		UPDATE documents d
+		SET title = $1, description = $2, updated_at = NOW()
+		WHERE d.id = $3 AND ` + hasRole("d", 4, RoleEditor) + ` AND ($5::text[] IS NULL OR d.id::text = ANY($5::text[]))
+		RETURNING d.user_id, d.length, d.num_words, d.num_sections, d.created_at, d.updated_at, ` + documentRole("d", 4) + `
 	`
 	err := pg.db.QueryRow(query,
 		document.Title,
 		document.Description,
-		document.Length,
-		document.NumWords,
-		document.NumSections,
 		document.ID,
-	).Scan(&document.UpdatedAt)
+		user.ID,
+		user.documentScope(),
+	).Scan(&document.UserID, &document.Length, &document.NumWords, &document.NumSections, &document.CreatedAt, &document.UpdatedAt, &document.Role)
 	if err != nil {
-		return nil, err
+		return nil, denied(pg.db, user, documentOfDocument, document.ID, err)
 	}
+	document.Shared = document.Role != RoleOwner
 	return document, nil
 }
 
-func (pg *PostgresDocumentStore) DeleteDocument(documentId string) error {
-	query := `DELETE FROM documents WHERE id = $1`
-	_, err := pg.db.Exec(query, documentId)
+func (pg *PostgresDocumentStore) DeleteDocument(user *User, documentId string) error {
+	query := `DELETE FROM documents d WHERE d.id = $1 AND ` + hasRole("d", 2, RoleOwner) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))`
+	result, err := pg.db.Exec(query, documentId, user.ID, user.documentScope())
 	if err != nil {
 		return err
 	}
+	if err := requireRowsAffected(result); err != nil {
+		return denied(pg.db, user, documentOfDocument, documentId, err)
+	}
 	return nil
 }
 
+// GetAllDocuments lists the documents the user owns and those shared with
+// them, newest first.
 func (pg *PostgresDocumentStore) GetAllDocuments(user *User) ([]*Document, error) {
 	query := `
-		SELECT id, user_id, title, description, length, num_words, num_sections, created_at, updated_at
-		FROM documents
-		WHERE user_id = $1
-		ORDER BY created_at DESC
+		SELECT d.id, d.user_id, d.title, d.description, d.length, d.num_words, d.num_sections, d.created_at, d.updated_at, ` + documentRole("d", 1) + `
+		FROM documents d
+		WHERE ` + hasRole("d", 1, RoleViewer) + ` AND ($2::text[] IS NULL OR d.id::text = ANY($2::text[]))
+		ORDER BY d.created_at DESC
 	`
-	rows, err := pg.db.Query(query, user.ID)
+	rows, err := pg.db.Query(query, user.ID, user.documentScope())
 	if err != nil {
 		return nil, err
 	}
@@ -144,10 +165,12 @@ func (pg *PostgresDocumentStore) GetAllDocuments(user *User) ([]*Document, error
 			&doc.NumSections,
 			&doc.CreatedAt,
 			&doc.UpdatedAt,
+			&doc.Role,
 		)
 		if err != nil {
 			return nil, err
 		}
+		doc.Shared = doc.Role != RoleOwner
 		documents = append(documents, doc)
 	}
 	if err := rows.Err(); err != nil {
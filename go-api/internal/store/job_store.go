@@ -0,0 +1,368 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	JobKindIndexSection = "index_section"
+
+	JobStatusPending = "pending"
+	JobStatusRunning = "running"
+	JobStatusDone    = "done"
+	JobStatusDead    = "dead"
+)
+
+// Index statuses report whether a section's embeddings and summary in the
+// agent backend match its current text.
+const (
+	IndexStatusIndexed  = "indexed"
+	IndexStatusQueued   = "queued"
+	IndexStatusIndexing = "indexing"
+	IndexStatusFailed   = "failed"
+	IndexStatusStale    = "stale"
+)
+
+// Job is a unit of background work. Failed jobs are retried later until
+// they run out of attempts, then left dead for inspection.
+type Job struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	SectionID   *string   `json:"section_id"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"max_attempts"`
+	RunAt       time.Time `json:"run_at"`
+	LastError   *string   `json:"last_error"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type SectionIndexStatus struct {
+	SectionID string     `json:"section_id"`
+	Title     string     `json:"title"`
+	Status    string     `json:"status"`
+	IndexedAt *time.Time `json:"indexed_at"`
+	Job       *Job       `json:"job"`
+}
+
+type PostgresJobStore struct {
+	db *sql.DB
+}
+
+func NewPostgresJobStore(db *sql.DB) *PostgresJobStore {
+	return &PostgresJobStore{db: db}
+}
+
+type JobStore interface {
+	EnqueueSectionIndex(*User, string) (*Job, error)
+	ReindexDocument(*User, string) ([]*Job, error)
+	GetIndexStatus(*User, string) ([]*SectionIndexStatus, error)
+	ClaimJob(time.Duration) (*Job, error)
+	ReadSectionForIndex(string) (*Section, string, error)
+	CompleteJob(*Job, string) error
+	FailJob(*Job, string, time.Time) error
+}
+
+const jobColumns = `j.id, j.kind, j.section_id, j.status, j.attempts, j.max_attempts, j.run_at, j.last_error, j.created_at, j.updated_at`
+
+// sectionIndexHash fingerprints the text the agent backend indexes, so a
+// section can be compared with what was last indexed.
+const sectionIndexHash = `md5(s.title || E'\n' || coalesce(s.content, ''))`
+
+func scanJob(row rowScanner) (*Job, error) {
+	job := &Job{}
+	err := row.Scan(
+		&job.ID,
+		&job.Kind,
+		&job.SectionID,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// EnqueueSectionIndex queues one of the user's sections to be indexed, billed
+// to the user. A job already waiting for the section is brought forward,
+// given a fresh set of attempts and billed to the user rather than queued
+// twice.
+func (p *PostgresJobStore) EnqueueSectionIndex(user *User, sectionId string) (*Job, error) {
+	query := `
+		INSERT INTO jobs AS j (kind, section_id, requested_by)
+		SELECT $1, s.id, $3
+		FROM sections s
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE s.id = $2 AND ` + hasRole("d", 3, RoleEditor) + ` AND ($4::text[] IS NULL OR d.id::text = ANY($4::text[]))
+		ON CONFLICT (kind, section_id) WHERE status = 'pending'
+		DO UPDATE SET requested_by = EXCLUDED.requested_by, run_at = NOW(), attempts = 0, last_error = NULL, updated_at = NOW()
+		RETURNING ` + jobColumns + `
+	`
+	job, err := scanJob(p.db.QueryRow(query, JobKindIndexSection, sectionId, user.ID, user.documentScope()))
+	if err != nil {
+		return nil, denied(p.db, user, documentOfSection, sectionId, err)
+	}
+	return job, nil
+}
+
+// ReindexDocument queues every section in a document whose index is not up to
+// date, billed to the user as EnqueueSectionIndex does.
+func (p *PostgresJobStore) ReindexDocument(user *User, documentId string) ([]*Job, error) {
+	query := `
+		INSERT INTO jobs AS j (kind, section_id, requested_by)
+		SELECT $1, s.id, $3
+		FROM sections s
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE d.id = $2 AND ` + hasRole("d", 3, RoleEditor) + ` AND ($4::text[] IS NULL OR d.id::text = ANY($4::text[]))
+			AND s.indexed_hash IS DISTINCT FROM ` + sectionIndexHash + `
+		ON CONFLICT (kind, section_id) WHERE status = 'pending'
+		DO UPDATE SET requested_by = EXCLUDED.requested_by, run_at = NOW(), attempts = 0, last_error = NULL, updated_at = NOW()
+		RETURNING ` + jobColumns + `
+	`
+	rows, err := p.db.Query(query, JobKindIndexSection, documentId, user.ID, user.documentScope())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// GetIndexStatus reports whether each section of a document is indexed,
+// along with the section's most recent job.
+func (p *PostgresJobStore) GetIndexStatus(user *User, documentId string) ([]*SectionIndexStatus, error) {
+	query := `
+		SELECT s.id, s.title, s.indexed_at, coalesce(s.indexed_hash = ` + sectionIndexHash + `, false),
+			j.id, j.kind, j.section_id, j.status, j.attempts, j.max_attempts, j.run_at, j.last_error, j.created_at, j.updated_at
+		FROM sections s
+		INNER JOIN documents d ON s.document_id = d.id
+		LEFT JOIN LATERAL (
+			SELECT *
+			FROM jobs
+			WHERE jobs.section_id = s.id
+			ORDER BY jobs.created_at DESC
+			LIMIT 1
+		) j ON true
+		WHERE d.id = $1 AND ` + hasRole("d", 2, RoleViewer) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		ORDER BY s.position ASC, s.created_at ASC
+	`
+	rows, err := p.db.Query(query, documentId, user.ID, user.documentScope())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := []*SectionIndexStatus{}
+	for rows.Next() {
+		status := &SectionIndexStatus{}
+		var current bool
+		var jobID, kind, sectionID, jobStatus, lastError sql.NullString
+		var attempts, maxAttempts sql.NullInt64
+		var runAt, createdAt, updatedAt sql.NullTime
+		err := rows.Scan(
+			&status.SectionID,
+			&status.Title,
+			&status.IndexedAt,
+			&current,
+			&jobID,
+			&kind,
+			&sectionID,
+			&jobStatus,
+			&attempts,
+			&maxAttempts,
+			&runAt,
+			&lastError,
+			&createdAt,
+			&updatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if jobID.Valid {
+			status.Job = &Job{
+				ID:          jobID.String,
+				Kind:        kind.String,
+				SectionID:   &sectionID.String,
+				Status:      jobStatus.String,
+				Attempts:    int(attempts.Int64),
+				MaxAttempts: int(maxAttempts.Int64),
+				RunAt:       runAt.Time,
+				CreatedAt:   createdAt.Time,
+				UpdatedAt:   updatedAt.Time,
+			}
+			if lastError.Valid {
+				status.Job.LastError = &lastError.String
+			}
+		}
+
+		switch {
+		case jobStatus.String == JobStatusPending:
+			status.Status = IndexStatusQueued
+		case jobStatus.String == JobStatusRunning:
+			status.Status = IndexStatusIndexing
+		case current:
+			status.Status = IndexStatusIndexed
+		case jobStatus.String == JobStatusDead:
+			status.Status = IndexStatusFailed
+		default:
+			status.Status = IndexStatusStale
+		}
+		statuses = append(statuses, status)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// ClaimJob takes the next job that is due, or one whose worker stopped
+// reporting back, and holds it for lease. It returns nil when nothing is due.
+// Jobs for a section already being indexed wait for that one to finish.
+func (p *PostgresJobStore) ClaimJob(lease time.Duration) (*Job, error) {
+	query := `
+		UPDATE jobs j
+		SET status = 'running', attempts = j.attempts + 1, locked_until = NOW() + $1 * INTERVAL '1 millisecond', updated_at = NOW()
+		WHERE j.id = (
+			SELECT next.id
+			FROM jobs next
+			WHERE (
+				(next.status = 'pending' AND next.run_at <= NOW())
+				OR (next.status = 'running' AND next.locked_until < NOW())
+			)
+			AND NOT EXISTS (
+				SELECT 1
+				FROM jobs busy
+				WHERE busy.section_id = next.section_id AND busy.id <> next.id
+					AND busy.status = 'running' AND busy.locked_until >= NOW()
+			)
+			ORDER BY next.run_at ASC
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + jobColumns + `
+	`
+	job, err := scanJob(p.db.QueryRow(query, lease.Milliseconds()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return job, err
+}
+
+// ReadSectionForIndex loads a section as it is now, for a job to index,
+// along with the fingerprint of the text being indexed.
+func (p *PostgresJobStore) ReadSectionForIndex(sectionId string) (*Section, string, error) {
+	query := `
+		SELECT s.id, s.document_id, s.parent_id, s.kind, s.position, s.title, s.content, s.summary, s.metadata, s.length, s.num_words, s.created_at, s.updated_at, ` + sectionIndexHash + `
+		FROM sections s
+		WHERE s.id = $1
+	`
+	section := &Section{}
+	var content, summary sql.NullString
+	var hash string
+	err := p.db.QueryRow(query, sectionId).Scan(
+		&section.ID,
+		&section.DocumentID,
+		&section.ParentID,
+		&section.Kind,
+		&section.Position,
+		&section.Title,
+		&content,
+		&summary,
+		&section.Metadata,
+		&section.Length,
+		&section.NumWords,
+		&section.CreatedAt,
+		&section.UpdatedAt,
+		&hash,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	section.Content = content.String
+	section.Summary = summary.String
+	return section, hash, nil
+}
+
+// CompleteJob marks a job done and records the fingerprint of what it
+// indexed. Only the latest finished job is kept for each section.
+func (p *PostgresJobStore) CompleteJob(job *Job, indexedHash string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE jobs
+		SET status = 'done', locked_until = NULL, last_error = NULL, updated_at = NOW()
+		WHERE id = $1
+	`, job.ID)
+	if err != nil {
+		return err
+	}
+
+	if job.SectionID != nil {
+		if indexedHash != "" {
+			_, err = tx.Exec(`
+				UPDATE sections
+				SET indexed_hash = $2, indexed_at = NOW()
+				WHERE id = $1
+			`, *job.SectionID, indexedHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(`
+			DELETE FROM jobs
+			WHERE section_id = $1 AND kind = $2 AND id <> $3 AND status IN ('done', 'dead')
+		`, *job.SectionID, job.Kind, job.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// FailJob records a failed attempt. The job runs again at retryAt, or is left
+// dead if it has used all its attempts or a newer job for the same section
+// has been queued in the meantime.
+func (p *PostgresJobStore) FailJob(job *Job, message string, retryAt time.Time) error {
+	query := `
+		UPDATE jobs j
+		SET status = CASE
+				WHEN j.attempts >= j.max_attempts THEN 'dead'
+				WHEN EXISTS (
+					SELECT 1 FROM jobs queued
+					WHERE queued.kind = j.kind AND queued.section_id = j.section_id AND queued.status = 'pending'
+				) THEN 'dead'
+				ELSE 'pending'
+			END,
+			run_at = $2, locked_until = NULL, last_error = $3, updated_at = NOW()
+		WHERE j.id = $1
+	`
+	_, err := p.db.Exec(query, job.ID, retryAt, message)
+	return err
+}
@@ -0,0 +1,399 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	InvitationStatusPending  = "pending"
+	InvitationStatusAccepted = "accepted"
+	InvitationStatusDeclined = "declined"
+	InvitationStatusRevoked  = "revoked"
+)
+
+var ErrInvalidMember = errors.New("invalid member")
+
+// Member is someone with a role on a document. The owner is listed as a
+// member with RoleOwner.
+type Member struct {
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Picture   string    `json:"picture"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Invitation offers a role on a document to whoever logs in with Email. It
+// is by email rather than user so people can be invited before their first
+// login.
+type Invitation struct {
+	ID            string     `json:"id"`
+	DocumentID    string     `json:"document_id"`
+	DocumentTitle string     `json:"document_title"`
+	Email         string     `json:"email"`
+	Role          string     `json:"role"`
+	Status        string     `json:"status"`
+	InvitedBy     *string    `json:"invited_by"`
+	RespondedAt   *time.Time `json:"responded_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+type PostgresMemberStore struct {
+	db *sql.DB
+}
+
+func NewPostgresMemberStore(db *sql.DB) *PostgresMemberStore {
+	return &PostgresMemberStore{db: db}
+}
+
+type MemberStore interface {
+	GetMembers(*User, string) ([]*Member, error)
+	UpdateMemberRole(*User, string, string, string) (*Member, error)
+	RemoveMember(*User, string, string) error
+	InviteMember(*User, *Invitation) (*Invitation, error)
+	GetDocumentInvitations(*User, string) ([]*Invitation, error)
+	RevokeInvitation(*User, string) error
+	GetInvitations(*User) ([]*Invitation, error)
+	AcceptInvitation(*User, string) (*Invitation, error)
+	DeclineInvitation(*User, string) error
+}
+
+const invitationColumns = `i.id, i.document_id, d.title, i.email, i.role, i.status, i.invited_by, i.responded_at, i.created_at, i.updated_at`
+
+func scanInvitation(row rowScanner) (*Invitation, error) {
+	invitation := &Invitation{}
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.DocumentID,
+		&invitation.DocumentTitle,
+		&invitation.Email,
+		&invitation.Role,
+		&invitation.Status,
+		&invitation.InvitedBy,
+		&invitation.RespondedAt,
+		&invitation.CreatedAt,
+		&invitation.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func scanInvitations(rows *sql.Rows) ([]*Invitation, error) {
+	defer rows.Close()
+
+	invitations := []*Invitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+func scanMember(row rowScanner) (*Member, error) {
+	member := &Member{}
+	err := row.Scan(&member.UserID, &member.Name, &member.Email, &member.Picture, &member.Role, &member.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// requireOwner checks that the user owns the document, returning
+// ErrForbidden when they can only see it and sql.ErrNoRows when they cannot.
+func requireOwner(q queryRower, user *User, documentId string) error {
+	var id string
+	err := q.QueryRow(
+		`SELECT d.id FROM documents d WHERE d.id = $1 AND `+hasRole("d", 2, RoleOwner)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))`,
+		documentId, user.ID, user.documentScope(),
+	).Scan(&id)
+	return denied(q, user, documentOfDocument, documentId, err)
+}
+
+// GetMembers lists everyone with a role on the document, the owner first.
+func (p *PostgresMemberStore) GetMembers(user *User, documentId string) ([]*Member, error) {
+	var visible bool
+	err := p.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM documents d WHERE d.id = $1 AND `+hasRole("d", 2, RoleViewer)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[])))`,
+		documentId, user.ID, user.documentScope(),
+	).Scan(&visible)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, sql.ErrNoRows
+	}
+
+	query := `
+		SELECT u.id, u.name, u.email, COALESCE(u.picture, ''), '` + RoleOwner + `', d.created_at, 0 AS rank
+		FROM documents d
+		INNER JOIN users u ON u.id = d.user_id
+		WHERE d.id = $1
+		UNION ALL
+		SELECT u.id, u.name, u.email, COALESCE(u.picture, ''), m.role, m.created_at, 1 AS rank
+		FROM document_members m
+		INNER JOIN users u ON u.id = m.user_id
+		WHERE m.document_id = $1
+		ORDER BY rank, created_at
+	`
+	rows, err := p.db.Query(query, documentId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*Member{}
+	for rows.Next() {
+		member := &Member{}
+		var rank int
+		err := rows.Scan(&member.UserID, &member.Name, &member.Email, &member.Picture, &member.Role, &member.CreatedAt, &rank)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// UpdateMemberRole changes a member's role. Only the owner may, and
+// ownership cannot be handed over this way.
+func (p *PostgresMemberStore) UpdateMemberRole(user *User, documentId string, memberId string, role string) (*Member, error) {
+	if !IsMemberRole(role) {
+		return nil, fmt.Errorf("%w: unknown role %q", ErrInvalidMember, role)
+	}
+
+	query := `
+		WITH updated AS (
+			UPDATE document_members m
+			SET role = $3, updated_at = NOW()
+			FROM documents d
+			WHERE m.document_id = d.id AND d.id = $1 AND m.user_id = $2 AND ` + hasRole("d", 4, RoleOwner) + `
+				AND ($5::text[] IS NULL OR d.id::text = ANY($5::text[]))
+			RETURNING m.user_id, m.role, m.created_at
+		)
+		SELECT u.id, u.name, u.email, COALESCE(u.picture, ''), updated.role, updated.created_at
+		FROM updated
+		INNER JOIN users u ON u.id = updated.user_id
+	`
+	member, err := scanMember(p.db.QueryRow(query, documentId, memberId, role, user.ID, user.documentScope()))
+	if err != nil {
+		return nil, denied(p.db, user, documentOfDocument, documentId, err)
+	}
+	return member, nil
+}
+
+// RemoveMember takes a member off the document. The owner may remove
+// anyone; members may remove themselves to leave the document.
+func (p *PostgresMemberStore) RemoveMember(user *User, documentId string, memberId string) error {
+	query := `
+		DELETE FROM document_members m
+		USING documents d
+		WHERE m.document_id = d.id AND d.id = $1 AND m.user_id = $2
+			AND (` + hasRole("d", 3, RoleOwner) + ` OR m.user_id = $3)
+			AND ($4::text[] IS NULL OR d.id::text = ANY($4::text[]))
+	`
+	result, err := p.db.Exec(query, documentId, memberId, user.ID, user.documentScope())
+	if err != nil {
+		return err
+	}
+	return denied(p.db, user, documentOfDocument, documentId, requireRowsAffected(result))
+}
+
+// InviteMember invites an email address to the document with a role. Only
+// the owner may invite. Inviting an address again while its invitation is
+// pending updates the role offered.
+func (p *PostgresMemberStore) InviteMember(user *User, invitation *Invitation) (*Invitation, error) {
+	if !IsMemberRole(invitation.Role) {
+		return nil, fmt.Errorf("%w: unknown role %q", ErrInvalidMember, invitation.Role)
+	}
+	address, err := mail.ParseAddress(strings.TrimSpace(invitation.Email))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid email address", ErrInvalidMember)
+	}
+	email := strings.ToLower(address.Address)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := requireOwner(tx, user, invitation.DocumentID); err != nil {
+		return nil, err
+	}
+
+	var hasAccess bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM users u, documents d
+			WHERE d.id = $1 AND lower(u.email) = $2
+				AND (u.id = d.user_id OR EXISTS (SELECT 1 FROM document_members m WHERE m.document_id = d.id AND m.user_id = u.id))
+		)`,
+		invitation.DocumentID, email,
+	).Scan(&hasAccess)
+	if err != nil {
+		return nil, err
+	}
+	if hasAccess {
+		return nil, fmt.Errorf("%w: %s already has access", ErrInvalidMember, email)
+	}
+
+	query := `
+		WITH invited AS (
+			INSERT INTO document_invitations AS i (document_id, email, role, invited_by)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (document_id, lower(email)) WHERE status = 'pending'
+			DO UPDATE SET role = EXCLUDED.role, invited_by = EXCLUDED.invited_by, updated_at = NOW()
+			RETURNING i.*
+		)
+		SELECT ` + invitationColumns + `
+		FROM invited i
+		INNER JOIN documents d ON d.id = i.document_id
+	`
+	created, err := scanInvitation(tx.QueryRow(query, invitation.DocumentID, email, invitation.Role, user.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// GetDocumentInvitations lists the document's pending invitations, for its
+// owner.
+func (p *PostgresMemberStore) GetDocumentInvitations(user *User, documentId string) ([]*Invitation, error) {
+	if err := requireOwner(p.db, user, documentId); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM document_invitations i
+		INNER JOIN documents d ON d.id = i.document_id
+		WHERE i.document_id = $1 AND i.status = $2
+		ORDER BY i.created_at
+	`
+	rows, err := p.db.Query(query, documentId, InvitationStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	return scanInvitations(rows)
+}
+
+func (p *PostgresMemberStore) RevokeInvitation(user *User, invitationId string) error {
+	query := `
+		UPDATE document_invitations i
+		SET status = $2, responded_at = NOW(), updated_at = NOW()
+		FROM documents d
+		WHERE i.document_id = d.id AND i.id = $1 AND i.status = $3 AND ` + hasRole("d", 4, RoleOwner) + `
+			AND ($5::text[] IS NULL OR d.id::text = ANY($5::text[]))
+	`
+	result, err := p.db.Exec(query, invitationId, InvitationStatusRevoked, InvitationStatusPending, user.ID, user.documentScope())
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// GetInvitations lists the pending invitations sent to the user's email
+// address.
+func (p *PostgresMemberStore) GetInvitations(user *User) ([]*Invitation, error) {
+	if user.DocumentIDs != nil {
+		return nil, ErrOutsideTokenScope
+	}
+
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM document_invitations i
+		INNER JOIN documents d ON d.id = i.document_id
+		WHERE lower(i.email) = lower($1) AND i.status = $2
+		ORDER BY i.created_at DESC
+	`
+	rows, err := p.db.Query(query, user.Email, InvitationStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	return scanInvitations(rows)
+}
+
+// AcceptInvitation makes the user a member of the invitation's document with
+// the role it offers. Invitations are matched on the email the user logged
+// in with.
+func (p *PostgresMemberStore) AcceptInvitation(user *User, invitationId string) (*Invitation, error) {
+	if user.DocumentIDs != nil {
+		return nil, ErrOutsideTokenScope
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE document_invitations i
+		SET status = $3, responded_at = NOW(), updated_at = NOW()
+		FROM documents d
+		WHERE i.document_id = d.id AND i.id = $1 AND lower(i.email) = lower($2) AND i.status = $4
+		RETURNING ` + invitationColumns + `
+	`
+	invitation, err := scanInvitation(tx.QueryRow(query, invitationId, user.Email, InvitationStatusAccepted, InvitationStatusPending))
+	if err != nil {
+		return nil, err
+	}
+
+	// The owner keeps their role if they were invited to their own document
+	_, err = tx.Exec(`
+		INSERT INTO document_members (document_id, user_id, role, invited_by)
+		SELECT d.id, $2, $3, $4 FROM documents d WHERE d.id = $1 AND d.user_id <> $2
+		ON CONFLICT (document_id, user_id)
+		DO UPDATE SET role = EXCLUDED.role, invited_by = EXCLUDED.invited_by, updated_at = NOW()`,
+		invitation.DocumentID, user.ID, invitation.Role, invitation.InvitedBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func (p *PostgresMemberStore) DeclineInvitation(user *User, invitationId string) error {
+	if user.DocumentIDs != nil {
+		return ErrOutsideTokenScope
+	}
+
+	query := `
+		UPDATE document_invitations
+		SET status = $3, responded_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND lower(email) = lower($2) AND status = $4
+	`
+	result, err := p.db.Exec(query, invitationId, user.Email, InvitationStatusDeclined, InvitationStatusPending)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jackwillis517/Scribo/internal/anchor"
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+var ErrInvalidAnchor = errors.New("invalid note anchor")
+
+// NoteAnchor pins a note to part of its section. Start and End are rune
+// offsets into the section's plain text; Quote, Prefix and Suffix are the
+// text at and around that range, used to find it again after edits. Status
+// is anchored, relocated (found again after an edit moved or changed it) or
+// orphaned (the quoted text is gone).
+type NoteAnchor struct {
+	anchor.Anchor
+	Status string `json:"status"`
+}
+
+// columns spreads an anchor over the notes table's anchor columns. Orphaned
+// anchors keep their quote and context so a later edit or restore can bring
+// them back, but have no range.
+func (a *NoteAnchor) columns() (start, end *int, quote, prefix, suffix, status *string) {
+	if a == nil {
+		return nil, nil, nil, nil, nil, nil
+	}
+	if a.Status != anchor.StatusOrphaned {
+		start, end = &a.Start, &a.End
+	}
+	return start, end, &a.Quote, &a.Prefix, &a.Suffix, &a.Status
+}
+
+// anchorNote checks the user may comment on the note's section and, if the
+// note carries an anchor, resolves it against the section's current text.
+func anchorNote(tx *sql.Tx, user *User, note *Note) error {
+	var content sql.NullString
+	err := tx.QueryRow(`
+		SELECT s.content
+		FROM sections s
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE s.id = $1 AND `+hasRole("d", 2, RoleCommenter)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		FOR SHARE OF s
+	`, note.SectionID, user.ID, user.documentScope()).Scan(&content)
+	if err != nil {
+		return denied(tx, user, documentOfSection, note.SectionID, err)
+	}
+	if note.Anchor == nil {
+		return nil
+	}
+
+	resolved, err := anchor.New(richtext.PlainText(content.String), note.Anchor.Anchor)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAnchor, err)
+	}
+	note.Anchor = &NoteAnchor{Anchor: resolved, Status: anchor.StatusAnchored}
+	return nil
+}
+
+// reanchorNotes re-resolves every anchored note on a section after its
+// content changed, in the same transaction as the change.
+func reanchorNotes(tx *sql.Tx, sectionID string, content string) error {
+	rows, err := tx.Query(`
+		SELECT id, anchor_start, anchor_end, anchor_quote, anchor_prefix, anchor_suffix, anchor_status
+		FROM notes
+		WHERE section_id = $1 AND anchor_quote IS NOT NULL
+		FOR UPDATE
+	`, sectionID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type anchoredNote struct {
+		id     string
+		anchor NoteAnchor
+	}
+	notes := []anchoredNote{}
+	for rows.Next() {
+		var note anchoredNote
+		var start, end sql.NullInt64
+		var prefix, suffix sql.NullString
+		err := rows.Scan(&note.id, &start, &end, &note.anchor.Quote, &prefix, &suffix, &note.anchor.Status)
+		if err != nil {
+			return err
+		}
+		note.anchor.Start, note.anchor.End = int(start.Int64), int(end.Int64)
+		note.anchor.Prefix, note.anchor.Suffix = prefix.String, suffix.String
+		if !start.Valid {
+			// Orphaned: there is no old position to prefer
+			note.anchor.Start = -1
+		}
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if len(notes) == 0 {
+		return nil
+	}
+
+	text := richtext.PlainText(content)
+	for _, note := range notes {
+		resolved, state := anchor.Resolve(text, note.anchor.Anchor)
+		updated := &NoteAnchor{Anchor: resolved, Status: state}
+		if *updated == note.anchor || state == anchor.StatusOrphaned && note.anchor.Status == anchor.StatusOrphaned {
+			continue
+		}
+
+		start, end, quote, prefix, suffix, status := updated.columns()
+		_, err := tx.Exec(`
+			UPDATE notes
+			SET anchor_start = $2, anchor_end = $3, anchor_quote = $4, anchor_prefix = $5, anchor_suffix = $6, anchor_status = $7
+			WHERE id = $1
+		`, note.id, start, end, quote, prefix, suffix, status)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
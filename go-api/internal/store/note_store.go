@@ -2,15 +2,18 @@ package store
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 )
 
 type Note struct {
-	ID        string    `json:"id"`
-	SectionID string    `json:"section_id"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        string      `json:"id"`
+	SectionID string      `json:"section_id"`
+	AuthorID  *string     `json:"author_id"`
+	Content   string      `json:"content"`
+	Anchor    *NoteAnchor `json:"anchor"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
 }
 
 type PostgresNoteStore struct {
@@ -22,106 +25,262 @@ func NewPostgresNoteStore(db *sql.DB) *PostgresNoteStore {
 }
 
 type NoteStore interface {
-	CreateNote(*Note) (*Note, error)
-	ReadNote(string) (*Note, error)
-	UpdateNote(*Note) (*Note, error)
-	DeleteNote(string) error
+	CreateNote(*User, *Note) (*Note, error)
+	ReadNote(*User, string) (*Note, error)
+	UpdateNote(*User, *Note) (*Note, error)
+	DeleteNote(*User, string) error
 	GetAllNotes(*User) ([]*Note, error)
+	GetNotesForSection(*User, string) ([]*Note, error)
+	GetNotesForDocument(*User, string) ([]*Note, error)
+	GetOrphanedNotes(*User, string) ([]*Note, error)
 }
 
-func (p *PostgresNoteStore) CreateNote(note *Note) (*Note, error) {
-	query := `
-	INSERT INTO notes (section_id, content)
-	VALUES ($1, $2)
-	RETURNING id, created_at, updated_at
-	`
-
-	err := p.db.QueryRow(query, note.SectionID, note.Content).Scan(&note.ID, &note.CreatedAt, &note.UpdatedAt)
-	if err != nil {
-		return nil, err
-	}
+const noteColumns = `n.id, n.section_id, n.author_id, n.content, n.anchor_start, n.anchor_end, n.anchor_quote, n.anchor_prefix, n.anchor_suffix, n.anchor_status, n.created_at, n.updated_at`
 
-	return note, nil
+type rowScanner interface {
+	Scan(dest ...any) error
 }
 
-func (p *PostgresNoteStore) ReadNote(noteId string) (*Note, error) {
+func scanNote(row rowScanner) (*Note, error) {
 	note := &Note{}
-	query := `
-		SELECT id, section_id, content, created_at, updated_at
-		FROM notes
-		WHERE id = $1
-	`
-	err := p.db.QueryRow(query, noteId).Scan(
+	var start, end sql.NullInt64
+	var quote, prefix, suffix, status sql.NullString
+	err := row.Scan(
 		&note.ID,
 		&note.SectionID,
+		&note.AuthorID,
 		&note.Content,
+		&start,
+		&end,
+		&quote,
+		&prefix,
+		&suffix,
+		&status,
 		&note.CreatedAt,
 		&note.UpdatedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if quote.Valid {
+		note.Anchor = &NoteAnchor{Status: status.String}
+		note.Anchor.Start = int(start.Int64)
+		note.Anchor.End = int(end.Int64)
+		note.Anchor.Quote = quote.String
+		note.Anchor.Prefix = prefix.String
+		note.Anchor.Suffix = suffix.String
+	}
+	return note, nil
+}
+
+func scanNotes(rows *sql.Rows) ([]*Note, error) {
+	defer rows.Close()
+
+	notes := []*Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// noteEditable is the SQL condition that the user bound to $param may change
+// note n: commenters may change their own notes, editors anyone's.
+func noteEditable(param int) string {
+	return fmt.Sprintf("((n.author_id = $%d AND %s) OR %s)", param, hasRole("d", param, RoleCommenter), hasRole("d", param, RoleEditor))
+}
+
+// CreateNote adds a note to a section the user may comment on. A note with an
+// anchor is pinned to the section text as it is now; ErrInvalidAnchor is
+// returned when the range or quote does not fit the text.
+func (p *PostgresNoteStore) CreateNote(user *User, note *Note) (*Note, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = anchorNote(tx, user, note)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+	INSERT INTO notes (section_id, author_id, content, anchor_start, anchor_end, anchor_quote, anchor_prefix, anchor_suffix, anchor_status)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING id, author_id, created_at, updated_at
+	`
+	start, end, quote, prefix, suffix, status := note.Anchor.columns()
+	err = tx.QueryRow(query, note.SectionID, user.ID, note.Content, start, end, quote, prefix, suffix, status).Scan(&note.ID, &note.AuthorID, &note.CreatedAt, &note.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
 	return note, nil
 }
 
-func (p *PostgresNoteStore) UpdateNote(note *Note) (*Note, error) {
+func (p *PostgresNoteStore) ReadNote(user *User, noteId string) (*Note, error) {
+	query := `
+		SELECT ` + noteColumns + `
+		FROM notes n
+		INNER JOIN sections s ON n.section_id = s.id
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE n.id = $1 AND ` + hasRole("d", 2, RoleViewer) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+	`
+	return scanNote(p.db.QueryRow(query, noteId, user.ID, user.documentScope()))
+}
+
+// UpdateNote changes a note's content. When the update carries an anchor the
+// note is re-pinned to it; otherwise the existing anchor is left alone.
+// Commenters can only update their own notes.
+func (p *PostgresNoteStore) UpdateNote(user *User, note *Note) (*Note, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if note.Anchor == nil {
+		query := `
+			UPDATE notes n
+			SET content = $2, updated_at = NOW()
+			FROM sections s, documents d
+			WHERE n.id = $1 AND n.section_id = s.id AND s.document_id = d.id AND ` + noteEditable(3) + ` AND ($4::text[] IS NULL OR d.id::text = ANY($4::text[]))
+			RETURNING ` + noteColumns + `
+		`
+		updated, err := scanNote(tx.QueryRow(query, note.ID, note.Content, user.ID, user.documentScope()))
+		if err != nil {
+			return nil, denied(tx, user, documentOfNote, note.ID, err)
+		}
+		return updated, tx.Commit()
+	}
+
+	err = tx.QueryRow(`
+		SELECT n.section_id, n.author_id
+		FROM notes n
+		INNER JOIN sections s ON n.section_id = s.id
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE n.id = $1 AND `+noteEditable(2)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		FOR UPDATE OF n
+	`, note.ID, user.ID, user.documentScope()).Scan(&note.SectionID, &note.AuthorID)
+	if err != nil {
+		return nil, denied(tx, user, documentOfNote, note.ID, err)
+	}
+
+	err = anchorNote(tx, user, note)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
 		UPDATE notes
-		SET content = $2, updated_at = NOW()
+		SET content = $2, anchor_start = $3, anchor_end = $4, anchor_quote = $5, anchor_prefix = $6, anchor_suffix = $7, anchor_status = $8, updated_at = NOW()
 		WHERE id = $1
-		RETURNING updated_at
+		RETURNING created_at, updated_at
 	`
-	err := p.db.QueryRow(query,
-		note.ID,
-		note.Content,
-	).Scan(&note.UpdatedAt)
+	start, end, quote, prefix, suffix, status := note.Anchor.columns()
+	err = tx.QueryRow(query, note.ID, note.Content, start, end, quote, prefix, suffix, status).Scan(&note.CreatedAt, &note.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		return nil, err
 	}
 	return note, nil
 }
 
-func (p *PostgresNoteStore) DeleteNote(noteId string) error {
-	query := `DELETE FROM notes WHERE id = $1`
-	_, err := p.db.Exec(query, noteId)
+func (p *PostgresNoteStore) DeleteNote(user *User, noteId string) error {
+	query := `
+		DELETE FROM notes n
+		USING sections s, documents d
+		WHERE n.id = $1 AND n.section_id = s.id AND s.document_id = d.id AND ` + noteEditable(2) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+	`
+	result, err := p.db.Exec(query, noteId, user.ID, user.documentScope())
 	if err != nil {
 		return err
 	}
+	if err := requireRowsAffected(result); err != nil {
+		return denied(p.db, user, documentOfNote, noteId, err)
+	}
 	return nil
 }
 
 func (p *PostgresNoteStore) GetAllNotes(user *User) ([]*Note, error) {
 	query := `
-		SELECT n.id, n.section_id, n.content, n.created_at, n.updated_at
+		SELECT ` + noteColumns + `
 		FROM notes n
 		INNER JOIN sections s ON n.section_id = s.id
 		INNER JOIN documents d ON s.document_id = d.id
-		WHERE d.user_id = $1
+		WHERE ` + hasRole("d", 1, RoleViewer) + ` AND ($2::text[] IS NULL OR d.id::text = ANY($2::text[]))
 		ORDER BY n.created_at DESC
 	`
-	rows, err := p.db.Query(query, user.ID)
+	rows, err := p.db.Query(query, user.ID, user.documentScope())
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return scanNotes(rows)
+}
 
-	notes := []*Note{}
-	for rows.Next() {
-		note := &Note{}
-		err := rows.Scan(
-			&note.ID,
-			&note.SectionID,
-			&note.Content,
-			&note.CreatedAt,
-			&note.UpdatedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-		notes = append(notes, note)
+// GetNotesForSection lists a section's notes in reading order: anchored notes
+// by where they sit in the text, then unanchored and orphaned ones.
+func (p *PostgresNoteStore) GetNotesForSection(user *User, sectionId string) ([]*Note, error) {
+	query := `
+		SELECT ` + noteColumns + `
+		FROM notes n
+		INNER JOIN sections s ON n.section_id = s.id
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE ` + hasRole("d", 1, RoleViewer) + ` AND s.id = $2 AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		ORDER BY n.anchor_start ASC NULLS LAST, n.created_at ASC
+	`
+	rows, err := p.db.Query(query, user.ID, sectionId, user.documentScope())
+	if err != nil {
+		return nil, err
 	}
-	if err := rows.Err(); err != nil {
+	return scanNotes(rows)
+}
+
+func (p *PostgresNoteStore) GetNotesForDocument(user *User, documentId string) ([]*Note, error) {
+	query := `
+		SELECT ` + noteColumns + `
+		FROM notes n
+		INNER JOIN sections s ON n.section_id = s.id
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE ` + hasRole("d", 1, RoleViewer) + ` AND d.id = $2 AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		ORDER BY n.created_at ASC
+	`
+	rows, err := p.db.Query(query, user.ID, documentId, user.documentScope())
+	if err != nil {
 		return nil, err
 	}
-	return notes, nil
+	return scanNotes(rows)
+}
+
+// GetOrphanedNotes lists the notes in a document whose anchored text has been
+// deleted from its section.
+func (p *PostgresNoteStore) GetOrphanedNotes(user *User, documentId string) ([]*Note, error) {
+	query := `
+		SELECT ` + noteColumns + `
+		FROM notes n
+		INNER JOIN sections s ON n.section_id = s.id
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE ` + hasRole("d", 1, RoleViewer) + ` AND d.id = $2 AND n.anchor_status = 'orphaned' AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		ORDER BY n.updated_at DESC
+	`
+	rows, err := p.db.Query(query, user.ID, documentId, user.documentScope())
+	if err != nil {
+		return nil, err
+	}
+	return scanNotes(rows)
 }
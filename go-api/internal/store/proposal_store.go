@@ -0,0 +1,404 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackwillis517/Scribo/internal/anchor"
+	"github.com/jackwillis517/Scribo/internal/diff"
+	"github.com/jackwillis517/Scribo/internal/richtext"
+)
+
+const (
+	ProposalSourceUser  = "user"
+	ProposalSourceAgent = "agent"
+)
+
+const (
+	ProposalStatusPending           = "pending"
+	ProposalStatusAccepted          = "accepted"
+	ProposalStatusPartiallyAccepted = "partially_accepted"
+	ProposalStatusRejected          = "rejected"
+)
+
+var (
+	ErrInvalidProposal  = errors.New("invalid proposal")
+	ErrProposalResolved = errors.New("proposal has already been resolved")
+	// ErrProposalStale is returned when the text a proposal replaces has been
+	// edited since it was made, so its diff no longer applies.
+	ErrProposalStale = errors.New("the proposed text has changed since the proposal was made")
+)
+
+// Proposal is a suggested replacement for a stretch of a section's plain text
+// (see richtext.PlainText). Diff compares the quoted text with the
+// replacement, and Changes numbers its edits so they can be accepted one by
+// one.
+type Proposal struct {
+	ID              string        `json:"id"`
+	SectionID       string        `json:"section_id"`
+	AuthorID        *string       `json:"author_id"`
+	ThreadID        *string       `json:"thread_id"`
+	Source          string        `json:"source"`
+	Status          string        `json:"status"`
+	Anchor          anchor.Anchor `json:"anchor"`
+	Replacement     string        `json:"replacement"`
+	Diff            *diff.Result  `json:"diff"`
+	Changes         []diff.Change `json:"changes"`
+	Note            string        `json:"note"`
+	AcceptedChanges []int         `json:"accepted_changes"`
+	ResolvedBy      *string       `json:"resolved_by"`
+	ResolvedAt      *time.Time    `json:"resolved_at"`
+	CreatedAt       time.Time     `json:"created_at"`
+	UpdatedAt       time.Time     `json:"updated_at"`
+}
+
+type PostgresProposalStore struct {
+	db       *sql.DB
+	sections *PostgresSectionStore
+}
+
+// NewPostgresProposalStore returns a store that saves accepted proposals to
+// their sections through sections, so they are recorded as revisions the
+// same way.
+func NewPostgresProposalStore(db *sql.DB, sections *PostgresSectionStore) *PostgresProposalStore {
+	return &PostgresProposalStore{db: db, sections: sections}
+}
+
+type ProposalStore interface {
+	CreateProposal(*User, *Proposal) (*Proposal, error)
+	ReadProposal(*User, string) (*Proposal, error)
+	GetProposalsForSection(*User, string, string) ([]*Proposal, error)
+	ResolveProposal(*User, string, string, []int) (*Proposal, error)
+	AcceptProposal(*User, string, []int) (*Proposal, *Section, error)
+}
+
+const proposalColumns = `p.id, p.section_id, p.author_id, p.thread_id, p.source, p.status, p.anchor_start, p.anchor_end, p.anchor_quote, p.anchor_prefix, p.anchor_suffix, p.replacement, p.diff, p.note, p.accepted_changes, p.resolved_by, p.resolved_at, p.created_at, p.updated_at`
+
+func scanProposal(row rowScanner) (*Proposal, error) {
+	proposal := &Proposal{}
+	var prefix, suffix, note sql.NullString
+	var diffJSON, acceptedJSON []byte
+	err := row.Scan(
+		&proposal.ID,
+		&proposal.SectionID,
+		&proposal.AuthorID,
+		&proposal.ThreadID,
+		&proposal.Source,
+		&proposal.Status,
+		&proposal.Anchor.Start,
+		&proposal.Anchor.End,
+		&proposal.Anchor.Quote,
+		&prefix,
+		&suffix,
+		&proposal.Replacement,
+		&diffJSON,
+		&note,
+		&acceptedJSON,
+		&proposal.ResolvedBy,
+		&proposal.ResolvedAt,
+		&proposal.CreatedAt,
+		&proposal.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	proposal.Anchor.Prefix, proposal.Anchor.Suffix = prefix.String, suffix.String
+	proposal.Note = note.String
+
+	proposal.Diff = &diff.Result{}
+	if err := json.Unmarshal(diffJSON, proposal.Diff); err != nil {
+		return nil, err
+	}
+	proposal.Changes = diff.Changes(proposal.Diff)
+	if acceptedJSON != nil {
+		if err := json.Unmarshal(acceptedJSON, &proposal.AcceptedChanges); err != nil {
+			return nil, err
+		}
+	}
+	return proposal, nil
+}
+
+func scanProposals(rows *sql.Rows) ([]*Proposal, error) {
+	defer rows.Close()
+
+	proposals := []*Proposal{}
+	for rows.Next() {
+		proposal, err := scanProposal(rows)
+		if err != nil {
+			return nil, err
+		}
+		proposals = append(proposals, proposal)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return proposals, nil
+}
+
+// CreateProposal stores a proposed replacement for part of one of the user's
+// sections. The anchor is a rune range or a quote, pinned against the
+// section text as it is now; ErrInvalidProposal is returned when it does not
+// fit the text or the thread is not about the section.
+func (p *PostgresProposalStore) CreateProposal(user *User, proposal *Proposal) (*Proposal, error) {
+	switch proposal.Source {
+	case "":
+		proposal.Source = ProposalSourceUser
+	case ProposalSourceUser, ProposalSourceAgent:
+	default:
+		return nil, fmt.Errorf("%w: unknown source %q", ErrInvalidProposal, proposal.Source)
+	}
+	if proposal.ThreadID != nil && *proposal.ThreadID == "" {
+		proposal.ThreadID = nil
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var content sql.NullString
+	err = tx.QueryRow(`
+		SELECT s.content
+		FROM sections s
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE s.id = $1 AND `+hasRole("d", 2, RoleCommenter)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		FOR SHARE OF s
+	`, proposal.SectionID, user.ID, user.documentScope()).Scan(&content)
+	if err != nil {
+		return nil, denied(tx, user, documentOfSection, proposal.SectionID, err)
+	}
+
+	if proposal.ThreadID != nil {
+		var found bool
+		err = tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM conversations WHERE thread_id = $1 AND section_id = $2)
+		`, *proposal.ThreadID, proposal.SectionID).Scan(&found)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: thread is not about this section", ErrInvalidProposal)
+		}
+	}
+
+	pinned, err := anchor.New(richtext.PlainText(content.String), proposal.Anchor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProposal, err)
+	}
+	proposal.Anchor = pinned
+
+	proposal.Diff, err = diff.Compare(pinned.Quote, proposal.Replacement, diff.GranularityWord)
+	if err != nil {
+		return nil, err
+	}
+	proposal.Changes = diff.Changes(proposal.Diff)
+	if len(proposal.Changes) == 0 {
+		return nil, fmt.Errorf("%w: the replacement is the same as the current text", ErrInvalidProposal)
+	}
+	diffJSON, err := json.Marshal(proposal.Diff)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+	INSERT INTO proposals (section_id, author_id, thread_id, source, anchor_start, anchor_end, anchor_quote, anchor_prefix, anchor_suffix, replacement, diff, note)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	RETURNING id, status, created_at, updated_at
+	`
+	proposal.AuthorID = &user.ID
+	err = tx.QueryRow(query,
+		proposal.SectionID,
+		user.ID,
+		proposal.ThreadID,
+		proposal.Source,
+		pinned.Start,
+		pinned.End,
+		pinned.Quote,
+		pinned.Prefix,
+		pinned.Suffix,
+		proposal.Replacement,
+		diffJSON,
+		proposal.Note,
+	).Scan(&proposal.ID, &proposal.Status, &proposal.CreatedAt, &proposal.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return proposal, nil
+}
+
+func (p *PostgresProposalStore) ReadProposal(user *User, proposalId string) (*Proposal, error) {
+	query := `
+		SELECT ` + proposalColumns + `
+		FROM proposals p
+		INNER JOIN sections s ON p.section_id = s.id
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE p.id = $1 AND ` + hasRole("d", 2, RoleViewer) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+	`
+	return scanProposal(p.db.QueryRow(query, proposalId, user.ID, user.documentScope()))
+}
+
+// GetProposalsForSection lists a section's proposals oldest first, only those
+// with the given status when one is given.
+func (p *PostgresProposalStore) GetProposalsForSection(user *User, sectionId string, status string) ([]*Proposal, error) {
+	query := `
+		SELECT ` + proposalColumns + `
+		FROM proposals p
+		INNER JOIN sections s ON p.section_id = s.id
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE ` + hasRole("d", 1, RoleViewer) + ` AND s.id = $2 AND ($3 = '' OR p.status = $3) AND ($4::text[] IS NULL OR d.id::text = ANY($4::text[]))
+		ORDER BY p.created_at ASC
+	`
+	rows, err := p.db.Query(query, user.ID, sectionId, status, user.documentScope())
+	if err != nil {
+		return nil, err
+	}
+	return scanProposals(rows)
+}
+
+// ResolveProposal closes a pending proposal with the given status, recording
+// the user who resolved it and which changes they accepted. Only one caller
+// can resolve a proposal; the others get ErrProposalResolved.
+func (p *PostgresProposalStore) ResolveProposal(user *User, proposalId string, status string, accepted []int) (*Proposal, error) {
+	var acceptedJSON []byte
+	if accepted != nil {
+		var err error
+		acceptedJSON, err = json.Marshal(accepted)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := `
+		UPDATE proposals p
+		SET status = $3, accepted_changes = $4, resolved_by = $2, resolved_at = NOW(), updated_at = NOW()
+		FROM sections s, documents d
+		WHERE p.id = $1 AND p.section_id = s.id AND s.document_id = d.id AND ` + hasRole("d", 2, RoleEditor) + ` AND p.status = 'pending' AND ($5::text[] IS NULL OR d.id::text = ANY($5::text[]))
+		RETURNING ` + proposalColumns + `
+	`
+	proposal, err := scanProposal(p.db.QueryRow(query, proposalId, user.ID, status, acceptedJSON, user.documentScope()))
+	if errors.Is(err, sql.ErrNoRows) {
+		existing, err := p.ReadProposal(user, proposalId)
+		if err != nil {
+			return nil, err
+		}
+		if existing.Status == ProposalStatusPending {
+			return nil, ErrForbidden
+		}
+		return nil, ErrProposalResolved
+	}
+	return proposal, err
+}
+
+// AcceptProposal applies the listed changes of a pending proposal (every
+// change when accepted is nil) to its section, saved as a revision by the
+// user, and marks the proposal accepted or partially accepted. The proposal
+// and section stay locked from reading the text to writing it back, so the
+// edit cannot overwrite a save made in between, and the proposal is only
+// resolved if the section is written.
+func (p *PostgresProposalStore) AcceptProposal(user *User, proposalId string, accepted []int) (*Proposal, *Section, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	proposal, err := scanProposal(tx.QueryRow(`
+		SELECT `+proposalColumns+`
+		FROM proposals p
+		INNER JOIN sections s ON p.section_id = s.id
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE p.id = $1 AND `+hasRole("d", 2, RoleEditor)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		FOR UPDATE OF p
+	`, proposalId, user.ID, user.documentScope()))
+	if err != nil {
+		return nil, nil, denied(tx, user, documentOfProposal, proposalId, err)
+	}
+	if proposal.Status != ProposalStatusPending {
+		return nil, nil, ErrProposalResolved
+	}
+
+	section := &Section{ID: proposal.SectionID}
+	err = tx.QueryRow(`
+		SELECT title, COALESCE(content, ''), COALESCE(summary, ''), metadata FROM sections WHERE id = $1 FOR UPDATE
+	`, section.ID).Scan(&section.Title, &section.Content, &section.Summary, &section.Metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	section.Content, err = proposal.Apply(section.Content, accepted)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = updateSection(tx, user, section)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = p.sections.recordRevision(tx, user, section)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	status := ProposalStatusAccepted
+	if accepted != nil && len(accepted) < len(proposal.Changes) {
+		status = ProposalStatusPartiallyAccepted
+	}
+	var acceptedJSON []byte
+	if accepted != nil {
+		acceptedJSON, err = json.Marshal(accepted)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	proposal, err = scanProposal(tx.QueryRow(`
+		UPDATE proposals p
+		SET status = $2, accepted_changes = $3, resolved_by = $4, resolved_at = NOW(), updated_at = NOW()
+		WHERE p.id = $1
+		RETURNING `+proposalColumns+`
+	`, proposalId, status, acceptedJSON, user.ID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return proposal, section, nil
+}
+
+// Apply returns section content with the proposal's accepted changes made
+// (every change when accepted is nil) and the rest of the quoted text left
+// as it is. It finds the quote again in case edits elsewhere moved it, and
+// returns ErrProposalStale when the quoted text itself has changed.
+func (proposal *Proposal) Apply(content string, accepted []int) (string, error) {
+	for _, index := range accepted {
+		if index < 0 || index >= len(proposal.Changes) {
+			return "", fmt.Errorf("%w: no change %d", ErrInvalidProposal, index)
+		}
+	}
+	if accepted == nil {
+		accepted = make([]int, len(proposal.Changes))
+		for i := range accepted {
+			accepted[i] = i
+		}
+	}
+
+	text := richtext.PlainText(content)
+	resolved, status := anchor.Resolve(text, proposal.Anchor)
+	if status == anchor.StatusOrphaned || resolved.Quote != proposal.Anchor.Quote {
+		return "", ErrProposalStale
+	}
+
+	runes := []rune(text)
+	edited := string(runes[:resolved.Start]) + diff.Apply(proposal.Diff, accepted) + string(runes[resolved.End:])
+	return richtext.Edit(content, edited), nil
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackwillis517/Scribo/internal/anchor"
+)
+
+func TestAcceptProposal(t *testing.T) {
+	db := testDB(t)
+	documents := NewPostgresDocumentStore(db)
+	sections := NewPostgresSectionStore(db, DefaultRevisionRetention)
+	proposals := NewPostgresProposalStore(db, sections)
+
+	alice := testUser(t, db, "alice")
+	document, err := documents.CreateDocument(&Document{Title: "Harbour"}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, err := sections.CreateSection(alice, &Section{DocumentID: document.ID, Title: "One", Content: "<p>The boats left the harbour at dawn.</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	propose := func() *Proposal {
+		t.Helper()
+		proposal, err := proposals.CreateProposal(alice, &Proposal{
+			SectionID:   section.ID,
+			Anchor:      anchor.Anchor{Quote: "left the harbour"},
+			Replacement: "slipped out of the harbour",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proposal
+	}
+
+	t.Run("stale", func(t *testing.T) {
+		proposal := propose()
+		_, err := sections.UpdateSection(alice, &Section{ID: section.ID, Title: "One", Content: "<p>The boats stayed in port.</p>"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = proposals.AcceptProposal(alice, proposal.ID, nil)
+		if !errors.Is(err, ErrProposalStale) {
+			t.Fatalf("got %v, want ErrProposalStale", err)
+		}
+		read, err := proposals.ReadProposal(alice, proposal.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read.Status != ProposalStatusPending {
+			t.Errorf("status is %s, want the proposal left pending", read.Status)
+		}
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		_, err := sections.UpdateSection(alice, &Section{ID: section.ID, Title: "One", Content: section.Content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proposal := propose()
+
+		accepted, updated, err := proposals.AcceptProposal(alice, proposal.ID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted.Status != ProposalStatusAccepted {
+			t.Errorf("status is %s, want %s", accepted.Status, ProposalStatusAccepted)
+		}
+		want := "<p>The boats slipped out of the harbour at dawn.</p>"
+		if updated.Content != want {
+			t.Errorf("section content is %q, want %q", updated.Content, want)
+		}
+
+		_, _, err = proposals.AcceptProposal(alice, proposal.ID, nil)
+		if !errors.Is(err, ErrProposalResolved) {
+			t.Errorf("accepting again got %v, want ErrProposalResolved", err)
+		}
+	})
+}
@@ -0,0 +1,245 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/jackwillis517/Scribo/internal/anchor"
+	"github.com/jackwillis517/Scribo/internal/identity"
+)
+
+// baselineSchema is db/ as the first release created it.
+const baselineSchema = `
+	CREATE TABLE users (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		google_id VARCHAR(255) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		picture VARCHAR(255),
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE sessions (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		jwt_token TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE documents (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		title VARCHAR(255) NOT NULL,
+		description TEXT,
+		length INT DEFAULT 0,
+		num_words INT DEFAULT 0,
+		num_sections INT DEFAULT 0,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE sections (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		document_id UUID REFERENCES documents(id) ON DELETE CASCADE,
+		title VARCHAR(255) NOT NULL,
+		content TEXT,
+		summary TEXT,
+		metadata JSONB,
+		length INT DEFAULT 0,
+		num_words INT DEFAULT 0,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE notes (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		section_id UUID REFERENCES sections(id) ON DELETE CASCADE,
+		content TEXT,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE conversations (
+		thread_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		document_id UUID REFERENCES documents(id) ON DELETE CASCADE,
+		section_id UUID NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE messages (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		thread_id UUID REFERENCES conversations(thread_id) ON DELETE CASCADE,
+		role TEXT NOT NULL,
+		content TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+`
+
+// TestSchemaUpgrade loads db/ over the tables as the first release created
+// them, holding what that release wrote, and checks the current code can
+// use what it finds.
+func TestSchemaUpgrade(t *testing.T) {
+	db := emptyTestDB(t)
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	var userID, oldSession, documentID, firstID, secondID, noteID, threadID, messageID string
+	err := db.QueryRow(`
+		WITH u AS (INSERT INTO users (google_id, name, email) VALUES ('g-1', 'Ada', 'ada@example.com') RETURNING id),
+		s AS (INSERT INTO sessions (user_id, jwt_token) SELECT id, 'old.jwt.token' FROM u RETURNING id),
+		d AS (INSERT INTO documents (user_id, title, description) SELECT id, 'The Analytical Engine', 'A novel about looms' FROM u RETURNING id),
+		first AS (INSERT INTO sections (document_id, title, content, created_at) SELECT id, 'Jacquard', '<p>Punched cards weave patterns.</p>', NOW() - INTERVAL '1 hour' FROM d RETURNING id),
+		second AS (INSERT INTO sections (document_id, title, content) SELECT id, 'Babbage', '<p>Gears turn slowly.</p>' FROM d RETURNING id),
+		n AS (INSERT INTO notes (section_id, content) SELECT id, 'Check the loom dates' FROM first RETURNING id),
+		c AS (INSERT INTO conversations (document_id, section_id) SELECT d.id, first.id FROM d, first RETURNING thread_id),
+		m AS (INSERT INTO messages (thread_id, role, content) SELECT thread_id, 'user', 'Is the opening slow?' FROM c RETURNING id)
+		SELECT u.id, s.id, d.id, first.id, second.id, n.id, c.thread_id, m.id FROM u, s, d, first, second, n, c, m
+	`).Scan(&userID, &oldSession, &documentID, &firstID, &secondID, &noteID, &threadID, &messageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadSchema(t, db)
+	// Loading again changes nothing
+	loadSchema(t, db)
+
+	ada := &User{ID: userID}
+
+	t.Run("sessions", func(t *testing.T) {
+		sessions := NewPostgresSessionStore(db)
+		session, err := sessions.CreateSession(&Session{UserID: userID, UserAgent: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sessions.GetActiveSession(session.ID); err != nil {
+			t.Errorf("reading a new session: %v", err)
+		}
+		if _, err := sessions.GetActiveSession(oldSession); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("a session from before the upgrade got %v, want sql.ErrNoRows", err)
+		}
+	})
+
+	t.Run("users", func(t *testing.T) {
+		// Users of other providers have no google_id
+		testUser(t, db, "grace")
+
+		user, err := NewPostgresUserStore(db).LoginUser(&identity.Identity{
+			Provider: identity.GoogleProviderName,
+			Subject:  "g-1",
+			Email:    "ada@example.com",
+			Name:     "Ada",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != userID {
+			t.Errorf("Google login found user %s, want the existing %s", user.ID, userID)
+		}
+	})
+
+	t.Run("outline", func(t *testing.T) {
+		sections := NewPostgresSectionStore(db, DefaultRevisionRetention)
+		read, err := sections.GetSectionsForDocument(ada, documentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(read) != 2 || read[0].ID != firstID || read[1].ID != secondID {
+			t.Fatalf("sections are %v, want %s then %s in the order they were written", sectionIDs(read), firstID, secondID)
+		}
+		for _, section := range read {
+			if section.Kind != SectionKindChapter || section.ParentID != nil {
+				t.Errorf("section %s is a %s under %v, want a top-level chapter", section.ID, section.Kind, section.ParentID)
+			}
+		}
+		reordered, err := sections.ReorderSections(ada, documentID, []SectionMove{{ID: secondID, Position: 0}, {ID: firstID, Position: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reordered) != 2 || reordered[0].ID != secondID {
+			t.Errorf("reordered sections are %v, want %s first", sectionIDs(reordered), secondID)
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		search := NewPostgresSearchStore(db)
+		for _, tc := range []struct{ query, kind, id string }{
+			{"analytical", SearchKindDocument, documentID},
+			{"punched", SearchKindSection, firstID},
+			{"loom dates", SearchKindNote, noteID},
+		} {
+			hits, err := search.Search(ada, SearchQuery{Query: tc.query, Limit: 20})
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, hit := range hits {
+				found = found || hit.Kind == tc.kind && hit.ID == tc.id
+			}
+			if !found {
+				t.Errorf("searching %q did not find %s %s", tc.query, tc.kind, tc.id)
+			}
+		}
+	})
+
+	t.Run("notes", func(t *testing.T) {
+		notes := NewPostgresNoteStore(db)
+		note, err := notes.ReadNote(ada, noteID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if note.Anchor != nil || note.AuthorID != nil {
+			t.Errorf("a note from before the upgrade has anchor %v and author %v, want neither", note.Anchor, note.AuthorID)
+		}
+		anchored, err := notes.CreateNote(ada, &Note{
+			SectionID: firstID,
+			Content:   "Which patterns?",
+			Anchor:    &NoteAnchor{Anchor: anchor.Anchor{Quote: "patterns"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if anchored.Anchor == nil || anchored.Anchor.Status != anchor.StatusAnchored {
+			t.Errorf("a new note is anchored %v, want %s", anchored.Anchor, anchor.StatusAnchored)
+		}
+	})
+
+	t.Run("threads", func(t *testing.T) {
+		agent := NewPostgresAgentStore(db)
+		threads, err := agent.GetThreads(ada, ThreadQuery{DocumentID: documentID, SectionID: firstID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(threads) != 1 || threads[0].ThreadID != threadID {
+			t.Fatalf("got %d threads, want the one from before the upgrade", len(threads))
+		}
+		if _, err := agent.RenameThread(ada, threadID, "Pacing"); err != nil {
+			t.Errorf("renaming: %v", err)
+		}
+		if _, err := agent.ArchiveThread(ada, threadID, true); err != nil {
+			t.Errorf("archiving: %v", err)
+		}
+		fork, err := agent.ForkThread(ada, threadID, messageID, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fork.ParentThreadID == nil || *fork.ParentThreadID != threadID {
+			t.Errorf("fork has parent %v, want %s", fork.ParentThreadID, threadID)
+		}
+	})
+
+	t.Run("indexing", func(t *testing.T) {
+		jobs, err := NewPostgresJobStore(db).ReindexDocument(ada, documentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != 2 {
+			t.Errorf("reindexing queued %d jobs, want one for each section from before the upgrade", len(jobs))
+		}
+	})
+}
+
+func sectionIDs(sections []*Section) []string {
+	ids := make([]string, len(sections))
+	for i, section := range sections {
+		ids[i] = section.ID
+	}
+	return ids
+}
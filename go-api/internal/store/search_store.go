@@ -0,0 +1,144 @@
+package store
+
+import (
+	"database/sql"
+	"html"
+	"strings"
+	"time"
+)
+
+const (
+	SearchKindDocument = "document"
+	SearchKindSection  = "section"
+	SearchKindNote     = "note"
+
+	SearchSortRelevance = "relevance"
+	SearchSortRecent    = "recent"
+)
+
+type SearchQuery struct {
+	Query      string
+	DocumentID string
+	Sort       string
+	Limit      int
+	Offset     int
+}
+
+// SearchHit is one matching document, section or note. Snippet is HTML-safe
+// text with the matched terms wrapped in <mark>. SectionID is set for
+// sections and notes.
+type SearchHit struct {
+	Kind          string    `json:"kind"`
+	ID            string    `json:"id"`
+	DocumentID    string    `json:"document_id"`
+	DocumentTitle string    `json:"document_title"`
+	SectionID     *string   `json:"section_id"`
+	Title         string    `json:"title"`
+	Snippet       string    `json:"snippet"`
+	Rank          float64   `json:"rank"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type PostgresSearchStore struct {
+	db *sql.DB
+}
+
+func NewPostgresSearchStore(db *sql.DB) *PostgresSearchStore {
+	return &PostgresSearchStore{db: db}
+}
+
+type SearchStore interface {
+	Search(*User, SearchQuery) ([]*SearchHit, error)
+}
+
+// ts_headline marks matches with private-use characters so the snippet can be
+// escaped before the markers are swapped for <mark> tags.
+const (
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
+var headlineOptions = `StartSel=` + highlightStart + `, StopSel=` + highlightStop + `, MaxWords=35, MinWords=12, MaxFragments=2, FragmentDelimiter=" … "`
+
+var highlighter = strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>")
+
+// highlight escapes a headline and turns its markers into <mark> tags.
+// Section content is stored as HTML, so its entities are decoded first.
+func highlight(headline string, fromHTML bool) string {
+	if fromHTML {
+		headline = html.UnescapeString(headline)
+	}
+	return highlighter.Replace(html.EscapeString(strings.Join(strings.Fields(headline), " ")))
+}
+
+// Search runs a web-style query ("quoted phrases", -excluded, or) over the
+// user's document titles and descriptions, section titles and content, and
+// notes. Titles outrank body text.
+func (p *PostgresSearchStore) Search(user *User, search SearchQuery) ([]*SearchHit, error) {
+	order := "rank DESC, updated_at DESC"
+	if search.Sort == SearchSortRecent {
+		order = "updated_at DESC, rank DESC"
+	}
+
+	query := `
+		WITH q AS (SELECT websearch_to_tsquery('english', $2) AS query)
+		SELECT * FROM (
+			SELECT 'document' AS kind, d.id, d.id AS document_id, d.title AS document_title, NULL::uuid AS section_id, d.title,
+				ts_headline('english', coalesce(d.description, ''), q.query, $4) AS snippet,
+				ts_rank_cd(d.search_vector, q.query) AS rank, d.updated_at
+			FROM documents d, q
+			WHERE ` + hasRole("d", 1, RoleViewer) + ` AND d.search_vector @@ q.query AND ($3 = '' OR d.id::text = $3) AND ($7::text[] IS NULL OR d.id::text = ANY($7::text[]))
+
+			UNION ALL
+
+			SELECT 'section', s.id, d.id, d.title, s.id, s.title,
+				ts_headline('english', regexp_replace(coalesce(s.content, ''), '<[^>]+>', ' ', 'g'), q.query, $4),
+				ts_rank_cd(s.search_vector, q.query), s.updated_at
+			FROM sections s
+			INNER JOIN documents d ON s.document_id = d.id, q
+			WHERE ` + hasRole("d", 1, RoleViewer) + ` AND s.search_vector @@ q.query AND ($3 = '' OR d.id::text = $3) AND ($7::text[] IS NULL OR d.id::text = ANY($7::text[]))
+
+			UNION ALL
+
+			SELECT 'note', n.id, d.id, d.title, s.id, s.title,
+				ts_headline('english', coalesce(n.content, ''), q.query, $4),
+				ts_rank_cd(n.search_vector, q.query), n.updated_at
+			FROM notes n
+			INNER JOIN sections s ON n.section_id = s.id
+			INNER JOIN documents d ON s.document_id = d.id, q
+			WHERE ` + hasRole("d", 1, RoleViewer) + ` AND n.search_vector @@ q.query AND ($3 = '' OR d.id::text = $3) AND ($7::text[] IS NULL OR d.id::text = ANY($7::text[]))
+		) hits
+		ORDER BY ` + order + `
+		LIMIT $5 OFFSET $6
+	`
+	rows, err := p.db.Query(query, user.ID, search.Query, search.DocumentID, headlineOptions, search.Limit, search.Offset, user.documentScope())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := []*SearchHit{}
+	for rows.Next() {
+		hit := &SearchHit{}
+		err := rows.Scan(
+			&hit.Kind,
+			&hit.ID,
+			&hit.DocumentID,
+			&hit.DocumentTitle,
+			&hit.SectionID,
+			&hit.Title,
+			&hit.Snippet,
+			&hit.Rank,
+			&hit.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		hit.Snippet = highlight(hit.Snippet, hit.Kind == SearchKindSection)
+		hits = append(hits, hit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
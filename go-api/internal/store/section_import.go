@@ -0,0 +1,73 @@
+package store
+
+// ImportDocument creates a document together with its sections in a single
+// transaction, so a failed import leaves nothing behind. Sections are stored
+// in the order given as top-level siblings, each with a first revision, and
+// the document totals are rolled up from them.
+func (p *PostgresSectionStore) ImportDocument(user *User, document *Document, sections []*Section) (*Document, []*Section, error) {
+	if user.DocumentIDs != nil {
+		return nil, nil, ErrOutsideTokenScope
+	}
+
+	for _, section := range sections {
+		kind, err := normalizeSectionKind(section.Kind)
+		if err != nil {
+			return nil, nil, err
+		}
+		section.Kind = kind
+		section.ComputeStats()
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO documents (user_id, title, description, length, num_words, num_sections)
+	VALUES ($1, $2, $3, 0, 0, 0)
+	RETURNING id, user_id, created_at
+	`
+	err = tx.QueryRow(query, user.ID, document.Title, document.Description).Scan(&document.ID, &document.UserID, &document.CreatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query = `
+	INSERT INTO sections (document_id, parent_id, kind, position, title, content, summary, metadata, length, num_words)
+	VALUES ($1, NULL, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING id, created_at, updated_at
+	`
+	for i, section := range sections {
+		section.DocumentID = document.ID
+		section.ParentID = nil
+		section.Position = i
+		err = tx.QueryRow(query, document.ID, section.Kind, section.Position, section.Title, section.Content, section.Summary, section.Metadata, section.Length, section.NumWords).Scan(&section.ID, &section.CreatedAt, &section.UpdatedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = p.recordRevision(tx, user, section)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = refreshDocumentStats(tx, document.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.QueryRow(`SELECT length, num_words, num_sections, updated_at FROM documents WHERE id = $1`, document.ID).Scan(&document.Length, &document.NumWords, &document.NumSections, &document.UpdatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	document.Role = RoleOwner
+	return document, sections, nil
+}
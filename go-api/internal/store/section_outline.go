@@ -0,0 +1,216 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	SectionKindPart    = "part"
+	SectionKindChapter = "chapter"
+	SectionKindScene   = "scene"
+)
+
+var ErrInvalidOutline = errors.New("invalid section outline")
+
+// sectionKindRank orders the kinds from the outside in. A section may only be
+// nested under a section of a strictly lower rank (a part holds chapters, a
+// chapter holds scenes).
+var sectionKindRank = map[string]int{
+	SectionKindPart:    0,
+	SectionKindChapter: 1,
+	SectionKindScene:   2,
+}
+
+type OutlineNode struct {
+	ID       string         `json:"id"`
+	ParentID *string        `json:"parent_id"`
+	Kind     string         `json:"kind"`
+	Position int            `json:"position"`
+	Title    string         `json:"title"`
+	Summary  string         `json:"summary"`
+	Length   int            `json:"length"`
+	NumWords int            `json:"num_words"`
+	Children []*OutlineNode `json:"children"`
+}
+
+type SectionMove struct {
+	ID       string  `json:"id"`
+	ParentID *string `json:"parent_id"`
+	Position int     `json:"position"`
+}
+
+func normalizeSectionKind(kind string) (string, error) {
+	if kind == "" {
+		return SectionKindChapter, nil
+	}
+	if _, ok := sectionKindRank[kind]; !ok {
+		return "", fmt.Errorf("%w: unknown kind %q", ErrInvalidOutline, kind)
+	}
+	return kind, nil
+}
+
+func validateNesting(parentKind string, childKind string) error {
+	if sectionKindRank[childKind] <= sectionKindRank[parentKind] {
+		return fmt.Errorf("%w: a %s cannot contain a %s", ErrInvalidOutline, parentKind, childKind)
+	}
+	return nil
+}
+
+func parentKey(parentID *string) string {
+	if parentID == nil {
+		return ""
+	}
+	return *parentID
+}
+
+// sortSiblings orders sections by position, falling back to creation time for
+// rows that predate positions or collide after a parent was deleted.
+func sortSiblings(sections []*Section) {
+	sort.SliceStable(sections, func(i, j int) bool {
+		if sections[i].Position != sections[j].Position {
+			return sections[i].Position < sections[j].Position
+		}
+		return sections[i].CreatedAt.Before(sections[j].CreatedAt)
+	})
+}
+
+// groupByParent buckets sections under their parent ID. Sections whose parent
+// is missing from the set are treated as top level.
+func groupByParent(sections []*Section) map[string][]*Section {
+	ids := make(map[string]bool, len(sections))
+	for _, s := range sections {
+		ids[s.ID] = true
+	}
+
+	children := map[string][]*Section{}
+	for _, s := range sections {
+		key := parentKey(s.ParentID)
+		if !ids[key] {
+			key = ""
+		}
+		children[key] = append(children[key], s)
+	}
+	for _, siblings := range children {
+		sortSiblings(siblings)
+	}
+	return children
+}
+
+// BuildOutline arranges a document's sections into a tree in manuscript order.
+func BuildOutline(sections []*Section) []*OutlineNode {
+	children := groupByParent(sections)
+
+	var build func(parent string) []*OutlineNode
+	build = func(parent string) []*OutlineNode {
+		nodes := []*OutlineNode{}
+		for _, s := range children[parent] {
+			nodes = append(nodes, &OutlineNode{
+				ID:       s.ID,
+				ParentID: s.ParentID,
+				Kind:     s.Kind,
+				Position: s.Position,
+				Title:    s.Title,
+				Summary:  s.Summary,
+				Length:   s.Length,
+				NumWords: s.NumWords,
+				Children: build(s.ID),
+			})
+		}
+		return nodes
+	}
+	return build("")
+}
+
+// OrderSections flattens a document's sections depth-first, so a part is
+// followed by its chapters and each chapter by its scenes.
+func OrderSections(sections []*Section) []*Section {
+	children := groupByParent(sections)
+
+	ordered := make([]*Section, 0, len(sections))
+	var walk func(parent string)
+	walk = func(parent string) {
+		for _, s := range children[parent] {
+			ordered = append(ordered, s)
+			walk(s.ID)
+		}
+	}
+	walk("")
+	return ordered
+}
+
+// applySectionMoves applies moves in order to the sections of one document and
+// renumbers every sibling list so positions are dense. It returns the sections
+// whose parent or position changed.
+func applySectionMoves(sections []*Section, moves []SectionMove) ([]*Section, error) {
+	byID := make(map[string]*Section, len(sections))
+	for _, s := range sections {
+		byID[s.ID] = s
+	}
+
+	children := groupByParent(sections)
+	original := make(map[string]Section, len(sections))
+	for _, s := range sections {
+		original[s.ID] = *s
+	}
+
+	for _, move := range moves {
+		section, ok := byID[move.ID]
+		if !ok {
+			return nil, fmt.Errorf("%w: section %s is not in this document", ErrInvalidOutline, move.ID)
+		}
+
+		newParent := parentKey(move.ParentID)
+		if newParent != "" {
+			parent, ok := byID[newParent]
+			if !ok {
+				return nil, fmt.Errorf("%w: parent %s is not in this document", ErrInvalidOutline, newParent)
+			}
+			for p := parent; p != nil; p = byID[parentKey(p.ParentID)] {
+				if p.ID == section.ID {
+					return nil, fmt.Errorf("%w: section %s cannot be moved inside itself", ErrInvalidOutline, section.ID)
+				}
+			}
+			if err := validateNesting(parent.Kind, section.Kind); err != nil {
+				return nil, err
+			}
+		}
+
+		oldParent := parentKey(section.ParentID)
+		if _, ok := byID[oldParent]; !ok {
+			oldParent = ""
+		}
+		siblings := children[oldParent]
+		for i, s := range siblings {
+			if s.ID == section.ID {
+				children[oldParent] = append(siblings[:i:i], siblings[i+1:]...)
+				break
+			}
+		}
+
+		target := children[newParent]
+		position := min(max(move.Position, 0), len(target))
+		target = append(target[:position:position], append([]*Section{section}, target[position:]...)...)
+		children[newParent] = target
+
+		if newParent == "" {
+			section.ParentID = nil
+		} else {
+			id := newParent
+			section.ParentID = &id
+		}
+	}
+
+	changed := []*Section{}
+	for _, siblings := range children {
+		for i, s := range siblings {
+			s.Position = i
+			before := original[s.ID]
+			if before.Position != s.Position || parentKey(before.ParentID) != parentKey(s.ParentID) {
+				changed = append(changed, s)
+			}
+		}
+	}
+	return changed, nil
+}
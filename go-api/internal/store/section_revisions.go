@@ -0,0 +1,222 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+type SectionRevision struct {
+	ID         string           `json:"id"`
+	SectionID  string           `json:"section_id"`
+	DocumentID string           `json:"document_id"`
+	AuthorID   *string          `json:"author_id"`
+	AuthorName *string          `json:"author_name"`
+	Title      string           `json:"title"`
+	Content    string           `json:"content,omitempty"`
+	Summary    string           `json:"summary"`
+	Metadata   *json.RawMessage `json:"metadata"`
+	Length     int              `json:"length"`
+	NumWords   int              `json:"num_words"`
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+// RevisionRetention bounds how many revisions are kept per section. The newest
+// MinKeep revisions are always kept, anything older than MaxAge beyond those is
+// pruned, and nothing past the newest MaxKeep survives regardless of age.
+// Zero values disable the corresponding rule.
+type RevisionRetention struct {
+	MinKeep int
+	MaxKeep int
+	MaxAge  time.Duration
+}
+
+var DefaultRevisionRetention = RevisionRetention{
+	MinKeep: 20,
+	MaxKeep: 200,
+	MaxAge:  90 * 24 * time.Hour,
+}
+
+func (p *PostgresSectionStore) recordRevision(tx *sql.Tx, user *User, section *Section) error {
+	query := `
+	INSERT INTO section_revisions (section_id, document_id, author_id, title, content, summary, metadata, length, num_words)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	_, err := tx.Exec(query,
+		section.ID,
+		section.DocumentID,
+		user.ID,
+		section.Title,
+		section.Content,
+		section.Summary,
+		section.Metadata,
+		section.Length,
+		section.NumWords,
+	)
+	if err != nil {
+		return err
+	}
+
+	return p.pruneRevisions(tx, section.ID)
+}
+
+func (p *PostgresSectionStore) pruneRevisions(tx *sql.Tx, sectionID string) error {
+	if p.retention.MaxKeep > 0 {
+		query := `
+			DELETE FROM section_revisions
+			WHERE section_id = $1 AND id NOT IN (
+				SELECT id FROM section_revisions
+				WHERE section_id = $1
+				ORDER BY created_at DESC
+				LIMIT $2
+			)
+		`
+		_, err := tx.Exec(query, sectionID, p.retention.MaxKeep)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.retention.MaxAge > 0 {
+		query := `
+			DELETE FROM section_revisions
+			WHERE section_id = $1 AND created_at < $2 AND id NOT IN (
+				SELECT id FROM section_revisions
+				WHERE section_id = $1
+				ORDER BY created_at DESC
+				LIMIT $3
+			)
+		`
+		_, err := tx.Exec(query, sectionID, time.Now().Add(-p.retention.MaxAge), p.retention.MinKeep)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *PostgresSectionStore) GetRevisions(user *User, sectionId string) ([]*SectionRevision, error) {
+	var exists bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM sections s
+			INNER JOIN documents d ON s.document_id = d.id
+			WHERE s.id = $1 AND ` + hasRole("d", 2, RoleViewer) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		)
+	`
+	err := p.db.QueryRow(query, sectionId, user.ID, user.documentScope()).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	query = `
+		SELECT r.id, r.section_id, r.document_id, r.author_id, u.name, r.title, r.summary, r.metadata, r.length, r.num_words, r.created_at
+		FROM section_revisions r
+		LEFT JOIN users u ON r.author_id = u.id
+		WHERE r.section_id = $1
+		ORDER BY r.created_at DESC
+	`
+	rows, err := p.db.Query(query, sectionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []*SectionRevision{}
+	for rows.Next() {
+		revision := &SectionRevision{}
+		err := rows.Scan(
+			&revision.ID,
+			&revision.SectionID,
+			&revision.DocumentID,
+			&revision.AuthorID,
+			&revision.AuthorName,
+			&revision.Title,
+			&revision.Summary,
+			&revision.Metadata,
+			&revision.Length,
+			&revision.NumWords,
+			&revision.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+func (p *PostgresSectionStore) ReadRevision(user *User, revisionId string) (*SectionRevision, error) {
+	revision := &SectionRevision{}
+	query := `
+		SELECT r.id, r.section_id, r.document_id, r.author_id, u.name, r.title, r.content, r.summary, r.metadata, r.length, r.num_words, r.created_at
+		FROM section_revisions r
+		INNER JOIN documents d ON r.document_id = d.id
+		LEFT JOIN users u ON r.author_id = u.id
+		WHERE r.id = $1 AND ` + hasRole("d", 2, RoleViewer) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+	`
+	err := p.db.QueryRow(query, revisionId, user.ID, user.documentScope()).Scan(
+		&revision.ID,
+		&revision.SectionID,
+		&revision.DocumentID,
+		&revision.AuthorID,
+		&revision.AuthorName,
+		&revision.Title,
+		&revision.Content,
+		&revision.Summary,
+		&revision.Metadata,
+		&revision.Length,
+		&revision.NumWords,
+		&revision.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+// RestoreRevision writes an earlier revision back onto its section. The
+// restore is itself recorded as a new revision, so it can be undone.
+func (p *PostgresSectionStore) RestoreRevision(user *User, revisionId string) (*Section, error) {
+	revision, err := p.ReadRevision(user, revisionId)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	section := &Section{
+		ID:       revision.SectionID,
+		Title:    revision.Title,
+		Content:  revision.Content,
+		Summary:  revision.Summary,
+		Metadata: revision.Metadata,
+	}
+
+	err = updateSection(tx, user, section)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.recordRevision(tx, user, section)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return section, nil
+}
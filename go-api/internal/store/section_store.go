@@ -10,6 +10,9 @@ import (
 type Section struct {
 	ID         string           `json:"id"`
 	DocumentID string           `json:"document_id"`
+	ParentID   *string          `json:"parent_id"`
+	Kind       string           `json:"kind"`
+	Position   int              `json:"position"`
 	Title      string           `json:"title"`
 	Content    string           `json:"content"`
 	Summary    string           `json:"summary"`
@@ -21,29 +24,89 @@ type Section struct {
 }
 
 type PostgresSectionStore struct {
-	db *sql.DB
+	db        *sql.DB
+	retention RevisionRetention
 }
 
-func NewPostgresSectionStore(db *sql.DB) *PostgresSectionStore {
-	return &PostgresSectionStore{db: db}
+func NewPostgresSectionStore(db *sql.DB, retention RevisionRetention) *PostgresSectionStore {
+	return &PostgresSectionStore{db: db, retention: retention}
 }
 
 type SectionStore interface {
-	CreateSection(*Section) (*Section, error)
-	ReadSection(string) (*Section, error)
-	UpdateSection(*Section) (*Section, error)
-	DeleteSection(string) error
+	CreateSection(*User, *Section) (*Section, error)
+	ReadSection(*User, string) (*Section, error)
+	UpdateSection(*User, *Section) (*Section, error)
+	AutosaveSection(*User, *Section) (*Section, error)
+	DeleteSection(*User, string) error
 	GetSectionsForDocument(*User, string) ([]*Section, error)
+	GetOutline(*User, string) ([]*OutlineNode, error)
+	ReorderSections(*User, string, []SectionMove) ([]*Section, error)
+	GetRevisions(*User, string) ([]*SectionRevision, error)
+	ReadRevision(*User, string) (*SectionRevision, error)
+	RestoreRevision(*User, string) (*Section, error)
+	ImportDocument(*User, *Document, []*Section) (*Document, []*Section, error)
 }
 
-func (p *PostgresSectionStore) CreateSection(section *Section) (*Section, error) {
+func (p *PostgresSectionStore) CreateSection(user *User, section *Section) (*Section, error) {
+	kind, err := normalizeSectionKind(section.Kind)
+	if err != nil {
+		return nil, err
+	}
+	section.Kind = kind
+	section.ComputeStats()
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the document so concurrent creates do not hand out the same position
+	var documentID string
+	err = tx.QueryRow(`SELECT d.id FROM documents d WHERE d.id = $1 AND `+hasRole("d", 2, RoleEditor)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[])) FOR UPDATE`, section.DocumentID, user.ID, user.documentScope()).Scan(&documentID)
+	if err != nil {
+		return nil, denied(tx, user, documentOfDocument, section.DocumentID, err)
+	}
+
+	if section.ParentID != nil {
+		var parentKind string
+		err = tx.QueryRow(`SELECT kind FROM sections WHERE id = $1 AND document_id = $2`, *section.ParentID, documentID).Scan(&parentKind)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: parent %s is not in this document", ErrInvalidOutline, *section.ParentID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := validateNesting(parentKind, section.Kind); err != nil {
+			return nil, err
+		}
+	}
+
 	query := `
-	INSERT INTO sections (document_id, title, content, summary, metadata, length, num_words)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)
-	RETURNING id, created_at, updated_at
+	INSERT INTO sections (document_id, parent_id, kind, position, title, content, summary, metadata, length, num_words)
+	VALUES ($1, $2, $3, (
+		SELECT COALESCE(MAX(position) + 1, 0) FROM sections
+		WHERE document_id = $1 AND parent_id IS NOT DISTINCT FROM $2
+	), $4, $5, $6, $7, $8, $9)
+	RETURNING id, position, created_at, updated_at
 	`
 
-	err := p.db.QueryRow(query, section.DocumentID, section.Title, section.Content, section.Summary, section.Metadata, section.Length, section.NumWords).Scan(&section.ID, &section.CreatedAt, &section.UpdatedAt)
+	err = tx.QueryRow(query, documentID, section.ParentID, section.Kind, section.Title, section.Content, section.Summary, section.Metadata, section.Length, section.NumWords).Scan(&section.ID, &section.Position, &section.CreatedAt, &section.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = refreshDocumentStats(tx, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.recordRevision(tx, user, section)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		return nil, err
 	}
@@ -51,16 +114,20 @@ func (p *PostgresSectionStore) CreateSection(section *Section) (*Section, error)
 	return section, nil
 }
 
-func (p *PostgresSectionStore) ReadSection(sectionId string) (*Section, error) {
+func (p *PostgresSectionStore) ReadSection(user *User, sectionId string) (*Section, error) {
 	section := &Section{}
 	query := `
-		SELECT id, document_id, title, content, summary, metadata, length, num_words, created_at, updated_at
-		FROM sections
-		WHERE id = $1
+		SELECT s.id, s.document_id, s.parent_id, s.kind, s.position, s.title, s.content, s.summary, s.metadata, s.length, s.num_words, s.created_at, s.updated_at
+		FROM sections s
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE s.id = $1 AND ` + hasRole("d", 2, RoleViewer) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
 	`
-	err := p.db.QueryRow(query, sectionId).Scan(
+	err := p.db.QueryRow(query, sectionId, user.ID, user.documentScope()).Scan(
 		&section.ID,
 		&section.DocumentID,
+		&section.ParentID,
+		&section.Kind,
+		&section.Position,
 		&section.Title,
 		&section.Content,
 		&section.Summary,
@@ -76,14 +143,83 @@ func (p *PostgresSectionStore) ReadSection(sectionId string) (*Section, error) {
 	return section, nil
 }
 
-func (p *PostgresSectionStore) UpdateSection(section *Section) (*Section, error) {
+func (p *PostgresSectionStore) UpdateSection(user *User, section *Section) (*Section, error) {
+	return p.saveSection(user, section, true)
+}
+
+// AutosaveSection saves a section as UpdateSection does but records no
+// revision, for callers that save every few seconds and record revisions at
+// their own pace with UpdateSection.
+func (p *PostgresSectionStore) AutosaveSection(user *User, section *Section) (*Section, error) {
+	return p.saveSection(user, section, false)
+}
+
+func (p *PostgresSectionStore) saveSection(user *User, section *Section, revise bool) (*Section, error) {
+	if section.Kind != "" {
+		if _, err := normalizeSectionKind(section.Kind); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = updateSection(tx, user, section)
+	if err != nil {
+		return nil, err
+	}
+
+	if revise {
+		err = p.recordRevision(tx, user, section)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return section, nil
+}
+
+// updateSection writes a section's editable fields, recounting its statistics
+// and the document totals and moving note anchors to follow the new text.
+func updateSection(tx *sql.Tx, user *User, section *Section) error {
+	section.ComputeStats()
+
+	// Lock the section and read what the update replaces
+	var documentID, kind string
+	var content sql.NullString
+	err := tx.QueryRow(`
+		SELECT s.document_id, s.kind, s.content
+		FROM sections s
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE s.id = $1 AND `+hasRole("d", 2, RoleEditor)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		FOR UPDATE OF s
+	`, section.ID, user.ID, user.documentScope()).Scan(&documentID, &kind, &content)
+	if err != nil {
+		return denied(tx, user, documentOfSection, section.ID, err)
+	}
+
+	if section.Kind != "" && section.Kind != kind {
+		err := checkKindChange(tx, documentID, section)
+		if err != nil {
+			return err
+		}
+	}
+
 	query := `
-		UPDATE sections
-		SET title = $1, content = $2, summary = $3, metadata = $4, length = $5, num_words = $6, updated_at = NOW()
-		WHERE id = $7
-		RETURNING updated_at
+		UPDATE sections s
+		SET title = $1, content = $2, summary = $3, metadata = $4, length = $5, num_words = $6, kind = COALESCE(NULLIF($9, ''), s.kind), updated_at = NOW()
+		FROM documents d
+		WHERE s.id = $7 AND s.document_id = d.id AND ` + hasRole("d", 8, RoleEditor) + ` AND ($10::text[] IS NULL OR d.id::text = ANY($10::text[]))
+		RETURNING s.document_id, s.parent_id, s.kind, s.position, s.created_at, s.updated_at
 	`
-	err := p.db.QueryRow(query,
+	err = tx.QueryRow(query,
 		section.Title,
 		section.Content,
 		section.Summary,
@@ -91,31 +227,121 @@ func (p *PostgresSectionStore) UpdateSection(section *Section) (*Section, error)
 		section.Length,
 		section.NumWords,
 		section.ID,
-	).Scan(&section.UpdatedAt)
+		user.ID,
+		section.Kind,
+		user.documentScope(),
+	).Scan(&section.DocumentID, &section.ParentID, &section.Kind, &section.Position, &section.CreatedAt, &section.UpdatedAt)
 	if err != nil {
-		return nil, err
+		return denied(tx, user, documentOfSection, section.ID, err)
 	}
-	return section, nil
+
+	err = refreshDocumentStats(tx, section.DocumentID)
+	if err != nil {
+		return err
+	}
+
+	// Saves that leave the text alone, such as a new title, leave the notes
+	// where they are
+	if section.Content == content.String {
+		return nil
+	}
+	return reanchorNotes(tx, section.ID, section.Content)
+}
+
+// checkKindChange returns ErrInvalidOutline when changing the section to
+// section.Kind would leave it unable to sit under its parent or to hold its
+// children. The document is locked as ReorderSections does, and the parent and
+// children with it, so the outline cannot change until the update commits.
+func checkKindChange(tx *sql.Tx, documentID string, section *Section) error {
+	_, err := tx.Exec(`SELECT id FROM documents WHERE id = $1 FOR UPDATE`, documentID)
+	if err != nil {
+		return err
+	}
+
+	// Read after the lock, since the outline may have changed before it
+	var parentKind string
+	err = tx.QueryRow(`
+		SELECT kind FROM sections
+		WHERE id = (SELECT parent_id FROM sections WHERE id = $1)
+		FOR UPDATE
+	`, section.ID).Scan(&parentKind)
+	switch {
+	case err == sql.ErrNoRows:
+		// A top-level section can be any kind
+	case err != nil:
+		return err
+	default:
+		if err := validateNesting(parentKind, section.Kind); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT kind FROM sections WHERE parent_id = $1 FOR UPDATE`, section.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var childKind string
+		if err := rows.Scan(&childKind); err != nil {
+			return err
+		}
+		if err := validateNesting(section.Kind, childKind); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
 }
 
-func (p *PostgresSectionStore) DeleteSection(sectionId string) error {
-	query := `DELETE FROM sections WHERE id = $1`
-	_, err := p.db.Exec(query, sectionId)
+func (p *PostgresSectionStore) DeleteSection(user *User, sectionId string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var documentID string
+	var parentID *string
+	query := `
+		SELECT s.document_id, s.parent_id
+		FROM sections s
+		INNER JOIN documents d ON s.document_id = d.id
+		WHERE s.id = $1 AND ` + hasRole("d", 2, RoleEditor) + ` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		FOR UPDATE OF s
+	`
+	err = tx.QueryRow(query, sectionId, user.ID, user.documentScope()).Scan(&documentID, &parentID)
+	if err != nil {
+		return denied(tx, user, documentOfSection, sectionId, err)
+	}
+
+	// Hand any children up to the grandparent instead of orphaning them
+	_, err = tx.Exec(`UPDATE sections SET parent_id = $2 WHERE parent_id = $1`, sectionId, parentID)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	_, err = tx.Exec(`DELETE FROM sections WHERE id = $1`, sectionId)
+	if err != nil {
+		return err
+	}
+
+	err = refreshDocumentStats(tx, documentID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (p *PostgresSectionStore) GetSectionsForDocument(user *User, documentId string) ([]*Section, error) {
 	query := `
-		SELECT s.id, s.document_id, s.title, s.content, s.summary, s.metadata, s.length, s.num_words, s.created_at, s.updated_at
+		SELECT s.id, s.document_id, s.parent_id, s.kind, s.position, s.title, s.content, s.summary, s.metadata, s.length, s.num_words, s.created_at, s.updated_at
 		FROM sections s
 		INNER JOIN documents d ON s.document_id = d.id
-		WHERE d.user_id = $1 AND s.document_id = $2
-		ORDER BY s.created_at DESC
+		WHERE ` + hasRole("d", 1, RoleViewer) + ` AND s.document_id = $2 AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[]))
+		ORDER BY s.position ASC, s.created_at ASC
 	`
-	rows, err := p.db.Query(query, user.ID, documentId)
+	rows, err := p.db.Query(query, user.ID, documentId, user.documentScope())
 	if err != nil {
 		fmt.Printf("Line 120 error: %v", err)
 		return nil, err
@@ -128,6 +354,9 @@ func (p *PostgresSectionStore) GetSectionsForDocument(user *User, documentId str
 		err := rows.Scan(
 			&section.ID,
 			&section.DocumentID,
+			&section.ParentID,
+			&section.Kind,
+			&section.Position,
 			&section.Title,
 			&section.Content,
 			&section.Summary,
@@ -147,5 +376,80 @@ func (p *PostgresSectionStore) GetSectionsForDocument(user *User, documentId str
 		fmt.Printf("Line 147 error: %v", err)
 		return nil, err
 	}
-	return sections, nil
+	return OrderSections(sections), nil
+}
+
+func (p *PostgresSectionStore) GetOutline(user *User, documentId string) ([]*OutlineNode, error) {
+	var exists bool
+	err := p.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM documents d WHERE d.id = $1 AND `+hasRole("d", 2, RoleViewer)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[])))`, documentId, user.ID, user.documentScope()).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	sections, err := p.GetSectionsForDocument(user, documentId)
+	if err != nil {
+		return nil, err
+	}
+	return BuildOutline(sections), nil
+}
+
+func (p *PostgresSectionStore) ReorderSections(user *User, documentId string, moves []SectionMove) ([]*Section, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var documentID string
+	err = tx.QueryRow(`SELECT d.id FROM documents d WHERE d.id = $1 AND `+hasRole("d", 2, RoleEditor)+` AND ($3::text[] IS NULL OR d.id::text = ANY($3::text[])) FOR UPDATE`, documentId, user.ID, user.documentScope()).Scan(&documentID)
+	if err != nil {
+		return nil, denied(tx, user, documentOfDocument, documentId, err)
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, parent_id, kind, position, created_at
+		FROM sections
+		WHERE document_id = $1
+		FOR UPDATE
+	`, documentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sections := []*Section{}
+	for rows.Next() {
+		section := &Section{DocumentID: documentID}
+		err := rows.Scan(&section.ID, &section.ParentID, &section.Kind, &section.Position, &section.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, section)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	changed, err := applySectionMoves(sections, moves)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, section := range changed {
+		_, err := tx.Exec(`UPDATE sections SET parent_id = $1, position = $2 WHERE id = $3`, section.ParentID, section.Position, section.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return p.GetSectionsForDocument(user, documentID)
 }
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUpdateSectionKindKeepsOutlineValid(t *testing.T) {
+	db := testDB(t)
+	documents := NewPostgresDocumentStore(db)
+	sections := NewPostgresSectionStore(db, DefaultRevisionRetention)
+
+	alice := testUser(t, db, "alice")
+	document, err := documents.CreateDocument(&Document{Title: "Outline"}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(parentID *string, kind string) *Section {
+		t.Helper()
+		section, err := sections.CreateSection(alice, &Section{DocumentID: document.ID, ParentID: parentID, Kind: kind, Title: kind})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return section
+	}
+	part := create(nil, SectionKindPart)
+	chapter := create(&part.ID, SectionKindChapter)
+	scene := create(&chapter.ID, SectionKindScene)
+
+	for _, tc := range []struct {
+		name    string
+		section *Section
+		kind    string
+		valid   bool
+	}{
+		{"scene under a chapter to a part", scene, SectionKindPart, false},
+		{"chapter holding a scene to a scene", chapter, SectionKindScene, false},
+		{"part holding a chapter to a chapter", part, SectionKindChapter, false},
+		{"unchanged kind", chapter, SectionKindChapter, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := sections.UpdateSection(alice, &Section{ID: tc.section.ID, Title: tc.section.Title, Kind: tc.kind})
+			if tc.valid && err != nil {
+				t.Fatalf("got %v, want no error", err)
+			}
+			if !tc.valid && !errors.Is(err, ErrInvalidOutline) {
+				t.Fatalf("got %v, want ErrInvalidOutline", err)
+			}
+
+			read, err := sections.ReadSection(alice, tc.section.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read.Kind != tc.section.Kind {
+				t.Errorf("kind is %q, want %q", read.Kind, tc.section.Kind)
+			}
+		})
+	}
+}
+
+func TestAutosaveSectionRecordsNoRevision(t *testing.T) {
+	db := testDB(t)
+	documents := NewPostgresDocumentStore(db)
+	sections := NewPostgresSectionStore(db, DefaultRevisionRetention)
+
+	alice := testUser(t, db, "alice")
+	document, err := documents.CreateDocument(&Document{Title: "Drafts"}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, err := sections.CreateSection(alice, &Section{DocumentID: document.ID, Title: "One", Content: "First."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := sections.GetRevisions(alice, section.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sections.AutosaveSection(alice, &Section{ID: section.ID, Title: "One", Content: "First. Second."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := sections.GetRevisions(alice, section.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("%d revisions after an autosave, want %d", len(after), len(before))
+	}
+	read, err := sections.ReadSection(alice, section.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Content != "First. Second." {
+		t.Errorf("content is %q, want the autosaved text", read.Content)
+	}
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SessionLifetime is how long a login lasts.
+const SessionLifetime = 72 * time.Hour
+
+// sessionTouchInterval limits how often a session's last_seen_at is written,
+// so authenticating a request is usually a single read.
+const sessionTouchInterval = 5 * time.Minute
+
+// Session is one login. The auth token carries its ID, and a token is only
+// accepted while its session is neither revoked nor expired.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Current marks the session the listing request was made with.
+	Current bool `json:"current"`
+}
+
+type PostgresSessionStore struct {
+	db *sql.DB
+}
+
+func NewPostgresSessionStore(db *sql.DB) *PostgresSessionStore {
+	return &PostgresSessionStore{db: db}
+}
+
+type SessionStore interface {
+	CreateSession(*Session) (*Session, error)
+	GetActiveSession(string) (*Session, error)
+	GetSessions(*User) ([]*Session, error)
+	RevokeSession(*User, string) error
+	RevokeAllSessions(*User, string) (int, error)
+}
+
+const sessionColumns = `id, user_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''), expires_at, last_seen_at, created_at`
+
+func scanSession(row rowScanner) (*Session, error) {
+	session := &Session{}
+	err := row.Scan(
+		&session.ID,
+		&session.UserID,
+		&session.UserAgent,
+		&session.IPAddress,
+		&session.ExpiresAt,
+		&session.LastSeenAt,
+		&session.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (p *PostgresSessionStore) CreateSession(session *Session) (*Session, error) {
+	query := `
+	INSERT INTO sessions (user_id, user_agent, ip_address, expires_at)
+	VALUES ($1, $2, $3, $4)
+	RETURNING ` + sessionColumns + `
+	`
+	expiresAt := time.Now().Add(SessionLifetime)
+	return scanSession(p.db.QueryRow(query, session.UserID, session.UserAgent, session.IPAddress, expiresAt))
+}
+
+// GetActiveSession returns a session that is neither revoked nor expired,
+// or sql.ErrNoRows, and notes that it has been seen.
+func (p *PostgresSessionStore) GetActiveSession(sessionId string) (*Session, error) {
+	query := `
+		SELECT ` + sessionColumns + `
+		FROM sessions
+		WHERE id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+	`
+	session, err := scanSession(p.db.QueryRow(query, sessionId))
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		_, err := p.db.Exec(`UPDATE sessions SET last_seen_at = NOW() WHERE id = $1`, session.ID)
+		if err != nil {
+			return nil, err
+		}
+		session.LastSeenAt = time.Now()
+	}
+	return session, nil
+}
+
+// GetSessions lists the user's active sessions, most recently used first.
+func (p *PostgresSessionStore) GetSessions(user *User) ([]*Session, error) {
+	query := `
+		SELECT ` + sessionColumns + `
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_seen_at DESC
+	`
+	rows, err := p.db.Query(query, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (p *PostgresSessionStore) RevokeSession(user *User, sessionId string) error {
+	query := `
+		UPDATE sessions
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`
+	result, err := p.db.Exec(query, sessionId, user.ID)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// RevokeAllSessions revokes every active session of the user except the one
+// with ID keep, if given, and returns how many it revoked.
+func (p *PostgresSessionStore) RevokeAllSessions(user *User, keep string) (int, error) {
+	query := `
+		UPDATE sessions
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW() AND ($2 = '' OR id::text <> $2)
+	`
+	result, err := p.db.Exec(query, user.ID, keep)
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := result.RowsAffected()
+	return int(revoked), err
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+// TestSessionRevocation checks that a session stops being active once it is
+// revoked or has expired, which is what the auth token cookie is checked
+// against.
+func TestSessionRevocation(t *testing.T) {
+	db := testDB(t)
+	sessions := NewPostgresSessionStore(db)
+	ada := testUser(t, db, "ada")
+
+	newSession := func(t *testing.T) *Session {
+		t.Helper()
+		session, err := sessions.CreateSession(&Session{UserID: ada.ID, UserAgent: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sessions.GetActiveSession(session.ID); err != nil {
+			t.Fatalf("a new session is not active: %v", err)
+		}
+		return session
+	}
+	inactive := func(t *testing.T, session *Session) {
+		t.Helper()
+		if _, err := sessions.GetActiveSession(session.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("got %v, want sql.ErrNoRows", err)
+		}
+	}
+
+	t.Run("revoked", func(t *testing.T) {
+		session := newSession(t)
+		if err := sessions.RevokeSession(ada, session.ID); err != nil {
+			t.Fatal(err)
+		}
+		inactive(t, session)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		session := newSession(t)
+		if _, err := db.Exec(`UPDATE sessions SET expires_at = NOW() - INTERVAL '1 second' WHERE id = $1`, session.ID); err != nil {
+			t.Fatal(err)
+		}
+		inactive(t, session)
+	})
+
+	t.Run("revoked by another user", func(t *testing.T) {
+		session := newSession(t)
+		bob := testUser(t, db, "bob")
+		if err := sessions.RevokeSession(bob, session.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("got %v, want sql.ErrNoRows", err)
+		}
+		if _, err := sessions.GetActiveSession(session.ID); err != nil {
+			t.Errorf("the session was revoked: %v", err)
+		}
+	})
+
+	t.Run("all but the current", func(t *testing.T) {
+		current := newSession(t)
+		other := newSession(t)
+		if _, err := sessions.RevokeAllSessions(ada, current.ID); err != nil {
+			t.Fatal(err)
+		}
+		inactive(t, other)
+		if _, err := sessions.GetActiveSession(current.ID); err != nil {
+			t.Errorf("the current session was revoked: %v", err)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackwillis517/Scribo/internal/identity"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// schemaFiles are the files in db/ in the order their tables reference each
+// other.
+var schemaFiles = []string{
+	"users.sql",
+	"user_identities.sql",
+	"sessions.sql",
+	"access_tokens.sql",
+	"documents.sql",
+	"document_members.sql",
+	"document_invitations.sql",
+	"sections.sql",
+	"section_revisions.sql",
+	"notes.sql",
+	"conversations.sql",
+	"messages.sql",
+	"jobs.sql",
+	"proposals.sql",
+	"usage.sql",
+}
+
+// testDB opens a schema of its own in the database TEST_DATABASE_URL names,
+// loaded from db/ and dropped when the test ends. The test is skipped when
+// TEST_DATABASE_URL is unset.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db := emptyTestDB(t)
+	loadSchema(t, db)
+	return db
+}
+
+// emptyTestDB is testDB without the tables.
+func emptyTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	schema := "scribo_test_" + hex.EncodeToString(suffix)
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		admin, err := sql.Open("pgx", databaseURL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer admin.Close()
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Error(err)
+		}
+	})
+
+	db, err := sql.Open("pgx", withSearchPath(t, databaseURL, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// loadSchema runs the files in db/, which create what is missing and bring
+// tables from earlier versions up to date.
+func loadSchema(t *testing.T, db *sql.DB) {
+	t.Helper()
+	for _, name := range schemaFiles {
+		ddl, err := os.ReadFile(filepath.Join("..", "..", "..", "db", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(string(ddl)); err != nil {
+			t.Fatalf("loading %s: %v", name, err)
+		}
+	}
+}
+
+// withSearchPath points every connection made with databaseURL at schema.
+func withSearchPath(t *testing.T, databaseURL string, schema string) string {
+	t.Helper()
+	if !strings.Contains(databaseURL, "://") {
+		return databaseURL + " search_path=" + schema
+	}
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// testUser logs in a new user through the dev provider.
+func testUser(t *testing.T, db *sql.DB, name string) *User {
+	t.Helper()
+	user, err := NewPostgresUserStore(db).LoginUser(&identity.Identity{
+		Provider: identity.DevProviderName,
+		Subject:  name,
+		Email:    name + "@example.com",
+		Name:     name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
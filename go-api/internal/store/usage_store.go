@@ -0,0 +1,194 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	UsageKindMessage      = "message"
+	UsageKindIndexSection = "index_section"
+)
+
+// TokenUsage is the LLM work one agent call did, as reported by the backend.
+type TokenUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// EstimateTokens guesses how many tokens text costs, at about four
+// characters a token, for calls the backend did not report usage for.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// UsageEvent records the tokens used by one request. Estimated is set when
+// the counts were guessed from the text rather than reported.
+type UsageEvent struct {
+	Kind         string    `json:"kind"`
+	DocumentID   *string   `json:"document_id"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	Estimated    bool      `json:"estimated"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Quota limits the tokens a user may use per UTC day and calendar month.
+// Zero means no limit. Rows in usage_quotas override the default per user.
+type Quota struct {
+	DailyTokens   int `json:"daily_tokens"`
+	MonthlyTokens int `json:"monthly_tokens"`
+}
+
+// UsagePeriod is a user's usage so far in the current day or month. Limit
+// is nil when the period is unlimited.
+type UsagePeriod struct {
+	Period   string    `json:"period"`
+	Used     int       `json:"used"`
+	Limit    *int      `json:"limit"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+type UsageSummary struct {
+	Day   UsagePeriod `json:"day"`
+	Month UsagePeriod `json:"month"`
+}
+
+// Exceeded returns the period whose limit the user has used up, or nil
+// while they are within their quota.
+func (s *UsageSummary) Exceeded() *UsagePeriod {
+	for _, period := range []*UsagePeriod{&s.Day, &s.Month} {
+		if period.Limit != nil && period.Used >= *period.Limit {
+			return period
+		}
+	}
+	return nil
+}
+
+// DailyUsage totals one UTC day's usage of one kind.
+type DailyUsage struct {
+	Day          string `json:"day"`
+	Kind         string `json:"kind"`
+	Requests     int    `json:"requests"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+}
+
+type PostgresUsageStore struct {
+	db *sql.DB
+}
+
+func NewPostgresUsageStore(db *sql.DB) *PostgresUsageStore {
+	return &PostgresUsageStore{db: db}
+}
+
+type UsageStore interface {
+	RecordUsage(*User, *UsageEvent) error
+	RecordJobUsage(string, *UsageEvent) error
+	GetUsageSummary(*User, Quota) (*UsageSummary, error)
+	GetDailyUsage(*User, int) ([]*DailyUsage, error)
+}
+
+func (p *PostgresUsageStore) RecordUsage(user *User, event *UsageEvent) error {
+	query := `
+	INSERT INTO usage_events (user_id, document_id, kind, input_tokens, output_tokens, estimated)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING created_at
+	`
+	return p.db.QueryRow(query, user.ID, event.DocumentID, event.Kind, event.InputTokens, event.OutputTokens, event.Estimated).Scan(&event.CreatedAt)
+}
+
+// RecordJobUsage records what a background job on a section cost, billed to
+// the user who queued it, whose quota was checked when they did, or to the
+// document's owner if that user has since been deleted. Usage for a section
+// that has since been deleted is dropped.
+func (p *PostgresUsageStore) RecordJobUsage(jobId string, event *UsageEvent) error {
+	query := `
+	INSERT INTO usage_events (user_id, document_id, kind, input_tokens, output_tokens, estimated)
+	SELECT COALESCE(j.requested_by, d.user_id), d.id, $2, $3, $4, $5
+	FROM jobs j
+	INNER JOIN sections s ON j.section_id = s.id
+	INNER JOIN documents d ON s.document_id = d.id
+	WHERE j.id = $1
+	`
+	_, err := p.db.Exec(query, jobId, event.Kind, event.InputTokens, event.OutputTokens, event.Estimated)
+	return err
+}
+
+// GetUsageSummary returns the user's usage in the current UTC day and month
+// against their quota: the user's own override where one is set, otherwise
+// the default quota given.
+func (p *PostgresUsageStore) GetUsageSummary(user *User, quota Quota) (*UsageSummary, error) {
+	now := time.Now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	query := `
+		SELECT
+			COALESCE(SUM(e.input_tokens + e.output_tokens) FILTER (WHERE e.created_at >= $2), 0),
+			COALESCE(SUM(e.input_tokens + e.output_tokens), 0),
+			(SELECT q.daily_tokens FROM usage_quotas q WHERE q.user_id = $1),
+			(SELECT q.monthly_tokens FROM usage_quotas q WHERE q.user_id = $1)
+		FROM usage_events e
+		WHERE e.user_id = $1 AND e.created_at >= $3
+	`
+	summary := &UsageSummary{
+		Day:   UsagePeriod{Period: "day", ResetsAt: dayStart.AddDate(0, 0, 1)},
+		Month: UsagePeriod{Period: "month", ResetsAt: monthStart.AddDate(0, 1, 0)},
+	}
+	var daily, monthly sql.NullInt64
+	err := p.db.QueryRow(query, user.ID, dayStart, monthStart).Scan(&summary.Day.Used, &summary.Month.Used, &daily, &monthly)
+	if err != nil {
+		return nil, err
+	}
+
+	summary.Day.Limit = quotaLimit(daily, quota.DailyTokens)
+	summary.Month.Limit = quotaLimit(monthly, quota.MonthlyTokens)
+	return summary, nil
+}
+
+func quotaLimit(override sql.NullInt64, fallback int) *int {
+	limit := fallback
+	if override.Valid {
+		limit = int(override.Int64)
+	}
+	if limit <= 0 {
+		return nil
+	}
+	return &limit
+}
+
+// GetDailyUsage totals the user's usage per UTC day and kind over the last
+// days days, newest first.
+func (p *PostgresUsageStore) GetDailyUsage(user *User, days int) ([]*DailyUsage, error) {
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1-days)
+
+	query := `
+		SELECT to_char(e.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, e.kind, COUNT(*), SUM(e.input_tokens), SUM(e.output_tokens)
+		FROM usage_events e
+		WHERE e.user_id = $1 AND e.created_at >= $2
+		GROUP BY day, e.kind
+		ORDER BY day DESC, e.kind ASC
+	`
+	rows, err := p.db.Query(query, user.ID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []*DailyUsage{}
+	for rows.Next() {
+		day := &DailyUsage{}
+		err := rows.Scan(&day.Day, &day.Kind, &day.Requests, &day.InputTokens, &day.OutputTokens)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, day)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
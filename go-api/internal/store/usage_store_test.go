@@ -0,0 +1,54 @@
+package store
+
+import "testing"
+
+// TestJobUsageBilledToRequester checks that indexing a section another user
+// saved is billed to them, the user whose quota was checked, and not to the
+// document's owner.
+func TestJobUsageBilledToRequester(t *testing.T) {
+	db := testDB(t)
+	documents := NewPostgresDocumentStore(db)
+	sections := NewPostgresSectionStore(db, DefaultRevisionRetention)
+	jobs := NewPostgresJobStore(db)
+	usage := NewPostgresUsageStore(db)
+
+	alice := testUser(t, db, "alice")
+	bob := testUser(t, db, "bob")
+	document, err := documents.CreateDocument(&Document{Title: "Shared"}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO document_members (document_id, user_id, role) VALUES ($1, $2, $3)`, document.ID, bob.ID, RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, err := sections.CreateSection(alice, &Section{DocumentID: document.ID, Title: "One", Content: "Bob's words."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := jobs.EnqueueSectionIndex(bob, section.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = usage.RecordJobUsage(job.ID, &UsageEvent{Kind: UsageKindIndexSection, InputTokens: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		user *User
+		used int
+	}{
+		{bob, 100},
+		{alice, 0},
+	} {
+		summary, err := usage.GetUsageSummary(tc.user, Quota{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.Day.Used != tc.used {
+			t.Errorf("%s has used %d tokens today, want %d", tc.user.Name, summary.Day.Used, tc.used)
+		}
+	}
+}
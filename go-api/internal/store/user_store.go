@@ -1,6 +1,11 @@
 package store
 
-import "database/sql"
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/jackwillis517/Scribo/internal/identity"
+)
 
 type User struct {
 	ID       string `json:"id"`
@@ -8,6 +13,19 @@ type User struct {
 	Name     string `json:"name"`
 	Email    string `json:"email"`
 	Picture  string `json:"picture"`
+	// DocumentIDs limits the request to these documents when it was made
+	// with an access token scoped to them; nil means all the user's
+	// documents.
+	DocumentIDs []string `json:"-"`
+}
+
+// documentScope is the query argument the ownership checks compare d.id
+// against: NULL when the user may reach all their documents.
+func (u *User) documentScope() any {
+	if u.DocumentIDs == nil {
+		return nil
+	}
+	return u.DocumentIDs
 }
 
 type PostgresUserStore struct {
@@ -19,39 +37,83 @@ func NewPostgresUserStore(db *sql.DB) *PostgresUserStore {
 }
 
 type UserStore interface {
-	CreateUser(*User) (*User, error)
-	FindUserByGoogleID(*User) (*User, error)
+	LoginUser(*identity.Identity) (*User, error)
 	GetUserByID(string) (*User, error)
 }
 
-func (p *PostgresUserStore) CreateUser(user *User) (*User, error) {
-	row := p.db.QueryRow(`INSERT INTO users (google_id, email, name, picture) VALUES ($1, $2, $3, $4) RETURNING id, google_id, email, name, picture`, user.GoogleID, user.Email, user.Name, user.Picture)
-	err := row.Scan(&user.ID, &user.GoogleID, &user.Name, &user.Email, &user.Picture)
+const userColumns = `u.id, COALESCE(u.google_id, ''), u.email, u.name, COALESCE(u.picture, '')`
+
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	err := row.Scan(&user.ID, &user.GoogleID, &user.Email, &user.Name, &user.Picture)
 	if err != nil {
 		return nil, err
 	}
-
 	return user, nil
 }
 
-func (p *PostgresUserStore) FindUserByGoogleID(user *User) (*User, error) {
-	row := p.db.QueryRow(`SELECT id, google_id, email, name FROM users WHERE google_id = $1`, user.GoogleID)
-	err := row.Scan(&user.ID, &user.GoogleID, &user.Email, &user.Name)
+// LoginUser returns the user an identity belongs to, creating the user on
+// their first login. Identities are matched on provider and subject only:
+// the same email from two providers is two accounts, since not every
+// provider verifies email addresses.
+func (p *PostgresUserStore) LoginUser(login *identity.Identity) (*User, error) {
+	tx, err := p.db.Begin()
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	return user, nil
-}
+	user, err := scanUser(tx.QueryRow(`
+		UPDATE user_identities i
+		SET last_login_at = NOW(), email = $3
+		FROM users u
+		WHERE i.provider = $1 AND i.subject = $2 AND i.user_id = u.id
+		RETURNING `+userColumns,
+		login.Provider, login.Subject, login.Email,
+	))
+	if err == nil {
+		return user, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
 
-func (p *PostgresUserStore) GetUserByID(id string) (*User, error) {
-	user := &User{}
-	row := p.db.QueryRow(`SELECT id, google_id, email, name, picture FROM users WHERE id = $1`, id)
-	err := row.Scan(&user.ID, &user.GoogleID, &user.Email, &user.Name, &user.Picture)
+	// Google accounts from before identities were recorded are found by
+	// their google_id
+	if login.Provider == identity.GoogleProviderName {
+		user, err = scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users u WHERE u.google_id = $1`, login.Subject))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
 
+	if user == nil {
+		var googleID *string
+		if login.Provider == identity.GoogleProviderName {
+			googleID = &login.Subject
+		}
+		user, err = scanUser(tx.QueryRow(`
+			INSERT INTO users AS u (google_id, email, name, picture)
+			VALUES ($1, $2, $3, $4)
+			RETURNING `+userColumns,
+			googleID, login.Email, login.Name, login.Picture,
+		))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4)
+	`, user.ID, login.Provider, login.Subject, login.Email)
 	if err != nil {
 		return nil, err
 	}
 
-	return user, nil
+	return user, tx.Commit()
+}
+
+func (p *PostgresUserStore) GetUserByID(id string) (*User, error) {
+	return scanUser(p.db.QueryRow(`SELECT `+userColumns+` FROM users u WHERE u.id = $1`, id))
 }
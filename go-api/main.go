@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	// "os"
 	"github.com/jackwillis517/Scribo/internal/app"
 	"github.com/jackwillis517/Scribo/internal/routes"
+	"github.com/jackwillis517/Scribo/internal/store"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
@@ -16,7 +22,9 @@ import (
 func main() {
 	// Parse optional server port argument default is 8081
 	var port int
+	var repairStats bool
 	flag.IntVar(&port, "port", 8081, "go api backend server port")
+	flag.BoolVar(&repairStats, "repair-stats", false, "recompute length, word and section counts for every document, then exit")
 	flag.Parse()
 
 	app, err := app.NewApplication()
@@ -25,6 +33,15 @@ func main() {
 	}
 	defer app.DB.Close()
 
+	if repairStats {
+		report, err := store.NewPostgresDocumentStore(app.DB).RepairAllStats()
+		if err != nil {
+			app.Logger.Fatal(err)
+		}
+		app.Logger.Printf("recomputed stats for %d documents, %d sections corrected\n", report.Documents, report.SectionsUpdated)
+		return
+	}
+
 	r := routes.SetupRoutes(app)
 
 	server := &http.Server{
@@ -35,10 +52,42 @@ func main() {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Background jobs and presence run until the server is asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	workersDone := make(chan struct{})
+	go func() {
+		app.JobWorker.Run(ctx)
+		close(workersDone)
+	}()
+
+	// Ending presence also closes the presence sockets, which Shutdown
+	// leaves alone
+	presenceDone := make(chan struct{})
+	go func() {
+		app.PresenceHub.Run(ctx)
+		close(presenceDone)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// Hijacked WebSockets are not closed by Shutdown, so end the editing
+		// sessions first and let them save
+		if err := app.CollabHub.Close(shutdownCtx); err != nil {
+			app.Logger.Printf("ERROR: closing editing sessions: %v", err)
+		}
+		server.Shutdown(shutdownCtx)
+	}()
+
 	app.Logger.Printf("we are running on port %d\n", port)
 
 	err = server.ListenAndServe()
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		app.Logger.Fatal(err)
 	}
+	<-workersDone
+	<-presenceDone
 }
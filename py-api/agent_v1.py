@@ -6,8 +6,10 @@ from pydantic import BaseModel
 from dotenv import load_dotenv
 from langchain.tools import tool
 from langchain_chroma import Chroma
-from flask import Flask, request, jsonify
+from flask import Flask, Response, request, jsonify, stream_with_context
 from langchain_core.documents import Document
+from langchain_core.callbacks import get_usage_metadata_callback
+from langchain_core.messages import AIMessageChunk
 from langgraph.prebuilt import create_react_agent
 from langgraph.checkpoint.postgres import PostgresSaver
 from langchain_openai import ChatOpenAI, OpenAIEmbeddings
@@ -151,20 +153,18 @@ def add_message(document_id: str, thread_id: str, role: str, content: str) -> No
 
 
 def update_section(section: Section) -> None:
+    # The Go API saves the section itself and queues it here for indexing, so
+    # only the summary is written back, and only if the text is unchanged.
     db_cursor.execute(
         """
         UPDATE sections
-        SET title = %s, content = %s, summary = %s, metadata = %s, length = %s, num_words = %s, updated_at = CURRENT_TIMESTAMP
-        WHERE id = %s
+        SET summary = %s
+        WHERE id = %s AND content IS NOT DISTINCT FROM %s
     """,
         (
-            section.title,
-            section.content,
             section.summary,
-            json.dumps(section.metadata),
-            section.length,
-            section.num_words,
             section.id,
+            section.content,
         ),
     )
     db_conn.commit()
@@ -399,7 +399,7 @@ def recall_ltm(query: str, document_id: str, thread_id: str) -> list[str]:
 # ============================================================================
 
 checkpointer = PostgresSaver(db_conn)
-llm = ChatOpenAI(model="gpt-4o-mini", temperature=0.4)
+llm = ChatOpenAI(model="gpt-4o-mini", temperature=0.4, stream_usage=True)
 tools = [
     query_router,
     query_optimizer,
@@ -455,31 +455,123 @@ def create_agent():
 # ============================================================================
 
 
+def context_aware(document_id: str, section_id: str, content: str) -> str:
+    # Inject document and section context into the user message
+    # so the agent can pass them to the retrieve tool
+    return f"""[CONTEXT: document_id="{document_id}", section_id="{section_id}"]
+
+User query: {content}"""
+
+
+def thread_inputs(
+    agent, document_id: str, section_id: str, thread_id: str, content: str
+) -> dict:
+    # A thread the agent has no saved state for, such as a fork, starts from
+    # the messages stored for it so the conversation carries on from there.
+    # Call this before storing the new message.
+    history = []
+    state = agent.get_state({"configurable": {"thread_id": thread_id}})
+    if not state.values.get("messages"):
+        db_cursor.execute(
+            """
+            SELECT role, content
+            FROM messages
+            WHERE thread_id = %s
+            ORDER BY created_at, id
+        """,
+            (thread_id,),
+        )
+        history = [
+            ("user" if role == "user" else "assistant", text)
+            for role, text in db_cursor.fetchall()
+        ]
+
+    return {
+        "messages": history
+        + [("user", context_aware(document_id, section_id, content))]
+    }
+
+
+def total_usage(usage_metadata: dict) -> dict:
+    # Sum the tokens of every model call, including those made inside tools,
+    # for the Go API's usage quotas
+    return {
+        "input_tokens": sum(u.get("input_tokens", 0) for u in usage_metadata.values()),
+        "output_tokens": sum(
+            u.get("output_tokens", 0) for u in usage_metadata.values()
+        ),
+    }
+
+
 def handle_message(
     document_id: str, section_id: str, thread_id: str | None, content: str
 ):
     if thread_id is None:
         thread_id = create_conversation(document_id, section_id)
+
+    agent = create_agent()
+    inputs = thread_inputs(agent, document_id, section_id, thread_id, content)
     add_message(document_id, thread_id, "user", content)
 
-    # Inject document and section context into the user message
-    # so the agent can pass them to the retrieve tool
-    context_aware_content = f"""[CONTEXT: document_id="{document_id}", section_id="{section_id}"]
+    with get_usage_metadata_callback() as usage:
+        response = agent.invoke(
+            input=inputs, config={"configurable": {"thread_id": thread_id}}
+        )
+
+    add_message(document_id, thread_id, "assistant", response["messages"][-1].content)
+
+    return thread_id, response["messages"][-1].content, total_usage(usage.usage_metadata)
 
-User query: {content}"""
+
+def sse(event: str, data: dict) -> str:
+    return f"event: {event}\ndata: {json.dumps(data)}\n\n"
+
+
+def stream_message(
+    document_id: str, section_id: str, thread_id: str | None, content: str
+):
+    """Like handle_message, but yields Server-Sent Events as the agent works:
+    thread, then token and tool events, then done with the full reply."""
+    if thread_id is None:
+        thread_id = create_conversation(document_id, section_id)
 
     agent = create_agent()
-    inputs = {"messages": [("user", context_aware_content)]}
-    response = agent.invoke(
-        input=inputs, config={"configurable": {"thread_id": thread_id}}
+    inputs = thread_inputs(agent, document_id, section_id, thread_id, content)
+    add_message(document_id, thread_id, "user", content)
+    yield sse("thread", {"thread_id": thread_id})
+
+    config = {"configurable": {"thread_id": thread_id}}
+    with get_usage_metadata_callback() as usage:
+        for chunk, metadata in agent.stream(
+            input=inputs, config=config, stream_mode="messages"
+        ):
+            if metadata.get("langgraph_node") != "agent" or not isinstance(
+                chunk, AIMessageChunk
+            ):
+                continue
+            for call in chunk.tool_call_chunks:
+                if call.get("name"):
+                    yield sse("tool", {"name": call["name"]})
+            if chunk.content:
+                yield sse("token", {"content": chunk.content})
+
+    answer = agent.get_state(config).values["messages"][-1].content
+    add_message(document_id, thread_id, "assistant", answer)
+    yield sse(
+        "done",
+        {
+            "document_id": document_id,
+            "thread_id": thread_id,
+            "role": "assistant",
+            "content": answer,
+            "usage": total_usage(usage.usage_metadata),
+        },
     )
 
-    add_message(document_id, thread_id, "assistant", response["messages"][-1].content)
-
-    return thread_id, response["messages"][-1].content
 
+def handle_save(section: Section) -> dict:
+    usage_metadata = {}
 
-def handle_save(section: Section) -> None:
     # Chunk, embed and upsert section
     section_docs = get_docs(section=section, namespace="general")
     print(f"Section docs chunked: {len(section_docs)}")
@@ -495,7 +587,9 @@ def handle_save(section: Section) -> None:
     if section.num_words > 100:
         llm = ChatOpenAI(model="gpt-4o-mini", temperature=0)
         summary_prompt = f"Summarize the following section of a document in four sentences:\n\n{section.content}"
-        new_summary = llm.invoke(summary_prompt).content
+        with get_usage_metadata_callback() as usage:
+            new_summary = llm.invoke(summary_prompt).content
+        usage_metadata = usage.usage_metadata
         print(f"Summary generated")
 
         # Update section on Postgres
@@ -517,6 +611,8 @@ def handle_save(section: Section) -> None:
     # Update section on Postgres
     update_section(section)
 
+    return total_usage(usage_metadata)
+
 
 @app.route("/message", methods=["POST"])
 def message():
@@ -537,13 +633,16 @@ def message():
         print(f"content: {content}")
 
         # Handle user message
-        thread_id, content = handle_message(document_id, section_id, thread_id, content)
+        thread_id, content, usage = handle_message(
+            document_id, section_id, thread_id, content
+        )
 
         response_data = {
             "document_id": document_id,
             "thread_id": thread_id,
             "role": "assistant",
             "content": content,
+            "usage": usage,
         }
         print(f"Response: {response_data}")
 
@@ -556,6 +655,26 @@ def message():
         return jsonify({"status": "error", "message": str(e)}), 500
 
 
+@app.route("/message/stream", methods=["POST"])
+def message_stream():
+    document_id = request.json["document_id"]
+    section_id = request.json["section_id"]
+    thread_id = request.json.get("thread_id")
+    content = request.json["content"]
+
+    def events():
+        try:
+            yield from stream_message(document_id, section_id, thread_id, content)
+        except GeneratorExit:
+            # The Go API hung up because the client went away
+            raise
+        except Exception as e:
+            print(f"ERROR in /message/stream endpoint: {e}")
+            yield sse("error", {"message": str(e)})
+
+    return Response(stream_with_context(events()), mimetype="text/event-stream")
+
+
 @app.route("/save", methods=["POST"])
 def embed():
     try:
@@ -570,11 +689,11 @@ def embed():
             id=request.json["id"],
         )
 
-        handle_save(section)
-        return jsonify({"status": "success"})
+        usage = handle_save(section)
+        return jsonify({"status": "success", "usage": usage})
     except Exception as e:
         print(e)
-        return jsonify({"status": "error", "message": str(e)})
+        return jsonify({"status": "error", "message": str(e)}), 500
 
 
 if __name__ == "__main__":